@@ -1,34 +1,225 @@
 package apiHandlersaccount
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/kdjuwidja/aishoppercommon/logger"
 	"netherealmstudio.com/m/v2/apiHandlers"
+	bizAccount "netherealmstudio.com/m/v2/biz/account"
+	bizAudit "netherealmstudio.com/m/v2/biz/audit"
+	bizPassword "netherealmstudio.com/m/v2/biz/password"
 	bizRegister "netherealmstudio.com/m/v2/biz/register"
+	bizUser "netherealmstudio.com/m/v2/biz/user"
 )
 
 type AccountHandler struct {
 	registrationManager *bizRegister.RegistrationManager
+	accountManager      *bizAccount.AccountManager
+	auditor             *bizAudit.Auditor
 	responseFactory     *apiHandlers.ResponseFactory
 }
 
-func InitializeAccountHandler(registrationManager *bizRegister.RegistrationManager, responseFactory *apiHandlers.ResponseFactory) *AccountHandler {
+func InitializeAccountHandler(registrationManager *bizRegister.RegistrationManager, accountManager *bizAccount.AccountManager, auditor *bizAudit.Auditor, responseFactory *apiHandlers.ResponseFactory) *AccountHandler {
 	return &AccountHandler{
 		registrationManager: registrationManager,
+		accountManager:      accountManager,
+		auditor:             auditor,
 		responseFactory:     responseFactory,
 	}
 }
 
 func (h *AccountHandler) GetRegistrationCode(c *gin.Context) {
-	code, err := h.registrationManager.GetRegistrationCode(c.Request.Context())
+	code, err := h.registrationManager.GetRegistrationCode(c.Request.Context(), c.GetString("userID"), bizRegister.RegistrationCodeOptions{})
 	if err != nil {
 		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
 		return
 	}
+	h.recordCodeCreated(c, code)
 
-	h.responseFactory.CreateOKResponse(c, map[string]string{"code": code})
+	h.responseFactory.CreateOKResponse(c, map[string]string{"code": code.Code})
+}
+
+func (h *AccountHandler) CreateRegistrationCode(c *gin.Context) {
+	var req struct {
+		TTLSeconds int    `json:"ttl_seconds"`
+		MaxUses    int    `json:"max_uses"`
+		Email      string `json:"email"`
+		RoleID     int    `json:"role_id"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	code, err := h.registrationManager.GetRegistrationCode(c.Request.Context(), c.GetString("userID"), bizRegister.RegistrationCodeOptions{
+		TTL:     time.Duration(req.TTLSeconds) * time.Second,
+		MaxUses: req.MaxUses,
+		Email:   req.Email,
+		RoleID:  req.RoleID,
+	})
+	if errors.Is(err, bizRegister.ErrInvalidRoleID) {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrInvalidRoleID, req.RoleID)
+		return
+	}
+	if err != nil {
+		logger.Errorf("failed to create registration code: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+	h.recordCodeCreated(c, code)
+
+	h.responseFactory.CreateCreatedResponse(c, code)
+}
+
+// CreateRegistrationCodeBatch creates a batch of codes, optionally emailing invite links. The batch is returned as
+// JSON, or as a CSV attachment when requested with ?format=csv.
+func (h *AccountHandler) CreateRegistrationCodeBatch(c *gin.Context) {
+	var req struct {
+		Count       int      `json:"count"`
+		Emails      []string `json:"emails"`
+		TTLSeconds  int      `json:"ttl_seconds"`
+		MaxUses     int      `json:"max_uses"`
+		RoleID      int      `json:"role_id"`
+		SendInvites bool     `json:"send_invites"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	codes, err := h.registrationManager.GetRegistrationCodes(c.Request.Context(), c.GetString("userID"), req.Count, req.Emails, bizRegister.RegistrationCodeOptions{
+		TTL:     time.Duration(req.TTLSeconds) * time.Second,
+		MaxUses: req.MaxUses,
+		RoleID:  req.RoleID,
+	}, req.SendInvites)
+	if errors.Is(err, bizRegister.ErrInvalidBatchSize) {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrInvalidBatchSize, h.registrationManager.GetMaxBatchSize())
+		return
+	}
+	if errors.Is(err, bizRegister.ErrInvalidRoleID) {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrInvalidRoleID, req.RoleID)
+		return
+	}
+	if err != nil {
+		logger.Errorf("failed to create registration code batch: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+	for _, code := range codes {
+		h.recordCodeCreated(c, code.RegistrationCodeInfo)
+	}
+
+	if c.Query("format") == "csv" {
+		h.writeRegistrationCodesCSV(c, codes)
+		return
+	}
+
+	h.responseFactory.CreateCreatedResponse(c, map[string]interface{}{"codes": codes})
+}
+
+func (h *AccountHandler) recordCodeCreated(c *gin.Context, code *bizRegister.RegistrationCodeInfo) {
+	h.auditor.Record(c.Request.Context(), bizAudit.Event{
+		Type:      bizAudit.EventRegistrationCodeCreated,
+		ActorID:   c.GetString("userID"),
+		SubjectID: bizAudit.CodeSubject(code.Code),
+		Details: map[string]string{
+			"email":      code.Email,
+			"role_id":    strconv.Itoa(code.RoleID),
+			"max_uses":   strconv.Itoa(code.MaxUses),
+			"expires_at": code.ExpiresAt.UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+func (h *AccountHandler) writeRegistrationCodesCSV(c *gin.Context, codes []*bizRegister.InvitedRegistrationCode) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	err := writer.Write([]string{"code", "email", "expires_at", "max_uses", "role_id", "invite_link", "invite_sent"})
+	for _, code := range codes {
+		if err != nil {
+			break
+		}
+		err = writer.Write([]string{
+			code.Code,
+			csvCell(code.Email),
+			code.ExpiresAt.UTC().Format(time.RFC3339),
+			strconv.Itoa(code.MaxUses),
+			strconv.Itoa(code.RoleID),
+			csvCell(code.InviteLink),
+			strconv.FormatBool(code.InviteSent),
+		})
+	}
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		logger.Errorf("failed to write registration codes csv: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=registration-codes-%s.csv", time.Now().UTC().Format("20060102T150405Z")))
+	c.Data(http.StatusCreated, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// csvCell prefixes values that spreadsheet applications would evaluate as a formula with a quote, so that a user
+// supplied value cannot inject a formula into the exported file.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func (h *AccountHandler) ListRegistrationCodes(c *gin.Context) {
+	codes, err := h.registrationManager.ListRegistrationCodes(c.Request.Context())
+	if err != nil {
+		logger.Errorf("failed to list registration codes: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]interface{}{"codes": codes})
+}
+
+func (h *AccountHandler) GetRegistrationCodeInfo(c *gin.Context) {
+	code, err := h.registrationManager.GetRegistrationCodeInfo(c.Request.Context(), c.Param("code"))
+	if errors.Is(err, bizRegister.ErrRegistrationCodeNotFound) {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrRegistrationCodeNotFound)
+		return
+	}
+	if err != nil {
+		logger.Errorf("failed to get registration code: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, code)
+}
+
+func (h *AccountHandler) RevokeRegistrationCode(c *gin.Context) {
+	err := h.registrationManager.RevokeRegistrationCode(c.Request.Context(), c.Param("code"))
+	if errors.Is(err, bizRegister.ErrRegistrationCodeNotFound) {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrRegistrationCodeNotFound)
+		return
+	}
+	if err != nil {
+		logger.Errorf("failed to revoke registration code: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Registration code revoked successfully"})
 }
 
 func (h *AccountHandler) RegisterAccount(c *gin.Context) {
@@ -48,6 +239,18 @@ func (h *AccountHandler) RegisterAccount(c *gin.Context) {
 	}
 
 	err := h.registrationManager.RegisterUser(c.Request.Context(), req.Code, req.Email, req.Password)
+	h.recordCodeRedeemed(c, req.Code, req.Email, err)
+	if h.handlePasswordPolicyViolation(c, err) {
+		return
+	}
+	if errors.Is(err, bizRegister.ErrEmailInUse) {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrEmailInUse)
+		return
+	}
+	if errors.Is(err, bizRegister.ErrRegistrationCodeNotFound) {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRegistrationCode)
+		return
+	}
 	if err != nil {
 		logger.Errorf("failed to register user: %v", err)
 		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
@@ -56,3 +259,167 @@ func (h *AccountHandler) RegisterAccount(c *gin.Context) {
 
 	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Account registered successfully"})
 }
+
+// recordCodeRedeemed records the redemption of the code, or the attempt to redeem a code that is not redeemable.
+// Registrations rejected before the code was looked at are not redemptions.
+func (h *AccountHandler) recordCodeRedeemed(c *gin.Context, code string, email string, err error) {
+	event := bizAudit.Event{
+		Type:      bizAudit.EventRegistrationCodeRedeemed,
+		SubjectID: bizAudit.CodeSubject(code),
+		Details:   map[string]string{"email": email},
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, bizRegister.ErrRegistrationCodeNotFound):
+		event.Outcome = bizAudit.OutcomeFailure
+	default:
+		return
+	}
+	h.auditor.Record(c.Request.Context(), event)
+}
+
+// handlePasswordPolicyViolation writes the error response for a password policy violation and reports whether err was one.
+func (h *AccountHandler) handlePasswordPolicyViolation(c *gin.Context, err error) bool {
+	var violation *bizPassword.PolicyViolation
+	if !errors.As(err, &violation) {
+		return false
+	}
+
+	if violation.Limit > 0 {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.PasswordViolationCodes[violation.Rule], violation.Limit)
+	} else {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.PasswordViolationCodes[violation.Rule])
+	}
+	return true
+}
+
+// handleAccountError maps account manager errors to API error responses.
+func (h *AccountHandler) handleAccountError(c *gin.Context, err error, action string) {
+	if h.handlePasswordPolicyViolation(c, err) {
+		return
+	}
+
+	switch {
+	case errors.Is(err, bizUser.ErrUserNotFound):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrUserNotFound)
+	case errors.Is(err, bizAccount.ErrInvalidCredentials):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidCredentials)
+	case errors.Is(err, bizAccount.ErrEmailInUse):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrEmailInUse)
+	case errors.Is(err, bizAccount.ErrInvalidVerificationToken):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidVerificationToken)
+	case errors.Is(err, bizUser.ErrLastAdmin):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrLastAdmin)
+	default:
+		logger.Errorf("failed to %s: %v", action, err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+	}
+}
+
+func (h *AccountHandler) ChangePassword(c *gin.Context) {
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredField, "current_password and new_password are required")
+		return
+	}
+
+	err := h.accountManager.ChangePassword(c.Request.Context(), c.GetString("userID"), req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		h.handleAccountError(c, err, "change password")
+		return
+	}
+	h.recordTokensRevoked(c, "password_changed")
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Password changed successfully"})
+}
+
+func (h *AccountHandler) ChangeEmail(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+		NewEmail string `json:"new_email"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	if req.Password == "" || req.NewEmail == "" {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredField, "password and new_email are required")
+		return
+	}
+
+	err := h.accountManager.RequestEmailChange(c.Request.Context(), c.GetString("userID"), req.Password, req.NewEmail)
+	if err != nil {
+		h.handleAccountError(c, err, "request email change")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Verification email sent"})
+}
+
+func (h *AccountHandler) VerifyEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	if req.Token == "" {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredField, "token")
+		return
+	}
+
+	err := h.accountManager.ConfirmEmailChange(c.Request.Context(), req.Token)
+	if err != nil {
+		h.handleAccountError(c, err, "confirm email change")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Email changed successfully"})
+}
+
+func (h *AccountHandler) DeleteAccount(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	if req.Password == "" {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredField, "password")
+		return
+	}
+
+	err := h.accountManager.DeleteAccount(c.Request.Context(), c.GetString("userID"), req.Password)
+	if err != nil {
+		h.handleAccountError(c, err, "delete account")
+		return
+	}
+	h.recordTokensRevoked(c, "account_deleted")
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Account deleted successfully"})
+}
+
+// recordTokensRevoked records the revocation of every token of the user, which the account manager does once the
+// user's credentials change or the account is gone.
+func (h *AccountHandler) recordTokensRevoked(c *gin.Context, reason string) {
+	userID := c.GetString("userID")
+	h.auditor.Record(c.Request.Context(), bizAudit.Event{
+		Type:      bizAudit.EventTokensRevoked,
+		ActorID:   userID,
+		SubjectID: userID,
+		Details:   map[string]string{"reason": reason},
+	})
+}
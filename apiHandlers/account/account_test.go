@@ -2,32 +2,61 @@ package apiHandlersaccount
 
 import (
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"netherealmstudio.com/m/v2/apiHandlers"
+	bizAccount "netherealmstudio.com/m/v2/biz/account"
+	bizAudit "netherealmstudio.com/m/v2/biz/audit"
+	bizPassword "netherealmstudio.com/m/v2/biz/password"
 	bizRegister "netherealmstudio.com/m/v2/biz/register"
+	bizUser "netherealmstudio.com/m/v2/biz/user"
 	"netherealmstudio.com/m/v2/db"
+	"netherealmstudio.com/m/v2/mailer"
 )
 
+const (
+	testAdminID       = "admin_user"
+	testAdminPassword = "adminpassword123"
+)
+
+type fakeTokenRevoker struct {
+}
+
+func (f *fakeTokenRevoker) RemoveByUserID(ctx context.Context, userID string) error {
+	return nil
+}
+
+type fakeScopeInvalidator struct {
+	users []string
+}
+
+func (f *fakeScopeInvalidator) InvalidateUser(userID string) {
+	f.users = append(f.users, userID)
+}
+
 func setupTestDB(t *testing.T) *gorm.DB {
 	dsn := "ai_shopper_dev:password@tcp(localhost:4306)/test_db?charset=utf8mb4&parseTime=True&loc=Local"
 	gormDB, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
 	require.NoError(t, err)
 
 	// Drop tables if they exist
-	err = gormDB.Migrator().DropTable(&db.User{}, &db.RegistrationCode{}, &db.UserRole{}, &db.Role{}, &db.RoleScope{})
+	err = gormDB.Migrator().DropTable(&db.User{}, &db.RegistrationCode{}, &db.UserRole{}, &db.Role{}, &db.RoleScope{}, &db.EmailVerification{})
 	require.NoError(t, err)
 
 	// Auto migrate the schema
-	err = gormDB.AutoMigrate(&db.User{}, &db.RegistrationCode{}, &db.UserRole{}, &db.Role{}, &db.RoleScope{})
+	err = gormDB.AutoMigrate(&db.User{}, &db.RegistrationCode{}, &db.UserRole{}, &db.Role{}, &db.RoleScope{}, &db.EmailVerification{})
 	require.NoError(t, err)
 
 	// Create test role
@@ -47,11 +76,26 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		t.Fatalf("Failed to create test role scope: %v", err)
 	}
 
+	// Create the admin, so that accounts can be deleted without removing the last admin
+	adminRole := db.Role{Description: "admin"}
+	require.NoError(t, gormDB.Create(&adminRole).Error)
+	require.NoError(t, gormDB.Create(&db.RoleScope{RoleID: adminRole.ID, Scope: bizUser.AdminScope}).Error)
+	hashedAdminPassword, err := bcrypt.GenerateFromPassword([]byte(testAdminPassword), bcrypt.MinCost)
+	require.NoError(t, err)
+	require.NoError(t, gormDB.Create(&db.User{ID: testAdminID, Email: "admin@example.com", Password: string(hashedAdminPassword), IsActive: true}).Error)
+	require.NoError(t, gormDB.Create(&db.UserRole{UserID: testAdminID, RoleID: adminRole.ID}).Error)
+
 	return gormDB
 }
 
+var (
+	testDB               *gorm.DB
+	testScopeInvalidator *fakeScopeInvalidator
+)
+
 func setupTestRouter(t *testing.T) (*gin.Engine, *AccountHandler) {
 	gormDB := setupTestDB(t)
+	testDB = gormDB
 
 	// Get the test role ID
 	var testRole db.Role
@@ -59,15 +103,33 @@ func setupTestRouter(t *testing.T) (*gin.Engine, *AccountHandler) {
 		t.Fatalf("Failed to get test role: %v", err)
 	}
 
-	registrationManager := bizRegister.NewRegistrationManager(gormDB, 3, testRole.ID)
+	passwordPolicy := bizPassword.NewPolicy(bizPassword.PolicyConfig{MinLength: 8, DisallowEmail: true}, nil)
+	passwordHasher, err := bizPassword.NewPasswordHasher(bizPassword.AlgorithmBcrypt, bizPassword.NewBcryptAlgorithm(bcrypt.MinCost))
+	require.NoError(t, err)
+	registrationManager := bizRegister.NewRegistrationManager(gormDB, 3, testRole.ID, time.Hour, passwordPolicy, passwordHasher,
+		bizRegister.NewInviter(mailer.NewLogMailer(), "http://localhost:9096/auth/register"), 10)
 	responseFactory := apiHandlers.Initialize()
-	accountHandler := InitializeAccountHandler(registrationManager, responseFactory)
+	testScopeInvalidator = &fakeScopeInvalidator{}
+	accountManager := bizAccount.NewAccountManager(gormDB, passwordPolicy, passwordHasher, &fakeTokenRevoker{}, testScopeInvalidator, mailer.NewLogMailer(), "http://localhost:3000/verify-email", time.Hour)
+	accountHandler := InitializeAccountHandler(registrationManager, accountManager, bizAudit.NewAuditor(), responseFactory)
 
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
 
 	router.POST("/register", accountHandler.RegisterAccount)
 	router.GET("/registration-code", accountHandler.GetRegistrationCode)
+	router.POST("/registration-codes/batch", accountHandler.CreateRegistrationCodeBatch)
+
+	// Stands in for TokenVerifier, which sets the user ID from the bearer token.
+	setUserID := func(next gin.HandlerFunc) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userID", c.GetHeader("X-User-ID"))
+			next(c)
+		}
+	}
+	router.PUT("/password", setUserID(accountHandler.ChangePassword))
+	router.PUT("/email", setUserID(accountHandler.ChangeEmail))
+	router.DELETE("/account", setUserID(accountHandler.DeleteAccount))
 
 	return router, accountHandler
 }
@@ -159,6 +221,24 @@ func TestRegisterAccountInvalidInput(t *testing.T) {
 			},
 			expected: http.StatusBadRequest,
 		},
+		{
+			name: "password too short",
+			payload: map[string]string{
+				"code":     "testcode",
+				"email":    "test@example.com",
+				"password": "short",
+			},
+			expected: http.StatusBadRequest,
+		},
+		{
+			name: "password matches email",
+			payload: map[string]string{
+				"code":     "testcode",
+				"email":    "test@example.com",
+				"password": "test@example.com",
+			},
+			expected: http.StatusBadRequest,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -226,11 +306,218 @@ func TestRegisterAccountWithUsedCode(t *testing.T) {
 	router.ServeHTTP(w, req)
 
 	// Should get an error response
-	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
 
 	var response map[string]interface{}
 	err = json.Unmarshal(w.Body.Bytes(), &response)
 	require.NoError(t, err)
-	assert.Contains(t, response, "code")
+	assert.Equal(t, apiHandlers.ErrInvalidRegistrationCode, response["code"])
 	assert.Contains(t, response, "error")
 }
+
+func TestRegisterAccountWithUnknownCode(t *testing.T) {
+	router, _ := setupTestRouter(t)
+
+	jsonData, err := json.Marshal(map[string]string{
+		"code":     "unknowncode",
+		"email":    "test@example.com",
+		"password": "testpassword123",
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/register", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, apiHandlers.ErrInvalidRegistrationCode, response["code"])
+}
+
+func registerTestUser(t *testing.T, router *gin.Engine, email string, password string) string {
+	req := httptest.NewRequest("GET", "/registration-code", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var codeResponse map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &codeResponse))
+
+	jsonData, err := json.Marshal(map[string]string{"code": codeResponse["code"], "email": email, "password": password})
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("POST", "/register", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var user db.User
+	require.NoError(t, testDB.Where("email = ?", email).First(&user).Error)
+	return user.ID
+}
+
+func sendAsUser(router *gin.Engine, method string, path string, userID string, payload map[string]string) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(payload)
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", userID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestChangePassword(t *testing.T) {
+	router, _ := setupTestRouter(t)
+	userID := registerTestUser(t, router, "test@example.com", "testpassword123")
+
+	w := sendAsUser(router, "PUT", "/password", userID, map[string]string{"current_password": "wrongpassword", "new_password": "newpassword123"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = sendAsUser(router, "PUT", "/password", userID, map[string]string{"current_password": "testpassword123"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = sendAsUser(router, "PUT", "/password", userID, map[string]string{"current_password": "testpassword123", "new_password": "newpassword123"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The old password no longer works
+	w = sendAsUser(router, "PUT", "/password", userID, map[string]string{"current_password": "testpassword123", "new_password": "anotherpassword123"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestChangeEmail(t *testing.T) {
+	router, _ := setupTestRouter(t)
+	userID := registerTestUser(t, router, "test@example.com", "testpassword123")
+	registerTestUser(t, router, "taken@example.com", "testpassword123")
+
+	w := sendAsUser(router, "PUT", "/email", userID, map[string]string{"password": "testpassword123", "new_email": "taken@example.com"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = sendAsUser(router, "PUT", "/email", userID, map[string]string{"password": "testpassword123", "new_email": "new@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The email is not changed until verified
+	var user db.User
+	require.NoError(t, testDB.Where("id = ?", userID).First(&user).Error)
+	assert.Equal(t, "test@example.com", user.Email)
+
+	var verification db.EmailVerification
+	require.NoError(t, testDB.Where("user_id = ?", userID).First(&verification).Error)
+	assert.Equal(t, "new@example.com", verification.NewEmail)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	router, _ := setupTestRouter(t)
+	userID := registerTestUser(t, router, "test@example.com", "testpassword123")
+
+	w := sendAsUser(router, "DELETE", "/account", userID, map[string]string{"password": "wrongpassword"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = sendAsUser(router, "DELETE", "/account", userID, map[string]string{"password": "testpassword123"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var user db.User
+	assert.Error(t, testDB.Where("id = ?", userID).First(&user).Error)
+	require.NoError(t, testDB.Unscoped().Where("id = ?", userID).First(&user).Error)
+	assert.True(t, user.DeletedAt.Valid)
+
+	var count int64
+	require.NoError(t, testDB.Unscoped().Model(&db.UserRole{}).Where("user_id = ?", userID).Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+
+	assert.Equal(t, []string{userID}, testScopeInvalidator.users)
+}
+
+func TestDeleteLastAdminAccount(t *testing.T) {
+	router, _ := setupTestRouter(t)
+
+	w := sendAsUser(router, "DELETE", "/account", testAdminID, map[string]string{"password": testAdminPassword})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Empty(t, testScopeInvalidator.users)
+
+	var user db.User
+	require.NoError(t, testDB.Where("id = ?", testAdminID).First(&user).Error)
+
+	var count int64
+	require.NoError(t, testDB.Model(&db.UserRole{}).Where("user_id = ?", testAdminID).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestCreateRegistrationCodeBatch(t *testing.T) {
+	router, _ := setupTestRouter(t)
+
+	jsonData, err := json.Marshal(map[string]interface{}{"emails": []string{"a@example.com", "b@example.com"}, "send_invites": true})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/registration-codes/batch", bytes.NewBuffer(jsonData))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var response struct {
+		Codes []struct {
+			Code       string `json:"code"`
+			Email      string `json:"email"`
+			InviteLink string `json:"invite_link"`
+			InviteSent bool   `json:"invite_sent"`
+		} `json:"codes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Len(t, response.Codes, 2)
+	assert.Equal(t, "a@example.com", response.Codes[0].Email)
+	assert.Contains(t, response.Codes[0].InviteLink, "code="+response.Codes[0].Code)
+	assert.True(t, response.Codes[0].InviteSent)
+
+	// CSV export
+	jsonData, err = json.Marshal(map[string]interface{}{"count": 3})
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("POST", "/registration-codes/batch?format=csv", bytes.NewBuffer(jsonData))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/csv")
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Len(t, records, 4)
+	assert.Equal(t, "code", records[0][0])
+
+	// Batch size limit
+	jsonData, err = json.Marshal(map[string]interface{}{"count": 11})
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("POST", "/registration-codes/batch", bytes.NewBuffer(jsonData))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWriteRegistrationCodesCSVEscapesFormulas(t *testing.T) {
+	handler := InitializeAccountHandler(nil, nil, bizAudit.NewAuditor(), apiHandlers.Initialize())
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	handler.writeRegistrationCodesCSV(c, []*bizRegister.InvitedRegistrationCode{
+		{
+			RegistrationCodeInfo: &bizRegister.RegistrationCodeInfo{Code: "code1", Email: "=HYPERLINK(\"http://evil\")@example.com"},
+			InviteLink:           "+cmd|' /C calc'!A0",
+		},
+		{
+			RegistrationCodeInfo: &bizRegister.RegistrationCodeInfo{Code: "code2", Email: "user@example.com"},
+			InviteLink:           "http://localhost:9096/auth/register?code=code2",
+		},
+	})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, "'=HYPERLINK(\"http://evil\")@example.com", records[1][1])
+	assert.Equal(t, "'+cmd|' /C calc'!A0", records[1][5])
+	assert.Equal(t, "user@example.com", records[2][1])
+	assert.Equal(t, "http://localhost:9096/auth/register?code=code2", records[2][5])
+}
@@ -0,0 +1,188 @@
+package apiHandlersaudit
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	defaultPageSize = 50
+	maxPageSize     = 500
+	maxRequestIDLen = 64
+)
+
+// EventLister returns a page of the audit events matching the filter, and the number of matching events.
+type EventLister interface {
+	List(ctx context.Context, filter bizaudit.EventFilter, limit int, offset int) ([]*bizaudit.Event, int64, error)
+}
+
+type AuditHandler struct {
+	auditor         *bizaudit.Auditor
+	eventLister     EventLister
+	responseFactory *apiHandlers.ResponseFactory
+}
+
+func InitializeAuditHandler(auditor *bizaudit.Auditor, eventLister EventLister, responseFactory *apiHandlers.ResponseFactory) *AuditHandler {
+	return &AuditHandler{
+		auditor:         auditor,
+		eventLister:     eventLister,
+		responseFactory: responseFactory,
+	}
+}
+
+// RequestInfo stamps the request with the client's IP, user agent and a request ID, so that the audit events recorded
+// for it can be told apart and correlated with other logs. A request ID set by one of the trusted proxies in front is
+// kept, and is sent back in the response either way. Clients cannot set the request ID of their own events.
+func RequestInfo(trustedProxies []string) (gin.HandlerFunc, error) {
+	prefixes := make([]netip.Prefix, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		prefix, err := parseTrustedProxy(strings.TrimSpace(proxy))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return func(c *gin.Context) {
+		requestID := ""
+		if isTrustedProxy(prefixes, c.RemoteIP()) {
+			requestID = c.GetHeader(RequestIDHeader)
+		}
+		if requestID == "" || len(requestID) > maxRequestIDLen {
+			requestID = uuid.New().String()
+		}
+		c.Header(RequestIDHeader, requestID)
+
+		c.Request = c.Request.WithContext(bizaudit.WithRequestInfo(c.Request.Context(), bizaudit.RequestInfo{
+			IP:        c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+			RequestID: requestID,
+		}))
+		c.Next()
+	}, nil
+}
+
+// parseTrustedProxy parses an IP address or CIDR, as accepted by gin's SetTrustedProxies.
+func parseTrustedProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		return netip.ParsePrefix(proxy)
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func isTrustedProxy(prefixes []netip.Prefix, remoteIP string) bool {
+	addr, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminChange records an admin change event for the action once next has handled the request. The first path parameter
+// is the subject of the change, and every path parameter is kept in the details.
+func (h *AuditHandler) AdminChange(action string, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		next(c)
+
+		details := map[string]string{
+			"action": action,
+			"status": strconv.Itoa(c.Writer.Status()),
+		}
+		subjectID := ""
+		for i, param := range c.Params {
+			value := param.Value
+			if param.Key == "code" {
+				value = bizaudit.CodeSubject(value)
+			}
+			if i == 0 {
+				subjectID = value
+			}
+			details[param.Key] = value
+		}
+		outcome := bizaudit.OutcomeSuccess
+		if c.Writer.Status() >= http.StatusBadRequest {
+			outcome = bizaudit.OutcomeFailure
+		}
+
+		h.auditor.Record(c.Request.Context(), bizaudit.Event{
+			Type:      bizaudit.EventAdminChange,
+			Outcome:   outcome,
+			ActorID:   c.GetString("userID"),
+			SubjectID: subjectID,
+			ClientID:  c.Param("client_id"),
+			Details:   details,
+		})
+	}
+}
+
+// ListEvents returns the audit events matching the query parameters, newest first. Times are RFC 3339, and the page is
+// selected with limit and offset.
+func (h *AuditHandler) ListEvents(c *gin.Context) {
+	filter := bizaudit.EventFilter{
+		Type:      c.Query("type"),
+		Outcome:   c.Query("outcome"),
+		ActorID:   c.Query("actor_id"),
+		SubjectID: c.Query("subject_id"),
+		ClientID:  c.Query("client_id"),
+		RequestID: c.Query("request_id"),
+	}
+	for param, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrInvalidParam, param)
+			return
+		}
+		*target = parsed
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageSize)))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrInvalidParam, "limit")
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrInvalidParam, "offset")
+		return
+	}
+
+	events, total, err := h.eventLister.List(c.Request.Context(), filter, limit, offset)
+	if err != nil {
+		logger.Errorf("failed to list audit events: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]interface{}{
+		"events": events,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
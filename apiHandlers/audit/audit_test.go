@@ -0,0 +1,173 @@
+package apiHandlersaudit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+)
+
+type fakeEventLister struct {
+	filter bizaudit.EventFilter
+	limit  int
+	offset int
+}
+
+func (f *fakeEventLister) List(ctx context.Context, filter bizaudit.EventFilter, limit int, offset int) ([]*bizaudit.Event, int64, error) {
+	f.filter, f.limit, f.offset = filter, limit, offset
+	return []*bizaudit.Event{{Type: bizaudit.EventLogin, Outcome: bizaudit.OutcomeSuccess, ActorID: "user-1"}}, 42, nil
+}
+
+func setupRouter(t *testing.T, buf *bytes.Buffer, lister *fakeEventLister) *gin.Engine {
+	h := InitializeAuditHandler(bizaudit.NewAuditor(bizaudit.NewJSONLinesSink(buf)), lister, apiHandlers.Initialize())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	// httptest requests come from 192.0.2.1.
+	requestInfo, err := RequestInfo([]string{"192.0.2.1"})
+	require.NoError(t, err)
+	router.Use(requestInfo)
+	router.Use(func(c *gin.Context) {
+		c.Set("userID", "admin-1")
+		c.Next()
+	})
+	router.GET("/audit/events", h.ListEvents)
+	router.PUT("/users/:user_id/roles/:role_id", h.AdminChange("assign_role", func(c *gin.Context) {
+		if c.Param("role_id") == "0" {
+			c.JSON(http.StatusNotFound, gin.H{})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{})
+	}))
+	return router
+}
+
+func TestAdminChange(t *testing.T) {
+	var buf bytes.Buffer
+	router := setupRouter(t, &buf, &fakeEventLister{})
+
+	req := httptest.NewRequest("PUT", "/users/user-2/roles/3", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	req.Header.Set("User-Agent", "admin-cli")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "req-1", w.Header().Get(RequestIDHeader))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/users/user-2/roles/0", nil))
+	generatedID := w.Header().Get(RequestIDHeader)
+	assert.NotEmpty(t, generatedID)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var event bizaudit.Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, bizaudit.EventAdminChange, event.Type)
+	assert.Equal(t, bizaudit.OutcomeSuccess, event.Outcome)
+	assert.Equal(t, "admin-1", event.ActorID)
+	assert.Equal(t, "user-2", event.SubjectID)
+	assert.Equal(t, "req-1", event.RequestID)
+	assert.Equal(t, "admin-cli", event.UserAgent)
+	assert.Equal(t, map[string]string{"action": "assign_role", "status": "200", "user_id": "user-2", "role_id": "3"}, event.Details)
+
+	event = bizaudit.Event{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(t, bizaudit.OutcomeFailure, event.Outcome)
+	assert.Equal(t, generatedID, event.RequestID)
+	assert.Equal(t, "404", event.Details["status"])
+}
+
+func TestRequestInfo_UntrustedRequestID(t *testing.T) {
+	requestInfo, err := RequestInfo([]string{"10.0.0.0/8", "::1"})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(requestInfo)
+	router.GET("/", func(c *gin.Context) {
+		info, _ := bizaudit.RequestInfoFromContext(c.Request.Context())
+		c.String(http.StatusOK, info.RequestID)
+	})
+
+	for remoteAddr, trusted := range map[string]bool{"10.1.2.3:1234": true, "[::1]:1234": true, "192.0.2.1:1234": false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(RequestIDHeader, "req-1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, w.Header().Get(RequestIDHeader), w.Body.String(), remoteAddr)
+		assert.Equal(t, trusted, w.Body.String() == "req-1", remoteAddr)
+	}
+
+	_, err = RequestInfo([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
+
+func TestAdminChange_RegistrationCode(t *testing.T) {
+	var buf bytes.Buffer
+	h := InitializeAuditHandler(bizaudit.NewAuditor(bizaudit.NewJSONLinesSink(&buf)), &fakeEventLister{}, apiHandlers.Initialize())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.DELETE("/codes/:code", h.AdminChange("revoke_registration_code", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	}))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/codes/ABCDEF123456", nil))
+
+	// The code is recorded by its hash, so that the audit log does not hold codes that may still be usable.
+	assert.NotContains(t, buf.String(), "ABCDEF123456")
+	var event bizaudit.Event
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+	assert.Equal(t, bizaudit.CodeSubject("ABCDEF123456"), event.SubjectID)
+	assert.Equal(t, bizaudit.CodeSubject("ABCDEF123456"), event.Details["code"])
+}
+
+func TestListEvents(t *testing.T) {
+	lister := &fakeEventLister{}
+	router := setupRouter(t, &bytes.Buffer{}, lister)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/audit/events?type=login&actor_id=user-1&from=2026-01-01T00:00:00Z&offset=10", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, "login", lister.filter.Type)
+	assert.Equal(t, "user-1", lister.filter.ActorID)
+	assert.Equal(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), lister.filter.From.UTC())
+	assert.True(t, lister.filter.To.IsZero())
+	assert.Equal(t, defaultPageSize, lister.limit)
+	assert.Equal(t, 10, lister.offset)
+
+	var body struct {
+		Events []bizaudit.Event `json:"events"`
+		Total  int64            `json:"total"`
+		Limit  int              `json:"limit"`
+		Offset int              `json:"offset"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Len(t, body.Events, 1)
+	assert.Equal(t, int64(42), body.Total)
+	assert.Equal(t, defaultPageSize, body.Limit)
+	assert.Equal(t, 10, body.Offset)
+}
+
+func TestListEvents_InvalidParams(t *testing.T) {
+	router := setupRouter(t, &bytes.Buffer{}, &fakeEventLister{})
+
+	for _, query := range []string{"from=yesterday", "to=2026-01-01", "limit=0", "limit=501", "limit=ten", "offset=-1"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/audit/events?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
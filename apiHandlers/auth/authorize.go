@@ -3,25 +3,38 @@ package apiHandlersauth
 import (
 	"html/template"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4/manage"
 	"github.com/go-oauth2/oauth2/v4/server"
 	"github.com/kdjuwidja/aishoppercommon/logger"
 	"github.com/kdjuwidja/aishoppercommon/osutil"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	"netherealmstudio.com/m/v2/metrics"
 	"netherealmstudio.com/m/v2/statestore"
+	"netherealmstudio.com/m/v2/token"
 )
 
 type AuthorizeHandler struct {
-	srv        *server.Server
-	tmpl       *template.Template
-	stateStore *statestore.StateStore
+	srv                   *server.Server
+	tmpl                  *template.Template
+	stateStore            *statestore.StateStore
+	pushedRequestStore    *statestore.PushedRequestStore
+	requestObjectVerifier *token.RequestObjectVerifier
+	apiClientStore        *bizapiclient.APIClientStore
 }
 
-func InitializeAuthorizeHandler(srv *server.Server, tmpl *template.Template, stateStore *statestore.StateStore) *AuthorizeHandler {
+func InitializeAuthorizeHandler(srv *server.Server, tmpl *template.Template, stateStore *statestore.StateStore, pushedRequestStore *statestore.PushedRequestStore, requestObjectVerifier *token.RequestObjectVerifier, apiClientStore *bizapiclient.APIClientStore) *AuthorizeHandler {
 	return &AuthorizeHandler{
-		srv:        srv,
-		tmpl:       tmpl,
-		stateStore: stateStore,
+		srv:                   srv,
+		tmpl:                  tmpl,
+		stateStore:            stateStore,
+		pushedRequestStore:    pushedRequestStore,
+		requestObjectVerifier: requestObjectVerifier,
+		apiClientStore:        apiClientStore,
 	}
 }
 
@@ -29,16 +42,75 @@ func (h *AuthorizeHandler) Handle(c *gin.Context) {
 	switch c.Request.Method {
 	case "GET":
 		clientID := c.Query("client_id")
+		if clientID == "" {
+			metrics.AuthorizeOutcome(metrics.AuthorizeInvalidRequest)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing client_id, redirect_uri, or state"})
+			return
+		}
+
+		client, err := h.apiClientStore.GetClient(clientID)
+		if err != nil {
+			metrics.AuthorizeOutcome(metrics.AuthorizeUnknownClient)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown client_id"})
+			return
+		}
+
+		// A request_uri refers to the parameters the client pushed to the PAR endpoint, and a request to a request object
+		// signed by the client. Either replaces the query.
 		redirectURI := c.Query("redirect_uri")
 		state := c.Query("state")
 		responseType := c.Query("response_type")
 		scope := c.Query("scope")
+		requestObject := c.Query("request")
+		requestURI := c.Query("request_uri")
+		switch {
+		case requestObject != "" && requestURI != "":
+			metrics.AuthorizeOutcome(metrics.AuthorizeInvalidRequest)
+			h.errorRedirect(c, client, redirectURI, state, "invalid_request", "request and request_uri cannot be used together")
+			return
+		case requestURI != "":
+			pushed, ok := h.pushedRequestStore.Take(requestURI, clientID)
+			if !ok {
+				metrics.AuthorizeOutcome(metrics.AuthorizeInvalidRequestURI)
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired request_uri"})
+				return
+			}
+			redirectURI, state, responseType, scope = pushed.RedirectURI, pushed.State, pushed.ResponseType, pushed.Scope
+		case client.RequirePAR:
+			metrics.AuthorizeOutcome(metrics.AuthorizePARRequired)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Client requires pushed authorization requests"})
+			return
+		case requestObject != "":
+			obj, err := h.requestObjectVerifier.Verify(client, requestObject)
+			if err != nil {
+				logger.Tracef("/authorize GET Rejected request object of client %s: %s", clientID, err)
+				metrics.AuthorizeOutcome(metrics.AuthorizeInvalidRequestObj)
+				h.errorRedirect(c, client, redirectURI, state, token.ErrCodeInvalidRequestObject, "request object could not be verified")
+				return
+			}
+			// Parameters repeated in the query must match the request object, which is the only one used.
+			if (responseType != "" && responseType != obj.ResponseType) || (redirectURI != "" && redirectURI != obj.RedirectURI) {
+				metrics.AuthorizeOutcome(metrics.AuthorizeInvalidRequestObj)
+				h.errorRedirect(c, client, obj.RedirectURI, obj.State, token.ErrCodeInvalidRequestObject, "query parameters do not match the request object")
+				return
+			}
+			redirectURI, state, responseType, scope = obj.RedirectURI, obj.State, obj.ResponseType, obj.Scope
+		}
 
-		if clientID == "" || redirectURI == "" || state == "" {
+		if redirectURI == "" || state == "" {
+			metrics.AuthorizeOutcome(metrics.AuthorizeInvalidRequest)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing client_id, redirect_uri, or state"})
 			return
 		}
 
+		// Checked before the state is stored, so that the login and registration pages only ever continue requests
+		// with a valid redirect URI.
+		if !isRedirectURIRegistered(client, redirectURI) {
+			metrics.AuthorizeOutcome(metrics.AuthorizeUnregisteredURI)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unregistered redirect_uri"})
+			return
+		}
+
 		// Store the client's state
 		h.stateStore.Add(state, clientID, redirectURI, scope)
 
@@ -80,14 +152,56 @@ func (h *AuthorizeHandler) Handle(c *gin.Context) {
 
 		// Validate state with client info
 		if !h.stateStore.ValidateWithClientInfo(state, clientID, redirectURI) {
+			metrics.AuthorizeOutcome(metrics.AuthorizeInvalidState)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state or mismatched client information"})
 			return
 		}
 
+		// Failed logins are counted by the user authorization handler. Other errors are redirected to the client.
 		if err := h.srv.HandleAuthorizeRequest(c.Writer, c.Request); err != nil {
 			logger.Errorf("Authorization error: %v", err)
+		} else {
+			metrics.AuthorizeOutcome(redirectOutcome(c.Writer.Header().Get("Location")))
 		}
 	default:
 		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
 	}
 }
+
+// isRedirectURIRegistered requires clients with registered redirect URIs to use one of them exactly. Other clients are
+// checked against their domain by go-oauth2 once the authorization request is handled.
+func isRedirectURIRegistered(client *bizapiclient.APIClient, redirectURI string) bool {
+	return client.RedirectURIs == "" || slices.Contains(strings.Fields(client.RedirectURIs), redirectURI)
+}
+
+// redirectOutcome returns the error code of the redirect to the client, or success when there is none.
+func redirectOutcome(location string) string {
+	target, err := url.Parse(location)
+	if err != nil {
+		return metrics.AuthorizeError
+	}
+	if code := target.Query().Get("error"); code != "" {
+		return code
+	}
+	return metrics.AuthorizeSuccess
+}
+
+// errorRedirect sends the error of RFC 6749 section 4.1.2.1 back to the client. Errors are only redirected to a URI the
+// client may use, and are shown to the user otherwise.
+func (h *AuthorizeHandler) errorRedirect(c *gin.Context, client *bizapiclient.APIClient, redirectURI string, state string, code string, description string) {
+	target, err := url.Parse(redirectURI)
+	if redirectURI == "" || err != nil || !isRedirectURIRegistered(client, redirectURI) ||
+		(client.RedirectURIs == "" && manage.DefaultValidateURI(client.Domain, redirectURI) != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": code, "error_description": description})
+		return
+	}
+
+	query := target.Query()
+	query.Set("error", code)
+	query.Set("error_description", description)
+	if state != "" {
+		query.Set("state", state)
+	}
+	target.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, target.String())
+}
@@ -0,0 +1,210 @@
+package apiHandlersauth
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	"github.com/kdjuwidja/aishoppercommon/osutil"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizclientauth "netherealmstudio.com/m/v2/biz/clientauth"
+	bizdevice "netherealmstudio.com/m/v2/biz/device"
+)
+
+// UserAuthenticator checks a user's email and password for a login to the client, and returns the user's ID.
+type UserAuthenticator interface {
+	AuthenticateUser(ctx context.Context, clientID string, email string, password string) (string, error)
+}
+
+// DeviceHandler serves the device authorization endpoint of RFC 8628, and the verification page on which the user
+// enters the code shown on the device and logs in to approve it.
+type DeviceHandler struct {
+	tmpl                *template.Template
+	deviceAuthorizer    *bizdevice.DeviceAuthorizer
+	apiClientStore      *bizapiclient.APIClientStore
+	clientAuthenticator *bizclientauth.ClientAuthenticator
+	userAuthenticator   UserAuthenticator
+	responseFactory     *apiHandlers.ResponseFactory
+}
+
+func InitializeDeviceHandler(tmpl *template.Template, deviceAuthorizer *bizdevice.DeviceAuthorizer, apiClientStore *bizapiclient.APIClientStore, clientAuthenticator *bizclientauth.ClientAuthenticator, userAuthenticator UserAuthenticator, responseFactory *apiHandlers.ResponseFactory) *DeviceHandler {
+	return &DeviceHandler{
+		tmpl:                tmpl,
+		deviceAuthorizer:    deviceAuthorizer,
+		apiClientStore:      apiClientStore,
+		clientAuthenticator: clientAuthenticator,
+		userAuthenticator:   userAuthenticator,
+		responseFactory:     responseFactory,
+	}
+}
+
+type devicePageData struct {
+	UserCode   string
+	ClientID   string
+	ClientName string
+	Scope      string
+	Email      string
+	Error      string
+	// Confirm is set once a valid user code was entered, and the login form is shown instead of the code form.
+	Confirm  bool
+	Approved bool
+	Denied   bool
+	BasePath string
+}
+
+// DeviceAuthorization issues a device code and user code to the device.
+func (h *DeviceHandler) DeviceAuthorization(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		logger.Tracef("/device_authorization POST Failed to parse form: %s", err)
+		oauthErrorResponse(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	client, err := h.clientAuthenticator.Authenticate(c.Request)
+	switch {
+	case err == nil:
+	case errors.Is(err, bizclientauth.ErrInvalidClient):
+		logger.Tracef("/device_authorization POST Failed to authenticate client: %s", err)
+		oauthErrorResponse(c, http.StatusUnauthorized, bizdevice.ErrInvalidClient.Error())
+		return
+	default:
+		logger.Errorf("failed to authenticate client: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	resp, err := h.deviceAuthorizer.Authorize(c.Request.Context(), client.ID, client.Secret, c.PostForm("scope"))
+	switch {
+	case err == nil:
+	case errors.Is(err, bizdevice.ErrInvalidClient):
+		oauthErrorResponse(c, http.StatusUnauthorized, err.Error())
+		return
+	case errors.Is(err, bizdevice.ErrUnauthorizedClient):
+		oauthErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	default:
+		logger.Errorf("failed to create device authorization: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, resp)
+}
+
+// Verify serves the verification page. A GET without user_code shows the code form, and one with a user_code, as
+// linked by verification_uri_complete, goes straight to the login form.
+func (h *DeviceHandler) Verify(c *gin.Context) {
+	switch c.Request.Method {
+	case "GET":
+		data := &devicePageData{UserCode: strings.ToUpper(strings.TrimSpace(c.Query("user_code")))}
+		if data.UserCode == "" {
+			h.render(c, http.StatusOK, data)
+			return
+		}
+		if !h.loadPending(c, data) {
+			h.render(c, http.StatusBadRequest, data)
+			return
+		}
+		h.render(c, http.StatusOK, data)
+	case "POST":
+		h.handleDecision(c)
+	default:
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
+	}
+}
+
+func (h *DeviceHandler) handleDecision(c *gin.Context) {
+	data := &devicePageData{
+		UserCode: strings.ToUpper(strings.TrimSpace(c.PostForm("user_code"))),
+		Email:    strings.TrimSpace(c.PostForm("email")),
+	}
+
+	if !h.loadPending(c, data) {
+		h.render(c, http.StatusBadRequest, data)
+		return
+	}
+
+	if c.PostForm("action") == "deny" {
+		if err := h.deviceAuthorizer.Deny(c.Request.Context(), data.UserCode); err != nil {
+			h.handleDecisionError(c, data, err)
+			return
+		}
+		data.Denied = true
+		h.render(c, http.StatusOK, data)
+		return
+	}
+
+	userID, err := h.userAuthenticator.AuthenticateUser(c.Request.Context(), data.ClientID, data.Email, c.PostForm("password"))
+	if err != nil {
+		logger.Tracef("/device POST Failed to authenticate user %s: %s", data.Email, err)
+		data.Error = h.responseFactory.GetErrorMessage(apiHandlers.ErrInvalidLogin)
+		h.render(c, http.StatusUnauthorized, data)
+		return
+	}
+
+	if err := h.deviceAuthorizer.Approve(c.Request.Context(), data.UserCode, userID); err != nil {
+		h.handleDecisionError(c, data, err)
+		return
+	}
+	logger.Infof("User %s approved device authorization of client %s", userID, data.ClientName)
+
+	data.Approved = true
+	h.render(c, http.StatusOK, data)
+}
+
+// loadPending fills in the client and scope of the user code, or the error to show on the code form.
+func (h *DeviceHandler) loadPending(c *gin.Context, data *devicePageData) bool {
+	auth, err := h.deviceAuthorizer.GetPending(c.Request.Context(), data.UserCode)
+	if err != nil {
+		if !errors.Is(err, bizdevice.ErrInvalidUserCode) {
+			logger.Errorf("failed to get device authorization: %v", err)
+		}
+		data.Error = h.responseFactory.GetErrorMessage(apiHandlers.ErrInvalidUserCode)
+		return false
+	}
+
+	data.Confirm = true
+	data.Scope = auth.Scope
+	data.ClientID = auth.ClientID
+	data.ClientName = auth.ClientID
+	if client, err := h.apiClientStore.GetClient(auth.ClientID); err == nil && client.Description != "" {
+		data.ClientName = client.Description
+	}
+	return true
+}
+
+func (h *DeviceHandler) handleDecisionError(c *gin.Context, data *devicePageData, err error) {
+	data.Confirm = false
+	if errors.Is(err, bizdevice.ErrInvalidUserCode) {
+		data.Error = h.responseFactory.GetErrorMessage(apiHandlers.ErrInvalidUserCode)
+		h.render(c, http.StatusBadRequest, data)
+		return
+	}
+
+	logger.Errorf("failed to decide on device authorization: %v", err)
+	data.Error = h.responseFactory.GetErrorMessage(apiHandlers.ErrInternalServerError)
+	h.render(c, http.StatusInternalServerError, data)
+}
+
+func (h *DeviceHandler) render(c *gin.Context, status int, data *devicePageData) {
+	data.BasePath = "/" + osutil.GetEnvString("SERVICE_NAME", "auth")
+
+	c.Status(status)
+	if err := h.tmpl.Execute(c.Writer, data); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Template execution error"})
+		logger.Errorf("Template execution error: %v", err)
+		return
+	}
+}
+
+// oauthErrorResponse writes the error response of RFC 6749 section 5.2 used by the grants go-oauth2 does not handle.
+func oauthErrorResponse(c *gin.Context, status int, code string) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, gin.H{"error": code})
+}
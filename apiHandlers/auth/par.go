@@ -0,0 +1,101 @@
+package apiHandlersauth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	bizclientauth "netherealmstudio.com/m/v2/biz/clientauth"
+	"netherealmstudio.com/m/v2/statestore"
+	"netherealmstudio.com/m/v2/token"
+)
+
+// PARHandler serves the pushed authorization request endpoint of RFC 9126. Clients post the authorization parameters
+// here and send the user to /authorize with only client_id and the returned request_uri, so that the parameters never
+// show up in browser history, logs or referers.
+type PARHandler struct {
+	pushedRequestStore    *statestore.PushedRequestStore
+	requestObjectVerifier *token.RequestObjectVerifier
+	clientAuthenticator   *bizclientauth.ClientAuthenticator
+	requestTTL            time.Duration
+}
+
+func InitializePARHandler(pushedRequestStore *statestore.PushedRequestStore, requestObjectVerifier *token.RequestObjectVerifier, clientAuthenticator *bizclientauth.ClientAuthenticator, requestTTL time.Duration) *PARHandler {
+	return &PARHandler{
+		pushedRequestStore:    pushedRequestStore,
+		requestObjectVerifier: requestObjectVerifier,
+		clientAuthenticator:   clientAuthenticator,
+		requestTTL:            requestTTL,
+	}
+}
+
+func (h *PARHandler) Handle(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		logger.Tracef("/par POST Failed to parse form: %s", err)
+		oauthErrorResponse(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	// Clients authenticate the same way as at the token endpoint. Public clients only identify themselves.
+	client, err := h.clientAuthenticator.Authenticate(c.Request)
+	switch {
+	case err == nil:
+	case errors.Is(err, bizclientauth.ErrInvalidClient):
+		logger.Tracef("/par POST Failed to authenticate client: %s", err)
+		oauthErrorResponse(c, http.StatusUnauthorized, "invalid_client")
+		return
+	default:
+		logger.Errorf("failed to authenticate client: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+		return
+	}
+	clientID := client.ID
+
+	// RFC 9126 section 2.1 forbids pushing a request that itself refers to a pushed request.
+	if c.PostForm("request_uri") != "" {
+		oauthErrorResponse(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	request := statestore.PushedRequest{
+		ClientID:     clientID,
+		RedirectURI:  c.PostForm("redirect_uri"),
+		ResponseType: c.PostForm("response_type"),
+		Scope:        c.PostForm("scope"),
+		State:        c.PostForm("state"),
+	}
+	// A signed request object may be pushed as well, and then its parameters are the only ones used.
+	if requestObject := c.PostForm("request"); requestObject != "" {
+		obj, err := h.requestObjectVerifier.Verify(client, requestObject)
+		if err != nil {
+			logger.Tracef("/par POST Rejected request object of client %s: %s", clientID, err)
+			oauthErrorResponse(c, http.StatusBadRequest, token.ErrCodeInvalidRequestObject)
+			return
+		}
+		request.RedirectURI, request.ResponseType, request.Scope, request.State = obj.RedirectURI, obj.ResponseType, obj.Scope, obj.State
+	}
+
+	if request.ResponseType != "code" {
+		oauthErrorResponse(c, http.StatusBadRequest, "unsupported_response_type")
+		return
+	}
+	if request.RedirectURI == "" || request.State == "" || !isRedirectURIRegistered(client, request.RedirectURI) {
+		oauthErrorResponse(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	requestURI, err := h.pushedRequestStore.Push(request, h.requestTTL)
+	if err != nil {
+		logger.Errorf("failed to store pushed authorization request: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, gin.H{
+		"request_uri": requestURI,
+		"expires_in":  int64(h.requestTTL.Seconds()),
+	})
+}
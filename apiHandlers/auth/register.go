@@ -0,0 +1,178 @@
+package apiHandlersauth
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4/server"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	"github.com/kdjuwidja/aishoppercommon/osutil"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
+	bizregister "netherealmstudio.com/m/v2/biz/register"
+	"netherealmstudio.com/m/v2/statestore"
+)
+
+// RegisterHandler serves the registration page. When reached from the login page of a pending /authorize request, the
+// new user is logged in and sent back to the client once registered.
+type RegisterHandler struct {
+	srv                 *server.Server
+	tmpl                *template.Template
+	stateStore          *statestore.StateStore
+	registrationManager *bizregister.RegistrationManager
+	auditor             *bizaudit.Auditor
+	responseFactory     *apiHandlers.ResponseFactory
+}
+
+func InitializeRegisterHandler(srv *server.Server, tmpl *template.Template, stateStore *statestore.StateStore, registrationManager *bizregister.RegistrationManager, auditor *bizaudit.Auditor, responseFactory *apiHandlers.ResponseFactory) *RegisterHandler {
+	return &RegisterHandler{
+		srv:                 srv,
+		tmpl:                tmpl,
+		stateStore:          stateStore,
+		registrationManager: registrationManager,
+		auditor:             auditor,
+		responseFactory:     responseFactory,
+	}
+}
+
+type registerPageData struct {
+	ClientID     string
+	RedirectURI  string
+	State        string
+	ResponseType string
+	Scope        string
+	Code         string
+	Email        string
+	Error        string
+	FieldErrors  map[string]string
+	Success      bool
+	BasePath     string
+}
+
+func (h *RegisterHandler) Handle(c *gin.Context) {
+	switch c.Request.Method {
+	case "GET":
+		h.render(c, http.StatusOK, &registerPageData{
+			ClientID:     c.Query("client_id"),
+			RedirectURI:  c.Query("redirect_uri"),
+			State:        c.Query("state"),
+			ResponseType: c.Query("response_type"),
+			Scope:        c.Query("scope"),
+			Code:         strings.ToUpper(c.Query("code")),
+			Email:        c.Query("email"),
+			FieldErrors:  map[string]string{},
+		})
+	case "POST":
+		h.handleRegister(c)
+	default:
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
+	}
+}
+
+func (h *RegisterHandler) handleRegister(c *gin.Context) {
+	data := &registerPageData{
+		ClientID:     c.PostForm("client_id"),
+		RedirectURI:  c.PostForm("redirect_uri"),
+		State:        c.PostForm("state"),
+		ResponseType: c.PostForm("response_type"),
+		Scope:        c.PostForm("scope"),
+		Code:         strings.ToUpper(strings.TrimSpace(c.PostForm("code"))),
+		Email:        strings.TrimSpace(c.PostForm("email")),
+		FieldErrors:  map[string]string{},
+	}
+	password := c.PostForm("password")
+
+	logger.Tracef("/register POST clientID: %s, redirectURI: %s, state: %s, email: %s", data.ClientID, data.RedirectURI, data.State, data.Email)
+
+	// Validate the pending authorize request up front so that the user is not registered without being able to continue.
+	hasPendingAuthorize := data.State != ""
+	if hasPendingAuthorize && !h.stateStore.ValidateWithClientInfo(data.State, data.ClientID, data.RedirectURI) {
+		data.Error = "Your login session has expired. Please return to the application and try again."
+		h.render(c, http.StatusBadRequest, data)
+		return
+	}
+
+	if data.Code == "" {
+		data.FieldErrors["code"] = h.responseFactory.GetErrorMessage(apiHandlers.ErrMissingRequiredField, "code")
+	}
+	if _, err := mail.ParseAddress(data.Email); err != nil {
+		data.FieldErrors["email"] = h.responseFactory.GetErrorMessage(apiHandlers.ErrInvalidEmail)
+	}
+	if password != c.PostForm("confirm_password") {
+		data.FieldErrors["confirm_password"] = h.responseFactory.GetErrorMessage(apiHandlers.ErrPasswordMismatch)
+	}
+	if len(data.FieldErrors) > 0 {
+		h.render(c, http.StatusBadRequest, data)
+		return
+	}
+
+	err := h.registrationManager.RegisterUser(c.Request.Context(), data.Code, data.Email, password)
+	h.recordCodeRedeemed(c, data, err)
+	var violation *bizpassword.PolicyViolation
+	switch {
+	case err == nil:
+	case errors.As(err, &violation):
+		if violation.Limit > 0 {
+			data.FieldErrors["password"] = h.responseFactory.GetErrorMessage(apiHandlers.PasswordViolationCodes[violation.Rule], violation.Limit)
+		} else {
+			data.FieldErrors["password"] = h.responseFactory.GetErrorMessage(apiHandlers.PasswordViolationCodes[violation.Rule])
+		}
+	case errors.Is(err, bizregister.ErrRegistrationCodeNotFound):
+		data.FieldErrors["code"] = h.responseFactory.GetErrorMessage(apiHandlers.ErrInvalidRegistrationCode)
+	case errors.Is(err, bizregister.ErrEmailInUse):
+		data.FieldErrors["email"] = h.responseFactory.GetErrorMessage(apiHandlers.ErrEmailInUse)
+	default:
+		logger.Errorf("failed to register user: %v", err)
+		data.Error = h.responseFactory.GetErrorMessage(apiHandlers.ErrInternalServerError)
+	}
+	if err != nil {
+		h.render(c, http.StatusBadRequest, data)
+		return
+	}
+
+	if !hasPendingAuthorize {
+		data.Success = true
+		h.render(c, http.StatusOK, data)
+		return
+	}
+
+	// The form carries the authorize parameters along with the email and password, so the pending authorize request
+	// can be completed exactly as if the user had submitted the login page.
+	if err := h.srv.HandleAuthorizeRequest(c.Writer, c.Request); err != nil {
+		logger.Errorf("Authorization error after registration: %v", err)
+	}
+}
+
+// recordCodeRedeemed records the redemption of the code, or the attempt to redeem a code that is not redeemable.
+func (h *RegisterHandler) recordCodeRedeemed(c *gin.Context, data *registerPageData, err error) {
+	event := bizaudit.Event{
+		Type:      bizaudit.EventRegistrationCodeRedeemed,
+		SubjectID: bizaudit.CodeSubject(data.Code),
+		ClientID:  data.ClientID,
+		Details:   map[string]string{"email": data.Email},
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, bizregister.ErrRegistrationCodeNotFound):
+		event.Outcome = bizaudit.OutcomeFailure
+	default:
+		return
+	}
+	h.auditor.Record(c.Request.Context(), event)
+}
+
+func (h *RegisterHandler) render(c *gin.Context, status int, data *registerPageData) {
+	data.BasePath = "/" + osutil.GetEnvString("SERVICE_NAME", "auth")
+
+	c.Status(status)
+	if err := h.tmpl.Execute(c.Writer, data); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Template execution error"})
+		logger.Errorf("Template execution error: %v", err)
+		return
+	}
+}
@@ -0,0 +1,240 @@
+package apiHandlersauth
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4/manage"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/server"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
+	bizregister "netherealmstudio.com/m/v2/biz/register"
+	"netherealmstudio.com/m/v2/db"
+	"netherealmstudio.com/m/v2/mailer"
+	"netherealmstudio.com/m/v2/statestore"
+)
+
+const (
+	testClientID    = "test_client"
+	testRedirectURI = "http://localhost:3000/callback"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	dsn := "ai_shopper_dev:password@tcp(localhost:4306)/test_db?charset=utf8mb4&parseTime=True&loc=Local"
+	gormDB, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+
+	err = gormDB.Migrator().DropTable(&db.User{}, &db.RegistrationCode{}, &db.UserRole{}, &db.Role{}, &db.RoleScope{})
+	require.NoError(t, err)
+
+	err = gormDB.AutoMigrate(&db.User{}, &db.RegistrationCode{}, &db.UserRole{}, &db.Role{}, &db.RoleScope{})
+	require.NoError(t, err)
+
+	require.NoError(t, gormDB.Create(&db.Role{ID: 1, Description: "Test role for registration"}).Error)
+	return gormDB
+}
+
+// setupRegisterRouter serves the registration page next to an authorization server that logs users in by email, so
+// that a pending authorize request can be completed after registration.
+func setupRegisterRouter(t *testing.T) (*gin.Engine, *bizregister.RegistrationManager, *statestore.StateStore) {
+	gormDB := setupTestDB(t)
+
+	passwordPolicy := bizpassword.NewPolicy(bizpassword.PolicyConfig{MinLength: 8, DisallowEmail: true}, nil)
+	passwordHasher, err := bizpassword.NewPasswordHasher(bizpassword.AlgorithmBcrypt, bizpassword.NewBcryptAlgorithm(bcrypt.MinCost))
+	require.NoError(t, err)
+	registrationManager := bizregister.NewRegistrationManager(gormDB, 3, 1, time.Hour, passwordPolicy, passwordHasher,
+		bizregister.NewInviter(mailer.NewLogMailer(), "http://localhost:9096/auth/register"), 10)
+
+	clientStore := store.NewClientStore()
+	require.NoError(t, clientStore.Set(testClientID, &models.Client{ID: testClientID, Domain: testRedirectURI}))
+	manager := manage.NewDefaultManager()
+	manager.MustTokenStorage(store.NewMemoryTokenStore())
+	manager.MapClientStorage(clientStore)
+	srv := server.NewDefaultServer(manager)
+	srv.SetUserAuthorizationHandler(func(w http.ResponseWriter, r *http.Request) (string, error) {
+		var user db.User
+		if err := gormDB.Where("email = ?", r.PostFormValue("email")).First(&user).Error; err != nil {
+			return "", err
+		}
+		return user.ID, nil
+	})
+
+	stateStore := statestore.NewStateStore()
+	tmpl := template.Must(template.ParseFiles("../../web/templates/register.html"))
+	registerHandler := InitializeRegisterHandler(srv, tmpl, stateStore, registrationManager, bizaudit.NewAuditor(), apiHandlers.Initialize())
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Any("/register", registerHandler.Handle)
+
+	return router, registrationManager, stateStore
+}
+
+func newRegistrationCode(t *testing.T, registrationManager *bizregister.RegistrationManager) string {
+	code, err := registrationManager.GetRegistrationCode(context.Background(), "admin_user", bizregister.RegistrationCodeOptions{})
+	require.NoError(t, err)
+	return code.Code
+}
+
+func postRegister(router *gin.Engine, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRegisterPageRejectsMissingOrInvalidCode(t *testing.T) {
+	router, _, _ := setupRegisterRouter(t)
+	responseFactory := apiHandlers.Initialize()
+
+	testCases := []struct {
+		name     string
+		code     string
+		expected string
+	}{
+		{
+			name:     "missing code",
+			code:     "",
+			expected: responseFactory.GetErrorMessage(apiHandlers.ErrMissingRequiredField, "code"),
+		},
+		{
+			name:     "unknown code",
+			code:     "NOSUCHCODE",
+			expected: responseFactory.GetErrorMessage(apiHandlers.ErrInvalidRegistrationCode),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := postRegister(router, url.Values{
+				"code":             {tc.code},
+				"email":            {"test@example.com"},
+				"password":         {"testpassword123"},
+				"confirm_password": {"testpassword123"},
+			})
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), template.HTMLEscapeString(tc.expected))
+		})
+	}
+}
+
+func TestRegisterPageShowsPasswordFieldErrors(t *testing.T) {
+	router, registrationManager, _ := setupRegisterRouter(t)
+	responseFactory := apiHandlers.Initialize()
+
+	testCases := []struct {
+		name            string
+		password        string
+		confirmPassword string
+		expected        string
+	}{
+		{
+			name:            "password too short",
+			password:        "short",
+			confirmPassword: "short",
+			expected:        responseFactory.GetErrorMessage(apiHandlers.ErrPasswordTooShort, 8),
+		},
+		{
+			name:            "password matches email",
+			password:        "test@example.com",
+			confirmPassword: "test@example.com",
+			expected:        responseFactory.GetErrorMessage(apiHandlers.ErrPasswordMatchesEmail),
+		},
+		{
+			name:            "passwords do not match",
+			password:        "testpassword123",
+			confirmPassword: "testpassword456",
+			expected:        responseFactory.GetErrorMessage(apiHandlers.ErrPasswordMismatch),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := postRegister(router, url.Values{
+				"code":             {newRegistrationCode(t, registrationManager)},
+				"email":            {"test@example.com"},
+				"password":         {tc.password},
+				"confirm_password": {tc.confirmPassword},
+			})
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), template.HTMLEscapeString(tc.expected))
+		})
+	}
+}
+
+func TestRegisterPageWithoutPendingAuthorize(t *testing.T) {
+	router, registrationManager, _ := setupRegisterRouter(t)
+
+	w := postRegister(router, url.Values{
+		"code":             {newRegistrationCode(t, registrationManager)},
+		"email":            {"test@example.com"},
+		"password":         {"testpassword123"},
+		"confirm_password": {"testpassword123"},
+	})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+}
+
+func TestRegisterPageContinuesPendingAuthorize(t *testing.T) {
+	router, registrationManager, stateStore := setupRegisterRouter(t)
+	stateStore.Add("test_state", testClientID, testRedirectURI, "profile")
+
+	w := postRegister(router, url.Values{
+		"client_id":        {testClientID},
+		"redirect_uri":     {testRedirectURI},
+		"state":            {"test_state"},
+		"response_type":    {"code"},
+		"scope":            {"profile"},
+		"code":             {newRegistrationCode(t, registrationManager)},
+		"email":            {"test@example.com"},
+		"password":         {"testpassword123"},
+		"confirm_password": {"testpassword123"},
+	})
+
+	require.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(location.String(), testRedirectURI))
+	assert.NotEmpty(t, location.Query().Get("code"))
+	assert.Equal(t, "test_state", location.Query().Get("state"))
+}
+
+func TestRegisterPageRejectsExpiredAuthorizeSession(t *testing.T) {
+	router, registrationManager, _ := setupRegisterRouter(t)
+
+	w := postRegister(router, url.Values{
+		"client_id":        {testClientID},
+		"redirect_uri":     {testRedirectURI},
+		"state":            {"unknown_state"},
+		"response_type":    {"code"},
+		"code":             {newRegistrationCode(t, registrationManager)},
+		"email":            {"test@example.com"},
+		"password":         {"testpassword123"},
+		"confirm_password": {"testpassword123"},
+	})
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Your login session has expired")
+}
@@ -0,0 +1,205 @@
+package apiHandlersauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4"
+	oauth2errors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizclientauth "netherealmstudio.com/m/v2/biz/clientauth"
+)
+
+const tokenTypeHintRefreshToken = "refresh_token"
+
+// ClientAuthenticator authenticates the client of a request.
+type ClientAuthenticator interface {
+	Authenticate(r *http.Request) (*bizapiclient.APIClient, error)
+}
+
+// RevocationHandler serves token revocation (RFC 7009) and token introspection (RFC 7662). Clients authenticate at
+// both endpoints the way they do at the token endpoint.
+type RevocationHandler struct {
+	tokenStore          oauth2.TokenStore
+	clientAuthenticator ClientAuthenticator
+	auditor             *bizaudit.Auditor
+}
+
+func InitializeRevocationHandler(tokenStore oauth2.TokenStore, clientAuthenticator ClientAuthenticator, auditor *bizaudit.Auditor) *RevocationHandler {
+	return &RevocationHandler{
+		tokenStore:          tokenStore,
+		clientAuthenticator: clientAuthenticator,
+		auditor:             auditor,
+	}
+}
+
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+}
+
+// Revoke revokes an access or refresh token issued to the calling client. Revoking a refresh token also revokes the
+// access token issued with it. As RFC 7009 requires, unknown tokens and tokens of other clients are answered like
+// revoked ones.
+func (h *RevocationHandler) Revoke(c *gin.Context) {
+	client, ok := h.authenticate(c, "/revoke")
+	if !ok {
+		return
+	}
+	tok := c.PostForm("token")
+	if tok == "" {
+		oauthErrorResponse(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	ctx := c.Request.Context()
+	ti, isRefresh, err := h.lookup(ctx, tok, c.PostForm("token_type_hint"))
+	if err != nil {
+		logger.Errorf("failed to look up token for revocation: %v", err)
+		oauthErrorResponse(c, http.StatusServiceUnavailable, "temporarily_unavailable")
+		return
+	}
+	if ti == nil || ti.GetClientID() != client.ID {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if isRefresh {
+		err = h.remove(ctx, h.tokenStore.RemoveByRefresh, tok)
+		if err == nil && ti.GetAccess() != "" {
+			err = h.remove(ctx, h.tokenStore.RemoveByAccess, ti.GetAccess())
+		}
+	} else {
+		err = h.remove(ctx, h.tokenStore.RemoveByAccess, tok)
+	}
+	if err != nil {
+		logger.Errorf("failed to revoke token: %v", err)
+		oauthErrorResponse(c, http.StatusServiceUnavailable, "temporarily_unavailable")
+		return
+	}
+
+	h.auditor.Record(ctx, bizaudit.Event{
+		Type:      bizaudit.EventTokensRevoked,
+		ActorID:   client.ID,
+		SubjectID: ti.GetUserID(),
+		ClientID:  client.ID,
+		Details:   map[string]string{"reason": "client_revocation"},
+	})
+	c.Status(http.StatusOK)
+}
+
+// Introspect reports whether a token is active and, if it is, what it was issued for.
+func (h *RevocationHandler) Introspect(c *gin.Context) {
+	if _, ok := h.authenticate(c, "/introspect"); !ok {
+		return
+	}
+	tok := c.PostForm("token")
+	if tok == "" {
+		oauthErrorResponse(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	ti, isRefresh, err := h.lookup(c.Request.Context(), tok, c.PostForm("token_type_hint"))
+	if err != nil {
+		logger.Errorf("failed to look up token for introspection: %v", err)
+		oauthErrorResponse(c, http.StatusServiceUnavailable, "temporarily_unavailable")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	if ti == nil {
+		c.JSON(http.StatusOK, introspectionResponse{Active: false})
+		return
+	}
+
+	resp := introspectionResponse{
+		Active:   true,
+		Scope:    ti.GetScope(),
+		ClientID: ti.GetClientID(),
+		Sub:      ti.GetUserID(),
+	}
+	createdAt, expiresIn := ti.GetAccessCreateAt(), ti.GetAccessExpiresIn()
+	if isRefresh {
+		createdAt, expiresIn = ti.GetRefreshCreateAt(), ti.GetRefreshExpiresIn()
+	} else {
+		resp.TokenType = "Bearer"
+	}
+	resp.Iat = createdAt.Unix()
+	if expiresIn > 0 {
+		expiresAt := createdAt.Add(expiresIn)
+		if !expiresAt.After(time.Now()) {
+			c.JSON(http.StatusOK, introspectionResponse{Active: false})
+			return
+		}
+		resp.Exp = expiresAt.Unix()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// authenticate authenticates the client of the request, and writes the error response if that fails.
+func (h *RevocationHandler) authenticate(c *gin.Context, route string) (*bizapiclient.APIClient, bool) {
+	if c.Request.Method != "POST" {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Method not allowed"})
+		return nil, false
+	}
+	if err := c.Request.ParseForm(); err != nil {
+		logger.Tracef("%s POST Failed to parse form: %s", route, err)
+		oauthErrorResponse(c, http.StatusBadRequest, "invalid_request")
+		return nil, false
+	}
+
+	client, err := h.clientAuthenticator.Authenticate(c.Request)
+	switch {
+	case err == nil:
+		return client, true
+	case errors.Is(err, bizclientauth.ErrInvalidClient):
+		logger.Tracef("%s POST Failed to authenticate client: %s", route, err)
+		oauthErrorResponse(c, http.StatusUnauthorized, bizclientauth.ErrInvalidClient.Error())
+	default:
+		logger.Errorf("failed to authenticate client: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+	}
+	return nil, false
+}
+
+// lookup finds the token as the kind named by the hint first, and then as the other kind, as RFC 7009 asks of servers
+// that cannot find a token by its hint. It returns a nil token if there is none. Some stores find a token info by
+// either of its tokens, so the token found has to be the one of the kind looked up.
+func (h *RevocationHandler) lookup(ctx context.Context, tok string, hint string) (oauth2.TokenInfo, bool, error) {
+	refreshFirst := hint == tokenTypeHintRefreshToken
+	for _, isRefresh := range []bool{refreshFirst, !refreshFirst} {
+		get, issued := h.tokenStore.GetByAccess, oauth2.TokenInfo.GetAccess
+		if isRefresh {
+			get, issued = h.tokenStore.GetByRefresh, oauth2.TokenInfo.GetRefresh
+		}
+		ti, err := get(ctx, tok)
+		if errors.Is(err, oauth2errors.ErrInvalidAccessToken) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if ti != nil && issued(ti) == tok {
+			return ti, isRefresh, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// remove removes a token, treating one that is already gone as removed.
+func (h *RevocationHandler) remove(ctx context.Context, remove func(context.Context, string) error, tok string) error {
+	if err := remove(ctx, tok); err != nil && !errors.Is(err, oauth2errors.ErrInvalidAccessToken) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package apiHandlersauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizclientauth "netherealmstudio.com/m/v2/biz/clientauth"
+	"netherealmstudio.com/m/v2/jtistore"
+)
+
+func setupRevocationTest(t *testing.T) (*gin.Engine, oauth2.TokenStore) {
+	gin.SetMode(gin.TestMode)
+	tokenStore, err := store.NewMemoryTokenStore()
+	require.NoError(t, err)
+	clientStore := testDeviceClientStore{
+		"app":      {ID: "app", Secret: "app-secret"},
+		"resource": {ID: "resource", Secret: "resource-secret"},
+		"jwt-app":  {ID: "jwt-app", Secret: "jwt-app-secret-of-at-least-32-bytes", TokenEndpointAuthMethod: bizapiclient.AuthMethodClientSecretJWT},
+	}
+	authenticator := bizclientauth.NewClientAuthenticator(clientStore, jtistore.NewMemoryJTIStore(), []string{"http://localhost/auth/revoke", "http://localhost/auth/introspect"}, nil)
+	handler := InitializeRevocationHandler(tokenStore, authenticator, bizaudit.NewAuditor())
+
+	router := gin.New()
+	router.POST("/revoke", handler.Revoke)
+	router.POST("/introspect", handler.Introspect)
+
+	require.NoError(t, tokenStore.Create(context.Background(), &models.Token{
+		ClientID:         "app",
+		UserID:           "user-1",
+		Scope:            "profile",
+		Access:           "access-1",
+		AccessCreateAt:   time.Now(),
+		AccessExpiresIn:  time.Hour,
+		Refresh:          "refresh-1",
+		RefreshCreateAt:  time.Now(),
+		RefreshExpiresIn: 24 * time.Hour,
+	}))
+	require.NoError(t, tokenStore.Create(context.Background(), &models.Token{
+		ClientID:        "jwt-app",
+		UserID:          "user-2",
+		Access:          "access-2",
+		AccessCreateAt:  time.Now(),
+		AccessExpiresIn: time.Hour,
+	}))
+	return router, tokenStore
+}
+
+func clientSecretAssertion(t *testing.T, clientID string, secret string) string {
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": "http://localhost/auth/revoke",
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"jti": clientID + "-" + time.Now().Format(time.RFC3339Nano),
+	}).SignedString([]byte(secret))
+	require.NoError(t, err)
+	return assertion
+}
+
+func postForm(router *gin.Engine, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func introspect(t *testing.T, router *gin.Engine, tok string) map[string]interface{} {
+	w := postForm(router, "/introspect", url.Values{"client_id": {"resource"}, "client_secret": {"resource-secret"}, "token": {tok}})
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestIntrospect(t *testing.T) {
+	router, _ := setupRevocationTest(t)
+
+	t.Run("Active access token", func(t *testing.T) {
+		resp := introspect(t, router, "access-1")
+		assert.Equal(t, true, resp["active"])
+		assert.Equal(t, "app", resp["client_id"])
+		assert.Equal(t, "user-1", resp["sub"])
+		assert.Equal(t, "profile", resp["scope"])
+		assert.Equal(t, "Bearer", resp["token_type"])
+		assert.NotZero(t, resp["exp"])
+	})
+
+	t.Run("Active refresh token", func(t *testing.T) {
+		resp := introspect(t, router, "refresh-1")
+		assert.Equal(t, true, resp["active"])
+		assert.Nil(t, resp["token_type"])
+	})
+
+	t.Run("Unknown token", func(t *testing.T) {
+		assert.Equal(t, map[string]interface{}{"active": false}, introspect(t, router, "unknown"))
+	})
+
+	t.Run("Invalid client", func(t *testing.T) {
+		w := postForm(router, "/introspect", url.Values{"client_id": {"resource"}, "client_secret": {"wrong"}, "token": {"access-1"}})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid_client")
+	})
+
+	t.Run("Missing token", func(t *testing.T) {
+		w := postForm(router, "/introspect", url.Values{"client_id": {"resource"}, "client_secret": {"resource-secret"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid_request")
+	})
+}
+
+func TestRevoke(t *testing.T) {
+	t.Run("Invalid client", func(t *testing.T) {
+		router, _ := setupRevocationTest(t)
+		w := postForm(router, "/revoke", url.Values{"client_id": {"app"}, "client_secret": {"wrong"}, "token": {"access-1"}})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, true, introspect(t, router, "access-1")["active"])
+	})
+
+	t.Run("Token of another client", func(t *testing.T) {
+		router, _ := setupRevocationTest(t)
+		w := postForm(router, "/revoke", url.Values{"client_id": {"resource"}, "client_secret": {"resource-secret"}, "token": {"access-1"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, true, introspect(t, router, "access-1")["active"])
+	})
+
+	t.Run("Unknown token", func(t *testing.T) {
+		router, _ := setupRevocationTest(t)
+		w := postForm(router, "/revoke", url.Values{"client_id": {"app"}, "client_secret": {"app-secret"}, "token": {"unknown"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Access token", func(t *testing.T) {
+		router, tokenStore := setupRevocationTest(t)
+		w := postForm(router, "/revoke", url.Values{"client_id": {"app"}, "client_secret": {"app-secret"}, "token": {"access-1"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		ti, _ := tokenStore.GetByAccess(context.Background(), "access-1")
+		assert.Nil(t, ti)
+	})
+
+	t.Run("Refresh token revokes its access token", func(t *testing.T) {
+		router, _ := setupRevocationTest(t)
+		w := postForm(router, "/revoke", url.Values{"client_id": {"app"}, "client_secret": {"app-secret"},
+			"token": {"refresh-1"}, "token_type_hint": {"refresh_token"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, false, introspect(t, router, "refresh-1")["active"])
+		assert.Equal(t, false, introspect(t, router, "access-1")["active"])
+	})
+
+	t.Run("Client assertion", func(t *testing.T) {
+		router, _ := setupRevocationTest(t)
+		assertion := clientSecretAssertion(t, "jwt-app", "jwt-app-secret-of-at-least-32-bytes")
+		w := postForm(router, "/revoke", url.Values{"client_assertion_type": {bizclientauth.ClientAssertionTypeJWTBearer},
+			"client_assertion": {assertion}, "token": {"access-2"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, false, introspect(t, router, "access-2")["active"])
+
+		// An assertion cannot be used twice.
+		w = postForm(router, "/revoke", url.Values{"client_assertion_type": {bizclientauth.ClientAssertionTypeJWTBearer},
+			"client_assertion": {assertion}, "token": {"access-2"}})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Client assertion client secret is not accepted", func(t *testing.T) {
+		router, _ := setupRevocationTest(t)
+		w := postForm(router, "/revoke", url.Values{"client_id": {"jwt-app"}, "client_secret": {"jwt-app-secret-of-at-least-32-bytes"}, "token": {"access-2"}})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, true, introspect(t, router, "access-2")["active"])
+	})
+}
@@ -1,23 +1,51 @@
 package apiHandlersauth
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-oauth2/oauth2/v4"
+	oauth2errors "github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/go-oauth2/oauth2/v4/server"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/kdjuwidja/aishoppercommon/logger"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizdevice "netherealmstudio.com/m/v2/biz/device"
+	"netherealmstudio.com/m/v2/dpop"
+	"netherealmstudio.com/m/v2/metrics"
+	"netherealmstudio.com/m/v2/mtls"
+	"netherealmstudio.com/m/v2/token"
 )
 
+// ClientStore looks up the API clients tokens are issued to.
+type ClientStore interface {
+	GetClient(clientID string) (*bizapiclient.APIClient, error)
+}
+
 type TokenHandler struct {
-	srv        *server.Server
-	tokenStore oauth2.TokenStore
+	srv              *server.Server
+	tokenStore       oauth2.TokenStore
+	clientStore      ClientStore
+	deviceAuthorizer *bizdevice.DeviceAuthorizer
+	tokenExchanger   *token.TokenExchanger
+	proofVerifier    *dpop.ProofVerifier
+	auditor          *bizaudit.Auditor
+	accessTTL        time.Duration
 }
 
-func InitializeTokenHandler(srv *server.Server, tokenStore oauth2.TokenStore) *TokenHandler {
+func InitializeTokenHandler(srv *server.Server, tokenStore oauth2.TokenStore, clientStore ClientStore, deviceAuthorizer *bizdevice.DeviceAuthorizer, tokenExchanger *token.TokenExchanger, proofVerifier *dpop.ProofVerifier, auditor *bizaudit.Auditor, accessTTL time.Duration) *TokenHandler {
 	return &TokenHandler{
-		srv:        srv,
-		tokenStore: tokenStore,
+		srv:              srv,
+		tokenStore:       tokenStore,
+		clientStore:      clientStore,
+		deviceAuthorizer: deviceAuthorizer,
+		tokenExchanger:   tokenExchanger,
+		proofVerifier:    proofVerifier,
+		auditor:          auditor,
+		accessTTL:        accessTTL,
 	}
 }
 
@@ -34,23 +62,271 @@ func (h *TokenHandler) Handle(c *gin.Context) {
 		return
 	}
 
-	code := c.PostForm("code")
-	token, err := h.tokenStore.GetByCode(c.Request.Context(), code)
-	if err != nil {
-		logger.Tracef("/token POST Failed to get token: %s", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+	// A DPoP proof binds the tokens issued for the request to the proof's key. The token exchange issues bearer tokens
+	// for calls between services, and says so in token_type.
+	jkt, ok := h.verifyProof(c)
+	if !ok {
+		return
+	}
+	// Tokens requested with a client certificate are bound to it.
+	var certThumbprint string
+	if cert := mtls.PeerCertificate(c.Request); cert != nil {
+		certThumbprint = mtls.Thumbprint(cert)
+		c.Request = c.Request.WithContext(mtls.WithThumbprint(c.Request.Context(), certThumbprint))
+	}
+
+	var tokenInfo oauth2.TokenInfo
+	var err error
+	switch oauth2.GrantType(c.PostForm("grant_type")) {
+	case bizdevice.GrantTypeDeviceCode:
+		h.handleDeviceCode(c)
 		return
+	case token.GrantTypeTokenExchange:
+		h.handleTokenExchange(c)
+		return
+	case oauth2.Refreshing:
+		tokenInfo, err = h.tokenStore.GetByRefresh(c.Request.Context(), c.PostForm("refresh_token"))
+		if err != nil {
+			logger.Tracef("/token POST Failed to get token: %s", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+		// Tokens bound to a key or certificate are only refreshed with a proof of the same key, over a connection
+		// with the same certificate.
+		claims := unverifiedClaims(tokenInfo.GetAccess())
+		if boundJKT := dpop.BoundThumbprint(claims); boundJKT != "" && boundJKT != jkt {
+			oauthErrorResponse(c, http.StatusBadRequest, dpop.ErrInvalidProof.Error())
+			return
+		}
+		if bound := mtls.BoundThumbprint(claims); bound != "" && bound != certThumbprint {
+			oauthErrorResponse(c, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		tokenInfo, err = h.tokenStore.GetByCode(c.Request.Context(), c.PostForm("code"))
+		if err != nil {
+			logger.Tracef("/token POST Failed to get token: %s", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+			return
+		}
 	}
 
-	requestedScope := token.GetScope()
+	requestedScope := tokenInfo.GetScope()
 
-	logger.Tracef("/token POST code: %s, requestedScope: %s, grant_type: %s", code, requestedScope, c.PostForm("grant_type"))
+	logger.Tracef("/token POST code: %s, requestedScope: %s, grant_type: %s", c.PostForm("code"), requestedScope, c.PostForm("grant_type"))
 
 	c.Request.Form.Set("requestedScope", requestedScope)
-	err = h.srv.HandleTokenRequest(c.Writer, c.Request)
+
+	// The same as srv.HandleTokenRequest, which cannot respond with the DPoP token type.
+	gt, tgr, err := h.srv.ValidationTokenRequest(c.Request)
+	if err == nil {
+		tokenInfo, err = h.srv.GetAccessToken(c.Request.Context(), gt, tgr)
+	}
 	if err != nil {
 		logger.Tracef("/token POST Failed to handle token request: %s", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle token request"})
+		h.tokenErrorResponse(c, err)
+		return
+	}
+	h.tokenResponse(c, tokenInfo)
+}
+
+// handleDeviceCode answers the polling of a device with the RFC 8628 errors until the user approved the request on the
+// verification page, and then issues the token. go-oauth2 does not know the device grant, so the token is generated
+// through the manager directly.
+func (h *TokenHandler) handleDeviceCode(c *gin.Context) {
+	clientID, clientSecret, ok := h.clientInfo(c)
+	if !ok {
+		return
+	}
+
+	auth, err := h.deviceAuthorizer.Poll(c.Request.Context(), clientID, clientSecret, c.PostForm("device_code"))
+	switch {
+	case err == nil:
+	case errors.Is(err, bizdevice.ErrInvalidClient):
+		oauthErrorResponse(c, http.StatusUnauthorized, err.Error())
+		return
+	case errors.Is(err, bizdevice.ErrUnauthorizedClient),
+		errors.Is(err, bizdevice.ErrInvalidGrant),
+		errors.Is(err, bizdevice.ErrAuthorizationPending),
+		errors.Is(err, bizdevice.ErrSlowDown),
+		errors.Is(err, bizdevice.ErrAccessDenied),
+		errors.Is(err, bizdevice.ErrExpiredToken):
+		logger.Tracef("/token POST device code poll of client %s: %s", clientID, err)
+		oauthErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	default:
+		logger.Errorf("failed to poll device authorization: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	c.Request.Form.Set("requestedScope", auth.Scope)
+	tokenInfo, err := h.srv.Manager.GenerateAccessToken(c.Request.Context(), oauth2.GrantType(bizdevice.GrantTypeDeviceCode), &oauth2.TokenGenerateRequest{
+		ClientID:       clientID,
+		ClientSecret:   clientSecret,
+		UserID:         auth.UserID,
+		Scope:          auth.Scope,
+		AccessTokenExp: h.accessTTL,
+		Request:        c.Request,
+	})
+	if err != nil {
+		// Errors other than go-oauth2's own come from the scope authority rejecting the requested scope.
+		if _, ok := oauth2errors.Descriptions[err]; !ok {
+			logger.Debugf("/token POST device code token for client %s rejected: %s", clientID, err)
+			err = oauth2errors.ErrInvalidScope
+		}
+		h.tokenErrorResponse(c, err)
+		return
+	}
+
+	h.tokenResponse(c, tokenInfo)
+}
+
+// handleTokenExchange lets a service exchange the access token of the user it acts for, for a token of the downstream
+// service it calls, per RFC 8693.
+func (h *TokenHandler) handleTokenExchange(c *gin.Context) {
+	clientID, clientSecret, ok := h.clientInfo(c)
+	if !ok {
 		return
 	}
+
+	resp, err := h.tokenExchanger.Exchange(c.Request.Context(), &token.TokenExchangeRequest{
+		ClientID:           clientID,
+		ClientSecret:       clientSecret,
+		SubjectToken:       c.PostForm("subject_token"),
+		SubjectTokenType:   c.PostForm("subject_token_type"),
+		RequestedTokenType: c.PostForm("requested_token_type"),
+		Audience:           c.PostForm("audience"),
+		Scope:              c.PostForm("scope"),
+	})
+	var exchangeErr *token.ExchangeError
+	switch {
+	case err == nil:
+	case errors.As(err, &exchangeErr):
+		logger.Debugf("/token POST token exchange of client %s rejected: %s", clientID, err)
+		status := http.StatusBadRequest
+		if exchangeErr.Code == token.ErrCodeInvalidClient {
+			status = http.StatusUnauthorized
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(status, gin.H{"error": exchangeErr.Code, "error_description": exchangeErr.Description})
+		return
+	default:
+		logger.Errorf("failed to exchange token: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+		return
+	}
+	logger.Infof("Client %s exchanged a token for audience %s with scope %s", clientID, c.PostForm("audience"), resp.Scope)
+	metrics.TokenIssued(string(token.GrantTypeTokenExchange), h.clientLabel(clientID))
+	h.auditor.Record(c.Request.Context(), bizaudit.Event{
+		Type:     bizaudit.EventTokenIssued,
+		ActorID:  clientID,
+		ClientID: clientID,
+		Details: map[string]string{
+			"grant_type": string(token.GrantTypeTokenExchange),
+			"audience":   c.PostForm("audience"),
+			"scope":      resp.Scope,
+		},
+	})
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, resp)
+}
+
+// clientInfo authenticates the client of the grants handled outside go-oauth2 the same way go-oauth2 does. The
+// returned secret is the client's own, which the grants compare against again.
+func (h *TokenHandler) clientInfo(c *gin.Context) (string, string, bool) {
+	clientID, clientSecret, err := h.srv.ClientInfoHandler(c.Request)
+	switch {
+	case err == nil:
+		return clientID, clientSecret, true
+	case errors.Is(err, oauth2errors.ErrInvalidClient):
+		logger.Tracef("/token POST Failed to authenticate client: %s", err)
+		oauthErrorResponse(c, http.StatusUnauthorized, "invalid_client")
+	default:
+		logger.Errorf("failed to authenticate client: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+	}
+	return "", "", false
+}
+
+// clientLabel returns the client label of the metrics. Dynamically registered clients share one label, so that
+// anyone able to register a client cannot grow the number of series.
+func (h *TokenHandler) clientLabel(clientID string) string {
+	client, err := h.clientStore.GetClient(clientID)
+	if err != nil || client.IsDynamic {
+		return metrics.DynamicClient
+	}
+	return clientID
+}
+
+// verifyProof verifies the DPoP proof of the request if it has one, and binds the tokens issued for the request to
+// the proof's key through the request context.
+func (h *TokenHandler) verifyProof(c *gin.Context) (string, bool) {
+	if c.GetHeader(dpop.HeaderName) == "" {
+		return "", true
+	}
+
+	jkt, err := h.proofVerifier.Verify(c.Request, "")
+	switch {
+	case err == nil:
+	case errors.Is(err, dpop.ErrInvalidProof):
+		logger.Tracef("/token POST Rejected DPoP proof: %s", err)
+		oauthErrorResponse(c, http.StatusBadRequest, dpop.ErrInvalidProof.Error())
+		return "", false
+	default:
+		logger.Errorf("failed to verify DPoP proof: %v", err)
+		oauthErrorResponse(c, http.StatusInternalServerError, "server_error")
+		return "", false
+	}
+
+	c.Request = c.Request.WithContext(dpop.WithThumbprint(c.Request.Context(), jkt))
+	return jkt, true
+}
+
+func (h *TokenHandler) tokenResponse(c *gin.Context, tokenInfo oauth2.TokenInfo) {
+	data := h.srv.GetTokenData(tokenInfo)
+	if dpop.ThumbprintFromContext(c.Request.Context()) != "" {
+		data["token_type"] = dpop.TokenType
+	}
+	metrics.TokenIssued(c.PostForm("grant_type"), h.clientLabel(tokenInfo.GetClientID()))
+	// Tokens of the client credentials grant have no user, and are issued to the client acting on its own behalf.
+	actorID := tokenInfo.GetUserID()
+	if actorID == "" {
+		actorID = tokenInfo.GetClientID()
+	}
+	h.auditor.Record(c.Request.Context(), bizaudit.Event{
+		Type:      bizaudit.EventTokenIssued,
+		ActorID:   actorID,
+		SubjectID: tokenInfo.GetUserID(),
+		ClientID:  tokenInfo.GetClientID(),
+		Details: map[string]string{
+			"grant_type": c.PostForm("grant_type"),
+			"scope":      tokenInfo.GetScope(),
+		},
+	})
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, data)
+}
+
+func (h *TokenHandler) tokenErrorResponse(c *gin.Context, err error) {
+	data, status, header := h.srv.GetErrorData(err)
+	for key := range header {
+		c.Header(key, header.Get(key))
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, data)
+}
+
+// unverifiedClaims returns the claims of a previously issued access token. The token comes from the token store, so
+// its signature is not checked again.
+func unverifiedClaims(accessToken string) jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(accessToken, claims); err != nil {
+		return jwt.MapClaims{}
+	}
+	return claims
 }
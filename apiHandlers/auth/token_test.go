@@ -0,0 +1,116 @@
+package apiHandlersauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/generates"
+	"github.com/go-oauth2/oauth2/v4/manage"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/server"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizdevice "netherealmstudio.com/m/v2/biz/device"
+	"netherealmstudio.com/m/v2/devicestore"
+	"netherealmstudio.com/m/v2/goauth"
+	"netherealmstudio.com/m/v2/metrics"
+)
+
+type testDeviceClientStore map[string]*bizapiclient.APIClient
+
+func (s testDeviceClientStore) GetClient(clientID string) (*bizapiclient.APIClient, error) {
+	client, ok := s[clientID]
+	if !ok {
+		return nil, fmt.Errorf("client not found")
+	}
+	return client, nil
+}
+
+func postToken(router *gin.Engine, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestDeviceCodeGrantIssuesRefreshToken(t *testing.T) {
+	clientStore := store.NewClientStore()
+	require.NoError(t, clientStore.Set("tv", &models.Client{ID: "tv"}))
+	tokenStore, err := store.NewMemoryTokenStore()
+	require.NoError(t, err)
+
+	manager := goauth.NewManager()
+	manager.MapClientStorage(clientStore)
+	manager.MustTokenStorage(tokenStore, nil)
+	manager.MapAccessGenerate(generates.NewAccessGenerate())
+	manager.SetGrantTypeConfig(oauth2.GrantType(bizdevice.GrantTypeDeviceCode), &manage.Config{
+		AccessTokenExp:    time.Hour,
+		RefreshTokenExp:   24 * time.Hour,
+		IsGenerateRefresh: true,
+	})
+	srv := server.NewDefaultServer(manager)
+	srv.SetClientInfoHandler(server.ClientFormHandler)
+
+	clients := testDeviceClientStore{"tv": {ID: "tv", GrantTypes: bizdevice.GrantTypeDeviceCode + " refresh_token"}}
+	deviceAuthorizer := bizdevice.NewDeviceAuthorizer(devicestore.NewMemoryDeviceStore(), clients,
+		bizdevice.DeviceAuthorizerConfig{ExpiresIn: 10 * time.Minute, Interval: 5, VerificationURI: "https://auth.example.com/auth/device"})
+	tokenHandler := InitializeTokenHandler(srv, tokenStore, clients, deviceAuthorizer, nil, nil, bizaudit.NewAuditor(), time.Hour)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/token", tokenHandler.Handle)
+
+	ctx := context.Background()
+	authorization, err := deviceAuthorizer.Authorize(ctx, "tv", "", "profile")
+	require.NoError(t, err)
+	require.NoError(t, deviceAuthorizer.Approve(ctx, authorization.UserCode, "test_user_1"))
+
+	w := postToken(router, url.Values{
+		"grant_type":  {bizdevice.GrantTypeDeviceCode},
+		"client_id":   {"tv"},
+		"device_code": {authorization.DeviceCode},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.NotEmpty(t, response["access_token"])
+	require.NotEmpty(t, response["refresh_token"])
+
+	// The refresh token is usable for the refresh token grant.
+	w = postToken(router, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"tv"},
+		"refresh_token": {response["refresh_token"].(string)},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var refreshed map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+	assert.NotEmpty(t, refreshed["access_token"])
+	assert.NotEqual(t, response["access_token"], refreshed["access_token"])
+}
+
+func TestClientLabel(t *testing.T) {
+	h := InitializeTokenHandler(nil, nil, testDeviceClientStore{
+		"shopper":    {ID: "shopper"},
+		"registered": {ID: "registered", IsDynamic: true},
+	}, nil, nil, nil, bizaudit.NewAuditor(), time.Hour)
+
+	assert.Equal(t, "shopper", h.clientLabel("shopper"))
+	assert.Equal(t, metrics.DynamicClient, h.clientLabel("registered"))
+	assert.Equal(t, metrics.DynamicClient, h.clientLabel("unknown"))
+}
@@ -0,0 +1,38 @@
+package apiHandlersclient
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+)
+
+// APIClientReloader reloads the in-memory API clients from the database.
+type APIClientReloader interface {
+	ReloadAPIClients(ctx context.Context) (*bizapiclient.ReloadResult, error)
+}
+
+type ClientHandler struct {
+	reloader        APIClientReloader
+	responseFactory *apiHandlers.ResponseFactory
+}
+
+func InitializeClientHandler(reloader APIClientReloader, responseFactory *apiHandlers.ResponseFactory) *ClientHandler {
+	return &ClientHandler{
+		reloader:        reloader,
+		responseFactory: responseFactory,
+	}
+}
+
+func (h *ClientHandler) ReloadClients(c *gin.Context) {
+	result, err := h.reloader.ReloadAPIClients(c.Request.Context())
+	if err != nil {
+		logger.Errorf("failed to reload API clients: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, result)
+}
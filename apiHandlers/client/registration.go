@@ -0,0 +1,168 @@
+package apiHandlersclient
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+)
+
+// ClientRegistrationHandler serves dynamic client registration (RFC 7591) and client configuration management
+// (RFC 7592). Errors use the OAuth error response format of those RFCs rather than the service's error codes.
+type ClientRegistrationHandler struct {
+	registrar           *bizapiclient.ClientRegistrar
+	reloader            APIClientReloader
+	initialAccessTokens []string
+	registrationBaseURI string
+}
+
+// InitializeClientRegistrationHandler creates the handler. Registration is disabled when no initial access tokens are
+// configured.
+func InitializeClientRegistrationHandler(registrar *bizapiclient.ClientRegistrar, reloader APIClientReloader, initialAccessTokens []string, registrationBaseURI string) *ClientRegistrationHandler {
+	return &ClientRegistrationHandler{
+		registrar:           registrar,
+		reloader:            reloader,
+		initialAccessTokens: initialAccessTokens,
+		registrationBaseURI: strings.TrimSuffix(registrationBaseURI, "/"),
+	}
+}
+
+type clientRegistrationResponse struct {
+	*bizapiclient.RegisteredClient
+	RegistrationClientURI string `json:"registration_client_uri"`
+}
+
+func (h *ClientRegistrationHandler) RegisterClient(c *gin.Context) {
+	if !h.isInitialAccessToken(bearerToken(c)) {
+		h.invalidToken(c)
+		return
+	}
+
+	var metadata bizapiclient.ClientMetadata
+	if err := json.NewDecoder(c.Request.Body).Decode(&metadata); err != nil {
+		h.errorResponse(c, http.StatusBadRequest, bizapiclient.ErrCodeInvalidClientMetadata, "Invalid request body")
+		return
+	}
+
+	client, err := h.registrar.Register(c.Request.Context(), &metadata)
+	if err != nil {
+		h.handleRegistrationError(c, err, "register client")
+		return
+	}
+	logger.Infof("Registered client %s (%s) with scope %s", client.ClientID, client.ClientName, client.Scope)
+
+	h.reloadClients(c)
+	h.writeClient(c, http.StatusCreated, client)
+}
+
+func (h *ClientRegistrationHandler) GetClient(c *gin.Context) {
+	client, err := h.registrar.GetClient(c.Request.Context(), c.Param("client_id"), bearerToken(c))
+	if err != nil {
+		h.handleRegistrationError(c, err, "get client")
+		return
+	}
+
+	h.writeClient(c, http.StatusOK, client)
+}
+
+func (h *ClientRegistrationHandler) UpdateClient(c *gin.Context) {
+	var metadata struct {
+		bizapiclient.ClientMetadata
+		ClientID string `json:"client_id"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&metadata); err != nil {
+		h.errorResponse(c, http.StatusBadRequest, bizapiclient.ErrCodeInvalidClientMetadata, "Invalid request body")
+		return
+	}
+
+	// RFC 7592 section 2.2 requires the client_id in the body to match the client being updated.
+	if metadata.ClientID != c.Param("client_id") {
+		h.errorResponse(c, http.StatusBadRequest, bizapiclient.ErrCodeInvalidClientMetadata, "client_id does not match")
+		return
+	}
+
+	client, err := h.registrar.UpdateClient(c.Request.Context(), c.Param("client_id"), bearerToken(c), &metadata.ClientMetadata)
+	if err != nil {
+		h.handleRegistrationError(c, err, "update client")
+		return
+	}
+
+	h.reloadClients(c)
+	h.writeClient(c, http.StatusOK, client)
+}
+
+func (h *ClientRegistrationHandler) DeleteClient(c *gin.Context) {
+	err := h.registrar.DeleteClient(c.Request.Context(), c.Param("client_id"), bearerToken(c))
+	if err != nil {
+		h.handleRegistrationError(c, err, "delete client")
+		return
+	}
+	logger.Infof("Deleted client %s", c.Param("client_id"))
+
+	h.reloadClients(c)
+	c.Status(http.StatusNoContent)
+}
+
+// reloadClients makes the change visible to the oauth2 server right away. Should it fail, the periodic reload picks
+// the change up later.
+func (h *ClientRegistrationHandler) reloadClients(c *gin.Context) {
+	if _, err := h.reloader.ReloadAPIClients(c.Request.Context()); err != nil {
+		logger.Errorf("failed to reload API clients after client registration change: %v", err)
+	}
+}
+
+func (h *ClientRegistrationHandler) writeClient(c *gin.Context, status int, client *bizapiclient.RegisteredClient) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(status, clientRegistrationResponse{
+		RegisteredClient:      client,
+		RegistrationClientURI: h.registrationBaseURI + "/" + client.ClientID,
+	})
+}
+
+func (h *ClientRegistrationHandler) handleRegistrationError(c *gin.Context, err error, action string) {
+	var invalidMetadata *bizapiclient.InvalidClientMetadataError
+	switch {
+	case errors.As(err, &invalidMetadata):
+		h.errorResponse(c, http.StatusBadRequest, invalidMetadata.Code, invalidMetadata.Description)
+	case errors.Is(err, bizapiclient.ErrInvalidRegistrationToken):
+		h.invalidToken(c)
+	default:
+		logger.Errorf("failed to %s: %v", action, err)
+		h.errorResponse(c, http.StatusInternalServerError, "server_error", "Internal server error")
+	}
+}
+
+func (h *ClientRegistrationHandler) isInitialAccessToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, initialAccessToken := range h.initialAccessTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(initialAccessToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *ClientRegistrationHandler) invalidToken(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	h.errorResponse(c, http.StatusUnauthorized, "invalid_token", "Invalid or missing access token")
+}
+
+func (h *ClientRegistrationHandler) errorResponse(c *gin.Context, status int, code string, description string) {
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+func bearerToken(c *gin.Context) string {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return token
+}
@@ -4,22 +4,36 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
 )
 
 type DevHandler struct {
+	passwordHasher *bizpassword.PasswordHasher
 }
 
-func InitializeDevHandler() *DevHandler {
-	return &DevHandler{}
+func InitializeDevHandler(passwordHasher *bizpassword.PasswordHasher) *DevHandler {
+	return &DevHandler{
+		passwordHasher: passwordHasher,
+	}
 }
 
 func (h *DevHandler) GetBCryptHash(c *gin.Context) {
 	password := c.Query("text")
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := h.passwordHasher.HashWith(bizpassword.AlgorithmBcrypt, password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"hash": hash})
+}
+
+// GetPasswordHash hashes the text with the currently preferred password hash algorithm.
+func (h *DevHandler) GetPasswordHash(c *gin.Context) {
+	password := c.Query("text")
+	hash, err := h.passwordHasher.Hash(password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"hash": string(hash)})
+	c.JSON(http.StatusOK, gin.H{"hash": hash})
 }
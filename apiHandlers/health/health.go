@@ -1,18 +1,80 @@
 package apiHandlershealth
 
 import (
+	"context"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/kdjuwidja/aishoppercommon/logger"
 )
 
+// Check reports whether a dependency the service needs to serve requests is usable.
+type Check func(ctx context.Context) error
+
+// HealthHandler serves the liveness and readiness probes. Liveness only tells that the process is up, so that it is not
+// restarted while a dependency is down. Readiness runs every check, so that the instance is taken out of the load
+// balancer until its dependencies are back, and while it drains on shutdown.
 type HealthHandler struct {
+	checks   map[string]Check
+	timeout  time.Duration
+	draining atomic.Bool
+}
+
+func InitializeHealthHandler(checks map[string]Check, timeout time.Duration) *HealthHandler {
+	return &HealthHandler{
+		checks:  checks,
+		timeout: timeout,
+	}
 }
 
-func InitializeHealthHandler() *HealthHandler {
-	return &HealthHandler{}
+// SetDraining makes the readiness probe fail from now on, so that no new requests are routed to the instance while
+// the in-flight ones finish.
+func (h *HealthHandler) SetDraining() {
+	h.draining.Store(true)
 }
 
 func (h *HealthHandler) HealthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
+
+func (h *HealthHandler) ReadinessCheck(c *gin.Context) {
+	if h.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]string, len(h.checks))
+	ready := true
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			err := check(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.Warnf("Readiness check %s failed: %v", name, err)
+				results[name] = "unavailable"
+				ready = false
+				return
+			}
+			results[name] = "ok"
+		}(name, check)
+	}
+	wg.Wait()
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": results})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": results})
+}
@@ -0,0 +1,78 @@
+package apiHandlershealth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func probe(t *testing.T, handler gin.HandlerFunc) (int, map[string]interface{}) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/probe", handler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/probe", nil))
+
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return w.Code, body
+}
+
+func TestReadinessCheck(t *testing.T) {
+	redisDown := false
+	h := InitializeHealthHandler(map[string]Check{
+		"mysql": func(ctx context.Context) error { return nil },
+		"redis": func(ctx context.Context) error {
+			if redisDown {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+	}, time.Second)
+
+	code, body := probe(t, h.ReadinessCheck)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"mysql": "ok", "redis": "ok"}, body["checks"])
+
+	redisDown = true
+	code, body = probe(t, h.ReadinessCheck)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]interface{}{"mysql": "ok", "redis": "unavailable"}, body["checks"])
+
+	// Liveness does not depend on the checks.
+	code, _ = probe(t, h.HealthCheck)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReadinessCheck_Timeout(t *testing.T) {
+	h := InitializeHealthHandler(map[string]Check{
+		"mysql": func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}, 10*time.Millisecond)
+
+	code, _ := probe(t, h.ReadinessCheck)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestReadinessCheck_Draining(t *testing.T) {
+	h := InitializeHealthHandler(map[string]Check{}, time.Second)
+	h.SetDraining()
+
+	code, body := probe(t, h.ReadinessCheck)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "draining", body["status"])
+
+	code, _ = probe(t, h.HealthCheck)
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -51,6 +51,20 @@ func (rf *ResponseFactory) CreateErrorResponsef(c *gin.Context, err string, args
 	c.JSON(response.Status, APIResponse{Code: response.Code, Error: formattedErrStr})
 }
 
+// GetErrorMessage returns the human readable message for the error code, for responses that are not JSON.
+func (rf *ResponseFactory) GetErrorMessage(err string, args ...interface{}) string {
+	response, ok := responseMap[err]
+	if !ok {
+		logger.Errorf("No status code found for error: %s", err)
+		return responseMap[ErrInternalServerError].ErrorStr
+	}
+
+	if len(args) == 0 {
+		return response.ErrorStr
+	}
+	return fmt.Sprintf(response.ErrorStr, args...)
+}
+
 func (rf *ResponseFactory) createSuccessResponse(c *gin.Context, status int, data interface{}) {
 	if data == nil || (reflect.ValueOf(data).Kind() == reflect.Slice && reflect.ValueOf(data).Len() == 0) {
 		c.JSON(status, gin.H{})
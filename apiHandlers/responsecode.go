@@ -1,6 +1,10 @@
 package apiHandlers
 
-import "net/http"
+import (
+	"net/http"
+
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
+)
 
 const (
 	ErrInvalidToken         = "GEN_00001"
@@ -8,7 +12,40 @@ const (
 	ErrMissingRequiredField = "GEN_00003"
 	ErrMissingRequiredParam = "GEN_00004"
 	ErrInvalidScope         = "GEN_00005"
+	ErrInvalidParam         = "GEN_00006"
+	ErrInvalidDPoPProof     = "GEN_00007"
+	ErrCertificateMismatch  = "GEN_00008"
 	ErrInternalServerError  = "GEN_99999"
+
+	ErrUserNotFound = "USR_00001"
+
+	ErrInvalidCredentials       = "ACC_00001"
+	ErrEmailInUse               = "ACC_00002"
+	ErrInvalidVerificationToken = "ACC_00003"
+	ErrInvalidEmail             = "ACC_00004"
+	ErrPasswordMismatch         = "ACC_00005"
+
+	ErrPasswordTooShort      = "PWD_00001"
+	ErrPasswordTooLong       = "PWD_00002"
+	ErrPasswordMissingUpper  = "PWD_00003"
+	ErrPasswordMissingLower  = "PWD_00004"
+	ErrPasswordMissingDigit  = "PWD_00005"
+	ErrPasswordMissingSymbol = "PWD_00006"
+	ErrPasswordMatchesEmail  = "PWD_00007"
+	ErrPasswordBreached      = "PWD_00008"
+
+	ErrRegistrationCodeNotFound = "REG_00001"
+	ErrInvalidRoleID            = "REG_00002"
+	ErrInvalidBatchSize         = "REG_00003"
+	ErrInvalidRegistrationCode  = "REG_00004"
+
+	ErrRoleNotFound = "ROL_00001"
+	ErrRoleExists   = "ROL_00002"
+	ErrUnknownScope = "ROL_00003"
+	ErrLastAdmin    = "ROL_00004"
+
+	ErrInvalidUserCode = "DEV_00001"
+	ErrInvalidLogin    = "DEV_00002"
 )
 
 var responseMap = map[string]response{
@@ -18,4 +55,49 @@ var responseMap = map[string]response{
 	ErrMissingRequiredField: {ErrMissingRequiredField, http.StatusBadRequest, "Missing field in body: %s"},
 	ErrMissingRequiredParam: {ErrMissingRequiredParam, http.StatusBadRequest, "Missing parameter: %s"},
 	ErrInvalidScope:         {ErrInvalidScope, http.StatusForbidden, "Missing scope: %s"},
+	ErrInvalidParam:         {ErrInvalidParam, http.StatusBadRequest, "Invalid parameter: %s"},
+	ErrInvalidDPoPProof:     {ErrInvalidDPoPProof, http.StatusUnauthorized, "Invalid or missing DPoP proof."},
+	ErrCertificateMismatch:  {ErrCertificateMismatch, http.StatusUnauthorized, "Token is bound to a different client certificate."},
+
+	ErrUserNotFound: {ErrUserNotFound, http.StatusNotFound, "User not found."},
+
+	ErrInvalidCredentials:       {ErrInvalidCredentials, http.StatusUnauthorized, "Current password is incorrect."},
+	ErrEmailInUse:               {ErrEmailInUse, http.StatusConflict, "Email is already in use."},
+	ErrInvalidVerificationToken: {ErrInvalidVerificationToken, http.StatusBadRequest, "Invalid or expired verification token."},
+	ErrInvalidEmail:             {ErrInvalidEmail, http.StatusBadRequest, "Invalid email address."},
+	ErrPasswordMismatch:         {ErrPasswordMismatch, http.StatusBadRequest, "Passwords do not match."},
+
+	ErrPasswordTooShort:      {ErrPasswordTooShort, http.StatusBadRequest, "Password must be at least %d characters long."},
+	ErrPasswordTooLong:       {ErrPasswordTooLong, http.StatusBadRequest, "Password must be at most %d bytes long."},
+	ErrPasswordMissingUpper:  {ErrPasswordMissingUpper, http.StatusBadRequest, "Password must contain an uppercase letter."},
+	ErrPasswordMissingLower:  {ErrPasswordMissingLower, http.StatusBadRequest, "Password must contain a lowercase letter."},
+	ErrPasswordMissingDigit:  {ErrPasswordMissingDigit, http.StatusBadRequest, "Password must contain a digit."},
+	ErrPasswordMissingSymbol: {ErrPasswordMissingSymbol, http.StatusBadRequest, "Password must contain a symbol."},
+	ErrPasswordMatchesEmail:  {ErrPasswordMatchesEmail, http.StatusBadRequest, "Password must not be the same as the email address."},
+	ErrPasswordBreached:      {ErrPasswordBreached, http.StatusBadRequest, "Password has appeared in a data breach. Choose a different password."},
+
+	ErrRegistrationCodeNotFound: {ErrRegistrationCodeNotFound, http.StatusNotFound, "Registration code not found."},
+	ErrInvalidRoleID:            {ErrInvalidRoleID, http.StatusBadRequest, "Role does not exist: %d"},
+	ErrInvalidBatchSize:         {ErrInvalidBatchSize, http.StatusBadRequest, "Batch size must be between 1 and %d."},
+	ErrInvalidRegistrationCode:  {ErrInvalidRegistrationCode, http.StatusBadRequest, "Registration code is invalid, expired or already used."},
+
+	ErrRoleNotFound: {ErrRoleNotFound, http.StatusNotFound, "Role not found."},
+	ErrRoleExists:   {ErrRoleExists, http.StatusConflict, "A role with this description already exists."},
+	ErrUnknownScope: {ErrUnknownScope, http.StatusBadRequest, "Unknown scope: %s"},
+	ErrLastAdmin:    {ErrLastAdmin, http.StatusConflict, "At least one active user must keep the admin scope."},
+
+	ErrInvalidUserCode: {ErrInvalidUserCode, http.StatusBadRequest, "The code is invalid or has expired. Check the code shown on your device."},
+	ErrInvalidLogin:    {ErrInvalidLogin, http.StatusUnauthorized, "Invalid email or password."},
+}
+
+// PasswordViolationCodes maps password policy rules to the error code explaining the violation.
+var PasswordViolationCodes = map[bizpassword.ViolationRule]string{
+	bizpassword.RuleTooShort:       ErrPasswordTooShort,
+	bizpassword.RuleTooLong:        ErrPasswordTooLong,
+	bizpassword.RuleMissingUpper:   ErrPasswordMissingUpper,
+	bizpassword.RuleMissingLower:   ErrPasswordMissingLower,
+	bizpassword.RuleMissingDigit:   ErrPasswordMissingDigit,
+	bizpassword.RuleMissingSymbol:  ErrPasswordMissingSymbol,
+	bizpassword.RuleMatchesEmail:   ErrPasswordMatchesEmail,
+	bizpassword.RuleBreachedSecret: ErrPasswordBreached,
 }
@@ -0,0 +1,245 @@
+package apiHandlersrole
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizrole "netherealmstudio.com/m/v2/biz/role"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	bizuser "netherealmstudio.com/m/v2/biz/user"
+)
+
+type RoleHandler struct {
+	roleManager     *bizrole.RoleManager
+	scopeRegistry   bizscope.ScopeRegistry
+	scopeCache      *bizscope.ScopeCache
+	responseFactory *apiHandlers.ResponseFactory
+}
+
+func InitializeRoleHandler(roleManager *bizrole.RoleManager, scopeRegistry bizscope.ScopeRegistry, scopeCache *bizscope.ScopeCache, responseFactory *apiHandlers.ResponseFactory) *RoleHandler {
+	return &RoleHandler{
+		roleManager:     roleManager,
+		scopeRegistry:   scopeRegistry,
+		scopeCache:      scopeCache,
+		responseFactory: responseFactory,
+	}
+}
+
+type roleRequest struct {
+	Description string   `json:"description"`
+	Scopes      []string `json:"scopes"`
+}
+
+func (h *RoleHandler) ListScopes(c *gin.Context) {
+	scopes, err := h.scopeRegistry.ListScopes(c.Request.Context())
+	if err != nil {
+		logger.Errorf("failed to list scopes: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]interface{}{"scopes": scopes})
+}
+
+// GetScopeCacheStats reports the hit ratio of the scope lookups made when issuing tokens.
+func (h *RoleHandler) GetScopeCacheStats(c *gin.Context) {
+	h.responseFactory.CreateOKResponse(c, h.scopeCache.Stats())
+}
+
+func (h *RoleHandler) ListRoles(c *gin.Context) {
+	roles, err := h.roleManager.ListRoles(c.Request.Context())
+	if err != nil {
+		logger.Errorf("failed to list roles: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]interface{}{"roles": roles})
+}
+
+func (h *RoleHandler) GetRole(c *gin.Context) {
+	roleID, ok := h.parseRoleID(c)
+	if !ok {
+		return
+	}
+
+	role, err := h.roleManager.GetRole(c.Request.Context(), roleID)
+	if err != nil {
+		h.handleRoleError(c, err, "get role")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, role)
+}
+
+func (h *RoleHandler) CreateRole(c *gin.Context) {
+	var req roleRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	if req.Description == "" {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredField, "description")
+		return
+	}
+
+	role, err := h.roleManager.CreateRole(c.Request.Context(), req.Description, req.Scopes)
+	if err != nil {
+		h.handleRoleError(c, err, "create role")
+		return
+	}
+
+	h.responseFactory.CreateCreatedResponse(c, role)
+}
+
+func (h *RoleHandler) UpdateRole(c *gin.Context) {
+	roleID, ok := h.parseRoleID(c)
+	if !ok {
+		return
+	}
+
+	var req roleRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	if req.Description == "" {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredField, "description")
+		return
+	}
+
+	role, err := h.roleManager.UpdateRole(c.Request.Context(), roleID, req.Description)
+	if err != nil {
+		h.handleRoleError(c, err, "update role")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, role)
+}
+
+func (h *RoleHandler) DeleteRole(c *gin.Context) {
+	roleID, ok := h.parseRoleID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.roleManager.DeleteRole(c.Request.Context(), roleID); err != nil {
+		h.handleRoleError(c, err, "delete role")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Role deleted successfully"})
+}
+
+func (h *RoleHandler) AddRoleScopes(c *gin.Context) {
+	roleID, ok := h.parseRoleID(c)
+	if !ok {
+		return
+	}
+
+	var req roleRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredField, "scopes")
+		return
+	}
+
+	role, err := h.roleManager.AddRoleScopes(c.Request.Context(), roleID, req.Scopes)
+	if err != nil {
+		h.handleRoleError(c, err, "add role scopes")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, role)
+}
+
+func (h *RoleHandler) RemoveRoleScope(c *gin.Context) {
+	roleID, ok := h.parseRoleID(c)
+	if !ok {
+		return
+	}
+
+	role, err := h.roleManager.RemoveRoleScope(c.Request.Context(), roleID, c.Param("scope"))
+	if err != nil {
+		h.handleRoleError(c, err, "remove role scope")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, role)
+}
+
+func (h *RoleHandler) GetUserRoles(c *gin.Context) {
+	roles, err := h.roleManager.GetUserRoles(c.Request.Context(), c.Param("user_id"))
+	if err != nil {
+		h.handleRoleError(c, err, "get user roles")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]interface{}{"roles": roles})
+}
+
+func (h *RoleHandler) AssignRole(c *gin.Context) {
+	roleID, ok := h.parseRoleID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.roleManager.AssignRole(c.Request.Context(), c.Param("user_id"), roleID); err != nil {
+		h.handleRoleError(c, err, "assign role")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Role assigned successfully"})
+}
+
+func (h *RoleHandler) UnassignRole(c *gin.Context) {
+	roleID, ok := h.parseRoleID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.roleManager.UnassignRole(c.Request.Context(), c.Param("user_id"), roleID); err != nil {
+		h.handleRoleError(c, err, "unassign role")
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "Role unassigned successfully"})
+}
+
+func (h *RoleHandler) parseRoleID(c *gin.Context) (int, bool) {
+	roleID, err := strconv.Atoi(c.Param("role_id"))
+	if err != nil {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrInvalidParam, "role_id")
+		return 0, false
+	}
+	return roleID, true
+}
+
+func (h *RoleHandler) handleRoleError(c *gin.Context, err error, action string) {
+	var unknownScope *bizrole.UnknownScopeError
+	switch {
+	case errors.As(err, &unknownScope):
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrUnknownScope, unknownScope.Scope)
+	case errors.Is(err, bizrole.ErrRoleNotFound):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrRoleNotFound)
+	case errors.Is(err, bizrole.ErrRoleExists):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrRoleExists)
+	case errors.Is(err, bizrole.ErrLastAdmin):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrLastAdmin)
+	case errors.Is(err, bizuser.ErrUserNotFound):
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrUserNotFound)
+	default:
+		logger.Errorf("failed to %s: %v", action, err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+	}
+}
@@ -0,0 +1,112 @@
+package apiHandlersuser
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizuser "netherealmstudio.com/m/v2/biz/user"
+)
+
+type UserHandler struct {
+	userManager     *bizuser.UserManager
+	auditor         *bizaudit.Auditor
+	responseFactory *apiHandlers.ResponseFactory
+}
+
+func InitializeUserHandler(userManager *bizuser.UserManager, auditor *bizaudit.Auditor, responseFactory *apiHandlers.ResponseFactory) *UserHandler {
+	return &UserHandler{
+		userManager:     userManager,
+		auditor:         auditor,
+		responseFactory: responseFactory,
+	}
+}
+
+type statusChangeRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (h *UserHandler) parseStatusChangeRequest(c *gin.Context) (string, string, bool) {
+	userID := c.Param("user_id")
+	if userID == "" {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredParam, "user_id")
+		return "", "", false
+	}
+
+	var req statusChangeRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInvalidRequestBody)
+		return "", "", false
+	}
+
+	if req.Reason == "" {
+		h.responseFactory.CreateErrorResponsef(c, apiHandlers.ErrMissingRequiredField, "reason")
+		return "", "", false
+	}
+
+	return userID, req.Reason, true
+}
+
+func (h *UserHandler) DeactivateUser(c *gin.Context) {
+	userID, reason, ok := h.parseStatusChangeRequest(c)
+	if !ok {
+		return
+	}
+
+	err := h.userManager.DeactivateUser(c.Request.Context(), c.GetString("userID"), userID, reason)
+	if errors.Is(err, bizuser.ErrUserNotFound) {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrUserNotFound)
+		return
+	}
+	if errors.Is(err, bizuser.ErrLastAdmin) {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrLastAdmin)
+		return
+	}
+	if err != nil {
+		logger.Errorf("failed to deactivate user: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+	h.auditor.Record(c.Request.Context(), bizaudit.Event{
+		Type:      bizaudit.EventTokensRevoked,
+		ActorID:   c.GetString("userID"),
+		SubjectID: userID,
+		Details:   map[string]string{"reason": "user_deactivated"},
+	})
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "User deactivated successfully"})
+}
+
+func (h *UserHandler) ReactivateUser(c *gin.Context) {
+	userID, reason, ok := h.parseStatusChangeRequest(c)
+	if !ok {
+		return
+	}
+
+	err := h.userManager.ReactivateUser(c.Request.Context(), c.GetString("userID"), userID, reason)
+	if errors.Is(err, bizuser.ErrUserNotFound) {
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrUserNotFound)
+		return
+	}
+	if err != nil {
+		logger.Errorf("failed to reactivate user: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, map[string]string{"message": "User reactivated successfully"})
+}
+
+func (h *UserHandler) GetStatusHistory(c *gin.Context) {
+	history, err := h.userManager.GetStatusHistory(c.Request.Context(), c.Param("user_id"))
+	if err != nil {
+		logger.Errorf("failed to get user status history: %v", err)
+		h.responseFactory.CreateErrorResponse(c, apiHandlers.ErrInternalServerError)
+		return
+	}
+
+	h.responseFactory.CreateOKResponse(c, history)
+}
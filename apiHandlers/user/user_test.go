@@ -0,0 +1,161 @@
+package apiHandlersuser
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"netherealmstudio.com/m/v2/apiHandlers"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	bizuser "netherealmstudio.com/m/v2/biz/user"
+	dbmodel "netherealmstudio.com/m/v2/db"
+	"netherealmstudio.com/m/v2/goauth"
+)
+
+const testJWTSecret = "test-secret"
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	dsn := "ai_shopper_dev:password@tcp(localhost:4306)/test_db?parseTime=True"
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+
+	err = db.Migrator().DropTable(&dbmodel.UserStatusChange{}, &dbmodel.UserRole{}, &dbmodel.RoleScope{}, &dbmodel.Role{}, &dbmodel.User{})
+	require.NoError(t, err)
+
+	err = db.AutoMigrate(&dbmodel.User{}, &dbmodel.UserStatusChange{}, &dbmodel.Role{}, &dbmodel.RoleScope{}, &dbmodel.UserRole{})
+	require.NoError(t, err)
+
+	for _, user := range []dbmodel.User{
+		{ID: "admin_user", Email: "admin@example.com", Password: "hashed_password_1", IsActive: true},
+		{ID: "test_user_1", Email: "test1@example.com", Password: "hashed_password_2", IsActive: true},
+	} {
+		require.NoError(t, db.Create(&user).Error)
+	}
+
+	require.NoError(t, db.Create(&dbmodel.Role{ID: 1, Description: "admin"}).Error)
+	require.NoError(t, db.Create(&dbmodel.RoleScope{RoleID: 1, Scope: bizuser.AdminScope}).Error)
+	require.NoError(t, db.Create(&dbmodel.UserRole{UserID: "admin_user", RoleID: 1}).Error)
+
+	return db
+}
+
+func newTokenStore(t *testing.T) *goauth.JWTTokenStore {
+	tokenStore, err := goauth.InitializeJWTTokenStore()
+	require.NoError(t, err)
+	return tokenStore.(*goauth.JWTTokenStore)
+}
+
+// issueToken signs an access token for the user and records it in the token store, as the token endpoint does.
+func issueToken(t *testing.T, store oauth2.TokenStore, userID string, scope string) string {
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"sub":   userID,
+		"scope": scope,
+		"jti":   uuid.New().String(),
+	}).SignedString([]byte(testJWTSecret))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Create(context.Background(), &models.Token{
+		ClientID:        "test_client",
+		UserID:          userID,
+		Scope:           scope,
+		Access:          access,
+		AccessCreateAt:  time.Now(),
+		AccessExpiresIn: time.Hour,
+	}))
+	return access
+}
+
+func TestDeactivatedUserLosesAccess(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	db := setupTestDB(t)
+
+	tokenStore := newTokenStore(t)
+	userManager := bizuser.NewUserManager(db, tokenStore)
+	responseFactory := apiHandlers.Initialize()
+	scopeRegistry := bizscope.NewStaticScopeRegistry([]*bizscope.ScopeDefinition{{Name: "admin"}, {Name: "profile"}})
+	tokenVerifier := apiHandlers.InitializeTokenVerifier(*responseFactory, scopeRegistry, nil, tokenStore, userManager)
+	userHandler := InitializeUserHandler(userManager, bizaudit.NewAuditor(), responseFactory)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/users/:user_id/deactivate", tokenVerifier.VerifyToken([]string{"admin"}, userHandler.DeactivateUser))
+	router.POST("/users/:user_id/reactivate", tokenVerifier.VerifyToken([]string{"admin"}, userHandler.ReactivateUser))
+	router.GET("/profile", tokenVerifier.VerifyToken([]string{"profile"}, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetString("userID")})
+	}))
+
+	adminToken := issueToken(t, tokenStore, "admin_user", "admin")
+	userToken := issueToken(t, tokenStore, "test_user_1", "profile")
+
+	call := func(method string, path string, token string, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, call("GET", "/profile", userToken, ""))
+
+	// The only admin cannot be deactivated.
+	assert.Equal(t, http.StatusConflict, call("POST", "/users/admin_user/deactivate", adminToken, `{"reason": "leaving"}`))
+
+	assert.Equal(t, http.StatusOK, call("POST", "/users/test_user_1/deactivate", adminToken, `{"reason": "suspicious activity"}`))
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/profile", userToken, ""))
+
+	// Even a token still in the store is rejected while the user is inactive.
+	staleToken := issueToken(t, tokenStore, "test_user_1", "profile")
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/profile", staleToken, ""))
+
+	// Reactivation does not restore the revoked token.
+	assert.Equal(t, http.StatusOK, call("POST", "/users/test_user_1/reactivate", adminToken, `{"reason": "cleared"}`))
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/profile", userToken, ""))
+	assert.Equal(t, http.StatusOK, call("GET", "/profile", staleToken, ""))
+}
+
+func TestUnissuedTokenRejected(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	db := setupTestDB(t)
+
+	tokenStore := newTokenStore(t)
+	tokenVerifier := apiHandlers.InitializeTokenVerifier(*apiHandlers.Initialize(), bizscope.NewStaticScopeRegistry([]*bizscope.ScopeDefinition{{Name: "profile"}}),
+		nil, tokenStore, bizuser.NewUserManager(db, tokenStore))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/profile", tokenVerifier.VerifyToken([]string{"profile"}, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	}))
+
+	// Correctly signed, but never issued by the token endpoint.
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"sub":   "test_user_1",
+		"scope": "profile",
+	}).SignedString([]byte(testJWTSecret))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+access)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -1,6 +1,8 @@
 package apiHandlers
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"os"
 	"slices"
@@ -9,29 +11,49 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/kdjuwidja/aishoppercommon/logger"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	"netherealmstudio.com/m/v2/dpop"
+	"netherealmstudio.com/m/v2/mtls"
 )
 
+// AccessTokenStore looks up the access tokens that have been issued and not revoked since.
+type AccessTokenStore interface {
+	IsAccessIssued(ctx context.Context, userID string, access string) (bool, error)
+}
+
+// UserStatusChecker reports whether a user exists and is active.
+type UserStatusChecker interface {
+	IsUserActive(ctx context.Context, userID string) (bool, error)
+}
+
 type TokenVerifier struct {
 	responseFactory ResponseFactory
+	scopeRegistry   bizscope.ScopeRegistry
+	proofVerifier   *dpop.ProofVerifier
+	tokenStore      AccessTokenStore
+	userStatus      UserStatusChecker
 }
 
-func InitializeTokenVerifier(responseFactory ResponseFactory) *TokenVerifier {
+func InitializeTokenVerifier(responseFactory ResponseFactory, scopeRegistry bizscope.ScopeRegistry, proofVerifier *dpop.ProofVerifier, tokenStore AccessTokenStore, userStatus UserStatusChecker) *TokenVerifier {
 	return &TokenVerifier{
 		responseFactory: responseFactory,
+		scopeRegistry:   scopeRegistry,
+		proofVerifier:   proofVerifier,
+		tokenStore:      tokenStore,
+		userStatus:      userStatus,
 	}
 }
 
 func (v *TokenVerifier) VerifyToken(scopes []string, next gin.HandlerFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		if token == "" || len(token) < 7 || token[:7] != "Bearer " {
+		// DPoP-bound tokens are presented with the DPoP scheme instead of Bearer.
+		scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+		if token == "" || (scheme != "Bearer" && scheme != dpop.TokenType) {
 			v.responseFactory.CreateErrorResponse(c, ErrInvalidToken)
 			c.Abort()
 			return
 		}
 
-		token = token[7:]
-
 		secret := os.Getenv("JWT_SECRET")
 		if secret == "" {
 			logger.Warn("JWT secret not configured. Using default secret.")
@@ -59,13 +81,27 @@ func (v *TokenVerifier) VerifyToken(scopes []string, next gin.HandlerFunc) gin.H
 			return
 		}
 
+		if !v.verifyProof(c, scheme, token, mapClaims) {
+			c.Abort()
+			return
+		}
+
+		// Tokens bound to a client certificate are only accepted over a connection presenting that certificate.
+		if thumbprint := mtls.BoundThumbprint(mapClaims); thumbprint != "" {
+			if cert := mtls.PeerCertificate(c.Request); cert == nil || mtls.Thumbprint(cert) != thumbprint {
+				v.responseFactory.CreateErrorResponse(c, ErrCertificateMismatch)
+				c.Abort()
+				return
+			}
+		}
+
 		if mapClaims["scope"] == nil {
 			v.responseFactory.CreateErrorResponse(c, ErrInvalidToken)
 			c.Abort()
 			return
 		}
 
-		jwtScopes := strings.Split(mapClaims["scope"].(string), " ")
+		jwtScopes := v.scopeRegistry.Expand(strings.Split(mapClaims["scope"].(string), " "))
 		for _, scope := range scopes {
 			if !slices.Contains(jwtScopes, scope) {
 				v.responseFactory.CreateErrorResponsef(c, ErrInvalidScope, scope)
@@ -75,14 +111,79 @@ func (v *TokenVerifier) VerifyToken(scopes []string, next gin.HandlerFunc) gin.H
 		}
 
 		// Extract and set user ID
-		if userID, exists := mapClaims["sub"].(string); exists {
-			c.Set("userID", userID)
-		} else {
+		userID, exists := mapClaims["sub"].(string)
+		if !exists {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing user ID in token"})
 			c.Abort()
 			return
 		}
 
+		if !v.verifyNotRevoked(c, token, userID) {
+			c.Abort()
+			return
+		}
+		c.Set("userID", userID)
+
 		next(c)
 	}
 }
+
+// verifyNotRevoked rejects tokens that are no longer in the token store, such as those revoked on deactivation or a
+// password change, and tokens of users that have been deactivated or deleted since. The signature alone would keep a
+// revoked token valid until it expires.
+func (v *TokenVerifier) verifyNotRevoked(c *gin.Context, token string, userID string) bool {
+	ctx := c.Request.Context()
+	issued, err := v.tokenStore.IsAccessIssued(ctx, userID, token)
+	if err != nil {
+		logger.Errorf("failed to look up access token: %v", err)
+		v.responseFactory.CreateErrorResponse(c, ErrInternalServerError)
+		return false
+	}
+	if !issued {
+		v.responseFactory.CreateErrorResponse(c, ErrInvalidToken)
+		return false
+	}
+
+	// Tokens of clients acting on their own behalf have no user.
+	if userID == "" {
+		return true
+	}
+	active, err := v.userStatus.IsUserActive(ctx, userID)
+	if err != nil {
+		logger.Errorf("failed to check status of user %s: %v", userID, err)
+		v.responseFactory.CreateErrorResponse(c, ErrInternalServerError)
+		return false
+	}
+	if !active {
+		v.responseFactory.CreateErrorResponse(c, ErrInvalidToken)
+		return false
+	}
+	return true
+}
+
+// verifyProof requires tokens bound to a DPoP key to come with a proof of possession of that key, so that a leaked
+// token cannot be used without the key. Bearer tokens pass without a proof.
+func (v *TokenVerifier) verifyProof(c *gin.Context, scheme string, token string, mapClaims jwt.MapClaims) bool {
+	jkt := dpop.BoundThumbprint(mapClaims)
+	if jkt == "" && scheme != dpop.TokenType {
+		return true
+	}
+	if jkt == "" || scheme != dpop.TokenType {
+		v.responseFactory.CreateErrorResponse(c, ErrInvalidToken)
+		return false
+	}
+
+	proofJKT, err := v.proofVerifier.Verify(c.Request, token)
+	if err != nil && !errors.Is(err, dpop.ErrInvalidProof) {
+		logger.Errorf("failed to verify DPoP proof: %v", err)
+		v.responseFactory.CreateErrorResponse(c, ErrInternalServerError)
+		return false
+	}
+	if err != nil || proofJKT != jkt {
+		logger.Tracef("Rejected DPoP proof: %v", err)
+		c.Header("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+		v.responseFactory.CreateErrorResponse(c, ErrInvalidDPoPProof)
+		return false
+	}
+	return true
+}
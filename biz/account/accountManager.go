@@ -0,0 +1,265 @@
+package bizaccount
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	"gorm.io/gorm"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
+	bizuser "netherealmstudio.com/m/v2/biz/user"
+	"netherealmstudio.com/m/v2/db"
+	"netherealmstudio.com/m/v2/mailer"
+)
+
+var (
+	ErrInvalidCredentials       = errors.New("invalid credentials")
+	ErrEmailInUse               = errors.New("email already in use")
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+)
+
+// ScopeCacheInvalidator drops the cached scopes of a user whose account is deleted.
+type ScopeCacheInvalidator interface {
+	InvalidateUser(userID string)
+}
+
+// AccountManager implements the self-service operations a logged-in user can perform on their own account.
+type AccountManager struct {
+	dbConn           *gorm.DB
+	passwordPolicy   *bizpassword.Policy
+	passwordHasher   *bizpassword.PasswordHasher
+	tokenRevoker     bizuser.TokenRevoker
+	scopeInvalidator ScopeCacheInvalidator
+	mailer           mailer.Mailer
+	emailVerifyURL   string
+	emailVerifyTTL   time.Duration
+}
+
+func NewAccountManager(dbConn *gorm.DB, passwordPolicy *bizpassword.Policy, passwordHasher *bizpassword.PasswordHasher, tokenRevoker bizuser.TokenRevoker, scopeInvalidator ScopeCacheInvalidator, accountMailer mailer.Mailer, emailVerifyURL string, emailVerifyTTL time.Duration) *AccountManager {
+	return &AccountManager{
+		dbConn:           dbConn,
+		passwordPolicy:   passwordPolicy,
+		passwordHasher:   passwordHasher,
+		tokenRevoker:     tokenRevoker,
+		scopeInvalidator: scopeInvalidator,
+		mailer:           accountMailer,
+		emailVerifyURL:   emailVerifyURL,
+		emailVerifyTTL:   emailVerifyTTL,
+	}
+}
+
+func (m *AccountManager) loadAndVerifyUser(tx *gorm.DB, userID string, password string) (*db.User, error) {
+	var user db.User
+	result := tx.Where("id = ?", userID).First(&user)
+	if result.Error == gorm.ErrRecordNotFound {
+		return nil, bizuser.ErrUserNotFound
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	ok, _, err := m.passwordHasher.Verify(password, user.Password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &user, nil
+}
+
+// ChangePassword replaces the user's password after verifying the current one. All tokens issued to the user are
+// revoked so that other sessions have to log in again with the new password.
+func (m *AccountManager) ChangePassword(ctx context.Context, userID string, currentPassword string, newPassword string) error {
+	user, err := m.loadAndVerifyUser(m.dbConn.WithContext(ctx), userID, currentPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := m.passwordPolicy.Validate(newPassword, user.Email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := m.passwordHasher.Hash(newPassword)
+	if err != nil {
+		logger.Errorf("failed to generate hashed password: %v", err)
+		return err
+	}
+
+	err = m.dbConn.WithContext(ctx).Model(&db.User{}).Where("id = ?", user.ID).Update("password", hashedPassword).Error
+	if err != nil {
+		return err
+	}
+
+	if err := m.tokenRevoker.RemoveByUserID(ctx, user.ID); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	return nil
+}
+
+// RequestEmailChange records a pending email change and sends a verification token to the new address. The user's
+// email is not changed until the token is confirmed with ConfirmEmailChange.
+func (m *AccountManager) RequestEmailChange(ctx context.Context, userID string, password string, newEmail string) error {
+	user, err := m.loadAndVerifyUser(m.dbConn.WithContext(ctx), userID, password)
+	if err != nil {
+		return err
+	}
+
+	inUse, err := m.isEmailInUse(m.dbConn.WithContext(ctx), newEmail)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrEmailInUse
+	}
+
+	token, err := generateVerificationToken()
+	if err != nil {
+		return err
+	}
+
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	// Only the latest request is honoured, so earlier pending requests are discarded.
+	if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&db.EmailVerification{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	verification := db.EmailVerification{
+		UserID:    user.ID,
+		NewEmail:  newEmail,
+		TokenHash: hashVerificationToken(token),
+		ExpiresAt: time.Now().Add(m.emailVerifyTTL),
+	}
+	if err := tx.Create(&verification).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	body := fmt.Sprintf("Confirm your new email address by visiting %s?token=%s\n\nThe link expires in %s. If you did not request this change, ignore this email.", m.emailVerifyURL, token, m.emailVerifyTTL)
+	if err := m.mailer.Send(ctx, newEmail, "Confirm your new email address", body); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// ConfirmEmailChange applies the pending email change identified by the verification token.
+func (m *AccountManager) ConfirmEmailChange(ctx context.Context, token string) error {
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	var verification db.EmailVerification
+	result := tx.Where("token_hash = ?", hashVerificationToken(token)).First(&verification)
+	if result.Error == gorm.ErrRecordNotFound {
+		tx.Rollback()
+		return ErrInvalidVerificationToken
+	}
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	// The verification is single use whether or not it has expired.
+	if err := tx.Unscoped().Delete(&verification).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if time.Now().After(verification.ExpiresAt) {
+		tx.Commit()
+		return ErrInvalidVerificationToken
+	}
+
+	inUse, err := m.isEmailInUse(tx, verification.NewEmail)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if inUse {
+		tx.Rollback()
+		return ErrEmailInUse
+	}
+
+	if err := tx.Model(&db.User{}).Where("id = ?", verification.UserID).Update("email", verification.NewEmail).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// DeleteAccount soft deletes the user, removes their role assignments along with their cached scopes and revokes all of
+// their tokens.
+func (m *AccountManager) DeleteAccount(ctx context.Context, userID string, password string) error {
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	user, err := m.loadAndVerifyUser(tx, userID, password)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// user_roles are hard deleted because scope lookups join on the table with raw SQL that does not filter deleted_at.
+	if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&db.UserRole{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&db.EmailVerification{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Where("id = ?", user.ID).Delete(&db.User{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := bizuser.EnsureAdminRemains(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	m.scopeInvalidator.InvalidateUser(user.ID)
+
+	if err := m.tokenRevoker.RemoveByUserID(ctx, user.ID); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	return nil
+}
+
+// isEmailInUse includes soft deleted users since the unique index on email still applies to them.
+func (m *AccountManager) isEmailInUse(tx *gorm.DB, email string) (bool, error) {
+	var count int64
+	if err := tx.Unscoped().Model(&db.User{}).Where("email = ?", email).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func generateVerificationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Only the hash of the verification token is stored so that a database leak cannot be used to take over accounts.
+func hashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
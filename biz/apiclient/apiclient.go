@@ -1,8 +1,12 @@
 package bizapiclient
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/kdjuwidja/aishoppercommon/logger"
 	"gorm.io/gorm"
@@ -17,9 +21,43 @@ type APIClient struct {
 	IsPublic    bool   `json:"is_public"`
 	Description string `json:"description"`
 	Scopes      string `json:"scopes"`
+	// RedirectURIs and GrantTypes are space separated, and empty for clients that only rely on Domain.
+	RedirectURIs string `json:"redirect_uris"`
+	GrantTypes   string `json:"grant_types"`
+	// ExchangeAudiences lists the audiences the client may exchange user tokens for, as space separated
+	// audience=scope,scope entries sorted by audience. Kept as a string so that reloads can compare clients.
+	ExchangeAudiences string `json:"exchange_audiences"`
+	// RequirePAR makes /authorize only accept requests pushed to the PAR endpoint (RFC 9126).
+	RequirePAR bool `json:"require_par"`
+	// JWKS is the client's JSON Web Key Set document, used to verify the JWTs it signs.
+	JWKS string `json:"jwks"`
+	// TokenEndpointAuthMethod is the configured authentication method. Use AuthMethod for the one enforced.
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method"`
+	// TLSClientAuthSubjectDN is the subject DN of the CA-issued certificate of a tls_client_auth client.
+	TLSClientAuthSubjectDN string `json:"tls_client_auth_subject_dn"`
+	// TLSClientCertSPKI pins the public key of the certificate of a self_signed_tls_client_auth client, as the base64
+	// encoded SHA-256 hash of its SubjectPublicKeyInfo.
+	TLSClientCertSPKI string `json:"tls_client_cert_spki"`
+	// IsDynamic marks clients registered through dynamic client registration (RFC 7591) rather than by an admin.
+	IsDynamic bool `json:"is_dynamic"`
+}
+
+// ReloadResult lists the IDs of the API clients changed by a reload.
+type ReloadResult struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+// Changed returns the IDs of every added, updated or removed client.
+func (r *ReloadResult) Changed() []string {
+	return slices.Concat(r.Added, r.Updated, r.Removed)
 }
 
 type APIClientStore struct {
+	// mu guards apiClients. The map is replaced as a whole on reload and the clients in it are never modified, so a
+	// client returned by GetClient stays consistent for the rest of the request.
+	mu         sync.RWMutex
 	apiClients map[string]*APIClient
 	dbConn     *gorm.DB
 	isLocalDev bool
@@ -36,6 +74,9 @@ func NewAPIClientStore(dbConn *gorm.DB, isLocalDev bool) *APIClientStore {
 }
 
 func (s *APIClientStore) GetAPIClients() []APIClient {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	apiClients := make([]APIClient, 0)
 	for _, apiClient := range s.apiClients {
 		apiClients = append(apiClients, *apiClient)
@@ -44,6 +85,9 @@ func (s *APIClientStore) GetAPIClients() []APIClient {
 }
 
 func (s *APIClientStore) GetScope(clientId string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if scope, ok := s.apiClients[clientId]; !ok {
 		return "", fmt.Errorf("client not found")
 	} else {
@@ -51,7 +95,41 @@ func (s *APIClientStore) GetScope(clientId string) (string, error) {
 	}
 }
 
+// IsGrantTypeAllowed reports whether the client may use the grant type. Clients without registered grant types may
+// use any grant type the server supports.
+func (c *APIClient) IsGrantTypeAllowed(grantType string) bool {
+	return c.GrantTypes == "" || slices.Contains(strings.Fields(c.GrantTypes), grantType)
+}
+
+// AuthMethod returns the token endpoint authentication method the client must use. Clients without a configured
+// method send their secret in the form, or nothing if they have none.
+func (c *APIClient) AuthMethod() string {
+	switch {
+	case c.TokenEndpointAuthMethod != "":
+		return c.TokenEndpointAuthMethod
+	case c.Secret == "":
+		return AuthMethodNone
+	default:
+		return AuthMethodClientSecretPost
+	}
+}
+
+// ExchangeScopes returns the scopes the client may request when exchanging a user token for the audience, and false
+// if the client may not exchange tokens for the audience at all.
+func (c *APIClient) ExchangeScopes(audience string) ([]string, bool) {
+	for _, entry := range strings.Fields(c.ExchangeAudiences) {
+		entryAudience, scopes, _ := strings.Cut(entry, "=")
+		if entryAudience == audience {
+			return strings.FieldsFunc(scopes, func(r rune) bool { return r == ',' }), true
+		}
+	}
+	return nil, false
+}
+
 func (s *APIClientStore) GetClient(clientId string) (*APIClient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if client, ok := s.apiClients[clientId]; !ok {
 		return nil, fmt.Errorf("client not found")
 	} else {
@@ -67,7 +145,9 @@ func createDefaultAPIClient(dbConn *gorm.DB) error {
 			client["domain"].(string),
 			client["is_public"].(bool),
 			client["description"].(string),
-			client["scopes"].(string))
+			client["scopes"].(string),
+			client["default_scopes"].(string),
+			client["exchange_audiences"].(map[string]string))
 		if err != nil {
 			return err
 		}
@@ -75,7 +155,7 @@ func createDefaultAPIClient(dbConn *gorm.DB) error {
 	return nil
 }
 
-func createDBRecords(dbConn *gorm.DB, clientId string, clientSecret string, clientDomain string, clientIsPublic bool, clientDescription string, clientScopes string) error {
+func createDBRecords(dbConn *gorm.DB, clientId string, clientSecret string, clientDomain string, clientIsPublic bool, clientDescription string, clientScopes string, clientDefaultScopes string, clientExchangeAudiences map[string]string) error {
 	var client dbmodel.APIClient
 	result := dbConn.Where("id = ?", clientId).First(&client)
 	if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
@@ -96,6 +176,7 @@ func createDBRecords(dbConn *gorm.DB, clientId string, clientSecret string, clie
 		}
 	}
 
+	defaultScopes := strings.Fields(clientDefaultScopes)
 	scopes := strings.Split(clientScopes, " ")
 	for _, scope := range scopes {
 		var apiClientScope dbmodel.APIClientScope
@@ -108,6 +189,7 @@ func createDBRecords(dbConn *gorm.DB, clientId string, clientSecret string, clie
 			apiClientScope = dbmodel.APIClientScope{
 				APIClientID: clientId,
 				Scope:       scope,
+				IsDefault:   slices.Contains(defaultScopes, scope),
 			}
 			err := dbConn.Create(&apiClientScope).Error
 			if err != nil {
@@ -116,6 +198,26 @@ func createDBRecords(dbConn *gorm.DB, clientId string, clientSecret string, clie
 		}
 	}
 
+	for audience, scopes := range clientExchangeAudiences {
+		var exchangeAudience dbmodel.APIClientExchangeAudience
+		result := dbConn.Where("api_client_id = ? AND audience = ?", clientId, audience).First(&exchangeAudience)
+		if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
+			return fmt.Errorf("error loading api client exchange audience: %v", result.Error)
+		}
+
+		if result.RowsAffected == 0 {
+			exchangeAudience = dbmodel.APIClientExchangeAudience{
+				APIClientID: clientId,
+				Audience:    audience,
+				Scopes:      scopes,
+			}
+			err := dbConn.Create(&exchangeAudience).Error
+			if err != nil {
+				return fmt.Errorf("error creating api client exchange audience: %v", err)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -133,11 +235,20 @@ func loadAPIClient(dbConn *gorm.DB) (map[string]*APIClient, error) {
 	apiClients := make(map[string]*APIClient)
 	for _, client := range dbClients {
 		apiClient := &APIClient{
-			ID:          client.ID,
-			Secret:      client.Secret,
-			Domain:      client.Domain,
-			IsPublic:    client.IsPublic,
-			Description: client.Description,
+			ID:           client.ID,
+			Secret:       client.Secret,
+			Domain:       client.Domain,
+			IsPublic:     client.IsPublic,
+			Description:  client.Description,
+			RedirectURIs: client.RedirectURIs,
+			GrantTypes:   client.GrantTypes,
+			RequirePAR:   client.RequirePAR,
+			JWKS:         client.JWKS,
+
+			TokenEndpointAuthMethod: client.TokenEndpointAuthMethod,
+			TLSClientAuthSubjectDN:  client.TLSClientAuthSubjectDN,
+			TLSClientCertSPKI:       client.TLSClientCertSPKI,
+			IsDynamic:               client.RegistrationTokenHash != "",
 		}
 		apiClients[client.ID] = apiClient
 	}
@@ -169,7 +280,12 @@ func loadAPIClientScope(dbConn *gorm.DB, apiClients map[string]*APIClient) error
 	}
 
 	for apiClientId, scopeList := range apiClientScopes {
-		apiClient := apiClients[apiClientId]
+		apiClient, ok := apiClients[apiClientId]
+		if !ok {
+			continue
+		}
+		// Sort so that reloads can compare scopes regardless of the order rows are returned in.
+		sort.Strings(scopeList)
 		apiClient.Scopes = strings.Join(scopeList, " ")
 		apiClients[apiClientId] = apiClient
 	}
@@ -177,6 +293,28 @@ func loadAPIClientScope(dbConn *gorm.DB, apiClients map[string]*APIClient) error
 	return nil
 }
 
+func loadAPIClientExchangeAudiences(dbConn *gorm.DB, apiClients map[string]*APIClient) error {
+	var dbAudiences []dbmodel.APIClientExchangeAudience
+	if err := dbConn.Order("audience").Find(&dbAudiences).Error; err != nil {
+		return fmt.Errorf("error loading client exchange audiences: %v", err)
+	}
+
+	exchangeAudiences := make(map[string][]string)
+	for _, audience := range dbAudiences {
+		scopes := strings.Fields(audience.Scopes)
+		sort.Strings(scopes)
+		exchangeAudiences[audience.APIClientID] = append(exchangeAudiences[audience.APIClientID], audience.Audience+"="+strings.Join(scopes, ","))
+	}
+
+	for apiClientId, entries := range exchangeAudiences {
+		if apiClient, ok := apiClients[apiClientId]; ok {
+			apiClient.ExchangeAudiences = strings.Join(entries, " ")
+		}
+	}
+
+	return nil
+}
+
 func (c *APIClientStore) initializeAPIClientStore() error {
 	if c.isLocalDev {
 		logger.Info("Creating default API clients...")
@@ -190,6 +328,58 @@ func (c *APIClientStore) initializeAPIClientStore() error {
 	if err != nil {
 		return err
 	}
+	err = loadAPIClientScope(c.dbConn, apiClients)
+	if err == nil {
+		err = loadAPIClientExchangeAudiences(c.dbConn, apiClients)
+	}
+
+	c.mu.Lock()
+	c.apiClients = apiClients
+	c.mu.Unlock()
+	return err
+}
+
+// Reload reads the API clients from the database and replaces the in-memory clients in one step. Requests that
+// already looked up a client keep using the version they got.
+func (c *APIClientStore) Reload(ctx context.Context) (*ReloadResult, error) {
+	dbConn := c.dbConn.WithContext(ctx)
+	apiClients, err := loadAPIClient(dbConn)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadAPIClientScope(dbConn, apiClients); err != nil {
+		return nil, err
+	}
+	if err := loadAPIClientExchangeAudiences(dbConn, apiClients); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := &ReloadResult{
+		Added:   []string{},
+		Updated: []string{},
+		Removed: []string{},
+	}
+	for id, apiClient := range apiClients {
+		current, ok := c.apiClients[id]
+		if !ok {
+			result.Added = append(result.Added, id)
+		} else if *current != *apiClient {
+			result.Updated = append(result.Updated, id)
+		}
+	}
+	for id := range c.apiClients {
+		if _, ok := apiClients[id]; !ok {
+			result.Removed = append(result.Removed, id)
+		}
+	}
+	sort.Strings(result.Added)
+	sort.Strings(result.Updated)
+	sort.Strings(result.Removed)
+
 	c.apiClients = apiClients
-	return loadAPIClientScope(c.dbConn, c.apiClients)
+
+	return result, nil
 }
@@ -1,6 +1,7 @@
 package bizapiclient
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,11 +19,11 @@ func setupTestDB(t *testing.T) *gorm.DB {
 	assert.NoError(t, err)
 
 	// Drop existing tables
-	err = db.Migrator().DropTable(&dbmodel.APIClientScope{}, &dbmodel.APIClient{})
+	err = db.Migrator().DropTable(&dbmodel.APIClientExchangeAudience{}, &dbmodel.APIClientScope{}, &dbmodel.APIClient{})
 	assert.NoError(t, err)
 
 	// Migrate the schema
-	err = db.AutoMigrate(&dbmodel.APIClient{}, &dbmodel.APIClientScope{})
+	err = db.AutoMigrate(&dbmodel.APIClient{}, &dbmodel.APIClientScope{}, &dbmodel.APIClientExchangeAudience{})
 	assert.NoError(t, err)
 
 	return db
@@ -273,3 +274,107 @@ func TestAPIClientStore_GetClient(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, retrievedClient)
 }
+
+func TestAPIClientStore_Reload(t *testing.T) {
+	db := setupTestDB(t)
+
+	// Create two clients with scopes
+	clients := []dbmodel.APIClient{
+		{ID: "kept_client", Secret: "secret", Domain: "http://kept.com", Description: "Kept client"},
+		{ID: "removed_client", Secret: "secret", Domain: "http://removed.com", Description: "Removed client"},
+	}
+	for _, client := range clients {
+		err := db.Create(&client).Error
+		assert.NoError(t, err)
+	}
+	scopes := []dbmodel.APIClientScope{
+		{APIClientID: "kept_client", Scope: "profile"},
+		{APIClientID: "removed_client", Scope: "profile"},
+	}
+	for _, scope := range scopes {
+		err := db.Create(&scope).Error
+		assert.NoError(t, err)
+	}
+
+	// Initialize store
+	store := NewAPIClientStore(db, false)
+	oldClient, err := store.GetClient("kept_client")
+	assert.NoError(t, err)
+
+	// Add a client, add a scope to an existing client and remove a client
+	err = db.Create(&dbmodel.APIClient{ID: "added_client", Secret: "secret", Domain: "http://added.com", Description: "Added client"}).Error
+	assert.NoError(t, err)
+	err = db.Create(&dbmodel.APIClientScope{APIClientID: "added_client", Scope: "search"}).Error
+	assert.NoError(t, err)
+	err = db.Create(&dbmodel.APIClientScope{APIClientID: "kept_client", Scope: "search"}).Error
+	assert.NoError(t, err)
+	err = db.Where("id = ?", "removed_client").Delete(&dbmodel.APIClient{}).Error
+	assert.NoError(t, err)
+
+	result, err := store.Reload(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"added_client"}, result.Added)
+	assert.Equal(t, []string{"kept_client"}, result.Updated)
+	assert.Equal(t, []string{"removed_client"}, result.Removed)
+
+	// Clients looked up before the reload are left untouched
+	assert.Equal(t, "profile", oldClient.Scopes)
+
+	scope, err := store.GetScope("kept_client")
+	assert.NoError(t, err)
+	assert.Equal(t, "profile search", scope)
+
+	_, err = store.GetClient("added_client")
+	assert.NoError(t, err)
+
+	_, err = store.GetClient("removed_client")
+	assert.Error(t, err)
+
+	// Reloading without changes reports nothing
+	result, err = store.Reload(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, result.Changed())
+}
+
+func TestAPIClientStore_ExchangeAudiences(t *testing.T) {
+	db := setupTestDB(t)
+
+	err := db.Create(&dbmodel.APIClient{ID: "search_client", Secret: "secret", Domain: "http://search.com", Description: "Search client"}).Error
+	assert.NoError(t, err)
+	err = db.Create(&dbmodel.APIClientScope{APIClientID: "search_client", Scope: "search"}).Error
+	assert.NoError(t, err)
+	audiences := []dbmodel.APIClientExchangeAudience{
+		{APIClientID: "search_client", Audience: "shoplist", Scopes: "shoplist:read shoplist"},
+		{APIClientID: "search_client", Audience: "profile", Scopes: "profile"},
+	}
+	for _, audience := range audiences {
+		err := db.Create(&audience).Error
+		assert.NoError(t, err)
+	}
+
+	store := NewAPIClientStore(db, false)
+	client, err := store.GetClient("search_client")
+	assert.NoError(t, err)
+	assert.Equal(t, "profile=profile shoplist=shoplist,shoplist:read", client.ExchangeAudiences)
+
+	scopes, ok := client.ExchangeScopes("shoplist")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"shoplist", "shoplist:read"}, scopes)
+}
+
+func TestAPIClient_ExchangeScopes(t *testing.T) {
+	client := &APIClient{ExchangeAudiences: "inventory= shoplist=shoplist:read"}
+
+	scopes, ok := client.ExchangeScopes("shoplist")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"shoplist:read"}, scopes)
+
+	scopes, ok = client.ExchangeScopes("inventory")
+	assert.True(t, ok)
+	assert.Empty(t, scopes)
+
+	_, ok = client.ExchangeScopes("billing")
+	assert.False(t, ok)
+	_, ok = (&APIClient{}).ExchangeScopes("shoplist")
+	assert.False(t, ok)
+}
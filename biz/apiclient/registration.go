@@ -0,0 +1,486 @@
+package bizapiclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	dbmodel "netherealmstudio.com/m/v2/db"
+	"netherealmstudio.com/m/v2/jwks"
+	"netherealmstudio.com/m/v2/mtls"
+)
+
+const (
+	AuthMethodNone             = "none"
+	AuthMethodClientSecretPost = "client_secret_post"
+	// AuthMethodClientSecretJWT and AuthMethodPrivateKeyJWT authenticate with a client assertion (RFC 7523), signed
+	// with the client secret or with a key of the client's JWKS.
+	AuthMethodClientSecretJWT = "client_secret_jwt"
+	AuthMethodPrivateKeyJWT   = "private_key_jwt"
+	// AuthMethodTLSClientAuth and AuthMethodSelfSignedTLSClientAuth authenticate with the TLS client certificate
+	// (RFC 8705 section 2), issued by a trusted CA to the registered subject DN, or self-signed with a pinned key.
+	AuthMethodTLSClientAuth           = "tls_client_auth"
+	AuthMethodSelfSignedTLSClientAuth = "self_signed_tls_client_auth"
+
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// Error codes defined by RFC 7591 section 3.2.2.
+	ErrCodeInvalidRedirectURI    = "invalid_redirect_uri"
+	ErrCodeInvalidClientMetadata = "invalid_client_metadata"
+)
+
+var ErrInvalidRegistrationToken = errors.New("invalid registration access token")
+
+// InvalidClientMetadataError is returned when the submitted client metadata is rejected.
+type InvalidClientMetadataError struct {
+	Code        string
+	Description string
+}
+
+func (e *InvalidClientMetadataError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// ClientMetadata is the client metadata of RFC 7591 section 2 supported by this service.
+type ClientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ClientName              string   `json:"client_name"`
+	Scope                   string   `json:"scope"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	// RequirePushedAuthorizationRequests is the client metadata of RFC 9126 section 6.
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests"`
+	// JWKS holds the client's public keys, by value as in RFC 7591 section 2.
+	JWKS json.RawMessage `json:"jwks,omitempty"`
+	// TLSClientAuthSubjectDN is the client metadata of RFC 8705 section 2.1.2 for tls_client_auth clients.
+	TLSClientAuthSubjectDN string `json:"tls_client_auth_subject_dn,omitempty"`
+	// TLSClientCertSPKI pins the key of a self_signed_tls_client_auth client as the base64 encoded SHA-256 hash of its
+	// SubjectPublicKeyInfo. Clients registering with a single key in jwks get the pin of that key.
+	TLSClientCertSPKI string `json:"tls_client_cert_spki,omitempty"`
+}
+
+// RegisteredClient is the client information response of RFC 7591 section 3.2.1.
+type RegisteredClient struct {
+	ClientMetadata
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64  `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+}
+
+// ClientRegistrationPolicy caps what a dynamically registered client may ask for.
+type ClientRegistrationPolicy struct {
+	AllowedScopes     []string
+	AllowedGrantTypes []string
+}
+
+// ClientRegistrar implements dynamic client registration (RFC 7591) and client configuration management (RFC 7592).
+type ClientRegistrar struct {
+	dbConn        *gorm.DB
+	scopeRegistry bizscope.ScopeRegistry
+	policy        ClientRegistrationPolicy
+}
+
+func NewClientRegistrar(dbConn *gorm.DB, scopeRegistry bizscope.ScopeRegistry, policy ClientRegistrationPolicy) *ClientRegistrar {
+	return &ClientRegistrar{
+		dbConn:        dbConn,
+		scopeRegistry: scopeRegistry,
+		policy:        policy,
+	}
+}
+
+// Register creates a client from the metadata. The returned client carries the secret and the registration access
+// token, neither of which can be retrieved again.
+func (r *ClientRegistrar) Register(ctx context.Context, metadata *ClientMetadata) (*RegisteredClient, error) {
+	if err := r.normalizeMetadata(ctx, metadata); err != nil {
+		return nil, err
+	}
+
+	clientID, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	secret := ""
+	if metadata.TokenEndpointAuthMethod != AuthMethodNone {
+		if secret, err = randomHex(20); err != nil {
+			return nil, err
+		}
+	}
+	registrationToken, registrationTokenHash, err := generateRegistrationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	client := dbmodel.APIClient{
+		ID:                    clientID,
+		Secret:                secret,
+		Domain:                clientDomain(metadata),
+		IsPublic:              metadata.TokenEndpointAuthMethod == AuthMethodNone,
+		Description:           metadata.ClientName,
+		RedirectURIs:          strings.Join(metadata.RedirectURIs, " "),
+		GrantTypes:            strings.Join(metadata.GrantTypes, " "),
+		RegistrationTokenHash: registrationTokenHash,
+		RequirePAR:            metadata.RequirePushedAuthorizationRequests,
+		JWKS:                  string(metadata.JWKS),
+
+		TokenEndpointAuthMethod: metadata.TokenEndpointAuthMethod,
+		TLSClientAuthSubjectDN:  metadata.TLSClientAuthSubjectDN,
+		TLSClientCertSPKI:       metadata.TLSClientCertSPKI,
+	}
+
+	tx := r.dbConn.WithContext(ctx).Begin()
+	if err := tx.Create(&client).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := replaceClientScopes(tx, clientID, metadata.Scope); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	registered := toRegisteredClient(&client, metadata.Scope)
+	registered.ClientSecret = secret
+	registered.RegistrationAccessToken = registrationToken
+	return registered, nil
+}
+
+func (r *ClientRegistrar) GetClient(ctx context.Context, clientID string, registrationToken string) (*RegisteredClient, error) {
+	client, err := r.authenticate(r.dbConn.WithContext(ctx), clientID, registrationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	scope, err := loadClientScope(r.dbConn.WithContext(ctx), clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	registered := toRegisteredClient(client, scope)
+	registered.ClientSecret = client.Secret
+	return registered, nil
+}
+
+// UpdateClient replaces the client metadata as described in RFC 7592 section 2.2. The client ID, secret and
+// registration access token are kept.
+func (r *ClientRegistrar) UpdateClient(ctx context.Context, clientID string, registrationToken string, metadata *ClientMetadata) (*RegisteredClient, error) {
+	if err := r.normalizeMetadata(ctx, metadata); err != nil {
+		return nil, err
+	}
+
+	tx := r.dbConn.WithContext(ctx).Begin()
+
+	client, err := r.authenticate(tx, clientID, registrationToken)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// A client switching from public to confidential needs a secret, and one switching the other way gives it up.
+	if metadata.TokenEndpointAuthMethod == AuthMethodNone {
+		client.Secret = ""
+	} else if client.Secret == "" {
+		if client.Secret, err = randomHex(20); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Model(&dbmodel.APIClient{}).Where("id = ?", clientID).Updates(map[string]interface{}{
+		"secret":        client.Secret,
+		"domain":        clientDomain(metadata),
+		"is_public":     metadata.TokenEndpointAuthMethod == AuthMethodNone,
+		"description":   metadata.ClientName,
+		"redirect_uris": strings.Join(metadata.RedirectURIs, " "),
+		"grant_types":   strings.Join(metadata.GrantTypes, " "),
+		"require_par":   metadata.RequirePushedAuthorizationRequests,
+		"jwks":          string(metadata.JWKS),
+
+		"token_endpoint_auth_method": metadata.TokenEndpointAuthMethod,
+		"tls_client_auth_subject_dn": metadata.TLSClientAuthSubjectDN,
+		"tls_client_cert_spki":       metadata.TLSClientCertSPKI,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := replaceClientScopes(tx, clientID, metadata.Scope); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return r.GetClient(ctx, clientID, registrationToken)
+}
+
+func (r *ClientRegistrar) DeleteClient(ctx context.Context, clientID string, registrationToken string) error {
+	tx := r.dbConn.WithContext(ctx).Begin()
+
+	if _, err := r.authenticate(tx, clientID, registrationToken); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// ScopeAuthority does not filter soft deleted rows, so the client's scopes are removed for good.
+	if err := tx.Unscoped().Where("api_client_id = ?", clientID).Delete(&dbmodel.APIClientScope{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("id = ?", clientID).Delete(&dbmodel.APIClient{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// authenticate loads a dynamically registered client and checks the registration access token against it. Clients
+// that were not registered dynamically have no token hash and can never be managed through this endpoint.
+func (r *ClientRegistrar) authenticate(tx *gorm.DB, clientID string, registrationToken string) (*dbmodel.APIClient, error) {
+	var client dbmodel.APIClient
+	err := tx.Where("id = ?", clientID).First(&client).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidRegistrationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if client.RegistrationTokenHash == "" || subtle.ConstantTimeCompare([]byte(client.RegistrationTokenHash), []byte(hashRegistrationToken(registrationToken))) != 1 {
+		return nil, ErrInvalidRegistrationToken
+	}
+
+	return &client, nil
+}
+
+// normalizeMetadata validates the metadata, fills in defaults and caps the scope to the registration policy.
+func (r *ClientRegistrar) normalizeMetadata(ctx context.Context, metadata *ClientMetadata) error {
+
+	switch metadata.TokenEndpointAuthMethod {
+	case "":
+		metadata.TokenEndpointAuthMethod = AuthMethodClientSecretPost
+	case AuthMethodNone, AuthMethodClientSecretPost, AuthMethodClientSecretJWT:
+	case AuthMethodPrivateKeyJWT:
+		if len(metadata.JWKS) == 0 {
+			return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, "private_key_jwt requires jwks"}
+		}
+	case AuthMethodTLSClientAuth:
+		if metadata.TLSClientAuthSubjectDN == "" {
+			return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, "tls_client_auth requires tls_client_auth_subject_dn"}
+		}
+	case AuthMethodSelfSignedTLSClientAuth:
+		if err := normalizeCertPin(metadata); err != nil {
+			return err
+		}
+	default:
+		return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, fmt.Sprintf("unsupported token_endpoint_auth_method: %s", metadata.TokenEndpointAuthMethod)}
+	}
+
+	// Clients that omit grant_types get the authorization code grant, and refresh tokens for it when they are allowed.
+	if len(metadata.GrantTypes) == 0 {
+		metadata.GrantTypes = []string{GrantTypeAuthorizationCode}
+		if slices.Contains(r.policy.AllowedGrantTypes, GrantTypeRefreshToken) {
+			metadata.GrantTypes = append(metadata.GrantTypes, GrantTypeRefreshToken)
+		}
+	}
+	for _, grantType := range metadata.GrantTypes {
+		if !slices.Contains(r.policy.AllowedGrantTypes, grantType) {
+			return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, fmt.Sprintf("grant type not allowed: %s", grantType)}
+		}
+	}
+
+	// Only the authorization code grant redirects back to the client. Device clients poll the token endpoint instead.
+	if len(metadata.RedirectURIs) == 0 && slices.Contains(metadata.GrantTypes, GrantTypeAuthorizationCode) {
+		return &InvalidClientMetadataError{ErrCodeInvalidRedirectURI, "at least one redirect URI is required"}
+	}
+	for _, redirectURI := range metadata.RedirectURIs {
+		if err := validateRedirectURI(redirectURI); err != nil {
+			return err
+		}
+	}
+
+	if len(metadata.JWKS) > 0 {
+		if _, err := jwks.Parse(metadata.JWKS); err != nil {
+			return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, err.Error()}
+		}
+	}
+
+	if metadata.ClientName == "" {
+		metadata.ClientName = "Dynamically registered client"
+	}
+
+	// RFC 7591 lets the server grant fewer scopes than requested. An empty request is granted the whole policy.
+	requested := strings.Fields(metadata.Scope)
+	if len(requested) == 0 {
+		requested = r.policy.AllowedScopes
+	}
+	granted := make([]string, 0, len(requested))
+	for _, scope := range requested {
+		if !slices.Contains(r.policy.AllowedScopes, scope) || slices.Contains(granted, scope) {
+			continue
+		}
+		ok, err := r.scopeRegistry.IsRegistered(ctx, scope)
+		if err != nil {
+			return err
+		}
+		if ok {
+			granted = append(granted, scope)
+		}
+	}
+	if len(granted) == 0 {
+		return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, "none of the requested scopes may be registered"}
+	}
+	metadata.Scope = strings.Join(granted, " ")
+
+	return nil
+}
+
+// clientDomain is the domain go-oauth2 falls back to for redirect URI checks. Device clients register no redirect URIs,
+// and so no domain either.
+// normalizeCertPin checks the tls_client_cert_spki of a self_signed_tls_client_auth client, or derives it from the
+// client's only key in jwks.
+func normalizeCertPin(metadata *ClientMetadata) error {
+	if metadata.TLSClientCertSPKI == "" {
+		if len(metadata.JWKS) == 0 {
+			return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, "self_signed_tls_client_auth requires tls_client_cert_spki or jwks"}
+		}
+		keySet, err := jwks.Parse(metadata.JWKS)
+		if err != nil {
+			return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, err.Error()}
+		}
+		publicKeys := keySet.PublicKeys()
+		if len(publicKeys) != 1 {
+			return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, "self_signed_tls_client_auth requires tls_client_cert_spki when jwks has more than one key"}
+		}
+		pin, err := mtls.PublicKeyPin(publicKeys[0])
+		if err != nil {
+			return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, err.Error()}
+		}
+		metadata.TLSClientCertSPKI = pin
+		return nil
+	}
+
+	if sum, err := base64.StdEncoding.DecodeString(metadata.TLSClientCertSPKI); err != nil || len(sum) != sha256.Size {
+		return &InvalidClientMetadataError{ErrCodeInvalidClientMetadata, "tls_client_cert_spki must be a base64 encoded SHA-256 hash"}
+	}
+	return nil
+}
+
+func clientDomain(metadata *ClientMetadata) string {
+	if len(metadata.RedirectURIs) == 0 {
+		return ""
+	}
+	return metadata.RedirectURIs[0]
+}
+
+// validateRedirectURI requires absolute URIs without fragments, and https unless the host is the loopback interface.
+func validateRedirectURI(redirectURI string) error {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil || !parsed.IsAbs() || parsed.Host == "" {
+		return &InvalidClientMetadataError{ErrCodeInvalidRedirectURI, fmt.Sprintf("redirect URI must be an absolute URI: %s", redirectURI)}
+	}
+	if parsed.Fragment != "" {
+		return &InvalidClientMetadataError{ErrCodeInvalidRedirectURI, fmt.Sprintf("redirect URI must not contain a fragment: %s", redirectURI)}
+	}
+
+	isLoopback := parsed.Hostname() == "localhost" || parsed.Hostname() == "127.0.0.1" || parsed.Hostname() == "::1"
+	if parsed.Scheme != "https" && !(parsed.Scheme == "http" && isLoopback) {
+		return &InvalidClientMetadataError{ErrCodeInvalidRedirectURI, fmt.Sprintf("redirect URI must use https: %s", redirectURI)}
+	}
+
+	return nil
+}
+
+func replaceClientScopes(tx *gorm.DB, clientID string, scope string) error {
+	if err := tx.Unscoped().Where("api_client_id = ?", clientID).Delete(&dbmodel.APIClientScope{}).Error; err != nil {
+		return err
+	}
+
+	for _, s := range strings.Fields(scope) {
+		// Every scope of a dynamically registered client is a default scope, so an empty request gets all of them.
+		if err := tx.Create(&dbmodel.APIClientScope{APIClientID: clientID, Scope: s, IsDefault: true}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadClientScope(tx *gorm.DB, clientID string) (string, error) {
+	scopes := []string{}
+	if err := tx.Model(&dbmodel.APIClientScope{}).Where("api_client_id = ?", clientID).Order("id").Pluck("scope", &scopes).Error; err != nil {
+		return "", err
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+func toRegisteredClient(client *dbmodel.APIClient, scope string) *RegisteredClient {
+	authMethod := client.TokenEndpointAuthMethod
+	if authMethod == "" {
+		authMethod = AuthMethodClientSecretPost
+		if client.IsPublic {
+			authMethod = AuthMethodNone
+		}
+	}
+
+	var keySet json.RawMessage
+	if client.JWKS != "" {
+		keySet = json.RawMessage(client.JWKS)
+	}
+
+	return &RegisteredClient{
+		ClientMetadata: ClientMetadata{
+			RedirectURIs:            strings.Fields(client.RedirectURIs),
+			GrantTypes:              strings.Fields(client.GrantTypes),
+			ClientName:              client.Description,
+			Scope:                   scope,
+			TokenEndpointAuthMethod: authMethod,
+
+			RequirePushedAuthorizationRequests: client.RequirePAR,
+			JWKS:                               keySet,
+			TLSClientAuthSubjectDN:             client.TLSClientAuthSubjectDN,
+			TLSClientCertSPKI:                  client.TLSClientCertSPKI,
+		},
+		ClientID:         client.ID,
+		ClientIDIssuedAt: client.CreatedAt.Unix(),
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func generateRegistrationToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRegistrationToken(token), nil
+}
+
+func hashRegistrationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
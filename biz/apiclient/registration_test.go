@@ -0,0 +1,242 @@
+package bizapiclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	"netherealmstudio.com/m/v2/mtls"
+)
+
+func newTestRegistrar(t *testing.T, withDB bool) *ClientRegistrar {
+	registry := bizscope.NewStaticScopeRegistry([]*bizscope.ScopeDefinition{{Name: "profile"}, {Name: "search"}, {Name: "admin"}})
+	policy := ClientRegistrationPolicy{
+		AllowedScopes:     []string{"profile", "search", "unregistered"},
+		AllowedGrantTypes: []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeDeviceCode},
+	}
+	if !withDB {
+		return NewClientRegistrar(nil, registry, policy)
+	}
+	return NewClientRegistrar(setupTestDB(t), registry, policy)
+}
+
+func TestClientRegistrar_NormalizeMetadata(t *testing.T) {
+	registrar := newTestRegistrar(t, false)
+	ctx := context.Background()
+
+	t.Run("Defaults", func(t *testing.T) {
+		metadata := &ClientMetadata{RedirectURIs: []string{"https://partner.example.com/callback"}}
+		require.NoError(t, registrar.normalizeMetadata(ctx, metadata))
+		assert.Equal(t, AuthMethodClientSecretPost, metadata.TokenEndpointAuthMethod)
+		assert.Equal(t, []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken}, metadata.GrantTypes)
+		assert.Equal(t, "profile search", metadata.Scope)
+		assert.NotEmpty(t, metadata.ClientName)
+	})
+
+	t.Run("DefaultsWithoutRefreshTokens", func(t *testing.T) {
+		registrar := NewClientRegistrar(nil, registrar.scopeRegistry, ClientRegistrationPolicy{
+			AllowedScopes:     []string{"profile"},
+			AllowedGrantTypes: []string{GrantTypeAuthorizationCode},
+		})
+		metadata := &ClientMetadata{RedirectURIs: []string{"https://partner.example.com/callback"}}
+		require.NoError(t, registrar.normalizeMetadata(ctx, metadata))
+		assert.Equal(t, []string{GrantTypeAuthorizationCode}, metadata.GrantTypes)
+	})
+
+	t.Run("ScopeCappedByPolicy", func(t *testing.T) {
+		metadata := &ClientMetadata{RedirectURIs: []string{"http://localhost:8080/cb"}, Scope: "admin search unregistered search"}
+		require.NoError(t, registrar.normalizeMetadata(ctx, metadata))
+		assert.Equal(t, "search", metadata.Scope)
+	})
+
+	t.Run("NoGrantableScope", func(t *testing.T) {
+		metadata := &ClientMetadata{RedirectURIs: []string{"https://partner.example.com/callback"}, Scope: "admin"}
+		var metadataErr *InvalidClientMetadataError
+		require.ErrorAs(t, registrar.normalizeMetadata(ctx, metadata), &metadataErr)
+		assert.Equal(t, ErrCodeInvalidClientMetadata, metadataErr.Code)
+	})
+
+	t.Run("GrantTypeNotAllowed", func(t *testing.T) {
+		metadata := &ClientMetadata{RedirectURIs: []string{"https://partner.example.com/callback"}, GrantTypes: []string{"client_credentials"}}
+		var metadataErr *InvalidClientMetadataError
+		require.ErrorAs(t, registrar.normalizeMetadata(ctx, metadata), &metadataErr)
+		assert.Equal(t, ErrCodeInvalidClientMetadata, metadataErr.Code)
+	})
+
+	t.Run("DeviceClientWithoutRedirectURIs", func(t *testing.T) {
+		metadata := &ClientMetadata{GrantTypes: []string{GrantTypeDeviceCode}, TokenEndpointAuthMethod: AuthMethodNone}
+		require.NoError(t, registrar.normalizeMetadata(ctx, metadata))
+		assert.Empty(t, metadata.RedirectURIs)
+	})
+
+	t.Run("UnsupportedAuthMethod", func(t *testing.T) {
+		metadata := &ClientMetadata{RedirectURIs: []string{"https://partner.example.com/callback"}, TokenEndpointAuthMethod: "client_secret_basic"}
+		var metadataErr *InvalidClientMetadataError
+		require.ErrorAs(t, registrar.normalizeMetadata(ctx, metadata), &metadataErr)
+	})
+
+	t.Run("SelfSignedTLSClientAuth", func(t *testing.T) {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		pin, err := mtls.PublicKeyPin(&privateKey.PublicKey)
+		require.NoError(t, err)
+
+		metadata := &ClientMetadata{RedirectURIs: []string{"https://partner.example.com/callback"},
+			TokenEndpointAuthMethod: AuthMethodSelfSignedTLSClientAuth, TLSClientCertSPKI: pin}
+		require.NoError(t, registrar.normalizeMetadata(ctx, metadata))
+		assert.Equal(t, pin, metadata.TLSClientCertSPKI)
+
+		// The pin of a client registering its key in jwks is derived from that key.
+		metadata = &ClientMetadata{RedirectURIs: []string{"https://partner.example.com/callback"},
+			TokenEndpointAuthMethod: AuthMethodSelfSignedTLSClientAuth, JWKS: publicKeySet(&privateKey.PublicKey)}
+		require.NoError(t, registrar.normalizeMetadata(ctx, metadata))
+		assert.Equal(t, pin, metadata.TLSClientCertSPKI)
+
+		for _, spki := range []string{"", "not-a-pin", base64.StdEncoding.EncodeToString([]byte("short"))} {
+			metadata := &ClientMetadata{RedirectURIs: []string{"https://partner.example.com/callback"},
+				TokenEndpointAuthMethod: AuthMethodSelfSignedTLSClientAuth, TLSClientCertSPKI: spki}
+			var metadataErr *InvalidClientMetadataError
+			require.ErrorAs(t, registrar.normalizeMetadata(ctx, metadata), &metadataErr, spki)
+			assert.Equal(t, ErrCodeInvalidClientMetadata, metadataErr.Code)
+		}
+	})
+
+	t.Run("InvalidRedirectURIs", func(t *testing.T) {
+		for _, redirectURI := range []string{"", "/callback", "http://partner.example.com/callback", "https://partner.example.com/cb#frag"} {
+			metadata := &ClientMetadata{RedirectURIs: []string{redirectURI}}
+			var metadataErr *InvalidClientMetadataError
+			require.ErrorAs(t, registrar.normalizeMetadata(ctx, metadata), &metadataErr, redirectURI)
+			assert.Equal(t, ErrCodeInvalidRedirectURI, metadataErr.Code)
+		}
+
+		var metadataErr *InvalidClientMetadataError
+		require.ErrorAs(t, registrar.normalizeMetadata(ctx, &ClientMetadata{}), &metadataErr)
+		assert.Equal(t, ErrCodeInvalidRedirectURI, metadataErr.Code)
+	})
+}
+
+func TestClientRegistrar_Lifecycle(t *testing.T) {
+	registrar := newTestRegistrar(t, true)
+	ctx := context.Background()
+
+	client, err := registrar.Register(ctx, &ClientMetadata{
+		RedirectURIs: []string{"https://partner.example.com/callback", "http://127.0.0.1:8080/callback"},
+		ClientName:   "Partner test client",
+		Scope:        "profile",
+	})
+	require.NoError(t, err)
+	assert.Len(t, client.ClientID, 32)
+	assert.NotEmpty(t, client.ClientSecret)
+	assert.NotEmpty(t, client.RegistrationAccessToken)
+	assert.Equal(t, "profile", client.Scope)
+
+	_, err = registrar.GetClient(ctx, client.ClientID, "wrong-token")
+	assert.ErrorIs(t, err, ErrInvalidRegistrationToken)
+
+	fetched, err := registrar.GetClient(ctx, client.ClientID, client.RegistrationAccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, client.ClientSecret, fetched.ClientSecret)
+	assert.Equal(t, []string{"https://partner.example.com/callback", "http://127.0.0.1:8080/callback"}, fetched.RedirectURIs)
+
+	updated, err := registrar.UpdateClient(ctx, client.ClientID, client.RegistrationAccessToken, &ClientMetadata{
+		RedirectURIs:            []string{"https://partner.example.com/v2/callback"},
+		Scope:                   "profile search",
+		TokenEndpointAuthMethod: AuthMethodNone,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, AuthMethodNone, updated.TokenEndpointAuthMethod)
+	assert.Empty(t, updated.ClientSecret)
+	assert.Equal(t, "profile search", updated.Scope)
+
+	store := NewAPIClientStore(registrar.dbConn, false)
+	storedClient, err := store.GetClient(client.ClientID)
+	require.NoError(t, err)
+	assert.True(t, storedClient.IsPublic)
+	assert.Equal(t, "https://partner.example.com/v2/callback", storedClient.RedirectURIs)
+
+	require.NoError(t, registrar.DeleteClient(ctx, client.ClientID, client.RegistrationAccessToken))
+	_, err = registrar.GetClient(ctx, client.ClientID, client.RegistrationAccessToken)
+	assert.ErrorIs(t, err, ErrInvalidRegistrationToken)
+}
+
+// publicKeySet returns a JWKS holding the EC public key.
+func publicKeySet(publicKey *ecdsa.PublicKey) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"keys":[{"kty":"EC","crv":"P-256","x":"%s","y":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, 32)))))
+}
+
+func TestClientRegistrar_SelfSignedTLSClientLifecycle(t *testing.T) {
+	registrar := newTestRegistrar(t, true)
+	ctx := context.Background()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pin, err := mtls.PublicKeyPin(&privateKey.PublicKey)
+	require.NoError(t, err)
+
+	client, err := registrar.Register(ctx, &ClientMetadata{
+		RedirectURIs:            []string{"https://partner.example.com/callback"},
+		TokenEndpointAuthMethod: AuthMethodSelfSignedTLSClientAuth,
+		TLSClientCertSPKI:       pin,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, pin, client.TLSClientCertSPKI)
+
+	store := NewAPIClientStore(registrar.dbConn, false)
+	storedClient, err := store.GetClient(client.ClientID)
+	require.NoError(t, err)
+	assert.Equal(t, AuthMethodSelfSignedTLSClientAuth, storedClient.TokenEndpointAuthMethod)
+	assert.Equal(t, pin, storedClient.TLSClientCertSPKI)
+
+	rotatedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	updated, err := registrar.UpdateClient(ctx, client.ClientID, client.RegistrationAccessToken, &ClientMetadata{
+		RedirectURIs:            []string{"https://partner.example.com/callback"},
+		TokenEndpointAuthMethod: AuthMethodSelfSignedTLSClientAuth,
+		JWKS:                    publicKeySet(&rotatedKey.PublicKey),
+	})
+	require.NoError(t, err)
+	rotatedPin, err := mtls.PublicKeyPin(&rotatedKey.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, rotatedPin, updated.TLSClientCertSPKI)
+
+	require.NoError(t, registrar.DeleteClient(ctx, client.ClientID, client.RegistrationAccessToken))
+}
+
+func TestClientRegistrar_DeviceClientLifecycle(t *testing.T) {
+	registrar := newTestRegistrar(t, true)
+	ctx := context.Background()
+
+	client, err := registrar.Register(ctx, &ClientMetadata{
+		GrantTypes:              []string{GrantTypeDeviceCode},
+		TokenEndpointAuthMethod: AuthMethodNone,
+		ClientName:              "Device test client",
+	})
+	require.NoError(t, err)
+	assert.Empty(t, client.RedirectURIs)
+	assert.Equal(t, []string{GrantTypeDeviceCode}, client.GrantTypes)
+
+	store := NewAPIClientStore(registrar.dbConn, false)
+	storedClient, err := store.GetClient(client.ClientID)
+	require.NoError(t, err)
+	assert.Empty(t, storedClient.Domain)
+	assert.True(t, storedClient.IsGrantTypeAllowed(GrantTypeDeviceCode))
+
+	_, err = registrar.UpdateClient(ctx, client.ClientID, client.RegistrationAccessToken, &ClientMetadata{
+		GrantTypes:              []string{GrantTypeDeviceCode},
+		TokenEndpointAuthMethod: AuthMethodNone,
+		ClientName:              "Renamed device test client",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, registrar.DeleteClient(ctx, client.ClientID, client.RegistrationAccessToken))
+}
@@ -0,0 +1,103 @@
+package bizaudit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/kdjuwidja/aishoppercommon/logger"
+)
+
+// Types of audit events.
+const (
+	EventLogin                    = "login"
+	EventTokenIssued              = "token_issued"
+	EventTokensRevoked            = "tokens_revoked"
+	EventRegistrationCodeCreated  = "registration_code_created"
+	EventRegistrationCodeRedeemed = "registration_code_redeemed"
+	EventAdminChange              = "admin_change"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event is a security relevant action. ActorID is who performed it, the user or client, and SubjectID what it was
+// performed on, such as a user, registration code or role.
+type Event struct {
+	Time      time.Time         `json:"time"`
+	Type      string            `json:"type"`
+	Outcome   string            `json:"outcome"`
+	ActorID   string            `json:"actor_id,omitempty"`
+	SubjectID string            `json:"subject_id,omitempty"`
+	ClientID  string            `json:"client_id,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// CodeSubject returns the subject of the events about a registration code, a prefix of the code's SHA-256 hash, so that
+// the events of a code can be found without the audit log holding usable codes.
+func CodeSubject(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sink stores audit events.
+type Sink interface {
+	Write(ctx context.Context, event *Event) error
+}
+
+// RequestInfo identifies the request an event was recorded for.
+type RequestInfo struct {
+	IP        string
+	UserAgent string
+	RequestID string
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a context carrying the request info, which every event recorded with it is stamped with.
+func WithRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the request info set by WithRequestInfo.
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// Auditor records audit events to every sink.
+type Auditor struct {
+	sinks []Sink
+}
+
+func NewAuditor(sinks ...Sink) *Auditor {
+	return &Auditor{sinks: sinks}
+}
+
+// Record stamps the event with the time and the request info of ctx, and writes it to every sink. Failing to write an
+// event is logged and does not fail the action it records.
+func (a *Auditor) Record(ctx context.Context, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Outcome == "" {
+		event.Outcome = OutcomeSuccess
+	}
+	if info, ok := RequestInfoFromContext(ctx); ok {
+		event.IP, event.UserAgent, event.RequestID = info.IP, info.UserAgent, info.RequestID
+	}
+
+	// The event is written even when the client has gone away in the meantime.
+	ctx = context.WithoutCancel(ctx)
+	for _, sink := range a.sinks {
+		if err := sink.Write(ctx, &event); err != nil {
+			logger.Errorf("failed to write audit event %s: %v", event.Type, err)
+		}
+	}
+}
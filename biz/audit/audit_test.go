@@ -0,0 +1,62 @@
+package bizaudit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingSink struct{}
+
+func (s *failingSink) Write(ctx context.Context, event *Event) error {
+	return errors.New("sink unavailable")
+}
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewAuditor(&failingSink{}, NewJSONLinesSink(&buf))
+
+	ctx := WithRequestInfo(context.Background(), RequestInfo{IP: "10.0.0.1", UserAgent: "curl/8.0", RequestID: "req-1"})
+	auditor.Record(ctx, Event{Type: EventLogin, ActorID: "user-1", ClientID: "client-1"})
+	auditor.Record(context.Background(), Event{Type: EventLogin, Outcome: OutcomeFailure, Details: map[string]string{"reason": "invalid_credentials"}})
+
+	// A failing sink does not keep the event from the others.
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var success Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &success))
+	assert.Equal(t, EventLogin, success.Type)
+	assert.Equal(t, OutcomeSuccess, success.Outcome)
+	assert.Equal(t, "user-1", success.ActorID)
+	assert.Equal(t, "client-1", success.ClientID)
+	assert.Equal(t, "10.0.0.1", success.IP)
+	assert.Equal(t, "curl/8.0", success.UserAgent)
+	assert.Equal(t, "req-1", success.RequestID)
+	assert.False(t, success.Time.IsZero())
+
+	var failure map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &failure))
+	assert.Equal(t, OutcomeFailure, failure["outcome"])
+	assert.Equal(t, map[string]interface{}{"reason": "invalid_credentials"}, failure["details"])
+	assert.NotContains(t, failure, "request_id")
+}
+
+func TestCodeSubject(t *testing.T) {
+	assert.Len(t, CodeSubject("ABCDEF123456"), 16)
+	assert.Equal(t, CodeSubject("ABCDEF123456"), CodeSubject("ABCDEF123456"))
+	assert.NotEqual(t, CodeSubject("ABCDEF123456"), CodeSubject("ABCDEF123457"))
+	assert.NotContains(t, CodeSubject("ABCDEF123456"), "ABCDEF")
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "abc", truncate("abc", 3))
+	assert.Equal(t, "ab", truncate("abc", 2))
+	assert.Equal(t, "éé", truncate("ééé", 2))
+}
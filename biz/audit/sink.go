@@ -0,0 +1,138 @@
+package bizaudit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"netherealmstudio.com/m/v2/db"
+)
+
+// EventFilter selects audit events. Empty fields and zero times match every event.
+type EventFilter struct {
+	Type      string
+	Outcome   string
+	ActorID   string
+	SubjectID string
+	ClientID  string
+	RequestID string
+	From      time.Time
+	To        time.Time
+}
+
+// DBStore keeps audit events in the audit_events table, and serves them to the admin query endpoint.
+type DBStore struct {
+	dbConn *gorm.DB
+}
+
+func NewDBStore(dbConn *gorm.DB) *DBStore {
+	return &DBStore{dbConn: dbConn}
+}
+
+func (s *DBStore) Write(ctx context.Context, event *Event) error {
+	details := ""
+	if len(event.Details) > 0 {
+		encoded, err := json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+		details = string(encoded)
+	}
+
+	return s.dbConn.WithContext(ctx).Create(&db.AuditEvent{
+		CreatedAt: event.Time,
+		Type:      event.Type,
+		Outcome:   event.Outcome,
+		ActorID:   truncate(event.ActorID, 255),
+		SubjectID: truncate(event.SubjectID, 255),
+		ClientID:  truncate(event.ClientID, 45),
+		IP:        event.IP,
+		UserAgent: truncate(event.UserAgent, 512),
+		RequestID: event.RequestID,
+		Details:   details,
+	}).Error
+}
+
+// List returns a page of the events matching the filter, newest first, and the number of matching events.
+func (s *DBStore) List(ctx context.Context, filter EventFilter, limit int, offset int) ([]*Event, int64, error) {
+	query := s.dbConn.WithContext(ctx).Model(&db.AuditEvent{})
+	for column, value := range map[string]string{
+		"type":       filter.Type,
+		"outcome":    filter.Outcome,
+		"actor_id":   filter.ActorID,
+		"subject_id": filter.SubjectID,
+		"client_id":  filter.ClientID,
+		"request_id": filter.RequestID,
+	} {
+		if value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rows []db.AuditEvent
+	if err := query.Order("id DESC").Limit(limit).Offset(offset).Find(&rows).Error; err != nil {
+		return nil, 0, err
+	}
+
+	events := make([]*Event, 0, len(rows))
+	for _, row := range rows {
+		event := &Event{
+			Time:      row.CreatedAt.UTC(),
+			Type:      row.Type,
+			Outcome:   row.Outcome,
+			ActorID:   row.ActorID,
+			SubjectID: row.SubjectID,
+			ClientID:  row.ClientID,
+			IP:        row.IP,
+			UserAgent: row.UserAgent,
+			RequestID: row.RequestID,
+		}
+		if row.Details != "" {
+			if err := json.Unmarshal([]byte(row.Details), &event.Details); err != nil {
+				return nil, 0, fmt.Errorf("invalid details of audit event %d: %v", row.ID, err)
+			}
+		}
+		events = append(events, event)
+	}
+	return events, total, nil
+}
+
+// JSONLinesSink writes every event as a JSON object on its own line, for log shippers to pick up.
+type JSONLinesSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *JSONLinesSink) Write(ctx context.Context, event *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoder.Encode(event)
+}
+
+// truncate shortens value to length characters, the size of its column.
+func truncate(value string, length int) string {
+	if utf8.RuneCountInString(value) <= length {
+		return value
+	}
+	return string([]rune(value)[:length])
+}
@@ -0,0 +1,213 @@
+package bizclientauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	oauth2errors "github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/golang-jwt/jwt/v5"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	"netherealmstudio.com/m/v2/jtistore"
+	"netherealmstudio.com/m/v2/jwks"
+	"netherealmstudio.com/m/v2/mtls"
+)
+
+const (
+	// ClientAssertionTypeJWTBearer is the client_assertion_type of RFC 7523 section 2.2.
+	ClientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// maxAssertionLifetime bounds how far in the future a client assertion may expire, and so how long its jti has to
+	// be remembered.
+	maxAssertionLifetime = 10 * time.Minute
+)
+
+var ErrInvalidClient = errors.New("invalid_client")
+
+var secretSigningMethods = []string{"HS256", "HS384", "HS512"}
+
+// ClientStore looks up the API clients being authenticated.
+type ClientStore interface {
+	GetClient(clientID string) (*bizapiclient.APIClient, error)
+}
+
+// ClientAuthenticator authenticates API clients with the token endpoint authentication method each client is
+// configured for: a secret in the form, a client assertion signed with the secret or with a key of the client's JWKS,
+// or the TLS client certificate. Client assertions can only be used once.
+type ClientAuthenticator struct {
+	clientStore ClientStore
+	jtiStore    jtistore.JTIStore
+	audiences   []string
+	clientCAs   *x509.CertPool
+}
+
+// NewClientAuthenticator creates an authenticator accepting client assertions addressed to any of the audiences,
+// which are the issuer and the URLs of the endpoints clients authenticate at, and client certificates issued by
+// clientCAs. Without clientCAs, tls_client_auth clients cannot authenticate.
+func NewClientAuthenticator(clientStore ClientStore, jtiStore jtistore.JTIStore, audiences []string, clientCAs *x509.CertPool) *ClientAuthenticator {
+	return &ClientAuthenticator{
+		clientStore: clientStore,
+		jtiStore:    jtiStore,
+		audiences:   audiences,
+		clientCAs:   clientCAs,
+	}
+}
+
+// Authenticate authenticates the client of the request. Failed authentication returns an error wrapping
+// ErrInvalidClient, while other errors come from the JTI store.
+func (a *ClientAuthenticator) Authenticate(r *http.Request) (*bizapiclient.APIClient, error) {
+	clientID := r.FormValue("client_id")
+	assertionType := r.FormValue("client_assertion_type")
+	assertion := r.FormValue("client_assertion")
+	if assertionType != "" || assertion != "" {
+		return a.authenticateAssertion(r.Context(), clientID, assertionType, assertion)
+	}
+
+	if clientID == "" {
+		return nil, fmt.Errorf("%w: client_id is required", ErrInvalidClient)
+	}
+	client, err := a.clientStore.GetClient(clientID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown client", ErrInvalidClient)
+	}
+
+	switch method := client.AuthMethod(); method {
+	case bizapiclient.AuthMethodNone, bizapiclient.AuthMethodClientSecretPost:
+		if subtle.ConstantTimeCompare([]byte(client.Secret), []byte(r.FormValue("client_secret"))) != 1 {
+			return nil, fmt.Errorf("%w: invalid client secret", ErrInvalidClient)
+		}
+		return client, nil
+	case bizapiclient.AuthMethodTLSClientAuth, bizapiclient.AuthMethodSelfSignedTLSClientAuth:
+		if err := a.verifyCertificate(r, client); err != nil {
+			return nil, err
+		}
+		return client, nil
+	default:
+		return nil, fmt.Errorf("%w: the client must authenticate with %s", ErrInvalidClient, method)
+	}
+}
+
+// verifyCertificate checks the TLS client certificate of the request. The listener only requests certificates without
+// verifying them, so that self-signed ones get through, and CA-issued certificates are verified here.
+func (a *ClientAuthenticator) verifyCertificate(r *http.Request, client *bizapiclient.APIClient) error {
+	cert := mtls.PeerCertificate(r)
+	if cert == nil {
+		return fmt.Errorf("%w: a client certificate is required", ErrInvalidClient)
+	}
+
+	if client.AuthMethod() == bizapiclient.AuthMethodSelfSignedTLSClientAuth {
+		if client.TLSClientCertSPKI == "" || subtle.ConstantTimeCompare([]byte(mtls.SPKIPin(cert)), []byte(client.TLSClientCertSPKI)) != 1 {
+			return fmt.Errorf("%w: client certificate key is not pinned for the client", ErrInvalidClient)
+		}
+		return nil
+	}
+
+	if a.clientCAs == nil {
+		return fmt.Errorf("%w: no client CAs are configured", ErrInvalidClient)
+	}
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         a.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidClient, err)
+	}
+	if client.TLSClientAuthSubjectDN == "" || cert.Subject.String() != client.TLSClientAuthSubjectDN {
+		return fmt.Errorf("%w: client certificate subject does not match the client", ErrInvalidClient)
+	}
+	return nil
+}
+
+// ClientInfoHandler lets go-oauth2 authenticate the clients of the token endpoint. It returns the client's own
+// secret, so that the manager's secret check passes for clients authenticating without sending it.
+func (a *ClientAuthenticator) ClientInfoHandler(r *http.Request) (string, string, error) {
+	client, err := a.Authenticate(r)
+	if errors.Is(err, ErrInvalidClient) {
+		return "", "", oauth2errors.ErrInvalidClient
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return client.ID, client.Secret, nil
+}
+
+func (a *ClientAuthenticator) authenticateAssertion(ctx context.Context, clientID string, assertionType string, assertion string) (*bizapiclient.APIClient, error) {
+	if assertionType != ClientAssertionTypeJWTBearer || assertion == "" {
+		return nil, fmt.Errorf("%w: unsupported client assertion", ErrInvalidClient)
+	}
+
+	// The assertion names the client it authenticates, so it is read once before the client's key is known.
+	unverified := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(assertion, unverified); err != nil {
+		return nil, fmt.Errorf("%w: malformed client assertion", ErrInvalidClient)
+	}
+	subject, _ := unverified.GetSubject()
+	if subject == "" || (clientID != "" && clientID != subject) {
+		return nil, fmt.Errorf("%w: client assertion subject does not match client_id", ErrInvalidClient)
+	}
+	client, err := a.clientStore.GetClient(subject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown client", ErrInvalidClient)
+	}
+
+	var keyfunc jwt.Keyfunc
+	var methods []string
+	switch method := client.AuthMethod(); method {
+	case bizapiclient.AuthMethodPrivateKeyJWT:
+		keySet, err := jwks.Parse([]byte(client.JWKS))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidClient, err)
+		}
+		keyfunc, methods = keySet.Keyfunc, jwks.SigningMethods
+	case bizapiclient.AuthMethodClientSecretJWT:
+		if client.Secret == "" {
+			return nil, fmt.Errorf("%w: the client has no secret", ErrInvalidClient)
+		}
+		keyfunc = func(*jwt.Token) (interface{}, error) { return []byte(client.Secret), nil }
+		methods = secretSigningMethods
+	default:
+		return nil, fmt.Errorf("%w: the client must authenticate with %s", ErrInvalidClient, method)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(assertion, claims, keyfunc,
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(client.ID),
+		jwt.WithSubject(client.ID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidClient, err)
+	}
+
+	audiences, _ := claims.GetAudience()
+	if !slices.ContainsFunc(audiences, func(aud string) bool { return slices.Contains(a.audiences, aud) }) {
+		return nil, fmt.Errorf("%w: client assertion is not addressed to this server", ErrInvalidClient)
+	}
+
+	exp, _ := claims.GetExpirationTime()
+	if exp.After(time.Now().Add(maxAssertionLifetime)) {
+		return nil, fmt.Errorf("%w: client assertion expires too late", ErrInvalidClient)
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, fmt.Errorf("%w: client assertion has no jti", ErrInvalidClient)
+	}
+	ok, err := a.jtiStore.Use(ctx, client.ID+":"+jti, exp.Time)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: client assertion was already used", ErrInvalidClient)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,236 @@
+package bizclientauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	"netherealmstudio.com/m/v2/jtistore"
+	"netherealmstudio.com/m/v2/mtls"
+)
+
+const testAudience = "https://auth.example.com/auth/token"
+
+type testClientStore map[string]*bizapiclient.APIClient
+
+func (s testClientStore) GetClient(clientID string) (*bizapiclient.APIClient, error) {
+	client, ok := s[clientID]
+	if !ok {
+		return nil, fmt.Errorf("client not found")
+	}
+	return client, nil
+}
+
+func newTestAuthenticator(t *testing.T) (*ClientAuthenticator, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keySet := fmt.Sprintf(`{"keys":[{"kty":"EC","crv":"P-256","x":%q,"y":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.Bytes()), base64.RawURLEncoding.EncodeToString(key.Y.Bytes()))
+
+	clients := testClientStore{
+		"legacy":  {ID: "legacy", Secret: "legacy-secret"},
+		"public":  {ID: "public"},
+		"hmac":    {ID: "hmac", Secret: "hmac-secret", TokenEndpointAuthMethod: bizapiclient.AuthMethodClientSecretJWT},
+		"partner": {ID: "partner", Secret: "unused", JWKS: keySet, TokenEndpointAuthMethod: bizapiclient.AuthMethodPrivateKeyJWT},
+	}
+	return NewClientAuthenticator(clients, jtistore.NewMemoryJTIStore(), []string{testAudience}, nil), key
+}
+
+func formRequest(values url.Values) *http.Request {
+	r, _ := http.NewRequest("POST", testAudience, strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func assertionClaims(clientID string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": testAudience,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"jti": fmt.Sprintf("%d", time.Now().UnixNano()),
+	}
+}
+
+func assertionRequest(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) *http.Request {
+	assertion, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	require.NoError(t, err)
+	return formRequest(url.Values{"client_assertion_type": {ClientAssertionTypeJWTBearer}, "client_assertion": {assertion}})
+}
+
+func TestClientAuthenticator_Secret(t *testing.T) {
+	authenticator, _ := newTestAuthenticator(t)
+
+	client, err := authenticator.Authenticate(formRequest(url.Values{"client_id": {"legacy"}, "client_secret": {"legacy-secret"}}))
+	require.NoError(t, err)
+	assert.Equal(t, "legacy", client.ID)
+
+	client, err = authenticator.Authenticate(formRequest(url.Values{"client_id": {"public"}}))
+	require.NoError(t, err)
+	assert.Equal(t, "public", client.ID)
+
+	_, err = authenticator.Authenticate(formRequest(url.Values{"client_id": {"legacy"}, "client_secret": {"wrong"}}))
+	assert.ErrorIs(t, err, ErrInvalidClient)
+
+	// Clients configured for client assertions cannot fall back to sending their secret.
+	_, err = authenticator.Authenticate(formRequest(url.Values{"client_id": {"hmac"}, "client_secret": {"hmac-secret"}}))
+	assert.ErrorIs(t, err, ErrInvalidClient)
+}
+
+func TestClientAuthenticator_PrivateKeyJWT(t *testing.T) {
+	authenticator, key := newTestAuthenticator(t)
+
+	claims := assertionClaims("partner")
+	client, err := authenticator.Authenticate(assertionRequest(t, jwt.SigningMethodES256, key, claims))
+	require.NoError(t, err)
+	assert.Equal(t, "partner", client.ID)
+
+	// The client's own secret is returned, so that go-oauth2's secret check passes.
+	clientID, clientSecret, err := authenticator.ClientInfoHandler(assertionRequest(t, jwt.SigningMethodES256, key, assertionClaims("partner")))
+	require.NoError(t, err)
+	assert.Equal(t, "partner", clientID)
+	assert.Equal(t, "unused", clientSecret)
+
+	t.Run("Replayed", func(t *testing.T) {
+		_, err := authenticator.Authenticate(assertionRequest(t, jwt.SigningMethodES256, key, claims))
+		assert.ErrorIs(t, err, ErrInvalidClient)
+	})
+}
+
+func TestClientAuthenticator_ClientSecretJWT(t *testing.T) {
+	authenticator, _ := newTestAuthenticator(t)
+
+	client, err := authenticator.Authenticate(assertionRequest(t, jwt.SigningMethodHS256, []byte("hmac-secret"), assertionClaims("hmac")))
+	require.NoError(t, err)
+	assert.Equal(t, "hmac", client.ID)
+
+	_, err = authenticator.Authenticate(assertionRequest(t, jwt.SigningMethodHS256, []byte("wrong"), assertionClaims("hmac")))
+	assert.ErrorIs(t, err, ErrInvalidClient)
+}
+
+func TestClientAuthenticator_AssertionRejections(t *testing.T) {
+	authenticator, key := newTestAuthenticator(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		key    *ecdsa.PrivateKey
+		modify func(jwt.MapClaims)
+	}{
+		"WrongKey":        {key: otherKey},
+		"WrongAudience":   {key: key, modify: func(c jwt.MapClaims) { c["aud"] = "https://other.example.com/token" }},
+		"IssuerMismatch":  {key: key, modify: func(c jwt.MapClaims) { c["iss"] = "other" }},
+		"NoJTI":           {key: key, modify: func(c jwt.MapClaims) { delete(c, "jti") }},
+		"Expired":         {key: key, modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		"LongLived":       {key: key, modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(time.Hour).Unix() }},
+		"UnknownClient":   {key: key, modify: func(c jwt.MapClaims) { c["iss"], c["sub"] = "unknown", "unknown" }},
+		"SecretOnlyUsage": {key: key, modify: func(c jwt.MapClaims) { c["iss"], c["sub"] = "legacy", "legacy" }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			claims := assertionClaims("partner")
+			if tc.modify != nil {
+				tc.modify(claims)
+			}
+			_, err := authenticator.Authenticate(assertionRequest(t, jwt.SigningMethodES256, tc.key, claims))
+			assert.ErrorIs(t, err, ErrInvalidClient)
+		})
+	}
+
+	t.Run("ClientIDMismatch", func(t *testing.T) {
+		assertion, err := jwt.NewWithClaims(jwt.SigningMethodES256, assertionClaims("partner")).SignedString(key)
+		require.NoError(t, err)
+		_, err = authenticator.Authenticate(formRequest(url.Values{
+			"client_id":             {"legacy"},
+			"client_assertion_type": {ClientAssertionTypeJWTBearer},
+			"client_assertion":      {assertion},
+		}))
+		assert.ErrorIs(t, err, ErrInvalidClient)
+	})
+}
+
+// issueCertificate creates a client certificate for the subject, signed by the parent, or self-signed without one.
+func issueCertificate(t *testing.T, subject string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: subject, Organization: []string{"Netherealm"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func certificateRequest(clientID string, cert *x509.Certificate) *http.Request {
+	r := formRequest(url.Values{"client_id": {clientID}})
+	if cert != nil {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	return r
+}
+
+func TestClientAuthenticator_Certificates(t *testing.T) {
+	ca, caKey := issueCertificate(t, "Test CA", true, nil, nil)
+	otherCA, otherCAKey := issueCertificate(t, "Other CA", true, nil, nil)
+	issued, _ := issueCertificate(t, "search-service", false, ca, caKey)
+	issuedByOther, _ := issueCertificate(t, "search-service", false, otherCA, otherCAKey)
+	selfSigned, _ := issueCertificate(t, "shoplist-service", false, nil, nil)
+	otherSelfSigned, _ := issueCertificate(t, "shoplist-service", false, nil, nil)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	clients := testClientStore{
+		"search":   {ID: "search", Secret: "unused", TokenEndpointAuthMethod: bizapiclient.AuthMethodTLSClientAuth, TLSClientAuthSubjectDN: "CN=search-service,O=Netherealm"},
+		"shoplist": {ID: "shoplist", Secret: "unused", TokenEndpointAuthMethod: bizapiclient.AuthMethodSelfSignedTLSClientAuth, TLSClientCertSPKI: mtls.SPKIPin(selfSigned)},
+	}
+	authenticator := NewClientAuthenticator(clients, jtistore.NewMemoryJTIStore(), []string{testAudience}, clientCAs)
+
+	client, err := authenticator.Authenticate(certificateRequest("search", issued))
+	require.NoError(t, err)
+	assert.Equal(t, "search", client.ID)
+
+	client, err = authenticator.Authenticate(certificateRequest("shoplist", selfSigned))
+	require.NoError(t, err)
+	assert.Equal(t, "shoplist", client.ID)
+
+	for name, r := range map[string]*http.Request{
+		"NoCertificate":       certificateRequest("search", nil),
+		"UntrustedCA":         certificateRequest("search", issuedByOther),
+		"SubjectMismatch":     certificateRequest("search", selfSigned),
+		"UnpinnedKey":         certificateRequest("shoplist", otherSelfSigned),
+		"SecretInsteadOfCert": formRequest(url.Values{"client_id": {"search"}, "client_secret": {"unused"}}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := authenticator.Authenticate(r)
+			assert.ErrorIs(t, err, ErrInvalidClient)
+		})
+	}
+}
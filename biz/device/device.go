@@ -0,0 +1,295 @@
+package bizdevice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	"netherealmstudio.com/m/v2/devicestore"
+)
+
+const (
+	// GrantTypeDeviceCode is the grant type of RFC 8628 section 3.4.
+	GrantTypeDeviceCode = bizapiclient.GrantTypeDeviceCode
+
+	// userCodeAlphabet leaves out vowels, to avoid spelling words, and characters easily confused with one another.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+
+	// slowDownIncrement is added to the polling interval every time a device polls too fast, per RFC 8628 section 3.5.
+	slowDownIncrement = 5
+
+	// expiredRetention keeps expired requests around for a while so that polling devices are told expired_token
+	// rather than invalid_grant.
+	expiredRetention = 10 * time.Minute
+
+	maxUserCodeAttempts = 5
+)
+
+// The error messages are the error codes of RFC 8628 section 3.5 and RFC 6749 section 5.2.
+var (
+	ErrInvalidClient        = errors.New("invalid_client")
+	ErrUnauthorizedClient   = errors.New("unauthorized_client")
+	ErrInvalidGrant         = errors.New("invalid_grant")
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+	ErrInvalidUserCode      = errors.New("invalid user code")
+)
+
+// ClientStore looks up the API clients allowed to start device authorizations.
+type ClientStore interface {
+	GetClient(clientID string) (*bizapiclient.APIClient, error)
+}
+
+type DeviceAuthorizerConfig struct {
+	// ExpiresIn is how long the user has to enter the user code.
+	ExpiresIn time.Duration
+	// Interval is the minimum number of seconds between two polls of the token endpoint.
+	Interval int
+	// VerificationURI is the verification page the user is asked to visit.
+	VerificationURI string
+}
+
+// DeviceAuthorizationResponse is the device authorization response of RFC 8628 section 3.2.
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceAuthorizer implements the device authorization grant of RFC 8628 for clients that cannot open a browser.
+type DeviceAuthorizer struct {
+	store       devicestore.DeviceStore
+	clientStore ClientStore
+	config      DeviceAuthorizerConfig
+}
+
+func NewDeviceAuthorizer(store devicestore.DeviceStore, clientStore ClientStore, config DeviceAuthorizerConfig) *DeviceAuthorizer {
+	return &DeviceAuthorizer{
+		store:       store,
+		clientStore: clientStore,
+		config:      config,
+	}
+}
+
+// Authorize starts a device authorization for the client.
+func (a *DeviceAuthorizer) Authorize(ctx context.Context, clientID string, clientSecret string, scope string) (*DeviceAuthorizationResponse, error) {
+	if err := a.authenticateClient(clientID, clientSecret); err != nil {
+		return nil, err
+	}
+
+	deviceCode, err := generateDeviceCode()
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		userCode, err := generateUserCode()
+		if err != nil {
+			return nil, err
+		}
+
+		err = a.store.Create(ctx, &devicestore.DeviceAuthorization{
+			DeviceCode: deviceCode,
+			UserCode:   userCode,
+			ClientID:   clientID,
+			Scope:      scope,
+			Status:     devicestore.StatusPending,
+			ExpiresAt:  time.Now().Add(a.config.ExpiresIn),
+			Interval:   a.config.Interval,
+		}, a.config.ExpiresIn+expiredRetention)
+		if errors.Is(err, devicestore.ErrUserCodeExists) && attempt < maxUserCodeAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &DeviceAuthorizationResponse{
+			DeviceCode:              deviceCode,
+			UserCode:                FormatUserCode(userCode),
+			VerificationURI:         a.config.VerificationURI,
+			VerificationURIComplete: a.config.VerificationURI + "?user_code=" + url.QueryEscape(FormatUserCode(userCode)),
+			ExpiresIn:               int(a.config.ExpiresIn.Seconds()),
+			Interval:                a.config.Interval,
+		}, nil
+	}
+}
+
+// GetPending returns the pending device authorization of the user code entered on the verification page.
+func (a *DeviceAuthorizer) GetPending(ctx context.Context, userCode string) (*devicestore.DeviceAuthorization, error) {
+	auth, err := a.store.GetByUserCode(ctx, NormalizeUserCode(userCode))
+	if errors.Is(err, devicestore.ErrNotFound) {
+		return nil, ErrInvalidUserCode
+	}
+	if err != nil {
+		return nil, err
+	}
+	if auth.Status != devicestore.StatusPending || !time.Now().Before(auth.ExpiresAt) {
+		return nil, ErrInvalidUserCode
+	}
+	return auth, nil
+}
+
+// Approve lets the device polling with the user code's device code obtain tokens for the user.
+func (a *DeviceAuthorizer) Approve(ctx context.Context, userCode string, userID string) error {
+	return a.decide(ctx, userCode, func(auth *devicestore.DeviceAuthorization) {
+		auth.Status = devicestore.StatusApproved
+		auth.UserID = userID
+	})
+}
+
+// Deny makes the device polling with the user code's device code fail with access_denied.
+func (a *DeviceAuthorizer) Deny(ctx context.Context, userCode string) error {
+	return a.decide(ctx, userCode, func(auth *devicestore.DeviceAuthorization) {
+		auth.Status = devicestore.StatusDenied
+	})
+}
+
+func (a *DeviceAuthorizer) decide(ctx context.Context, userCode string, decision func(auth *devicestore.DeviceAuthorization)) error {
+	auth, err := a.GetPending(ctx, userCode)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.store.Update(ctx, auth.DeviceCode, func(auth *devicestore.DeviceAuthorization) error {
+		// Checked again inside the update in case the request was decided on in the meantime.
+		if auth.Status != devicestore.StatusPending || !time.Now().Before(auth.ExpiresAt) {
+			return ErrInvalidUserCode
+		}
+		decision(auth)
+		return nil
+	})
+	if errors.Is(err, devicestore.ErrNotFound) {
+		return ErrInvalidUserCode
+	}
+	return err
+}
+
+// Poll is called for every token request of the device. It returns the approved device authorization exactly once,
+// and one of the RFC 8628 errors until then.
+func (a *DeviceAuthorizer) Poll(ctx context.Context, clientID string, clientSecret string, deviceCode string) (*devicestore.DeviceAuthorization, error) {
+	// Authenticated before touching the device code, so that a wrong secret can neither redeem it nor count as a poll.
+	if err := a.authenticateClient(clientID, clientSecret); err != nil {
+		return nil, err
+	}
+	if deviceCode == "" {
+		return nil, ErrInvalidGrant
+	}
+
+	var slowDown bool
+	auth, err := a.store.Update(ctx, deviceCode, func(auth *devicestore.DeviceAuthorization) error {
+		if auth.ClientID != clientID {
+			return ErrInvalidGrant
+		}
+
+		now := time.Now()
+		slowDown = !auth.LastPolledAt.IsZero() && now.Sub(auth.LastPolledAt) < time.Duration(auth.Interval)*time.Second
+		if slowDown {
+			auth.Interval += slowDownIncrement
+		}
+		auth.LastPolledAt = now
+		return nil
+	})
+	if errors.Is(err, devicestore.ErrNotFound) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !time.Now().Before(auth.ExpiresAt) {
+		return nil, ErrExpiredToken
+	}
+	if slowDown {
+		return nil, ErrSlowDown
+	}
+
+	switch auth.Status {
+	case devicestore.StatusPending:
+		return nil, ErrAuthorizationPending
+	case devicestore.StatusDenied:
+		if _, err := a.store.Delete(ctx, deviceCode); err != nil {
+			return nil, err
+		}
+		return nil, ErrAccessDenied
+	}
+
+	// The device code is single use. Of several concurrent polls only the one that deletes it gets the tokens.
+	deleted, err := a.store.Delete(ctx, deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	if !deleted {
+		return nil, ErrInvalidGrant
+	}
+	return auth, nil
+}
+
+// authenticateClient checks the secret of confidential clients the same way the oauth2 manager does, and that the
+// client registered for the device grant.
+func (a *DeviceAuthorizer) authenticateClient(clientID string, clientSecret string) error {
+	client, err := a.clientStore.GetClient(clientID)
+	if err != nil {
+		return ErrInvalidClient
+	}
+	if client.Secret != "" && subtle.ConstantTimeCompare([]byte(client.Secret), []byte(clientSecret)) != 1 {
+		return ErrInvalidClient
+	}
+	if !client.IsGrantTypeAllowed(GrantTypeDeviceCode) {
+		return ErrUnauthorizedClient
+	}
+	return nil
+}
+
+// NormalizeUserCode drops the separators and casing users may type along with the user code.
+func NormalizeUserCode(userCode string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(userCode) {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// FormatUserCode splits the user code in two halves for readability, e.g. BDFG-HJKL.
+func FormatUserCode(userCode string) string {
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+func generateDeviceCode() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func generateUserCode() (string, error) {
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
@@ -0,0 +1,157 @@
+package bizdevice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	"netherealmstudio.com/m/v2/devicestore"
+)
+
+type testClientStore map[string]*bizapiclient.APIClient
+
+func (s testClientStore) GetClient(clientID string) (*bizapiclient.APIClient, error) {
+	client, ok := s[clientID]
+	if !ok {
+		return nil, fmt.Errorf("client not found")
+	}
+	return client, nil
+}
+
+func newTestAuthorizer(interval int) (*DeviceAuthorizer, *devicestore.MemoryDeviceStore) {
+	store := devicestore.NewMemoryDeviceStore()
+	clients := testClientStore{
+		"cli":      {ID: "cli", GrantTypes: GrantTypeDeviceCode},
+		"web":      {ID: "web", GrantTypes: bizapiclient.GrantTypeAuthorizationCode},
+		"tv":       {ID: "tv", Secret: "tv-secret"},
+		"shoplist": {ID: "shoplist"},
+	}
+	return NewDeviceAuthorizer(store, clients, DeviceAuthorizerConfig{
+		ExpiresIn:       10 * time.Minute,
+		Interval:        interval,
+		VerificationURI: "https://auth.example.com/auth/device",
+	}), store
+}
+
+// expirePoll moves the last poll back so that the next poll does not count as too fast.
+func expirePoll(t *testing.T, store *devicestore.MemoryDeviceStore, deviceCode string) {
+	_, err := store.Update(context.Background(), deviceCode, func(auth *devicestore.DeviceAuthorization) error {
+		auth.LastPolledAt = auth.LastPolledAt.Add(-time.Hour)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDeviceAuthorizer_Authorize(t *testing.T) {
+	authorizer, _ := newTestAuthorizer(5)
+	ctx := context.Background()
+
+	resp, err := authorizer.Authorize(ctx, "cli", "", "shoplist")
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.DeviceCode)
+	assert.Regexp(t, `^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`, resp.UserCode)
+	assert.Equal(t, "https://auth.example.com/auth/device", resp.VerificationURI)
+	assert.Equal(t, "https://auth.example.com/auth/device?user_code="+resp.UserCode, resp.VerificationURIComplete)
+	assert.Equal(t, 600, resp.ExpiresIn)
+	assert.Equal(t, 5, resp.Interval)
+
+	_, err = authorizer.Authorize(ctx, "unknown", "", "")
+	assert.ErrorIs(t, err, ErrInvalidClient)
+
+	_, err = authorizer.Authorize(ctx, "tv", "wrong", "")
+	assert.ErrorIs(t, err, ErrInvalidClient)
+
+	_, err = authorizer.Authorize(ctx, "tv", "tv-secret", "")
+	assert.NoError(t, err)
+
+	_, err = authorizer.Authorize(ctx, "web", "", "")
+	assert.ErrorIs(t, err, ErrUnauthorizedClient)
+}
+
+func TestDeviceAuthorizer_ApproveAndPoll(t *testing.T) {
+	authorizer, store := newTestAuthorizer(5)
+	ctx := context.Background()
+
+	resp, err := authorizer.Authorize(ctx, "cli", "", "shoplist")
+	require.NoError(t, err)
+
+	_, err = authorizer.Poll(ctx, "cli", "", resp.DeviceCode)
+	assert.ErrorIs(t, err, ErrAuthorizationPending)
+
+	// Polling again right away is too fast, and raises the interval.
+	_, err = authorizer.Poll(ctx, "cli", "", resp.DeviceCode)
+	assert.ErrorIs(t, err, ErrSlowDown)
+	auth, err := store.GetByDeviceCode(ctx, resp.DeviceCode)
+	require.NoError(t, err)
+	assert.Equal(t, 10, auth.Interval)
+
+	// Another client cannot redeem the device code.
+	_, err = authorizer.Poll(ctx, "shoplist", "", resp.DeviceCode)
+	assert.ErrorIs(t, err, ErrInvalidGrant)
+
+	// The user may type the code in lower case and without the dash.
+	pending, err := authorizer.GetPending(ctx, strings.ToLower(NormalizeUserCode(resp.UserCode)))
+	require.NoError(t, err)
+	assert.Equal(t, "cli", pending.ClientID)
+	assert.Equal(t, "shoplist", pending.Scope)
+
+	require.NoError(t, authorizer.Approve(ctx, resp.UserCode, "user-1"))
+	assert.ErrorIs(t, authorizer.Approve(ctx, resp.UserCode, "user-2"), ErrInvalidUserCode)
+
+	expirePoll(t, store, resp.DeviceCode)
+	approved, err := authorizer.Poll(ctx, "cli", "", resp.DeviceCode)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", approved.UserID)
+	assert.Equal(t, "shoplist", approved.Scope)
+
+	// The device code is single use.
+	_, err = authorizer.Poll(ctx, "cli", "", resp.DeviceCode)
+	assert.ErrorIs(t, err, ErrInvalidGrant)
+}
+
+func TestDeviceAuthorizer_Deny(t *testing.T) {
+	authorizer, _ := newTestAuthorizer(0)
+	ctx := context.Background()
+
+	resp, err := authorizer.Authorize(ctx, "cli", "", "")
+	require.NoError(t, err)
+
+	require.NoError(t, authorizer.Deny(ctx, resp.UserCode))
+	_, err = authorizer.Poll(ctx, "cli", "", resp.DeviceCode)
+	assert.ErrorIs(t, err, ErrAccessDenied)
+
+	_, err = authorizer.Poll(ctx, "cli", "", resp.DeviceCode)
+	assert.ErrorIs(t, err, ErrInvalidGrant)
+}
+
+func TestDeviceAuthorizer_Expired(t *testing.T) {
+	authorizer, store := newTestAuthorizer(0)
+	ctx := context.Background()
+
+	resp, err := authorizer.Authorize(ctx, "cli", "", "")
+	require.NoError(t, err)
+
+	_, err = store.Update(ctx, resp.DeviceCode, func(auth *devicestore.DeviceAuthorization) error {
+		auth.ExpiresAt = time.Now().Add(-time.Second)
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = authorizer.GetPending(ctx, resp.UserCode)
+	assert.ErrorIs(t, err, ErrInvalidUserCode)
+	assert.ErrorIs(t, authorizer.Approve(ctx, resp.UserCode, "user-1"), ErrInvalidUserCode)
+
+	_, err = authorizer.Poll(ctx, "cli", "", resp.DeviceCode)
+	assert.ErrorIs(t, err, ErrExpiredToken)
+}
+
+func TestUserCodeFormatting(t *testing.T) {
+	assert.Equal(t, "BCDFGHJK", NormalizeUserCode(" bcdf-ghjk "))
+	assert.Equal(t, "BCDF-GHJK", FormatUserCode("BCDFGHJK"))
+	assert.Equal(t, "BCD", FormatUserCode("BCD"))
+}
@@ -0,0 +1,132 @@
+package bizpassword
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kdjuwidja/aishoppercommon/logger"
+)
+
+const hashPrefixLength = 5
+
+// BreachedPasswordList reports whether a password appears in a list of known breached passwords.
+type BreachedPasswordList interface {
+	Contains(password string) (bool, error)
+}
+
+// FileBreachedPasswordList checks passwords against a local copy of a breached password SHA-1 hash list in the
+// Have I Been Pwned format (one "HASH" or "HASH:COUNT" per line, sorted by hash). Lookups follow the k-anonymity
+// range model: only the first 5 hex characters of the hash are used to locate the range of candidate suffixes, so
+// the list never needs to be loaded into memory as a whole.
+type FileBreachedPasswordList struct {
+	file    *os.File
+	offsets map[string]int64
+}
+
+// NewFileBreachedPasswordList scans the file once to index the byte offset of every hash prefix.
+func NewFileBreachedPasswordList(path string) (*FileBreachedPasswordList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %w", err)
+	}
+
+	offsets := make(map[string]int64)
+	reader := bufio.NewReader(file)
+	var offset int64
+	lastHash := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			hash := parseHashLine(line)
+			if len(hash) > hashPrefixLength {
+				if hash < lastHash {
+					file.Close()
+					return nil, fmt.Errorf("breached password list is not sorted by hash at offset %d", offset)
+				}
+				lastHash = hash
+
+				prefix := hash[:hashPrefixLength]
+				if _, ok := offsets[prefix]; !ok {
+					offsets[prefix] = offset
+				}
+			}
+			offset += int64(len(line))
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read breached password list: %w", err)
+		}
+	}
+
+	logger.Infof("Loaded breached password list %s with %d hash prefixes.", path, len(offsets))
+	return &FileBreachedPasswordList{
+		file:    file,
+		offsets: offsets,
+	}, nil
+}
+
+// Range returns the hash suffixes in the list that share the given 5 character prefix.
+func (l *FileBreachedPasswordList) Range(prefix string) ([]string, error) {
+	prefix = strings.ToUpper(prefix)
+	offset, ok := l.offsets[prefix]
+	if !ok {
+		return nil, nil
+	}
+
+	// ReadAt is safe for concurrent use, so lookups do not need to be serialised.
+	reader := bufio.NewReader(io.NewSectionReader(l.file, offset, 1<<62))
+	suffixes := make([]string, 0)
+	for {
+		line, err := reader.ReadString('\n')
+		hash := parseHashLine(line)
+		if len(hash) <= hashPrefixLength || hash[:hashPrefixLength] != prefix {
+			break
+		}
+		suffixes = append(suffixes, hash[hashPrefixLength:])
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return suffixes, nil
+}
+
+func (l *FileBreachedPasswordList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := l.Range(hash[:hashPrefixLength])
+	if err != nil {
+		return false, err
+	}
+
+	for _, suffix := range suffixes {
+		if suffix == hash[hashPrefixLength:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (l *FileBreachedPasswordList) Close() error {
+	return l.file.Close()
+}
+
+// parseHashLine strips the optional ":COUNT" suffix and normalises the hash to upper case.
+func parseHashLine(line string) string {
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return strings.ToUpper(hash)
+}
@@ -0,0 +1,51 @@
+package bizpassword
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeHashList(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestFileBreachedPasswordList(t *testing.T) {
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8 and of "123456" is 7C4A8D09CA3762AF61E59520943DC26494F8941B
+	path := writeHashList(t, "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD7:3\n"+
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\n"+
+		"5baa6ffffffffffffffffffffffffffffffffff0:1\n"+
+		"7C4A8D09CA3762AF61E59520943DC26494F8941B:37359195")
+
+	list, err := NewFileBreachedPasswordList(path)
+	require.NoError(t, err)
+	defer list.Close()
+
+	breached, err := list.Contains("password")
+	assert.NoError(t, err)
+	assert.True(t, breached)
+
+	breached, err = list.Contains("123456")
+	assert.NoError(t, err)
+	assert.True(t, breached)
+
+	breached, err = list.Contains("correct horse battery staple")
+	assert.NoError(t, err)
+	assert.False(t, breached)
+
+	suffixes, err := list.Range("5baa6")
+	assert.NoError(t, err)
+	assert.Len(t, suffixes, 3)
+}
+
+func TestFileBreachedPasswordListUnsorted(t *testing.T) {
+	path := writeHashList(t, "7C4A8D09CA3762AF61E59520943DC26494F8941B:1\n5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:1\n")
+
+	_, err := NewFileBreachedPasswordList(path)
+	assert.Error(t, err)
+}
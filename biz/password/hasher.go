@@ -0,0 +1,224 @@
+package bizpassword
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+var ErrUnsupportedHash = errors.New("unsupported password hash format")
+
+// Algorithm is a password hashing scheme producing PHC formatted strings ($id$params$salt$hash).
+type Algorithm interface {
+	ID() string
+	// Matches reports whether the encoded hash was produced by this algorithm.
+	Matches(encoded string) bool
+	Hash(password string) (string, error)
+	Verify(password string, encoded string) (bool, error)
+	// NeedsRehash reports whether the encoded hash was produced with parameters weaker than the current configuration.
+	NeedsRehash(encoded string) bool
+}
+
+// PasswordHasher hashes new passwords with the preferred algorithm and verifies hashes of any registered algorithm,
+// so that the preferred algorithm or its cost can be changed without invalidating existing passwords.
+type PasswordHasher struct {
+	preferred  Algorithm
+	algorithms []Algorithm
+}
+
+// NewPasswordHasher creates a hasher that prefers the algorithm with the given ID among the supported algorithms.
+func NewPasswordHasher(preferredID string, algorithms ...Algorithm) (*PasswordHasher, error) {
+	for _, algorithm := range algorithms {
+		if algorithm.ID() == preferredID {
+			return &PasswordHasher{
+				preferred:  algorithm,
+				algorithms: algorithms,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("preferred password hash algorithm %q is not supported", preferredID)
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	return h.preferred.Hash(password)
+}
+
+// HashWith hashes the password with a specific supported algorithm rather than the preferred one.
+func (h *PasswordHasher) HashWith(algorithmID string, password string) (string, error) {
+	for _, algorithm := range h.algorithms {
+		if algorithm.ID() == algorithmID {
+			return algorithm.Hash(password)
+		}
+	}
+	return "", fmt.Errorf("password hash algorithm %q is not supported", algorithmID)
+}
+
+// Verify checks the password against the encoded hash. needsRehash is true when the password is correct but the hash
+// was not produced by the preferred algorithm with its current parameters.
+func (h *PasswordHasher) Verify(password string, encoded string) (ok bool, needsRehash bool, err error) {
+	for _, algorithm := range h.algorithms {
+		if !algorithm.Matches(encoded) {
+			continue
+		}
+
+		ok, err = algorithm.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+
+		return true, algorithm != h.preferred || algorithm.NeedsRehash(encoded), nil
+	}
+	return false, false, ErrUnsupportedHash
+}
+
+type BcryptAlgorithm struct {
+	cost int
+}
+
+func NewBcryptAlgorithm(cost int) *BcryptAlgorithm {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+	return &BcryptAlgorithm{cost: cost}
+}
+
+func (a *BcryptAlgorithm) ID() string {
+	return AlgorithmBcrypt
+}
+
+// Matches accepts the $2a$, $2b$ and $2y$ variants. bcrypt's modular crypt format predates PHC and is kept as is.
+func (a *BcryptAlgorithm) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (a *BcryptAlgorithm) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), a.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (a *BcryptAlgorithm) Verify(password string, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *BcryptAlgorithm) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < a.cost
+}
+
+type Argon2idAlgorithm struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  int
+	keyLength   uint32
+}
+
+// NewArgon2idAlgorithm creates an argon2id algorithm. memory is in KiB.
+func NewArgon2idAlgorithm(memory uint32, iterations uint32, parallelism uint8) *Argon2idAlgorithm {
+	return &Argon2idAlgorithm{
+		memory:      memory,
+		iterations:  iterations,
+		parallelism: parallelism,
+		saltLength:  16,
+		keyLength:   32,
+	}
+}
+
+func (a *Argon2idAlgorithm) ID() string {
+	return AlgorithmArgon2id
+}
+
+func (a *Argon2idAlgorithm) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a *Argon2idAlgorithm) Hash(password string) (string, error) {
+	salt := make([]byte, a.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.iterations, a.memory, a.parallelism, a.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.memory, a.iterations, a.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func decodeArgon2id(encoded string) (*argon2idParams, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	params := &argon2idParams{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+
+	return params, nil
+}
+
+func (a *Argon2idAlgorithm) Verify(password string, encoded string) (bool, error) {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (a *Argon2idAlgorithm) NeedsRehash(encoded string) bool {
+	params, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.memory < a.memory || params.iterations < a.iterations || params.parallelism != a.parallelism ||
+		len(params.salt) < a.saltLength || uint32(len(params.key)) < a.keyLength
+}
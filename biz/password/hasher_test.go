@@ -0,0 +1,84 @@
+package bizpassword
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestHasher(t *testing.T, preferred string, bcryptCost int, argonIterations uint32) *PasswordHasher {
+	hasher, err := NewPasswordHasher(preferred,
+		NewArgon2idAlgorithm(8*1024, argonIterations, 1),
+		NewBcryptAlgorithm(bcryptCost))
+	require.NoError(t, err)
+	return hasher
+}
+
+func TestPasswordHasherArgon2id(t *testing.T) {
+	hasher := newTestHasher(t, AlgorithmArgon2id, bcrypt.MinCost, 1)
+
+	encoded, err := hasher.Hash("correct horse")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=8192,t=1,p=1$"))
+
+	ok, needsRehash, err := hasher.Verify("correct horse", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, needsRehash)
+
+	ok, _, err = hasher.Verify("wrong horse", encoded)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestPasswordHasherUpgradesBcrypt(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	hasher := newTestHasher(t, AlgorithmArgon2id, bcrypt.MinCost, 1)
+	ok, needsRehash, err := hasher.Verify("correct horse", string(legacy))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+
+	// A wrong password never asks for a rehash
+	ok, needsRehash, err = hasher.Verify("wrong horse", string(legacy))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, needsRehash)
+}
+
+func TestPasswordHasherRehashOnCostIncrease(t *testing.T) {
+	weak := newTestHasher(t, AlgorithmArgon2id, bcrypt.MinCost, 1)
+	encoded, err := weak.Hash("correct horse")
+	require.NoError(t, err)
+
+	strong := newTestHasher(t, AlgorithmArgon2id, bcrypt.MinCost, 2)
+	ok, needsRehash, err := strong.Verify("correct horse", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+
+	weakBcrypt := newTestHasher(t, AlgorithmBcrypt, bcrypt.MinCost, 1)
+	encoded, err = weakBcrypt.Hash("correct horse")
+	require.NoError(t, err)
+
+	strongBcrypt := newTestHasher(t, AlgorithmBcrypt, bcrypt.MinCost+1, 1)
+	ok, needsRehash, err = strongBcrypt.Verify("correct horse", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+}
+
+func TestPasswordHasherUnsupported(t *testing.T) {
+	hasher := newTestHasher(t, AlgorithmArgon2id, bcrypt.MinCost, 1)
+
+	_, _, err := hasher.Verify("password", "plaintext")
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+
+	_, err = NewPasswordHasher("scrypt", NewBcryptAlgorithm(bcrypt.MinCost))
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package bizpassword
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/kdjuwidja/aishoppercommon/logger"
+)
+
+// bcrypt silently ignores everything after the 72nd byte, so longer passwords give a false sense of security.
+const BcryptMaxLength = 72
+
+type ViolationRule string
+
+const (
+	RuleTooShort       ViolationRule = "too_short"
+	RuleTooLong        ViolationRule = "too_long"
+	RuleMissingUpper   ViolationRule = "missing_upper"
+	RuleMissingLower   ViolationRule = "missing_lower"
+	RuleMissingDigit   ViolationRule = "missing_digit"
+	RuleMissingSymbol  ViolationRule = "missing_symbol"
+	RuleMatchesEmail   ViolationRule = "matches_email"
+	RuleBreachedSecret ViolationRule = "breached"
+)
+
+// PolicyViolation describes the first rule a password failed. Limit holds the configured bound for length rules.
+type PolicyViolation struct {
+	Rule  ViolationRule
+	Limit int
+}
+
+func (v *PolicyViolation) Error() string {
+	if v.Limit > 0 {
+		return fmt.Sprintf("password policy violation: %s (%d)", v.Rule, v.Limit)
+	}
+	return fmt.Sprintf("password policy violation: %s", v.Rule)
+}
+
+type PolicyConfig struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	DisallowEmail bool
+}
+
+type Policy struct {
+	config       PolicyConfig
+	breachedList BreachedPasswordList
+}
+
+// NewPolicy creates a password policy. breachedList is optional, pass nil to skip the breached password check.
+func NewPolicy(config PolicyConfig, breachedList BreachedPasswordList) *Policy {
+	if config.MaxLength <= 0 || config.MaxLength > BcryptMaxLength {
+		config.MaxLength = BcryptMaxLength
+	}
+
+	return &Policy{
+		config:       config,
+		breachedList: breachedList,
+	}
+}
+
+// Validate checks the password against the policy and returns a *PolicyViolation for the first rule that fails.
+func (p *Policy) Validate(password string, email string) error {
+	if len([]rune(password)) < p.config.MinLength {
+		return &PolicyViolation{Rule: RuleTooShort, Limit: p.config.MinLength}
+	}
+
+	// The maximum is measured in bytes rather than characters since that is what bcrypt truncates on.
+	if len(password) > p.config.MaxLength {
+		return &PolicyViolation{Rule: RuleTooLong, Limit: p.config.MaxLength}
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+
+	if p.config.RequireUpper && !hasUpper {
+		return &PolicyViolation{Rule: RuleMissingUpper}
+	}
+	if p.config.RequireLower && !hasLower {
+		return &PolicyViolation{Rule: RuleMissingLower}
+	}
+	if p.config.RequireDigit && !hasDigit {
+		return &PolicyViolation{Rule: RuleMissingDigit}
+	}
+	if p.config.RequireSymbol && !hasSymbol {
+		return &PolicyViolation{Rule: RuleMissingSymbol}
+	}
+
+	if p.config.DisallowEmail && email != "" && matchesEmail(password, email) {
+		return &PolicyViolation{Rule: RuleMatchesEmail}
+	}
+
+	if p.breachedList != nil {
+		breached, err := p.breachedList.Contains(password)
+		if err != nil {
+			// Fail open so that an unreadable list does not block every registration.
+			logger.Errorf("failed to check breached password list: %v", err)
+		} else if breached {
+			return &PolicyViolation{Rule: RuleBreachedSecret}
+		}
+	}
+
+	return nil
+}
+
+// matchesEmail reports whether the password is the email address or its local part, ignoring case.
+func matchesEmail(password string, email string) bool {
+	if strings.EqualFold(password, email) {
+		return true
+	}
+
+	localPart, _, found := strings.Cut(email, "@")
+	return found && strings.EqualFold(password, localPart)
+}
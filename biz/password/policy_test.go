@@ -0,0 +1,71 @@
+package bizpassword
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBreachedList struct {
+	passwords map[string]bool
+}
+
+func (f *fakeBreachedList) Contains(password string) (bool, error) {
+	return f.passwords[password], nil
+}
+
+func TestPolicyValidate(t *testing.T) {
+	policy := NewPolicy(PolicyConfig{
+		MinLength:     8,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		DisallowEmail: true,
+	}, &fakeBreachedList{passwords: map[string]bool{"Password1!": true}})
+
+	testCases := []struct {
+		name     string
+		password string
+		email    string
+		rule     ViolationRule
+		limit    int
+	}{
+		{name: "too short", password: "Ab1!", rule: RuleTooShort, limit: 8},
+		{name: "too long", password: "Aa1!" + strings.Repeat("a", 70), rule: RuleTooLong, limit: BcryptMaxLength},
+		{name: "missing upper", password: "abcdefg1!", rule: RuleMissingUpper},
+		{name: "missing lower", password: "ABCDEFG1!", rule: RuleMissingLower},
+		{name: "missing digit", password: "Abcdefgh!", rule: RuleMissingDigit},
+		{name: "missing symbol", password: "Abcdefgh1", rule: RuleMissingSymbol},
+		{name: "matches email", password: "Test.User1!@Example.com", email: "test.user1!@example.com", rule: RuleMatchesEmail},
+		{name: "matches email local part", password: "Test.User1!", email: "test.user1!@example.com", rule: RuleMatchesEmail},
+		{name: "breached", password: "Password1!", rule: RuleBreachedSecret},
+		{name: "valid", password: "Correct-Horse-1", email: "test@example.com"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := policy.Validate(tc.password, tc.email)
+			if tc.rule == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var violation *PolicyViolation
+			require.ErrorAs(t, err, &violation)
+			assert.Equal(t, tc.rule, violation.Rule)
+			assert.Equal(t, tc.limit, violation.Limit)
+		})
+	}
+}
+
+func TestPolicyMaxLengthCappedAtBcryptLimit(t *testing.T) {
+	policy := NewPolicy(PolicyConfig{MaxLength: 200}, nil)
+
+	var violation *PolicyViolation
+	require.ErrorAs(t, policy.Validate(strings.Repeat("a", 73), ""), &violation)
+	assert.Equal(t, RuleTooLong, violation.Rule)
+	assert.Equal(t, BcryptMaxLength, violation.Limit)
+}
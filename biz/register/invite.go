@@ -0,0 +1,42 @@
+package bizregister
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"netherealmstudio.com/m/v2/mailer"
+)
+
+// Inviter builds registration invite links and emails them to invitees.
+type Inviter struct {
+	mailer    mailer.Mailer
+	inviteURL string
+}
+
+func NewInviter(inviteMailer mailer.Mailer, inviteURL string) *Inviter {
+	return &Inviter{
+		mailer:    inviteMailer,
+		inviteURL: inviteURL,
+	}
+}
+
+// InviteLink returns the registration page URL prefilled with the code and, when the code is bound to one, the email.
+func (i *Inviter) InviteLink(code string, email string) string {
+	query := url.Values{}
+	query.Set("code", code)
+	if email != "" {
+		query.Set("email", email)
+	}
+	return i.inviteURL + "?" + query.Encode()
+}
+
+func (i *Inviter) SendInvite(ctx context.Context, code *RegistrationCodeInfo) error {
+	if code.Email == "" {
+		return fmt.Errorf("registration code %s is not bound to an email", code.Code)
+	}
+
+	body := fmt.Sprintf("You have been invited to create an account.\n\nRegister at %s\n\nYour registration code is %s and expires on %s.",
+		i.InviteLink(code.Code, code.Email), code.Code, code.ExpiresAt.Format("2006-01-02 15:04 MST"))
+	return i.mailer.Send(ctx, code.Email, "Your invitation", body)
+}
@@ -0,0 +1,19 @@
+package bizregister
+
+import (
+	"testing"
+)
+
+func TestInviteLink(t *testing.T) {
+	inviter := NewInviter(nil, "http://localhost:9096/auth/register")
+
+	link := inviter.InviteLink("ABC123", "")
+	if link != "http://localhost:9096/auth/register?code=ABC123" {
+		t.Errorf("Unexpected invite link: %s", link)
+	}
+
+	link = inviter.InviteLink("ABC123", "first+last@example.com")
+	if link != "http://localhost:9096/auth/register?code=ABC123&email=first%2Blast%40example.com" {
+		t.Errorf("Unexpected invite link: %s", link)
+	}
+}
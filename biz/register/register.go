@@ -2,31 +2,191 @@ package bizregister
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/kdjuwidja/aishoppercommon/logger"
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
 	"netherealmstudio.com/m/v2/db"
+	"netherealmstudio.com/m/v2/tracing"
 )
 
+var (
+	ErrRegistrationCodeNotFound = errors.New("registration code not found")
+	ErrInvalidRoleID            = errors.New("role does not exist")
+	ErrInvalidBatchSize         = errors.New("invalid registration code batch size")
+	ErrEmailInUse               = errors.New("email already in use")
+)
+
+const (
+	CodeStatusActive    = "active"
+	CodeStatusExpired   = "expired"
+	CodeStatusExhausted = "exhausted"
+	CodeStatusRevoked   = "revoked"
+)
+
+// RegistrationCodeOptions configures a new registration code. Zero values fall back to the manager's defaults: the
+// default TTL, a single use, no bound email and the default user role.
+type RegistrationCodeOptions struct {
+	TTL     time.Duration
+	MaxUses int
+	Email   string
+	RoleID  int
+}
+
+// RegistrationCodeInfo is the admin facing view of a registration code.
+type RegistrationCodeInfo struct {
+	Code      string    `json:"code"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses"`
+	UseCount  int       `json:"use_count"`
+	Email     string    `json:"email,omitempty"`
+	RoleID    int       `json:"role_id"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InvitedRegistrationCode is a code created as part of a batch along with its invite link.
+type InvitedRegistrationCode struct {
+	*RegistrationCodeInfo
+	InviteLink string `json:"invite_link"`
+	InviteSent bool   `json:"invite_sent"`
+}
+
 type RegistrationManager struct {
-	maxRetry   int
-	dbConn     *gorm.DB
-	userRoleID int
+	maxRetry       int
+	dbConn         *gorm.DB
+	userRoleID     int
+	codeTTL        time.Duration
+	passwordPolicy *bizpassword.Policy
+	passwordHasher *bizpassword.PasswordHasher
+	inviter        *Inviter
+	maxBatchSize   int
 }
 
-func NewRegistrationManager(dbConn *gorm.DB, maxRetry int, userRoleID int) *RegistrationManager {
+func NewRegistrationManager(dbConn *gorm.DB, maxRetry int, userRoleID int, codeTTL time.Duration, passwordPolicy *bizpassword.Policy, passwordHasher *bizpassword.PasswordHasher, inviter *Inviter, maxBatchSize int) *RegistrationManager {
 	return &RegistrationManager{
-		dbConn:     dbConn,
-		maxRetry:   maxRetry,
-		userRoleID: userRoleID,
+		dbConn:         dbConn,
+		maxRetry:       maxRetry,
+		userRoleID:     userRoleID,
+		codeTTL:        codeTTL,
+		passwordPolicy: passwordPolicy,
+		passwordHasher: passwordHasher,
+		inviter:        inviter,
+		maxBatchSize:   maxBatchSize,
+	}
+}
+
+func (r *RegistrationManager) GetMaxBatchSize() int {
+	return r.maxBatchSize
+}
+
+// GetRegistrationCode creates a new registration code issued by createdBy.
+func (r *RegistrationManager) GetRegistrationCode(ctx context.Context, createdBy string, options RegistrationCodeOptions) (*RegistrationCodeInfo, error) {
+	options, err := r.resolveOptions(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	dbCode, err := r.createRegistrationCode(r.dbConn.WithContext(ctx), createdBy, options)
+	if err != nil {
+		return nil, err
+	}
+	return toRegistrationCodeInfo(dbCode), nil
+}
+
+// GetRegistrationCodes creates a batch of registration codes in a single transaction, so either every code is created
+// or none is. When emails are given one code is created per email and bound to it, otherwise count codes are created.
+// If sendInvites is set, each email bound code is sent to its invitee once the batch is committed.
+func (r *RegistrationManager) GetRegistrationCodes(ctx context.Context, createdBy string, count int, emails []string, options RegistrationCodeOptions, sendInvites bool) ([]*InvitedRegistrationCode, error) {
+	if len(emails) > 0 {
+		count = len(emails)
+	}
+	if count <= 0 || count > r.maxBatchSize {
+		return nil, ErrInvalidBatchSize
+	}
+
+	options, err := r.resolveOptions(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]*InvitedRegistrationCode, 0, count)
+	txCtx, span := tracing.Start(ctx, "RegistrationManager.GetRegistrationCodes", attribute.Int("count", count))
+	err = r.dbConn.WithContext(txCtx).Transaction(func(tx *gorm.DB) error {
+		for i := 0; i < count; i++ {
+			codeOptions := options
+			if len(emails) > 0 {
+				codeOptions.Email = emails[i]
+			}
+
+			dbCode, err := r.createRegistrationCode(tx, createdBy, codeOptions)
+			if err != nil {
+				return err
+			}
+
+			info := toRegistrationCodeInfo(dbCode)
+			codes = append(codes, &InvitedRegistrationCode{
+				RegistrationCodeInfo: info,
+				InviteLink:           r.inviter.InviteLink(info.Code, info.Email),
+			})
+		}
+		return nil
+	})
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if sendInvites {
+		for _, code := range codes {
+			if code.Email == "" {
+				continue
+			}
+
+			// A failed invite does not undo the batch; the admin can resend from the exported links.
+			if err := r.inviter.SendInvite(ctx, code.RegistrationCodeInfo); err != nil {
+				logger.Errorf("failed to send invite for registration code %s: %v", code.Code, err)
+				continue
+			}
+			code.InviteSent = true
+		}
 	}
+
+	return codes, nil
+}
+
+// resolveOptions validates the options and fills in the manager's defaults.
+func (r *RegistrationManager) resolveOptions(ctx context.Context, options RegistrationCodeOptions) (RegistrationCodeOptions, error) {
+	if options.RoleID != 0 {
+		var count int64
+		if err := r.dbConn.WithContext(ctx).Model(&db.Role{}).Where("id = ?", options.RoleID).Count(&count).Error; err != nil {
+			return options, err
+		}
+		if count == 0 {
+			return options, ErrInvalidRoleID
+		}
+	}
+
+	if options.TTL <= 0 {
+		options.TTL = r.codeTTL
+	}
+	if options.MaxUses <= 0 {
+		options.MaxUses = 1
+	}
+	return options, nil
 }
 
-func (r *RegistrationManager) GetRegistrationCode(ctx context.Context) (string, error) {
+// createRegistrationCode generates a random code and retries on collision with an existing code. Codes already taken,
+// including revoked ones, are skipped before the insert. MySQL only rolls back the failing statement on a duplicate key,
+// so a concurrent insert of the same code does not undo the rest of the caller's transaction either.
+func (r *RegistrationManager) createRegistrationCode(tx *gorm.DB, createdBy string, options RegistrationCodeOptions) (*db.RegistrationCode, error) {
 	success := false
 	retry := 0
 	for !success && retry < r.maxRetry {
@@ -37,29 +197,107 @@ func (r *RegistrationManager) GetRegistrationCode(ctx context.Context) (string,
 		}
 
 		dbCode := db.RegistrationCode{
-			Code: code,
+			Code:      code,
+			ExpiresAt: time.Now().Add(options.TTL),
+			MaxUses:   options.MaxUses,
+			Email:     strings.ToLower(options.Email),
+			RoleID:    options.RoleID,
+			CreatedBy: createdBy,
 		}
 
-		// Create fails if the code already exists
-		err = r.dbConn.Create(&dbCode).Error
-		if err != nil {
+		var count int64
+		if err := tx.Unscoped().Model(&db.RegistrationCode{}).Where("code = ?", code).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			retry++
+			continue
+		}
+
+		// Create fails if the code was inserted since
+		if err := tx.Create(&dbCode).Error; err != nil {
 			retry++
 			continue
 		}
 
 		success = true
-		return code, nil
+		return &dbCode, nil
+	}
+
+	return nil, fmt.Errorf("failed to generate registration code after %d retries", r.maxRetry)
+}
+
+// ListRegistrationCodes returns the codes that can still be redeemed, newest first.
+func (r *RegistrationManager) ListRegistrationCodes(ctx context.Context) ([]*RegistrationCodeInfo, error) {
+	var dbCodes []db.RegistrationCode
+	err := r.dbConn.WithContext(ctx).Where("expires_at > ? AND use_count < max_uses", time.Now()).Order("created_at DESC").Find(&dbCodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]*RegistrationCodeInfo, 0, len(dbCodes))
+	for i := range dbCodes {
+		codes = append(codes, toRegistrationCodeInfo(&dbCodes[i]))
+	}
+	return codes, nil
+}
+
+// GetRegistrationCodeInfo returns the code whatever its status, including consumed and revoked codes.
+func (r *RegistrationManager) GetRegistrationCodeInfo(ctx context.Context, code string) (*RegistrationCodeInfo, error) {
+	var dbCode db.RegistrationCode
+	result := r.dbConn.WithContext(ctx).Unscoped().Where("code = ?", code).First(&dbCode)
+	if result.Error == gorm.ErrRecordNotFound {
+		return nil, ErrRegistrationCodeNotFound
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return toRegistrationCodeInfo(&dbCode), nil
+}
+
+// RevokeRegistrationCode prevents any further use of the code.
+func (r *RegistrationManager) RevokeRegistrationCode(ctx context.Context, code string) error {
+	result := r.dbConn.WithContext(ctx).Where("code = ?", code).Delete(&db.RegistrationCode{})
+	if result.Error != nil {
+		return result.Error
 	}
 
-	return "", fmt.Errorf("failed to generate registration code after %d retries", r.maxRetry)
+	if result.RowsAffected == 0 {
+		return ErrRegistrationCodeNotFound
+	}
+	return nil
 }
 
-// RegisterUser registers a new user with the given code(single use), email, and password
-func (r *RegistrationManager) RegisterUser(ctx context.Context, code string, email string, password string) error {
+// RegisterUser registers a new user with the given code, email, and password. The user is granted the role bound to
+// the code, or the default user role if the code has none.
+func (r *RegistrationManager) RegisterUser(ctx context.Context, code string, email string, password string) (err error) {
+	// Validate before the transaction so that a rejected password does not consume the code.
+	if err := r.passwordPolicy.Validate(password, email); err != nil {
+		return err
+	}
+
+	ctx, span := tracing.Start(ctx, "RegistrationManager.RegisterUser")
+	defer func() { tracing.End(span, err) }()
+
 	tx := r.dbConn.WithContext(ctx).Begin()
 
-	// Ensure code exists before creating user. The code is consumed in the process of registration within a single transaction so that no locking is required.
-	result := tx.Unscoped().Delete(&db.RegistrationCode{}, "code = ?", code)
+	// Soft deleted users are included since the unique index on email still applies to them.
+	var emailCount int64
+	if err := tx.Unscoped().Model(&db.User{}).Where("email = ?", email).Count(&emailCount).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if emailCount > 0 {
+		tx.Rollback()
+		return ErrEmailInUse
+	}
+
+	// Ensure the code is redeemable before creating user. The use is counted with a single conditional update within
+	// the registration transaction so that concurrent registrations cannot exceed the maximum uses without locking.
+	result := tx.Model(&db.RegistrationCode{}).
+		Where("code = ? AND expires_at > ? AND use_count < max_uses AND (email = '' OR email = ?)", code, time.Now(), strings.ToLower(email)).
+		Update("use_count", gorm.Expr("use_count + 1"))
 	if result.Error != nil {
 		tx.Rollback()
 		return result.Error
@@ -67,10 +305,24 @@ func (r *RegistrationManager) RegisterUser(ctx context.Context, code string, ema
 
 	if result.RowsAffected == 0 {
 		tx.Rollback()
-		return fmt.Errorf("registration code not found")
+		return ErrRegistrationCodeNotFound
+	}
+
+	var dbCode db.RegistrationCode
+	if err := tx.Where("code = ?", code).First(&dbCode).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Exhausted codes are soft deleted so that they no longer show up as outstanding but can still be inspected.
+	if dbCode.UseCount >= dbCode.MaxUses {
+		if err := tx.Where("code = ?", code).Delete(&db.RegistrationCode{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := r.passwordHasher.Hash(password)
 	if err != nil {
 		logger.Errorf("failed to generate hashed password: %v", err)
 		tx.Rollback()
@@ -80,7 +332,7 @@ func (r *RegistrationManager) RegisterUser(ctx context.Context, code string, ema
 	user := db.User{
 		ID:       strings.ReplaceAll(uuid.New().String(), "-", ""),
 		Email:    email,
-		Password: string(hashedPassword),
+		Password: hashedPassword,
 	}
 
 	err = tx.Create(&user).Error
@@ -89,9 +341,14 @@ func (r *RegistrationManager) RegisterUser(ctx context.Context, code string, ema
 		return err
 	}
 
+	roleID := r.userRoleID
+	if dbCode.RoleID != 0 {
+		roleID = dbCode.RoleID
+	}
+
 	userRole := db.UserRole{
 		UserID: user.ID,
-		RoleID: r.userRoleID,
+		RoleID: roleID,
 	}
 
 	err = tx.Create(&userRole).Error
@@ -103,3 +360,27 @@ func (r *RegistrationManager) RegisterUser(ctx context.Context, code string, ema
 	tx.Commit()
 	return nil
 }
+
+func toRegistrationCodeInfo(dbCode *db.RegistrationCode) *RegistrationCodeInfo {
+	status := CodeStatusActive
+	switch {
+	case dbCode.UseCount >= dbCode.MaxUses:
+		status = CodeStatusExhausted
+	case dbCode.DeletedAt.Valid:
+		status = CodeStatusRevoked
+	case time.Now().After(dbCode.ExpiresAt):
+		status = CodeStatusExpired
+	}
+
+	return &RegistrationCodeInfo{
+		Code:      dbCode.Code,
+		Status:    status,
+		ExpiresAt: dbCode.ExpiresAt,
+		MaxUses:   dbCode.MaxUses,
+		UseCount:  dbCode.UseCount,
+		Email:     dbCode.Email,
+		RoleID:    dbCode.RoleID,
+		CreatedBy: dbCode.CreatedBy,
+		CreatedAt: dbCode.CreatedAt,
+	}
+}
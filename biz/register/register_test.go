@@ -3,12 +3,23 @@ package bizregister
 import (
 	"context"
 	"testing"
+	"time"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
 	dbmodel "netherealmstudio.com/m/v2/db"
 )
 
+type recordingMailer struct {
+	recipients []string
+}
+
+func (m *recordingMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	m.recipients = append(m.recipients, to)
+	return nil
+}
+
 func setupTestDB(t *testing.T) *gorm.DB {
 	dsn := "ai_shopper_dev:password@tcp(localhost:4306)/test_db?parseTime=True"
 	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
@@ -49,16 +60,26 @@ func TestRegistrationManager(t *testing.T) {
 		t.Fatalf("Failed to get test role: %v", err)
 	}
 
-	manager := NewRegistrationManager(db, 3, testRole.ID)
+	passwordHasher, err := bizpassword.NewPasswordHasher(bizpassword.AlgorithmArgon2id, bizpassword.NewArgon2idAlgorithm(8*1024, 1, 1))
+	if err != nil {
+		t.Fatalf("Failed to create password hasher: %v", err)
+	}
+	inviteMailer := &recordingMailer{}
+	manager := NewRegistrationManager(db, 3, testRole.ID, time.Hour, bizpassword.NewPolicy(bizpassword.PolicyConfig{MinLength: 8, DisallowEmail: true}, nil), passwordHasher,
+		NewInviter(inviteMailer, "http://localhost:9096/auth/register"), 10)
 
 	t.Run("GetRegistrationCode", func(t *testing.T) {
-		code, err := manager.GetRegistrationCode(context.Background())
+		codeInfo, err := manager.GetRegistrationCode(context.Background(), "test_admin", RegistrationCodeOptions{})
 		if err != nil {
 			t.Fatalf("Failed to get registration code: %v", err)
 		}
+		code := codeInfo.Code
 		if len(code) != 6 {
 			t.Errorf("Expected code length 6, got %d", len(code))
 		}
+		if codeInfo.MaxUses != 1 || codeInfo.CreatedBy != "test_admin" || codeInfo.Status != CodeStatusActive {
+			t.Errorf("Unexpected code defaults: %+v", codeInfo)
+		}
 
 		// Verify code exists in DB
 		var dbCode dbmodel.RegistrationCode
@@ -69,10 +90,11 @@ func TestRegistrationManager(t *testing.T) {
 
 	t.Run("RegisterUser", func(t *testing.T) {
 		// Get a code first
-		code, err := manager.GetRegistrationCode(context.Background())
+		codeInfo, err := manager.GetRegistrationCode(context.Background(), "test_admin", RegistrationCodeOptions{})
 		if err != nil {
 			t.Fatalf("Failed to get registration code: %v", err)
 		}
+		code := codeInfo.Code
 
 		// Register user
 		err = manager.RegisterUser(context.Background(), code, "test@example.com", "password123")
@@ -117,4 +139,151 @@ func TestRegistrationManager(t *testing.T) {
 			t.Error("Expected error for invalid code, got nil")
 		}
 	})
+
+	t.Run("MultiUseCode", func(t *testing.T) {
+		codeInfo, err := manager.GetRegistrationCode(context.Background(), "test_admin", RegistrationCodeOptions{MaxUses: 2})
+		if err != nil {
+			t.Fatalf("Failed to get registration code: %v", err)
+		}
+
+		if err := manager.RegisterUser(context.Background(), codeInfo.Code, "multi1@example.com", "password123"); err != nil {
+			t.Fatalf("Failed to register first user: %v", err)
+		}
+		if err := manager.RegisterUser(context.Background(), codeInfo.Code, "multi2@example.com", "password123"); err != nil {
+			t.Fatalf("Failed to register second user: %v", err)
+		}
+		if err := manager.RegisterUser(context.Background(), codeInfo.Code, "multi3@example.com", "password123"); err == nil {
+			t.Error("Expected error for exhausted code, got nil")
+		}
+
+		info, err := manager.GetRegistrationCodeInfo(context.Background(), codeInfo.Code)
+		if err != nil {
+			t.Fatalf("Failed to get registration code info: %v", err)
+		}
+		if info.Status != CodeStatusExhausted || info.UseCount != 2 {
+			t.Errorf("Expected exhausted code with 2 uses, got %+v", info)
+		}
+	})
+
+	t.Run("ExpiredCode", func(t *testing.T) {
+		codeInfo, err := manager.GetRegistrationCode(context.Background(), "test_admin", RegistrationCodeOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get registration code: %v", err)
+		}
+		db.Model(&dbmodel.RegistrationCode{}).Where("code = ?", codeInfo.Code).Update("expires_at", time.Now().Add(-time.Minute))
+
+		if err := manager.RegisterUser(context.Background(), codeInfo.Code, "expired@example.com", "password123"); err == nil {
+			t.Error("Expected error for expired code, got nil")
+		}
+	})
+
+	t.Run("EmailBoundCode", func(t *testing.T) {
+		codeInfo, err := manager.GetRegistrationCode(context.Background(), "test_admin", RegistrationCodeOptions{Email: "Bound@Example.com"})
+		if err != nil {
+			t.Fatalf("Failed to get registration code: %v", err)
+		}
+
+		if err := manager.RegisterUser(context.Background(), codeInfo.Code, "other@example.com", "password123"); err == nil {
+			t.Error("Expected error for mismatched email, got nil")
+		}
+		if err := manager.RegisterUser(context.Background(), codeInfo.Code, "bound@example.com", "password123"); err != nil {
+			t.Errorf("Failed to register bound email: %v", err)
+		}
+	})
+
+	t.Run("RoleBoundCode", func(t *testing.T) {
+		boundRole := dbmodel.Role{Description: "Bound role"}
+		if err := db.Create(&boundRole).Error; err != nil {
+			t.Fatalf("Failed to create role: %v", err)
+		}
+
+		codeInfo, err := manager.GetRegistrationCode(context.Background(), "test_admin", RegistrationCodeOptions{RoleID: boundRole.ID})
+		if err != nil {
+			t.Fatalf("Failed to get registration code: %v", err)
+		}
+		if err := manager.RegisterUser(context.Background(), codeInfo.Code, "role@example.com", "password123"); err != nil {
+			t.Fatalf("Failed to register user: %v", err)
+		}
+
+		var user dbmodel.User
+		db.Where("email = ?", "role@example.com").First(&user)
+		var userRole dbmodel.UserRole
+		if err := db.Where("user_id = ?", user.ID).First(&userRole).Error; err != nil {
+			t.Fatalf("User role not found in database: %v", err)
+		}
+		if userRole.RoleID != boundRole.ID {
+			t.Errorf("Expected role %d, got %d", boundRole.ID, userRole.RoleID)
+		}
+
+		if _, err := manager.GetRegistrationCode(context.Background(), "test_admin", RegistrationCodeOptions{RoleID: 9999}); err != ErrInvalidRoleID {
+			t.Errorf("Expected ErrInvalidRoleID, got %v", err)
+		}
+	})
+
+	t.Run("ListAndRevokeCodes", func(t *testing.T) {
+		codeInfo, err := manager.GetRegistrationCode(context.Background(), "test_admin", RegistrationCodeOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get registration code: %v", err)
+		}
+
+		codes, err := manager.ListRegistrationCodes(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to list registration codes: %v", err)
+		}
+		found := false
+		for _, c := range codes {
+			found = found || c.Code == codeInfo.Code
+		}
+		if !found {
+			t.Error("Expected new code in outstanding codes")
+		}
+
+		if err := manager.RevokeRegistrationCode(context.Background(), codeInfo.Code); err != nil {
+			t.Fatalf("Failed to revoke registration code: %v", err)
+		}
+		if err := manager.RevokeRegistrationCode(context.Background(), codeInfo.Code); err != ErrRegistrationCodeNotFound {
+			t.Errorf("Expected ErrRegistrationCodeNotFound, got %v", err)
+		}
+		if err := manager.RegisterUser(context.Background(), codeInfo.Code, "revoked@example.com", "password123"); err == nil {
+			t.Error("Expected error for revoked code, got nil")
+		}
+
+		info, err := manager.GetRegistrationCodeInfo(context.Background(), codeInfo.Code)
+		if err != nil {
+			t.Fatalf("Failed to get registration code info: %v", err)
+		}
+		if info.Status != CodeStatusRevoked {
+			t.Errorf("Expected revoked status, got %s", info.Status)
+		}
+	})
+
+	t.Run("GetRegistrationCodes", func(t *testing.T) {
+		codes, err := manager.GetRegistrationCodes(context.Background(), "test_admin", 0, []string{"invite1@example.com", "invite2@example.com"}, RegistrationCodeOptions{MaxUses: 3}, true)
+		if err != nil {
+			t.Fatalf("Failed to get registration codes: %v", err)
+		}
+		if len(codes) != 2 {
+			t.Fatalf("Expected 2 codes, got %d", len(codes))
+		}
+		for i, code := range codes {
+			if code.Email != []string{"invite1@example.com", "invite2@example.com"}[i] || code.MaxUses != 3 || !code.InviteSent {
+				t.Errorf("Unexpected batch code: %+v", code)
+			}
+		}
+		if len(inviteMailer.recipients) != 2 {
+			t.Errorf("Expected 2 invites sent, got %d", len(inviteMailer.recipients))
+		}
+
+		codes, err = manager.GetRegistrationCodes(context.Background(), "test_admin", 5, nil, RegistrationCodeOptions{}, true)
+		if err != nil {
+			t.Fatalf("Failed to get registration codes: %v", err)
+		}
+		if len(codes) != 5 || codes[0].InviteSent {
+			t.Errorf("Expected 5 unsent codes, got %d", len(codes))
+		}
+
+		if _, err := manager.GetRegistrationCodes(context.Background(), "test_admin", 11, nil, RegistrationCodeOptions{}, false); err != ErrInvalidBatchSize {
+			t.Errorf("Expected ErrInvalidBatchSize, got %v", err)
+		}
+	})
 }
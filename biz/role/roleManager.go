@@ -0,0 +1,410 @@
+package bizrole
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	bizuser "netherealmstudio.com/m/v2/biz/user"
+	"netherealmstudio.com/m/v2/db"
+)
+
+// AdminScope is the scope that grants access to the administration endpoints.
+const AdminScope = bizuser.AdminScope
+
+var (
+	ErrRoleNotFound = errors.New("role not found")
+	ErrRoleExists   = errors.New("role already exists")
+	ErrLastAdmin    = bizuser.ErrLastAdmin
+)
+
+// UnknownScopeError is returned when a scope is not in the scope registry.
+type UnknownScopeError struct {
+	Scope string
+}
+
+func (e *UnknownScopeError) Error() string {
+	return fmt.Sprintf("unknown scope: %s", e.Scope)
+}
+
+// ScopeCacheInvalidator drops cached user scopes after role assignments or role scopes change.
+type ScopeCacheInvalidator interface {
+	InvalidateUser(userID string)
+	InvalidateAllUsers()
+}
+
+type RoleInfo struct {
+	ID          int      `json:"id"`
+	Description string   `json:"description"`
+	Scopes      []string `json:"scopes"`
+}
+
+type RoleManager struct {
+	dbConn           *gorm.DB
+	scopeRegistry    bizscope.ScopeRegistry
+	scopeInvalidator ScopeCacheInvalidator
+}
+
+func NewRoleManager(dbConn *gorm.DB, scopeRegistry bizscope.ScopeRegistry, scopeInvalidator ScopeCacheInvalidator) *RoleManager {
+	return &RoleManager{
+		dbConn:           dbConn,
+		scopeRegistry:    scopeRegistry,
+		scopeInvalidator: scopeInvalidator,
+	}
+}
+
+func (m *RoleManager) ListRoles(ctx context.Context) ([]*RoleInfo, error) {
+	var roles []db.Role
+	if err := m.dbConn.WithContext(ctx).Order("id").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+
+	var roleScopes []db.RoleScope
+	if err := m.dbConn.WithContext(ctx).Order("scope").Find(&roleScopes).Error; err != nil {
+		return nil, err
+	}
+
+	infos := make([]*RoleInfo, 0, len(roles))
+	infoByID := make(map[int]*RoleInfo)
+	for _, role := range roles {
+		info := &RoleInfo{ID: role.ID, Description: role.Description, Scopes: []string{}}
+		infos = append(infos, info)
+		infoByID[role.ID] = info
+	}
+	for _, roleScope := range roleScopes {
+		if info, ok := infoByID[roleScope.RoleID]; ok {
+			info.Scopes = append(info.Scopes, roleScope.Scope)
+		}
+	}
+
+	return infos, nil
+}
+
+func (m *RoleManager) GetRole(ctx context.Context, roleID int) (*RoleInfo, error) {
+	return m.getRole(m.dbConn.WithContext(ctx), roleID)
+}
+
+func (m *RoleManager) getRole(tx *gorm.DB, roleID int) (*RoleInfo, error) {
+	var role db.Role
+	err := tx.Where("id = ?", roleID).First(&role).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := []string{}
+	if err := tx.Model(&db.RoleScope{}).Where("role_id = ?", roleID).Order("scope").Pluck("scope", &scopes).Error; err != nil {
+		return nil, err
+	}
+
+	return &RoleInfo{ID: role.ID, Description: role.Description, Scopes: scopes}, nil
+}
+
+// CreateRole creates a role granting the given scopes. Every scope must be registered.
+func (m *RoleManager) CreateRole(ctx context.Context, description string, scopes []string) (*RoleInfo, error) {
+	if err := m.validateScopes(ctx, scopes); err != nil {
+		return nil, err
+	}
+
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	if err := m.checkDescriptionAvailable(tx, description, 0); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	role := db.Role{Description: description}
+	if err := tx.Create(&role).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := addRoleScopes(tx, role.ID, scopes); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	info, err := m.getRole(tx, role.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return info, tx.Commit().Error
+}
+
+func (m *RoleManager) UpdateRole(ctx context.Context, roleID int, description string) (*RoleInfo, error) {
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	if err := m.checkDescriptionAvailable(tx, description, roleID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	result := tx.Model(&db.Role{}).Where("id = ?", roleID).Update("description", description)
+	if result.Error != nil {
+		tx.Rollback()
+		return nil, result.Error
+	}
+
+	// getRole also reports a missing role when the description was unchanged and no row was affected.
+	info, err := m.getRole(tx, roleID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return info, tx.Commit().Error
+}
+
+// DeleteRole deletes the role together with its scopes and user assignments.
+func (m *RoleManager) DeleteRole(ctx context.Context, roleID int) error {
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	if _, err := m.getRole(tx, roleID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// ScopeAuthority does not filter soft deleted rows, so role scopes and user roles are removed for good.
+	if err := tx.Unscoped().Where("role_id = ?", roleID).Delete(&db.RoleScope{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Unscoped().Where("role_id = ?", roleID).Delete(&db.UserRole{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("id = ?", roleID).Delete(&db.Role{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := bizuser.EnsureAdminRemains(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	m.scopeInvalidator.InvalidateAllUsers()
+
+	return nil
+}
+
+// AddRoleScopes grants additional scopes to the role. Scopes the role already has are ignored.
+func (m *RoleManager) AddRoleScopes(ctx context.Context, roleID int, scopes []string) (*RoleInfo, error) {
+	if err := m.validateScopes(ctx, scopes); err != nil {
+		return nil, err
+	}
+
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	if _, err := m.getRole(tx, roleID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := addRoleScopes(tx, roleID, scopes); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	info, err := m.getRole(tx, roleID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	m.scopeInvalidator.InvalidateAllUsers()
+
+	return info, nil
+}
+
+func (m *RoleManager) RemoveRoleScope(ctx context.Context, roleID int, scope string) (*RoleInfo, error) {
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	if _, err := m.getRole(tx, roleID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Unscoped().Where("role_id = ? AND scope = ?", roleID, scope).Delete(&db.RoleScope{}).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if scope == AdminScope {
+		if err := bizuser.EnsureAdminRemains(tx); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	info, err := m.getRole(tx, roleID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	m.scopeInvalidator.InvalidateAllUsers()
+
+	return info, nil
+}
+
+// GetUserRoles returns the roles assigned to the user.
+func (m *RoleManager) GetUserRoles(ctx context.Context, userID string) ([]*RoleInfo, error) {
+	if err := checkUserExists(m.dbConn.WithContext(ctx), userID); err != nil {
+		return nil, err
+	}
+
+	roleIDs := []int{}
+	err := m.dbConn.WithContext(ctx).Model(&db.UserRole{}).Where("user_id = ?", userID).Order("role_id").Pluck("role_id", &roleIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make([]*RoleInfo, 0, len(roleIDs))
+	for _, roleID := range roleIDs {
+		role, err := m.GetRole(ctx, roleID)
+		if errors.Is(err, ErrRoleNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+func (m *RoleManager) AssignRole(ctx context.Context, userID string, roleID int) error {
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	if err := checkUserExists(tx, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := m.getRole(tx, roleID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var count int64
+	if err := tx.Model(&db.UserRole{}).Where("user_id = ? AND role_id = ?", userID, roleID).Count(&count).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count > 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	if err := tx.Create(&db.UserRole{UserID: userID, RoleID: roleID}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	m.scopeInvalidator.InvalidateUser(userID)
+
+	return nil
+}
+
+func (m *RoleManager) UnassignRole(ctx context.Context, userID string, roleID int) error {
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	if err := checkUserExists(tx, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := m.getRole(tx, roleID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Unscoped().Where("user_id = ? AND role_id = ?", userID, roleID).Delete(&db.UserRole{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := bizuser.EnsureAdminRemains(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	m.scopeInvalidator.InvalidateUser(userID)
+
+	return nil
+}
+
+func (m *RoleManager) validateScopes(ctx context.Context, scopes []string) error {
+	for _, scope := range scopes {
+		ok, err := m.scopeRegistry.IsRegistered(ctx, scope)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &UnknownScopeError{Scope: scope}
+		}
+	}
+	return nil
+}
+
+// checkDescriptionAvailable fails when another role than excludeID already uses the description, as the local dev
+// seeding looks roles up by description.
+func (m *RoleManager) checkDescriptionAvailable(tx *gorm.DB, description string, excludeID int) error {
+	var count int64
+	if err := tx.Model(&db.Role{}).Where("description = ? AND id <> ?", description, excludeID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrRoleExists
+	}
+	return nil
+}
+
+func addRoleScopes(tx *gorm.DB, roleID int, scopes []string) error {
+	for _, scope := range scopes {
+		var count int64
+		if err := tx.Model(&db.RoleScope{}).Where("role_id = ? AND scope = ?", roleID, scope).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		if err := tx.Create(&db.RoleScope{RoleID: roleID, Scope: scope}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkUserExists(tx *gorm.DB, userID string) error {
+	var count int64
+	if err := tx.Model(&db.User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return bizuser.ErrUserNotFound
+	}
+	return nil
+}
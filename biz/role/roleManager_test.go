@@ -0,0 +1,192 @@
+package bizrole
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	bizaccount "netherealmstudio.com/m/v2/biz/account"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	bizuser "netherealmstudio.com/m/v2/biz/user"
+	dbmodel "netherealmstudio.com/m/v2/db"
+	"netherealmstudio.com/m/v2/mailer"
+)
+
+const adminPassword = "adminpassword123"
+
+type fakeScopeInvalidator struct {
+	users    []string
+	allUsers int
+}
+
+func (f *fakeScopeInvalidator) InvalidateUser(userID string) {
+	f.users = append(f.users, userID)
+}
+
+func (f *fakeScopeInvalidator) InvalidateAllUsers() {
+	f.allUsers++
+}
+
+type fakeTokenRevoker struct {
+}
+
+func (f *fakeTokenRevoker) RemoveByUserID(ctx context.Context, userID string) error {
+	return nil
+}
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	dsn := "ai_shopper_dev:password@tcp(localhost:4306)/test_db?parseTime=True"
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+
+	err = db.Migrator().DropTable(&dbmodel.UserRole{}, &dbmodel.RoleScope{}, &dbmodel.Role{}, &dbmodel.UserStatusChange{}, &dbmodel.EmailVerification{}, &dbmodel.User{})
+	require.NoError(t, err)
+
+	err = db.AutoMigrate(&dbmodel.User{}, &dbmodel.Role{}, &dbmodel.RoleScope{}, &dbmodel.UserRole{}, &dbmodel.UserStatusChange{}, &dbmodel.EmailVerification{})
+	require.NoError(t, err)
+
+	hashedAdminPassword, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	users := []dbmodel.User{
+		{ID: "admin_user", Email: "admin@example.com", Password: string(hashedAdminPassword), IsActive: true},
+		{ID: "regular_user", Email: "user@example.com", Password: "hashed_password", IsActive: true},
+	}
+	for _, user := range users {
+		require.NoError(t, db.Create(&user).Error)
+	}
+
+	require.NoError(t, db.Create(&dbmodel.Role{ID: 1, Description: "admin"}).Error)
+	require.NoError(t, db.Create(&dbmodel.RoleScope{RoleID: 1, Scope: "admin"}).Error)
+	require.NoError(t, db.Create(&dbmodel.UserRole{UserID: "admin_user", RoleID: 1}).Error)
+
+	return db
+}
+
+func TestRoleManager(t *testing.T) {
+	db := setupTestDB(t)
+	invalidator := &fakeScopeInvalidator{}
+	manager := NewRoleManager(db, bizscope.NewStaticScopeRegistry([]*bizscope.ScopeDefinition{{Name: "admin"}, {Name: "profile"}, {Name: "search"}}), invalidator)
+	ctx := context.Background()
+
+	var roleID int
+
+	t.Run("CreateRole", func(t *testing.T) {
+		role, err := manager.CreateRole(ctx, "regular users", []string{"search", "profile"})
+		require.NoError(t, err)
+		assert.Equal(t, "regular users", role.Description)
+		assert.Equal(t, []string{"profile", "search"}, role.Scopes)
+		roleID = role.ID
+	})
+
+	t.Run("CreateRoleDuplicateDescription", func(t *testing.T) {
+		_, err := manager.CreateRole(ctx, "regular users", nil)
+		assert.ErrorIs(t, err, ErrRoleExists)
+	})
+
+	t.Run("CreateRoleUnknownScope", func(t *testing.T) {
+		_, err := manager.CreateRole(ctx, "billing", []string{"billing"})
+		var unknownScope *UnknownScopeError
+		require.ErrorAs(t, err, &unknownScope)
+		assert.Equal(t, "billing", unknownScope.Scope)
+	})
+
+	t.Run("UpdateRole", func(t *testing.T) {
+		role, err := manager.UpdateRole(ctx, roleID, "members")
+		require.NoError(t, err)
+		assert.Equal(t, "members", role.Description)
+
+		_, err = manager.UpdateRole(ctx, 999, "missing")
+		assert.ErrorIs(t, err, ErrRoleNotFound)
+	})
+
+	t.Run("AddAndRemoveRoleScopes", func(t *testing.T) {
+		role, err := manager.AddRoleScopes(ctx, roleID, []string{"admin", "profile"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"admin", "profile", "search"}, role.Scopes)
+
+		role, err = manager.RemoveRoleScope(ctx, roleID, "admin")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"profile", "search"}, role.Scopes)
+		assert.Equal(t, 2, invalidator.allUsers)
+	})
+
+	t.Run("AssignRole", func(t *testing.T) {
+		require.NoError(t, manager.AssignRole(ctx, "regular_user", roleID))
+		require.NoError(t, manager.AssignRole(ctx, "regular_user", roleID))
+
+		roles, err := manager.GetUserRoles(ctx, "regular_user")
+		require.NoError(t, err)
+		require.Len(t, roles, 1)
+		assert.Equal(t, roleID, roles[0].ID)
+		assert.Contains(t, invalidator.users, "regular_user")
+
+		assert.ErrorIs(t, manager.AssignRole(ctx, "missing_user", roleID), bizuser.ErrUserNotFound)
+		assert.ErrorIs(t, manager.AssignRole(ctx, "regular_user", 999), ErrRoleNotFound)
+	})
+
+	t.Run("LastAdmin", func(t *testing.T) {
+		assert.ErrorIs(t, manager.UnassignRole(ctx, "admin_user", 1), ErrLastAdmin)
+
+		_, err := manager.RemoveRoleScope(ctx, 1, "admin")
+		assert.ErrorIs(t, err, ErrLastAdmin)
+
+		assert.ErrorIs(t, manager.DeleteRole(ctx, 1), ErrLastAdmin)
+
+		userManager := bizuser.NewUserManager(db, &fakeTokenRevoker{})
+		assert.ErrorIs(t, userManager.DeactivateUser(ctx, "admin_user", "admin_user", "leaving"), ErrLastAdmin)
+
+		passwordHasher, err := bizpassword.NewPasswordHasher(bizpassword.AlgorithmBcrypt, bizpassword.NewBcryptAlgorithm(bcrypt.MinCost))
+		require.NoError(t, err)
+		accountManager := bizaccount.NewAccountManager(db, bizpassword.NewPolicy(bizpassword.PolicyConfig{}, nil), passwordHasher,
+			&fakeTokenRevoker{}, invalidator, mailer.NewLogMailer(), "http://localhost:3000/verify-email", time.Hour)
+		assert.ErrorIs(t, accountManager.DeleteAccount(ctx, "admin_user", adminPassword), ErrLastAdmin)
+
+		var admin dbmodel.User
+		require.NoError(t, db.Where("id = ?", "admin_user").First(&admin).Error)
+		assert.True(t, admin.IsActive)
+
+		roles, err := manager.GetUserRoles(ctx, "admin_user")
+		require.NoError(t, err)
+		require.Len(t, roles, 1)
+		assert.Equal(t, []string{"admin"}, roles[0].Scopes)
+	})
+
+	t.Run("UnassignAdminWithAnotherAdmin", func(t *testing.T) {
+		require.NoError(t, manager.AssignRole(ctx, "regular_user", 1))
+		assert.NoError(t, manager.UnassignRole(ctx, "admin_user", 1))
+	})
+
+	t.Run("DeleteRole", func(t *testing.T) {
+		// The role has a fixture of its own, assigned to the only remaining admin.
+		role, err := manager.CreateRole(ctx, "guests", []string{"search"})
+		require.NoError(t, err)
+		require.NoError(t, manager.AssignRole(ctx, "regular_user", role.ID))
+
+		require.NoError(t, manager.DeleteRole(ctx, role.ID))
+
+		_, err = manager.GetRole(ctx, role.ID)
+		assert.ErrorIs(t, err, ErrRoleNotFound)
+
+		var count int64
+		require.NoError(t, db.Unscoped().Model(&dbmodel.UserRole{}).Where("role_id = ?", role.ID).Count(&count).Error)
+		assert.Zero(t, count)
+	})
+
+	t.Run("ListRoles", func(t *testing.T) {
+		roles, err := manager.ListRoles(ctx)
+		require.NoError(t, err)
+		require.Len(t, roles, 2)
+		assert.Equal(t, "admin", roles[0].Description)
+		assert.Equal(t, "members", roles[1].Description)
+	})
+}
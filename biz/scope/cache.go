@@ -0,0 +1,135 @@
+package bizscope
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sweepThreshold is the number of entries above which expired entries are swept when a new entry is stored.
+const sweepThreshold = 10000
+
+type scopeSet struct {
+	scopes        []string
+	defaultScopes []string
+	expiresAt     time.Time
+}
+
+type ScopeCacheStats struct {
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+	Clients  int     `json:"clients"`
+	Users    int     `json:"users"`
+}
+
+// ScopeCache is a read-through cache of the scopes held by API clients and users. Entries expire after the TTL, and
+// are dropped earlier through the Invalidate methods whenever roles, role scopes or client scopes change. A TTL of
+// zero disables caching.
+type ScopeCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	clients map[string]*scopeSet
+	users   map[string]*scopeSet
+	// generation is bumped by every invalidation so that a lookup racing with an invalidation does not store the
+	// scopes it loaded before the change.
+	generation uint64
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+func NewScopeCache(ttl time.Duration) *ScopeCache {
+	return &ScopeCache{
+		ttl:     ttl,
+		clients: make(map[string]*scopeSet),
+		users:   make(map[string]*scopeSet),
+	}
+}
+
+func (c *ScopeCache) getClient(clientID string, load func() (*scopeSet, error)) (*scopeSet, error) {
+	return c.get(c.clients, clientID, load)
+}
+
+func (c *ScopeCache) getUser(userID string, load func() (*scopeSet, error)) (*scopeSet, error) {
+	return c.get(c.users, userID, load)
+}
+
+func (c *ScopeCache) get(entries map[string]*scopeSet, key string, load func() (*scopeSet, error)) (*scopeSet, error) {
+	now := time.Now()
+
+	c.mu.RLock()
+	entry, ok := entries[key]
+	generation := c.generation
+	c.mu.RUnlock()
+
+	if ok && now.Before(entry.expiresAt) {
+		c.hits.Add(1)
+		return entry, nil
+	}
+	c.misses.Add(1)
+
+	entry, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if c.ttl <= 0 {
+		return entry, nil
+	}
+	entry.expiresAt = now.Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return entry, nil
+	}
+	if len(entries) >= sweepThreshold {
+		for k, e := range entries {
+			if !now.Before(e.expiresAt) {
+				delete(entries, k)
+			}
+		}
+	}
+	entries[key] = entry
+
+	return entry, nil
+}
+
+// InvalidateClient drops the cached scopes of an API client after its scopes changed.
+func (c *ScopeCache) InvalidateClient(clientID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	delete(c.clients, clientID)
+}
+
+// InvalidateUser drops the cached scopes of a user after roles were assigned to or removed from them.
+func (c *ScopeCache) InvalidateUser(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	delete(c.users, userID)
+}
+
+// InvalidateAllUsers drops the cached scopes of every user after a role or its scopes changed.
+func (c *ScopeCache) InvalidateAllUsers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	clear(c.users)
+}
+
+func (c *ScopeCache) Stats() ScopeCacheStats {
+	c.mu.RLock()
+	stats := ScopeCacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Clients: len(c.clients),
+		Users:   len(c.users),
+	}
+	c.mu.RUnlock()
+
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,101 @@
+package bizscope
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScopeCache(t *testing.T) {
+	loads := 0
+	load := func() (*scopeSet, error) {
+		loads++
+		return &scopeSet{scopes: []string{"profile"}}, nil
+	}
+
+	t.Run("ReadThrough", func(t *testing.T) {
+		cache := NewScopeCache(time.Minute)
+		loads = 0
+
+		set, err := cache.getUser("user_1", load)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"profile"}, set.scopes)
+
+		_, err = cache.getUser("user_1", load)
+		require.NoError(t, err)
+		_, err = cache.getClient("user_1", load)
+		require.NoError(t, err)
+		assert.Equal(t, 2, loads)
+
+		stats := cache.Stats()
+		assert.Equal(t, uint64(1), stats.Hits)
+		assert.Equal(t, uint64(2), stats.Misses)
+		assert.InDelta(t, 1.0/3.0, stats.HitRatio, 0.0001)
+		assert.Equal(t, 1, stats.Users)
+		assert.Equal(t, 1, stats.Clients)
+	})
+
+	t.Run("Invalidate", func(t *testing.T) {
+		cache := NewScopeCache(time.Minute)
+		loads = 0
+
+		cache.getUser("user_1", load)
+		cache.getClient("client_1", load)
+		cache.InvalidateUser("user_1")
+		cache.getUser("user_1", load)
+		assert.Equal(t, 3, loads)
+
+		cache.InvalidateAllUsers()
+		cache.getUser("user_1", load)
+		cache.getClient("client_1", load)
+		assert.Equal(t, 4, loads)
+
+		cache.InvalidateClient("client_1")
+		cache.getClient("client_1", load)
+		assert.Equal(t, 5, loads)
+	})
+
+	t.Run("InvalidationDuringLoad", func(t *testing.T) {
+		cache := NewScopeCache(time.Minute)
+
+		_, err := cache.getUser("user_1", func() (*scopeSet, error) {
+			cache.InvalidateUser("user_1")
+			return &scopeSet{scopes: []string{"stale"}}, nil
+		})
+		require.NoError(t, err)
+		assert.Zero(t, cache.Stats().Users)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		cache := NewScopeCache(time.Millisecond)
+		loads = 0
+
+		cache.getUser("user_1", load)
+		time.Sleep(5 * time.Millisecond)
+		cache.getUser("user_1", load)
+		assert.Equal(t, 2, loads)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		cache := NewScopeCache(0)
+		loads = 0
+
+		cache.getUser("user_1", load)
+		cache.getUser("user_1", load)
+		assert.Equal(t, 2, loads)
+		assert.Zero(t, cache.Stats().Users)
+	})
+
+	t.Run("LoadError", func(t *testing.T) {
+		cache := NewScopeCache(time.Minute)
+
+		_, err := cache.getUser("user_1", func() (*scopeSet, error) {
+			return nil, errors.New("db down")
+		})
+		assert.Error(t, err)
+		assert.Zero(t, cache.Stats().Users)
+	})
+}
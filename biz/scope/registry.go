@@ -0,0 +1,118 @@
+package bizscope
+
+import (
+	"context"
+	"sort"
+
+	"gorm.io/gorm"
+	dbmodel "netherealmstudio.com/m/v2/db"
+)
+
+// ScopeDefinition describes a scope. A scope is implied by each of its parents, e.g. holding "shoplist" grants
+// "shoplist:read" when "shoplist" is a parent of "shoplist:read".
+type ScopeDefinition struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	ConsentText string   `json:"consent_text"`
+	Parents     []string `json:"parents"`
+}
+
+// ScopeRegistry knows every scope that roles and API clients may be granted.
+type ScopeRegistry interface {
+	IsRegistered(ctx context.Context, scope string) (bool, error)
+	ListScopes(ctx context.Context) ([]*ScopeDefinition, error)
+	// Expand returns the scopes together with every scope they imply, directly or transitively.
+	Expand(scopes []string) []string
+}
+
+// StaticScopeRegistry is a ScopeRegistry backed by a snapshot of scope definitions loaded at startup, so that
+// expanding the scopes of every verified token does not hit the database.
+type StaticScopeRegistry struct {
+	definitions map[string]*ScopeDefinition
+	children    map[string][]string
+}
+
+func NewStaticScopeRegistry(definitions []*ScopeDefinition) *StaticScopeRegistry {
+	registry := &StaticScopeRegistry{
+		definitions: make(map[string]*ScopeDefinition),
+		children:    make(map[string][]string),
+	}
+	for _, definition := range definitions {
+		if definition.Name == "" {
+			continue
+		}
+		registry.definitions[definition.Name] = definition
+		for _, parent := range definition.Parents {
+			registry.children[parent] = append(registry.children[parent], definition.Name)
+		}
+	}
+	return registry
+}
+
+// LoadScopeRegistry reads the scope definitions and their parents from the database.
+func LoadScopeRegistry(ctx context.Context, dbConn *gorm.DB) (*StaticScopeRegistry, error) {
+	var scopes []dbmodel.Scope
+	if err := dbConn.WithContext(ctx).Find(&scopes).Error; err != nil {
+		return nil, err
+	}
+
+	var scopeParents []dbmodel.ScopeParent
+	if err := dbConn.WithContext(ctx).Find(&scopeParents).Error; err != nil {
+		return nil, err
+	}
+
+	parents := make(map[string][]string)
+	for _, scopeParent := range scopeParents {
+		parents[scopeParent.Scope] = append(parents[scopeParent.Scope], scopeParent.Parent)
+	}
+
+	definitions := make([]*ScopeDefinition, 0, len(scopes))
+	for _, scope := range scopes {
+		definitions = append(definitions, &ScopeDefinition{
+			Name:        scope.Name,
+			Description: scope.Description,
+			ConsentText: scope.ConsentText,
+			Parents:     parents[scope.Name],
+		})
+	}
+
+	return NewStaticScopeRegistry(definitions), nil
+}
+
+func (r *StaticScopeRegistry) IsRegistered(ctx context.Context, scope string) (bool, error) {
+	_, ok := r.definitions[scope]
+	return ok, nil
+}
+
+func (r *StaticScopeRegistry) ListScopes(ctx context.Context) ([]*ScopeDefinition, error) {
+	definitions := make([]*ScopeDefinition, 0, len(r.definitions))
+	for _, definition := range r.definitions {
+		definitions = append(definitions, definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Name < definitions[j].Name
+	})
+	return definitions, nil
+}
+
+// Expand keeps unregistered scopes as they are, so tokens issued before a scope was registered stay valid.
+func (r *StaticScopeRegistry) Expand(scopes []string) []string {
+	seen := make(map[string]bool)
+	expanded := make([]string, 0, len(scopes))
+
+	pending := append([]string{}, scopes...)
+	for len(pending) > 0 {
+		scope := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if scope == "" || seen[scope] {
+			continue
+		}
+
+		seen[scope] = true
+		expanded = append(expanded, scope)
+		pending = append(pending, r.children[scope]...)
+	}
+
+	sort.Strings(expanded)
+	return expanded
+}
@@ -0,0 +1,49 @@
+package bizscope
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticScopeRegistry(t *testing.T) {
+	registry := NewStaticScopeRegistry([]*ScopeDefinition{
+		{Name: "admin"},
+		{Name: "profile"},
+		{Name: "shoplist"},
+		{Name: "shoplist:read", Parents: []string{"shoplist"}},
+		{Name: "shoplist:items:read", Parents: []string{"shoplist:read"}},
+		// A cycle must not make expansion loop forever.
+		{Name: "cycle:a", Parents: []string{"cycle:b"}},
+		{Name: "cycle:b", Parents: []string{"cycle:a"}},
+	})
+	ctx := context.Background()
+
+	t.Run("IsRegistered", func(t *testing.T) {
+		ok, err := registry.IsRegistered(ctx, "shoplist:read")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = registry.IsRegistered(ctx, "billing")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("ListScopes", func(t *testing.T) {
+		scopes, err := registry.ListScopes(ctx)
+		require.NoError(t, err)
+		require.Len(t, scopes, 7)
+		assert.Equal(t, "admin", scopes[0].Name)
+		assert.Equal(t, []string{"shoplist"}, scopes[6].Parents)
+	})
+
+	t.Run("Expand", func(t *testing.T) {
+		assert.Equal(t, []string{"profile", "shoplist", "shoplist:items:read", "shoplist:read"}, registry.Expand([]string{"shoplist", "profile"}))
+		assert.Equal(t, []string{"shoplist:items:read", "shoplist:read"}, registry.Expand([]string{"shoplist:read"}))
+		assert.Equal(t, []string{"cycle:a", "cycle:b"}, registry.Expand([]string{"cycle:a"}))
+		assert.Equal(t, []string{"unregistered"}, registry.Expand([]string{"unregistered"}))
+		assert.Empty(t, registry.Expand([]string{""}))
+	})
+}
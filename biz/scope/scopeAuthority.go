@@ -6,59 +6,158 @@ import (
 	"strings"
 
 	"github.com/kdjuwidja/aishoppercommon/logger"
+	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/gorm"
+	"netherealmstudio.com/m/v2/metrics"
+	"netherealmstudio.com/m/v2/tracing"
 )
 
 type ScopeAuthority struct {
-	dbConn *gorm.DB
+	dbConn         *gorm.DB
+	scopeRegistry  ScopeRegistry
+	scopeCache     *ScopeCache
+	allowDownscope bool
 }
 
-func NewScopeAuthority(dbConn *gorm.DB) *ScopeAuthority {
+// NewScopeAuthority creates a ScopeAuthority. When allowDownscope is set, a request for scopes that are only partially
+// permitted is granted the permitted subset instead of being rejected.
+func NewScopeAuthority(dbConn *gorm.DB, scopeRegistry ScopeRegistry, scopeCache *ScopeCache, allowDownscope bool) *ScopeAuthority {
 	return &ScopeAuthority{
-		dbConn: dbConn,
+		dbConn:         dbConn,
+		scopeRegistry:  scopeRegistry,
+		scopeCache:     scopeCache,
+		allowDownscope: allowDownscope,
 	}
 }
 
-func (s *ScopeAuthority) AuthorizeScope(ctx context.Context, apiClientID string, userID string, requestedScope string) error {
-	if requestedScope == "" {
-		return nil
+func (s *ScopeAuthority) loadAPIClientScopes(ctx context.Context, apiClientID string) (*scopeSet, error) {
+	rows := []struct {
+		Scope     string
+		IsDefault bool
+	}{}
+	err := s.dbConn.WithContext(ctx).Raw("SELECT DISTINCT scope, is_default FROM api_clients INNER JOIN api_client_scopes ON api_clients.id = api_client_scopes.api_client_id WHERE api_client_id = ?", apiClientID).Scan(&rows).Error
+	if err != nil {
+		return nil, err
 	}
 
-	apiClientScopes := []string{}
-	err := s.dbConn.WithContext(ctx).Raw("SELECT DISTINCT(scope) FROM api_clients INNER JOIN api_client_scopes ON api_clients.id = api_client_scopes.api_client_id WHERE api_client_id = ?", apiClientID).Scan(&apiClientScopes).Error
+	set := &scopeSet{scopes: []string{}, defaultScopes: []string{}}
+	for _, row := range rows {
+		set.scopes = append(set.scopes, row.Scope)
+		if row.IsDefault {
+			set.defaultScopes = append(set.defaultScopes, row.Scope)
+		}
+	}
+	return set, nil
+}
+
+func (s *ScopeAuthority) loadUserScopes(ctx context.Context, userID string) (*scopeSet, error) {
+	userScopes := []string{}
+	err := s.dbConn.WithContext(ctx).Raw("SELECT DISTINCT(scope) FROM role_scopes INNER JOIN (SELECT user_id, role_id FROM user_roles WHERE user_id = ?) as tbl1 ON role_scopes.role_id = tbl1.role_id", userID).Scan(&userScopes).Error
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &scopeSet{scopes: userScopes}, nil
+}
+
+// AuthorizeScope returns the space separated scope to grant for the request. An empty request is granted the client's
+// default scopes that the user holds.
+func (s *ScopeAuthority) AuthorizeScope(ctx context.Context, apiClientID string, userID string, requestedScope string) (string, error) {
+	ctx, span := tracing.Start(ctx, "ScopeAuthority.AuthorizeScope",
+		attribute.String("client_id", apiClientID),
+		attribute.String("scope.requested", requestedScope))
+	granted, err := s.authorizeScope(ctx, apiClientID, userID, requestedScope)
+	span.SetAttributes(attribute.String("scope.granted", granted))
+	tracing.End(span, err)
+	return granted, err
+}
+
+func (s *ScopeAuthority) authorizeScope(ctx context.Context, apiClientID string, userID string, requestedScope string) (string, error) {
+	apiClientSet, err := s.scopeCache.getClient(apiClientID, func() (*scopeSet, error) {
+		return s.loadAPIClientScopes(ctx, apiClientID)
+	})
+	if err != nil {
+		return "", err
+	}
+	apiClientScopes := apiClientSet.scopes
 	if len(apiClientScopes) == 0 {
 		logger.Errorf("api client does not have any scopes, apiClientID: %s", apiClientID)
-		return fmt.Errorf("the requested scope is invalid, unknown, or malformed")
+		metrics.ScopeDenied(metrics.ScopeDeniedClientHasNoScopes)
+		return "", fmt.Errorf("the requested scope is invalid, unknown, or malformed")
 	}
 
-	userScopes := []string{}
-	err = s.dbConn.WithContext(ctx).Raw("SELECT DISTINCT(scope) FROM role_scopes INNER JOIN (SELECT user_id, role_id FROM user_roles WHERE user_id = ?) as tbl1 ON role_scopes.role_id = tbl1.role_id", userID).Scan(&userScopes).Error
+	userSet, err := s.scopeCache.getUser(userID, func() (*scopeSet, error) {
+		return s.loadUserScopes(ctx, userID)
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
+	userScopes := userSet.scopes
 	if len(userScopes) == 0 {
 		logger.Errorf("user does not have any scopes, userID: %s", userID)
-		return fmt.Errorf("the requested scope is invalid, unknown, or malformed")
+		metrics.ScopeDenied(metrics.ScopeDeniedUserHasNoScopes)
+		return "", fmt.Errorf("the requested scope is invalid, unknown, or malformed")
 	}
 
-	rs := strings.Split(requestedScope, " ")
+	// A scope granted to the user or client also grants every scope it implies.
+	userScopes = s.scopeRegistry.Expand(userScopes)
+	apiClientScopes = s.scopeRegistry.Expand(apiClientScopes)
+
+	if strings.TrimSpace(requestedScope) == "" {
+		defaultScopes := apiClientSet.defaultScopes
+		granted := intersect(defaultScopes, userScopes)
+		if len(granted) == 0 {
+			logger.Errorf("user does not have any of the default scopes, apiClientID: %s, userID: %s, defaultScopes: %v", apiClientID, userID, defaultScopes)
+			metrics.ScopeDenied(metrics.ScopeDeniedNoDefaultScope)
+			return "", fmt.Errorf("the requested scope is invalid, unknown, or malformed")
+		}
+		return strings.Join(granted, " "), nil
+	}
+
+	rs := strings.Fields(requestedScope)
 
 	// Check if requestedScopes is a subset of userScopes
-	if !isSubset(rs, userScopes) {
+	if !isSubset(rs, userScopes) && !s.allowDownscope {
 		logger.Errorf("user does not have all requested scopes, userID: %s, requestedScope: %s, userScopes: %v", userID, requestedScope, userScopes)
-		return fmt.Errorf("the requested scope is invalid, unknown, or malformed")
+		metrics.ScopeDenied(metrics.ScopeDeniedUserLacksScope)
+		return "", fmt.Errorf("the requested scope is invalid, unknown, or malformed")
 	}
 
 	// Check if requestedScopes is a subset of apiClientScopes
-	if !isSubset(rs, apiClientScopes) {
+	if !isSubset(rs, apiClientScopes) && !s.allowDownscope {
 		logger.Errorf("api client does not have all requested scopes, apiClientID: %s, requestedScope: %s, apiClientScopes: %v", apiClientID, requestedScope, apiClientScopes)
-		return fmt.Errorf("the requested scope is invalid, unknown, or malformed")
+		metrics.ScopeDenied(metrics.ScopeDeniedClientLacksScope)
+		return "", fmt.Errorf("the requested scope is invalid, unknown, or malformed")
+	}
+
+	granted := intersect(intersect(rs, userScopes), apiClientScopes)
+	if len(granted) == 0 {
+		logger.Errorf("none of the requested scopes can be granted, apiClientID: %s, userID: %s, requestedScope: %s", apiClientID, userID, requestedScope)
+		metrics.ScopeDenied(metrics.ScopeDeniedNothingGranted)
+		return "", fmt.Errorf("the requested scope is invalid, unknown, or malformed")
+	}
+	if len(granted) < len(rs) {
+		logger.Infof("downscoped request, apiClientID: %s, userID: %s, requestedScope: %s, grantedScope: %v", apiClientID, userID, requestedScope, granted)
 	}
 
-	return nil
+	return strings.Join(granted, " "), nil
+}
+
+// intersect returns the elements of a that are present in b, in the order of a and without duplicates
+func intersect(a, b []string) []string {
+	bMap := make(map[string]bool)
+	for _, s := range b {
+		bMap[s] = true
+	}
+
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, s := range a {
+		if bMap[s] && !seen[s] {
+			result = append(result, s)
+			seen[s] = true
+		}
+	}
+	return result
 }
 
 // isSubset checks if all elements in subset are present in superset
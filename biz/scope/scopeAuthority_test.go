@@ -3,8 +3,10 @@ package bizscope
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -151,6 +153,7 @@ func createTestData(db *gorm.DB) error {
 		{
 			APIClientID: "test_client_1",
 			Scope:       "profile",
+			IsDefault:   true,
 		},
 		{
 			APIClientID: "test_client_1",
@@ -183,7 +186,15 @@ func TestScopeAuthority(t *testing.T) {
 	err := createTestData(db)
 	assert.NoError(t, err)
 
-	scopeAuth := NewScopeAuthority(db)
+	scopeRegistry := NewStaticScopeRegistry([]*ScopeDefinition{
+		{Name: "profile"},
+		{Name: "shoplist"},
+		{Name: "shoplist:read", Parents: []string{"shoplist"}},
+		{Name: "search"},
+		{Name: "search:read", Parents: []string{"search"}},
+	})
+	scopeCache := NewScopeCache(time.Minute)
+	scopeAuth := NewScopeAuthority(db, scopeRegistry, scopeCache, false)
 
 	tests := []struct {
 		name           string
@@ -191,6 +202,7 @@ func TestScopeAuthority(t *testing.T) {
 		userID         string
 		requestedScope string
 		wantErr        bool
+		wantScope      string
 		description    string
 	}{
 		{
@@ -225,13 +237,38 @@ func TestScopeAuthority(t *testing.T) {
 			wantErr:        true,
 			description:    "Client 2 requesting scope it doesn't have",
 		},
+		{
+			name:           "Implied scope granted by parent",
+			apiClientID:    "test_client_1",
+			userID:         "test_user_2",
+			requestedScope: "profile shoplist:read",
+			wantErr:        false,
+			description:    "shoplist held by both user and client implies shoplist:read",
+		},
+		{
+			name:           "Implied scope not granted to user",
+			apiClientID:    "test_client_1",
+			userID:         "test_user_2",
+			requestedScope: "search:read",
+			wantErr:        true,
+			description:    "User 2 does not hold search, so search:read is not implied",
+		},
 		{
 			name:           "Empty scope string",
 			apiClientID:    "test_client_1",
 			userID:         "test_user_1",
 			requestedScope: "",
 			wantErr:        false,
-			description:    "Empty scope string is valid - no special permissions requested",
+			wantScope:      "profile",
+			description:    "Empty scope string is granted the client's default scopes held by the user",
+		},
+		{
+			name:           "Empty scope string without default scopes",
+			apiClientID:    "test_client_2",
+			userID:         "test_user_1",
+			requestedScope: "",
+			wantErr:        true,
+			description:    "Empty scope string fails when the client has no default scopes",
 		},
 		{
 			name:           "Non-existent user",
@@ -277,12 +314,41 @@ func TestScopeAuthority(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := scopeAuth.AuthorizeScope(context.Background(), tt.apiClientID, tt.userID, tt.requestedScope)
+			grantedScope, err := scopeAuth.AuthorizeScope(context.Background(), tt.apiClientID, tt.userID, tt.requestedScope)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
+				if tt.wantScope != "" {
+					assert.Equal(t, tt.wantScope, grantedScope)
+				}
 			}
 		})
 	}
+
+	t.Run("Downscoping", func(t *testing.T) {
+		downscopingAuth := NewScopeAuthority(db, scopeRegistry, scopeCache, true)
+
+		grantedScope, err := downscopingAuth.AuthorizeScope(context.Background(), "test_client_2", "test_user_1", "profile search shoplist:read")
+		assert.NoError(t, err)
+		assert.Equal(t, "profile shoplist:read", grantedScope)
+
+		_, err = downscopingAuth.AuthorizeScope(context.Background(), "test_client_2", "test_user_1", "search")
+		assert.Error(t, err)
+	})
+
+	t.Run("CacheInvalidation", func(t *testing.T) {
+		_, err := scopeAuth.AuthorizeScope(context.Background(), "test_client_1", "test_user_2", "search")
+		assert.Error(t, err)
+
+		require.NoError(t, db.Create(&dbmodel.UserRole{UserID: "test_user_2", RoleID: 1}).Error)
+
+		// The cached scopes of the user are served until the user is invalidated.
+		_, err = scopeAuth.AuthorizeScope(context.Background(), "test_client_1", "test_user_2", "search")
+		assert.Error(t, err)
+
+		scopeCache.InvalidateUser("test_user_2")
+		_, err = scopeAuth.AuthorizeScope(context.Background(), "test_client_1", "test_user_2", "search")
+		assert.NoError(t, err)
+	})
 }
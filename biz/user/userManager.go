@@ -0,0 +1,145 @@
+package bizuser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kdjuwidja/aishoppercommon/logger"
+	"gorm.io/gorm"
+	"netherealmstudio.com/m/v2/db"
+)
+
+// AdminScope is the scope that grants access to the administration endpoints.
+const AdminScope = "admin"
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrLastAdmin    = errors.New("operation would remove the last admin")
+)
+
+// TokenRevoker removes every token issued to a user from the token store.
+type TokenRevoker interface {
+	RemoveByUserID(ctx context.Context, userID string) error
+}
+
+type UserManager struct {
+	dbConn       *gorm.DB
+	tokenRevoker TokenRevoker
+}
+
+func NewUserManager(dbConn *gorm.DB, tokenRevoker TokenRevoker) *UserManager {
+	return &UserManager{
+		dbConn:       dbConn,
+		tokenRevoker: tokenRevoker,
+	}
+}
+
+// DeactivateUser suspends the user and revokes all of their outstanding tokens.
+func (m *UserManager) DeactivateUser(ctx context.Context, actorID string, userID string, reason string) error {
+	if err := m.setUserActive(ctx, actorID, userID, false, reason); err != nil {
+		return err
+	}
+
+	if err := m.tokenRevoker.RemoveByUserID(ctx, userID); err != nil {
+		logger.Errorf("failed to revoke tokens for deactivated user %s: %v", userID, err)
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	return nil
+}
+
+// ReactivateUser lifts a previous suspension. Tokens revoked on deactivation are not restored.
+func (m *UserManager) ReactivateUser(ctx context.Context, actorID string, userID string, reason string) error {
+	return m.setUserActive(ctx, actorID, userID, true, reason)
+}
+
+// setUserActive updates the user's active flag and records who made the change and why within a single transaction.
+func (m *UserManager) setUserActive(ctx context.Context, actorID string, userID string, isActive bool, reason string) error {
+	tx := m.dbConn.WithContext(ctx).Begin()
+
+	result := tx.Model(&db.User{}).Where("id = ?", userID).Update("is_active", isActive)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		// Updating to the current value affects no rows, so distinguish that from a missing user.
+		var count int64
+		if err := tx.Model(&db.User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if count == 0 {
+			tx.Rollback()
+			return ErrUserNotFound
+		}
+	}
+
+	if !isActive {
+		if err := EnsureAdminRemains(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	statusChange := db.UserStatusChange{
+		UserID:    userID,
+		IsActive:  isActive,
+		ChangedBy: actorID,
+		Reason:    reason,
+	}
+
+	if err := tx.Create(&statusChange).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// IsUserActive reports whether the user exists and is active. Deleted users are not active.
+func (m *UserManager) IsUserActive(ctx context.Context, userID string) (bool, error) {
+	var user db.User
+	err := m.dbConn.WithContext(ctx).Select("is_active").Where("id = ?", userID).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return user.IsActive, nil
+}
+
+// GetStatusHistory returns the status changes recorded for the user, newest first.
+func (m *UserManager) GetStatusHistory(ctx context.Context, userID string) ([]db.UserStatusChange, error) {
+	var history []db.UserStatusChange
+	err := m.dbConn.WithContext(ctx).Where("user_id = ?", userID).Order("id DESC").Find(&history).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// EnsureAdminRemains fails with ErrLastAdmin when no active user holds the admin scope through a role any more. It is
+// called within the transaction that removes an admin, after the change. The admin role assignments are read with a
+// locking read so that two admins cannot concurrently remove each other.
+func EnsureAdminRemains(tx *gorm.DB) error {
+	var count int64
+	err := tx.Raw(`SELECT COUNT(DISTINCT user_roles.user_id) FROM user_roles
+		INNER JOIN role_scopes ON role_scopes.role_id = user_roles.role_id
+		INNER JOIN users ON users.id = user_roles.user_id
+		WHERE role_scopes.scope = ? AND users.is_active = 1 AND users.deleted_at IS NULL
+		AND user_roles.deleted_at IS NULL AND role_scopes.deleted_at IS NULL FOR UPDATE`, AdminScope).Scan(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package bizuser
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	dbmodel "netherealmstudio.com/m/v2/db"
+)
+
+type fakeTokenRevoker struct {
+	revoked []string
+}
+
+func (f *fakeTokenRevoker) RemoveByUserID(ctx context.Context, userID string) error {
+	f.revoked = append(f.revoked, userID)
+	return nil
+}
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	dsn := "ai_shopper_dev:password@tcp(localhost:4306)/test_db?parseTime=True"
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+
+	err = db.Migrator().DropTable(&dbmodel.UserStatusChange{}, &dbmodel.UserRole{}, &dbmodel.RoleScope{}, &dbmodel.Role{}, &dbmodel.User{})
+	require.NoError(t, err)
+
+	err = db.AutoMigrate(&dbmodel.User{}, &dbmodel.UserStatusChange{}, &dbmodel.Role{}, &dbmodel.RoleScope{}, &dbmodel.UserRole{})
+	require.NoError(t, err)
+
+	users := []dbmodel.User{
+		{ID: "admin_user", Email: "admin@example.com", Password: "hashed_password", IsActive: true},
+		{ID: "test_user_1", Email: "test1@example.com", Password: "hashed_password_1", IsActive: true},
+	}
+	for _, user := range users {
+		require.NoError(t, db.Create(&user).Error)
+	}
+
+	require.NoError(t, db.Create(&dbmodel.Role{ID: 1, Description: "admin"}).Error)
+	require.NoError(t, db.Create(&dbmodel.RoleScope{RoleID: 1, Scope: AdminScope}).Error)
+	require.NoError(t, db.Create(&dbmodel.UserRole{UserID: "admin_user", RoleID: 1}).Error)
+
+	return db
+}
+
+func TestUserManager(t *testing.T) {
+	db := setupTestDB(t)
+	revoker := &fakeTokenRevoker{}
+	manager := NewUserManager(db, revoker)
+	ctx := context.Background()
+
+	t.Run("DeactivateUser", func(t *testing.T) {
+		err := manager.DeactivateUser(ctx, "admin_user", "test_user_1", "suspicious activity")
+		assert.NoError(t, err)
+
+		var user dbmodel.User
+		require.NoError(t, db.Where("id = ?", "test_user_1").First(&user).Error)
+		assert.False(t, user.IsActive)
+		assert.Equal(t, []string{"test_user_1"}, revoker.revoked)
+	})
+
+	t.Run("ReactivateUser", func(t *testing.T) {
+		err := manager.ReactivateUser(ctx, "admin_user", "test_user_1", "cleared")
+		assert.NoError(t, err)
+
+		var user dbmodel.User
+		require.NoError(t, db.Where("id = ?", "test_user_1").First(&user).Error)
+		assert.True(t, user.IsActive)
+	})
+
+	t.Run("ReactivateActiveUser", func(t *testing.T) {
+		err := manager.ReactivateUser(ctx, "admin_user", "test_user_1", "no-op")
+		assert.NoError(t, err)
+	})
+
+	t.Run("UserNotFound", func(t *testing.T) {
+		err := manager.DeactivateUser(ctx, "admin_user", "non_existent", "reason")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	})
+
+	t.Run("GetStatusHistory", func(t *testing.T) {
+		history, err := manager.GetStatusHistory(ctx, "test_user_1")
+		assert.NoError(t, err)
+		require.Len(t, history, 3)
+		assert.Equal(t, "no-op", history[0].Reason)
+		assert.False(t, history[2].IsActive)
+		assert.Equal(t, "admin_user", history[2].ChangedBy)
+	})
+}
@@ -1,6 +1,10 @@
 package db
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type APIClient struct {
 	gorm.Model
@@ -9,6 +13,21 @@ type APIClient struct {
 	Domain      string `json:"domain" gorm:"type:varchar(255);not null"`
 	IsPublic    bool   `json:"is_public" gorm:"type:tinyint(1);not null;default:0"`
 	Description string `json:"description" gorm:"type:varchar(255);"`
+	// RedirectURIs and GrantTypes are space separated. They are only set for dynamically registered clients.
+	RedirectURIs          string `json:"redirect_uris" gorm:"type:varchar(2048);not null;default:''"`
+	GrantTypes            string `json:"grant_types" gorm:"type:varchar(255);not null;default:''"`
+	RegistrationTokenHash string `json:"-" gorm:"type:varchar(64);not null;default:''"`
+	// RequirePAR rejects authorization requests of the client that were not pushed to the PAR endpoint first.
+	RequirePAR bool `json:"require_par" gorm:"type:tinyint(1);not null;default:0"`
+	// JWKS is the JSON Web Key Set the client signs request objects with. Empty for clients without keys.
+	JWKS string `json:"jwks" gorm:"type:text"`
+	// TokenEndpointAuthMethod is how the client authenticates (RFC 7591 section 2). Empty for clients created before it
+	// was configurable, which send their secret in the form, or nothing if they have none.
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method" gorm:"type:varchar(32);not null;default:''"`
+	// TLSClientAuthSubjectDN and TLSClientCertSPKI identify the client certificate of clients authenticating with
+	// tls_client_auth and self_signed_tls_client_auth (RFC 8705).
+	TLSClientAuthSubjectDN string `json:"tls_client_auth_subject_dn" gorm:"type:varchar(512);not null;default:''"`
+	TLSClientCertSPKI      string `json:"tls_client_cert_spki" gorm:"type:varchar(64);not null;default:''"`
 }
 
 type APIClientScope struct {
@@ -16,9 +35,37 @@ type APIClientScope struct {
 	ID          uint      `json:"id" gorm:"primaryKey;autoIncrement"`
 	APIClientID string    `json:"api_client_id" gorm:"type:varchar(45);not null;foreignKey:ID;references:APIClient"`
 	Scope       string    `json:"scope" gorm:"type:varchar(255);not null"`
+	IsDefault   bool      `json:"is_default" gorm:"type:tinyint(1);not null;default:0"`
+	APIClient   APIClient `json:"api_client" gorm:"foreignKey:APIClientID"`
+}
+
+// APIClientExchangeAudience allows an API client to exchange a user's access token for a token of the audience,
+// limited to the space separated scopes, on behalf of the user.
+type APIClientExchangeAudience struct {
+	gorm.Model
+	ID          uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	APIClientID string    `json:"api_client_id" gorm:"type:varchar(45);not null;index;foreignKey:ID;references:APIClient"`
+	Audience    string    `json:"audience" gorm:"type:varchar(255);not null"`
+	Scopes      string    `json:"scopes" gorm:"type:varchar(1024);not null"`
 	APIClient   APIClient `json:"api_client" gorm:"foreignKey:APIClientID"`
 }
 
+type Scope struct {
+	gorm.Model
+	ID          uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name        string `json:"name" gorm:"type:varchar(255);not null;uniqueIndex"`
+	Description string `json:"description" gorm:"type:varchar(255);not null"`
+	ConsentText string `json:"consent_text" gorm:"type:varchar(255);not null;default:''"`
+}
+
+// ScopeParent records that holding Parent implies Scope.
+type ScopeParent struct {
+	gorm.Model
+	ID     uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	Scope  string `json:"scope" gorm:"type:varchar(255);not null;index"`
+	Parent string `json:"parent" gorm:"type:varchar(255);not null"`
+}
+
 type Role struct {
 	gorm.Model
 	ID          int    `json:"id" gorm:"primaryKey;autoIncrement"`
@@ -41,6 +88,24 @@ type User struct {
 	IsActive bool   `json:"is_active" gorm:"type:tinyint(1);not null;default:1"`
 }
 
+type UserStatusChange struct {
+	gorm.Model
+	ID        uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID    string `json:"user_id" gorm:"type:varchar(32);not null;index"`
+	IsActive  bool   `json:"is_active" gorm:"type:tinyint(1);not null"`
+	ChangedBy string `json:"changed_by" gorm:"type:varchar(32);not null"`
+	Reason    string `json:"reason" gorm:"type:varchar(255);not null"`
+}
+
+type EmailVerification struct {
+	gorm.Model
+	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	UserID    string    `json:"user_id" gorm:"type:varchar(32);not null;index"`
+	NewEmail  string    `json:"new_email" gorm:"type:varchar(255);not null"`
+	TokenHash string    `json:"-" gorm:"type:varchar(64);not null;uniqueIndex"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null"`
+}
+
 type UserRole struct {
 	gorm.Model
 	UserID string `json:"user_id" gorm:"type:varchar(32);not null;foreignKey:ID;references:User"`
@@ -51,5 +116,28 @@ type UserRole struct {
 
 type RegistrationCode struct {
 	gorm.Model
-	Code string `json:"code" gorm:"type:varchar(6);primaryKey"`
+	Code      string    `json:"code" gorm:"type:varchar(6);primaryKey"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"not null;index"`
+	MaxUses   int       `json:"max_uses" gorm:"not null;default:1"`
+	UseCount  int       `json:"use_count" gorm:"not null;default:0"`
+	Email     string    `json:"email" gorm:"type:varchar(255);not null;default:''"`
+	RoleID    int       `json:"role_id" gorm:"not null;default:0"`
+	CreatedBy string    `json:"created_by" gorm:"type:varchar(32);not null;default:''"`
+}
+
+// AuditEvent records a security relevant action, who performed it and from where. Events are only ever appended, so
+// there is no soft delete.
+type AuditEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	CreatedAt time.Time `json:"created_at" gorm:"not null;index"`
+	Type      string    `json:"type" gorm:"type:varchar(64);not null;index"`
+	Outcome   string    `json:"outcome" gorm:"type:varchar(16);not null"`
+	ActorID   string    `json:"actor_id" gorm:"type:varchar(255);not null;default:'';index"`
+	SubjectID string    `json:"subject_id" gorm:"type:varchar(255);not null;default:'';index"`
+	ClientID  string    `json:"client_id" gorm:"type:varchar(45);not null;default:'';index"`
+	IP        string    `json:"ip" gorm:"type:varchar(45);not null;default:''"`
+	UserAgent string    `json:"user_agent" gorm:"type:varchar(512);not null;default:''"`
+	RequestID string    `json:"request_id" gorm:"type:varchar(64);not null;default:'';index"`
+	// Details holds the event specific attributes as a JSON object.
+	Details string `json:"details" gorm:"type:text"`
 }
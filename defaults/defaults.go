@@ -4,20 +4,69 @@ import "github.com/kdjuwidja/aishoppercommon/osutil"
 
 var DEFAULT_API_CLIENTS = []map[string]interface{}{
 	{
-		"id":          "82ce1a881b304775ad288e57e41387f3",
-		"secret":      "",
-		"domain":      "http://localhost:3000",
-		"is_public":   true,
-		"description": "Default client for ai_shopper_depot",
-		"scopes":      "profile shoplist search",
-	},
-	{
-		"id":          "de0125bfee1a486385819cdbb95ac675",
-		"secret":      "",
-		"domain":      "http://localhost:3000",
-		"is_public":   true,
-		"description": "Default admin client for ai_shopper_depot",
-		"scopes":      "admin",
+		"id":                 "82ce1a881b304775ad288e57e41387f3",
+		"secret":             "",
+		"domain":             "http://localhost:3000",
+		"is_public":          true,
+		"description":        "Default client for ai_shopper_depot",
+		"scopes":             "profile shoplist search",
+		"default_scopes":     "profile",
+		"exchange_audiences": map[string]string{},
+	},
+	{
+		"id":                 "de0125bfee1a486385819cdbb95ac675",
+		"secret":             "",
+		"domain":             "http://localhost:3000",
+		"is_public":          true,
+		"description":        "Default admin client for ai_shopper_depot",
+		"scopes":             "admin",
+		"default_scopes":     "admin",
+		"exchange_audiences": map[string]string{},
+	},
+	{
+		"id":             "5f0c2a8e9b7d4e13a6c1d2f3e4b5a697",
+		"secret":         osutil.GetEnvString("DEFAULT_SEARCH_CLIENT_SECRET", "search-secret"),
+		"domain":         "http://localhost:3000",
+		"is_public":      false,
+		"description":    "Default client for ai_shopper_search",
+		"scopes":         "search",
+		"default_scopes": "search",
+		"exchange_audiences": map[string]string{
+			"shoplist": "shoplist:read",
+		},
+	},
+}
+
+var DEFAULT_SCOPES = []map[string]interface{}{
+	{
+		"name":         "admin",
+		"description":  "Administration of users, roles and registration codes",
+		"consent_text": "Manage users, roles and registration codes",
+		"parents":      []string{},
+	},
+	{
+		"name":         "profile",
+		"description":  "User profile and account",
+		"consent_text": "View and update your profile",
+		"parents":      []string{},
+	},
+	{
+		"name":         "shoplist",
+		"description":  "Full access to shopping lists",
+		"consent_text": "View and edit your shopping lists",
+		"parents":      []string{},
+	},
+	{
+		"name":         "shoplist:read",
+		"description":  "Read-only access to shopping lists",
+		"consent_text": "View your shopping lists",
+		"parents":      []string{"shoplist"},
+	},
+	{
+		"name":         "search",
+		"description":  "Product search",
+		"consent_text": "Search products on your behalf",
+		"parents":      []string{},
 	},
 }
 
@@ -0,0 +1,171 @@
+package devicestore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusDenied   = "denied"
+)
+
+var (
+	ErrNotFound       = errors.New("device authorization not found")
+	ErrUserCodeExists = errors.New("user code already in use")
+)
+
+// DeviceAuthorization is a pending device authorization request of RFC 8628.
+type DeviceAuthorization struct {
+	DeviceCode   string    `json:"device_code"`
+	UserCode     string    `json:"user_code"`
+	ClientID     string    `json:"client_id"`
+	Scope        string    `json:"scope"`
+	Status       string    `json:"status"`
+	UserID       string    `json:"user_id"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Interval     int       `json:"interval"`
+	LastPolledAt time.Time `json:"last_polled_at"`
+}
+
+// DeviceStore keeps device authorizations until they are redeemed or their TTL runs out. Every record can be looked up
+// by both its device code, held by the device, and its user code, entered by the user on the verification page.
+type DeviceStore interface {
+	// Create stores a new device authorization, and returns ErrUserCodeExists if its user code is already in use.
+	Create(ctx context.Context, auth *DeviceAuthorization, ttl time.Duration) error
+	GetByDeviceCode(ctx context.Context, deviceCode string) (*DeviceAuthorization, error)
+	GetByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error)
+	// Update applies update to the device authorization atomically. The record is left unchanged if update returns an
+	// error, which is then returned as is.
+	Update(ctx context.Context, deviceCode string, update func(auth *DeviceAuthorization) error) (*DeviceAuthorization, error)
+	// Delete removes the device authorization, and reports whether it was still there, so that concurrent redemptions
+	// of the same device code can tell which one won.
+	Delete(ctx context.Context, deviceCode string) (bool, error)
+}
+
+type memoryEntry struct {
+	auth      DeviceAuthorization
+	removeAt  time.Time
+	userIndex string
+}
+
+// MemoryDeviceStore keeps device authorizations in process memory. It only suits a single instance of the service.
+type MemoryDeviceStore struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryEntry
+	userCodes map[string]string
+}
+
+func NewMemoryDeviceStore() *MemoryDeviceStore {
+	return &MemoryDeviceStore{
+		entries:   make(map[string]*memoryEntry),
+		userCodes: make(map[string]string),
+	}
+}
+
+func (s *MemoryDeviceStore) Create(ctx context.Context, auth *DeviceAuthorization, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	if _, ok := s.userCodes[auth.UserCode]; ok {
+		return ErrUserCodeExists
+	}
+
+	s.entries[auth.DeviceCode] = &memoryEntry{
+		auth:      *auth,
+		removeAt:  now.Add(ttl),
+		userIndex: auth.UserCode,
+	}
+	s.userCodes[auth.UserCode] = auth.DeviceCode
+	return nil
+}
+
+func (s *MemoryDeviceStore) GetByDeviceCode(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.get(deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	auth := entry.auth
+	return &auth, nil
+}
+
+func (s *MemoryDeviceStore) GetByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deviceCode, ok := s.userCodes[userCode]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	entry, err := s.get(deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	auth := entry.auth
+	return &auth, nil
+}
+
+func (s *MemoryDeviceStore) Update(ctx context.Context, deviceCode string, update func(auth *DeviceAuthorization) error) (*DeviceAuthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.get(deviceCode)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := entry.auth
+	if err := update(&auth); err != nil {
+		return nil, err
+	}
+	entry.auth = auth
+
+	return &auth, nil
+}
+
+func (s *MemoryDeviceStore) Delete(ctx context.Context, deviceCode string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[deviceCode]
+	if !ok {
+		return false, nil
+	}
+	s.remove(deviceCode, entry)
+	return true, nil
+}
+
+// get returns the entry of the device code unless its TTL has run out. The caller must hold the lock.
+func (s *MemoryDeviceStore) get(deviceCode string) (*memoryEntry, error) {
+	entry, ok := s.entries[deviceCode]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !time.Now().Before(entry.removeAt) {
+		s.remove(deviceCode, entry)
+		return nil, ErrNotFound
+	}
+	return entry, nil
+}
+
+func (s *MemoryDeviceStore) remove(deviceCode string, entry *memoryEntry) {
+	delete(s.entries, deviceCode)
+	delete(s.userCodes, entry.userIndex)
+}
+
+func (s *MemoryDeviceStore) sweep(now time.Time) {
+	for deviceCode, entry := range s.entries {
+		if !now.Before(entry.removeAt) {
+			s.remove(deviceCode, entry)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package devicestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDeviceStore(t *testing.T) {
+	store := NewMemoryDeviceStore()
+	ctx := context.Background()
+
+	auth := &DeviceAuthorization{DeviceCode: "device-1", UserCode: "BCDFGHJK", ClientID: "cli", Status: StatusPending}
+	require.NoError(t, store.Create(ctx, auth, time.Minute))
+	assert.ErrorIs(t, store.Create(ctx, &DeviceAuthorization{DeviceCode: "device-2", UserCode: "BCDFGHJK"}, time.Minute), ErrUserCodeExists)
+
+	byUserCode, err := store.GetByUserCode(ctx, "BCDFGHJK")
+	require.NoError(t, err)
+	assert.Equal(t, "device-1", byUserCode.DeviceCode)
+
+	// Records handed out are copies.
+	byUserCode.Status = StatusApproved
+	byDeviceCode, err := store.GetByDeviceCode(ctx, "device-1")
+	require.NoError(t, err)
+	assert.Equal(t, StatusPending, byDeviceCode.Status)
+
+	updated, err := store.Update(ctx, "device-1", func(auth *DeviceAuthorization) error {
+		auth.Status = StatusApproved
+		auth.UserID = "user-1"
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", updated.UserID)
+
+	// A failing update leaves the record unchanged.
+	errUpdate := errors.New("update failed")
+	_, err = store.Update(ctx, "device-1", func(auth *DeviceAuthorization) error {
+		auth.UserID = "user-2"
+		return errUpdate
+	})
+	assert.ErrorIs(t, err, errUpdate)
+	byDeviceCode, err = store.GetByDeviceCode(ctx, "device-1")
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", byDeviceCode.UserID)
+
+	deleted, err := store.Delete(ctx, "device-1")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = store.Delete(ctx, "device-1")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	_, err = store.GetByUserCode(ctx, "BCDFGHJK")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Update(ctx, "device-1", func(auth *DeviceAuthorization) error { return nil })
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryDeviceStore_Expiry(t *testing.T) {
+	store := NewMemoryDeviceStore()
+	ctx := context.Background()
+
+	require.NoError(t, store.Create(ctx, &DeviceAuthorization{DeviceCode: "device-1", UserCode: "BCDFGHJK"}, -time.Second))
+
+	_, err := store.GetByDeviceCode(ctx, "device-1")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// The user code of an expired record can be handed out again.
+	assert.NoError(t, store.Create(ctx, &DeviceAuthorization{DeviceCode: "device-2", UserCode: "BCDFGHJK"}, time.Minute))
+}
@@ -0,0 +1,151 @@
+package devicestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	deviceCodeKeyPrefix = "device:code:"
+	userCodeKeyPrefix   = "device:user:"
+
+	// maxUpdateRetries bounds the optimistic transaction retries of Update when the record is modified concurrently.
+	maxUpdateRetries = 5
+)
+
+// RedisDeviceStore keeps device authorizations in Redis so that every instance of the service sees the same requests.
+// A record is stored as JSON under its device code, with the user code mapping to the device code, both expiring
+// with the record.
+type RedisDeviceStore struct {
+	redisClient *redis.Client
+}
+
+func NewRedisDeviceStore(redisClient *redis.Client) *RedisDeviceStore {
+	return &RedisDeviceStore{
+		redisClient: redisClient,
+	}
+}
+
+func (s *RedisDeviceStore) Create(ctx context.Context, auth *DeviceAuthorization, ttl time.Duration) error {
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+
+	// Claim the user code first, so that a collision never overwrites another pending request.
+	ok, err := s.redisClient.SetNX(ctx, userCodeKeyPrefix+auth.UserCode, auth.DeviceCode, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUserCodeExists
+	}
+
+	if err := s.redisClient.Set(ctx, deviceCodeKeyPrefix+auth.DeviceCode, data, ttl).Err(); err != nil {
+		s.redisClient.Del(ctx, userCodeKeyPrefix+auth.UserCode)
+		return err
+	}
+	return nil
+}
+
+func (s *RedisDeviceStore) GetByDeviceCode(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	data, err := s.redisClient.Get(ctx, deviceCodeKeyPrefix+deviceCode).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var auth DeviceAuthorization
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+func (s *RedisDeviceStore) GetByUserCode(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	deviceCode, err := s.redisClient.Get(ctx, userCodeKeyPrefix+userCode).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.GetByDeviceCode(ctx, deviceCode)
+}
+
+// Update reads, modifies and writes the record in a WATCH/MULTI/EXEC transaction, so that concurrent polls and the
+// user's approval never overwrite each other.
+func (s *RedisDeviceStore) Update(ctx context.Context, deviceCode string, update func(auth *DeviceAuthorization) error) (*DeviceAuthorization, error) {
+	key := deviceCodeKeyPrefix + deviceCode
+
+	var updated DeviceAuthorization
+	txf := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var auth DeviceAuthorization
+		if err := json.Unmarshal(data, &auth); err != nil {
+			return err
+		}
+		if err := update(&auth); err != nil {
+			return err
+		}
+
+		data, err = json.Marshal(&auth)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		updated = auth
+		return nil
+	}
+
+	for i := 0; i < maxUpdateRetries; i++ {
+		err := s.redisClient.Watch(ctx, txf, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &updated, nil
+	}
+	return nil, redis.TxFailedErr
+}
+
+func (s *RedisDeviceStore) Delete(ctx context.Context, deviceCode string) (bool, error) {
+	auth, err := s.GetByDeviceCode(ctx, deviceCode)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Only the caller whose DEL removed the record reports it as deleted.
+	deleted, err := s.redisClient.Del(ctx, deviceCodeKeyPrefix+deviceCode).Result()
+	if err != nil {
+		return false, err
+	}
+	s.redisClient.Del(ctx, userCodeKeyPrefix+auth.UserCode)
+
+	return deleted > 0, nil
+}
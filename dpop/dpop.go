@@ -0,0 +1,145 @@
+package dpop
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"netherealmstudio.com/m/v2/jtistore"
+	"netherealmstudio.com/m/v2/jwks"
+)
+
+const (
+	// HeaderName is the request header carrying the DPoP proof.
+	HeaderName = "DPoP"
+	// TokenType is the token_type of DPoP-bound access tokens, and the Authorization scheme they are presented with.
+	TokenType = "DPoP"
+
+	proofType = "dpop+jwt"
+	// clockSkew is how far in the future the iat of a proof may be, for clients with a clock slightly ahead.
+	clockSkew = 5 * time.Second
+)
+
+var ErrInvalidProof = errors.New("invalid_dpop_proof")
+
+type thumbprintContextKey struct{}
+
+// WithThumbprint returns a context carrying the JWK thumbprint the tokens issued for the request are bound to.
+func WithThumbprint(ctx context.Context, jkt string) context.Context {
+	return context.WithValue(ctx, thumbprintContextKey{}, jkt)
+}
+
+// ThumbprintFromContext returns the JWK thumbprint set by WithThumbprint, or "" for requests without a DPoP proof.
+func ThumbprintFromContext(ctx context.Context) string {
+	jkt, _ := ctx.Value(thumbprintContextKey{}).(string)
+	return jkt
+}
+
+// BoundThumbprint returns the cnf.jkt claim of an access token's claims, or "" if the token is a bearer token.
+func BoundThumbprint(claims jwt.MapClaims) string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
+
+// ProofVerifier verifies DPoP proofs (RFC 9449 section 4.3).
+type ProofVerifier struct {
+	origin   string
+	jtiStore jtistore.JTIStore
+	maxAge   time.Duration
+}
+
+// NewProofVerifier creates a verifier for proofs made for URLs under origin, the scheme and host clients reach this
+// service at, and issued at most maxAge ago. Proof IDs are remembered in the JTI store so that proofs are single use.
+func NewProofVerifier(origin string, jtiStore jtistore.JTIStore, maxAge time.Duration) *ProofVerifier {
+	return &ProofVerifier{
+		origin:   origin,
+		jtiStore: jtiStore,
+		maxAge:   maxAge,
+	}
+}
+
+// Verify checks the DPoP proof of the request and returns the thumbprint of the key it was signed with. If accessToken
+// is set, the proof must also be bound to it through the ath claim. Rejected proofs return an error wrapping
+// ErrInvalidProof, while other errors come from the JTI store.
+func (v *ProofVerifier) Verify(r *http.Request, accessToken string) (string, error) {
+	proofs := r.Header.Values(HeaderName)
+	if len(proofs) != 1 {
+		return "", fmt.Errorf("%w: exactly one DPoP header is required", ErrInvalidProof)
+	}
+
+	var jkt string
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(proofs[0], claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != proofType {
+			return nil, fmt.Errorf("typ must be %s", proofType)
+		}
+		jwk, err := json.Marshal(token.Header["jwk"])
+		if err != nil || token.Header["jwk"] == nil {
+			return nil, fmt.Errorf("jwk header is required")
+		}
+		publicKey, err := jwks.ParseKey(jwk)
+		if err != nil {
+			return nil, err
+		}
+		if !jwks.FitsAlgorithm(publicKey, token.Method.Alg()) {
+			return nil, fmt.Errorf("jwk does not fit alg %s", token.Method.Alg())
+		}
+		if jkt, err = jwks.Thumbprint(jwk); err != nil {
+			return nil, err
+		}
+		return publicKey, nil
+	}, jwt.WithValidMethods(jwks.SigningMethods))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+
+	if htm, _ := claims["htm"].(string); htm != r.Method {
+		return "", fmt.Errorf("%w: htm does not match the request", ErrInvalidProof)
+	}
+	if htu, _ := claims["htu"].(string); htu != v.RequestURL(r) {
+		return "", fmt.Errorf("%w: htu does not match the request", ErrInvalidProof)
+	}
+
+	iat, err := claims.GetIssuedAt()
+	if err != nil || iat == nil {
+		return "", fmt.Errorf("%w: iat is required", ErrInvalidProof)
+	}
+	now := time.Now()
+	if iat.Before(now.Add(-v.maxAge)) || iat.After(now.Add(clockSkew)) {
+		return "", fmt.Errorf("%w: proof is too old or issued in the future", ErrInvalidProof)
+	}
+
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if ath, _ := claims["ath"].(string); ath != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", fmt.Errorf("%w: ath does not match the access token", ErrInvalidProof)
+		}
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", fmt.Errorf("%w: jti is required", ErrInvalidProof)
+	}
+	ok, err := v.jtiStore.Use(r.Context(), "dpop:"+jkt+":"+jti, iat.Add(v.maxAge+clockSkew))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: proof was already used", ErrInvalidProof)
+	}
+
+	return jkt, nil
+}
+
+// RequestURL returns the htu a proof for the request must carry: the URL of the request without query and fragment,
+// as reached from outside through the configured origin.
+func (v *ProofVerifier) RequestURL(r *http.Request) string {
+	return v.origin + r.URL.Path
+}
@@ -0,0 +1,132 @@
+package dpop
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"netherealmstudio.com/m/v2/jtistore"
+)
+
+const testOrigin = "https://auth.example.com"
+
+func publicJWK(key *ecdsa.PrivateKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func proofClaims(method string, url string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"htm": method,
+		"htu": url,
+		"iat": time.Now().Unix(),
+		"jti": base64.RawURLEncoding.EncodeToString([]byte(time.Now().String())),
+	}
+}
+
+func signProof(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	proof := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	proof.Header["typ"] = proofType
+	proof.Header["jwk"] = publicJWK(key)
+	signed, err := proof.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func proofRequest(method string, path string, proof string) *http.Request {
+	r, _ := http.NewRequest(method, "http://internal:9096"+path+"?ignored=1", nil)
+	r.Header.Set(HeaderName, proof)
+	return r
+}
+
+func TestProofVerifier_Verify(t *testing.T) {
+	verifier := NewProofVerifier(testOrigin, jtistore.NewMemoryJTIStore(), time.Minute)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	proof := signProof(t, key, proofClaims("POST", testOrigin+"/auth/token"))
+	jkt, err := verifier.Verify(proofRequest("POST", "/auth/token", proof), "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, jkt)
+
+	// Proofs are single use.
+	_, err = verifier.Verify(proofRequest("POST", "/auth/token", proof), "")
+	assert.ErrorIs(t, err, ErrInvalidProof)
+
+	// Proofs presented with an access token are bound to it through ath, and signed with the same key.
+	sum := sha256.Sum256([]byte("access-token"))
+	claims := proofClaims("GET", testOrigin+"/account/profile")
+	claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	sameKey, err := verifier.Verify(proofRequest("GET", "/account/profile", signProof(t, key, claims)), "access-token")
+	require.NoError(t, err)
+	assert.Equal(t, jkt, sameKey)
+}
+
+func TestProofVerifier_Rejections(t *testing.T) {
+	verifier := NewProofVerifier(testOrigin, jtistore.NewMemoryJTIStore(), time.Minute)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	for name, modify := range map[string]func(jwt.MapClaims){
+		"WrongMethod": func(c jwt.MapClaims) { c["htm"] = "GET" },
+		"WrongURL":    func(c jwt.MapClaims) { c["htu"] = testOrigin + "/auth/other" },
+		"TooOld":      func(c jwt.MapClaims) { c["iat"] = time.Now().Add(-2 * time.Minute).Unix() },
+		"FromFuture":  func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Minute).Unix() },
+		"NoJTI":       func(c jwt.MapClaims) { delete(c, "jti") },
+		"NoIAT":       func(c jwt.MapClaims) { delete(c, "iat") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			claims := proofClaims("POST", testOrigin+"/auth/token")
+			modify(claims)
+			_, err := verifier.Verify(proofRequest("POST", "/auth/token", signProof(t, key, claims)), "")
+			assert.ErrorIs(t, err, ErrInvalidProof)
+		})
+	}
+
+	t.Run("WrongAccessToken", func(t *testing.T) {
+		sum := sha256.Sum256([]byte("other-token"))
+		claims := proofClaims("POST", testOrigin+"/auth/token")
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+		_, err := verifier.Verify(proofRequest("POST", "/auth/token", signProof(t, key, claims)), "access-token")
+		assert.ErrorIs(t, err, ErrInvalidProof)
+	})
+
+	t.Run("SignedWithOtherKey", func(t *testing.T) {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		proof := jwt.NewWithClaims(jwt.SigningMethodES256, proofClaims("POST", testOrigin+"/auth/token"))
+		proof.Header["typ"] = proofType
+		proof.Header["jwk"] = publicJWK(key)
+		signed, err := proof.SignedString(otherKey)
+		require.NoError(t, err)
+		_, err = verifier.Verify(proofRequest("POST", "/auth/token", signed), "")
+		assert.ErrorIs(t, err, ErrInvalidProof)
+	})
+
+	t.Run("WrongType", func(t *testing.T) {
+		proof := jwt.NewWithClaims(jwt.SigningMethodES256, proofClaims("POST", testOrigin+"/auth/token"))
+		proof.Header["jwk"] = publicJWK(key)
+		signed, err := proof.SignedString(key)
+		require.NoError(t, err)
+		_, err = verifier.Verify(proofRequest("POST", "/auth/token", signed), "")
+		assert.ErrorIs(t, err, ErrInvalidProof)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", testOrigin+"/auth/token", nil)
+		_, err := verifier.Verify(r, "")
+		assert.ErrorIs(t, err, ErrInvalidProof)
+	})
+}
@@ -0,0 +1,59 @@
+package goauth
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/go-oauth2/oauth2/v4/manage"
+	oauthmodels "github.com/go-oauth2/oauth2/v4/models"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+)
+
+// APIClientInfoStore serves the oauth2 server's client lookups from the APIClientStore instead of a copy of it, so
+// that reloaded clients become visible to the oauth2 server and to the token generator at the same time.
+type APIClientInfoStore struct {
+	apiClientStore *bizapiclient.APIClientStore
+}
+
+func NewAPIClientInfoStore(apiClientStore *bizapiclient.APIClientStore) *APIClientInfoStore {
+	return &APIClientInfoStore{
+		apiClientStore: apiClientStore,
+	}
+}
+
+func (s *APIClientInfoStore) GetByID(ctx context.Context, id string) (oauth2.ClientInfo, error) {
+	client, err := s.apiClientStore.GetClient(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The manager validates redirect URIs against the domain only, so clients with registered redirect URIs hand those
+	// to validateRedirectURI through the domain instead.
+	domain := client.Domain
+	if client.RedirectURIs != "" {
+		domain = client.RedirectURIs
+	}
+
+	return &oauthmodels.Client{
+		ID:     client.ID,
+		Secret: client.Secret,
+		Domain: domain,
+	}, nil
+}
+
+// validateRedirectURI accepts a redirect URI matching one of the client's registered redirect URIs, and otherwise
+// falls back to go-oauth2's check against the client's domain. The authorize handler already requires an exact match
+// for clients with registered redirect URIs before the request reaches the manager.
+func validateRedirectURI(baseURI string, redirectURI string) error {
+	registered := strings.Fields(baseURI)
+	if slices.Contains(registered, redirectURI) {
+		return nil
+	}
+	if len(registered) > 1 {
+		return errors.ErrInvalidRedirectURI
+	}
+	return manage.DefaultValidateURI(baseURI, redirectURI)
+}
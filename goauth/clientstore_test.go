@@ -0,0 +1,18 @@
+package goauth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRedirectURI(t *testing.T) {
+	registered := "https://partner.example.com/callback http://127.0.0.1:8080/callback"
+	assert.NoError(t, validateRedirectURI(registered, "http://127.0.0.1:8080/callback"))
+	assert.Error(t, validateRedirectURI(registered, "https://partner.example.com/other"))
+
+	// A single registered redirect URI matches exactly, and a domain keeps go-oauth2's host check.
+	assert.NoError(t, validateRedirectURI("https://partner.example.com/callback", "https://partner.example.com/callback"))
+	assert.NoError(t, validateRedirectURI("http://localhost:3000", "http://localhost:3000/auth/callback"))
+	assert.Error(t, validateRedirectURI("http://localhost:3000", "http://evil.example.com/callback"))
+}
@@ -1,18 +1,31 @@
 package goauth
 
 import (
-	"fmt"
+	"context"
+	stderrors "errors"
 	"net/http"
 
+	"github.com/go-oauth2/oauth2/v4"
 	"github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/kdjuwidja/aishoppercommon/logger"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
 	dbmodel "netherealmstudio.com/m/v2/db"
+	"netherealmstudio.com/m/v2/metrics"
+)
+
+var (
+	errInvalidPassword = errors.New("invalid password")
+	errInactiveUser    = errors.New("user is inactive")
 )
 
 type GoAuthHandler struct {
-	dbConn *gorm.DB
+	dbConn         *gorm.DB
+	passwordHasher *bizpassword.PasswordHasher
+	apiClientStore *bizapiclient.APIClientStore
+	auditor        *bizaudit.Auditor
 }
 
 func (h *GoAuthHandler) validateUser(email, password string) (string, error) {
@@ -26,9 +39,26 @@ func (h *GoAuthHandler) validateUser(email, password string) (string, error) {
 		return "000000", errors.New("user not found")
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	ok, needsRehash, err := h.passwordHasher.Verify(password, user.Password)
 	if err != nil {
-		return "000000", fmt.Errorf("invalid password")
+		return "000000", err
+	}
+	if !ok {
+		return "000000", errInvalidPassword
+	}
+
+	if !user.IsActive {
+		return "000000", errInactiveUser
+	}
+
+	// Upgrade the stored hash to the preferred algorithm while the plain text password is available. Failing to do so
+	// does not fail the login since the existing hash is still valid.
+	if needsRehash {
+		if hashedPassword, err := h.passwordHasher.Hash(password); err != nil {
+			logger.Errorf("failed to rehash password for user %s: %v", user.ID, err)
+		} else if err := h.dbConn.Model(&dbmodel.User{}).Where("id = ?", user.ID).Update("password", hashedPassword).Error; err != nil {
+			logger.Errorf("failed to store rehashed password for user %s: %v", user.ID, err)
+		}
 	}
 
 	logger.Debugf("ValidateUser %v successfully\n", user)
@@ -40,14 +70,79 @@ func (h *GoAuthHandler) userAuthorizationHandler(w http.ResponseWriter, r *http.
 	password := r.PostFormValue("password")
 	logger.Tracef("email: %s, password: %s", email, password)
 
-	userID, err = h.validateUser(email, password)
-	if err != nil {
+	userID, err = h.authenticateUser(r.Context(), r.FormValue("client_id"), email, password)
+	switch {
+	case err == nil:
+	case stderrors.Is(err, gorm.ErrRecordNotFound), stderrors.Is(err, errInvalidPassword):
+		metrics.AuthorizeOutcome(metrics.AuthorizeInvalidCredentials)
+		return "", err
+	case stderrors.Is(err, errInactiveUser):
+		metrics.AuthorizeOutcome(metrics.AuthorizeInactiveUser)
+		return "", err
+	default:
+		metrics.AuthorizeOutcome(metrics.AuthorizeError)
 		return "", err
 	}
 
 	return userID, nil
 }
 
+// authenticateUser validates the user's email and password, and records the login attempt in the audit log.
+func (h *GoAuthHandler) authenticateUser(ctx context.Context, clientID string, email string, password string) (string, error) {
+	userID, err := h.validateUser(email, password)
+
+	event := bizaudit.Event{
+		Type:     bizaudit.EventLogin,
+		ActorID:  userID,
+		ClientID: clientID,
+		Details:  map[string]string{"email": email},
+	}
+	if err != nil {
+		event.ActorID = ""
+		event.Outcome = bizaudit.OutcomeFailure
+		event.Details["reason"] = loginFailureReason(err)
+	}
+	h.auditor.Record(ctx, event)
+
+	return userID, err
+}
+
+func loginFailureReason(err error) string {
+	switch {
+	case stderrors.Is(err, gorm.ErrRecordNotFound), stderrors.Is(err, errInvalidPassword):
+		return "invalid_credentials"
+	case stderrors.Is(err, errInactiveUser):
+		return "inactive_user"
+	default:
+		return "error"
+	}
+}
+
+// refreshingValidationHandler rejects refresh token requests for users that have been deactivated since the token was issued.
+func (h *GoAuthHandler) refreshingValidationHandler(ti oauth2.TokenInfo) (bool, error) {
+	var user dbmodel.User
+	result := h.dbConn.Where("id = ?", ti.GetUserID()).First(&user)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	if !user.IsActive {
+		logger.Debugf("Refresh rejected for inactive user %s", user.ID)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// clientAuthorizedHandler rejects grant types the client did not register for.
+func (h *GoAuthHandler) clientAuthorizedHandler(clientID string, grant oauth2.GrantType) (bool, error) {
+	client, err := h.apiClientStore.GetClient(clientID)
+	if err != nil {
+		return false, errors.ErrInvalidClient
+	}
+	return client.IsGrantTypeAllowed(grant.String()), nil
+}
+
 func (h *GoAuthHandler) setInternalErrorHandler(err error) (re *errors.Response) {
 	logger.Errorf("Internal Error: %s", err.Error())
 	return
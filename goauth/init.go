@@ -1,31 +1,51 @@
 package goauth
 
 import (
+	"context"
+	"crypto/x509"
 	"fmt"
+	"net/url"
+	"os"
 	"time"
 
 	"github.com/go-oauth2/oauth2/v4"
 	"github.com/go-oauth2/oauth2/v4/manage"
-	oauthmodels "github.com/go-oauth2/oauth2/v4/models"
 	"github.com/go-oauth2/oauth2/v4/server"
-	"github.com/go-oauth2/oauth2/v4/store"
 	"github.com/kdjuwidja/aishoppercommon/logger"
 	"github.com/kdjuwidja/aishoppercommon/osutil"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizclientauth "netherealmstudio.com/m/v2/biz/clientauth"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
 	bizscope "netherealmstudio.com/m/v2/biz/scope"
 	dbmodel "netherealmstudio.com/m/v2/db"
 	"netherealmstudio.com/m/v2/defaults"
+	"netherealmstudio.com/m/v2/devicestore"
+	"netherealmstudio.com/m/v2/dpop"
+	"netherealmstudio.com/m/v2/jtistore"
+	"netherealmstudio.com/m/v2/metrics"
 	"netherealmstudio.com/m/v2/statestore"
 	"netherealmstudio.com/m/v2/token"
 )
 
 type GoAuth struct {
-	srv        *server.Server
-	statestore *statestore.StateStore
-	tokenStore oauth2.TokenStore
-	manager    *manage.Manager
+	srv            *server.Server
+	statestore     *statestore.StateStore
+	pushedRequests *statestore.PushedRequestStore
+	tokenStore     *JWTTokenStore
+	scopeRegistry  *bizscope.StaticScopeRegistry
+	scopeCache     *bizscope.ScopeCache
+	apiClientStore *bizapiclient.APIClientStore
+	deviceStore    devicestore.DeviceStore
+	tokenExchanger *token.TokenExchanger
+	clientAuth     *bizclientauth.ClientAuthenticator
+	proofVerifier  *dpop.ProofVerifier
+	issuer         string
+	goAuthHandler  *GoAuthHandler
+	manager        *Manager
 }
 
 func (g *GoAuth) GetSrv() *server.Server {
@@ -36,54 +56,157 @@ func (g *GoAuth) GetStateStore() *statestore.StateStore {
 	return g.statestore
 }
 
-func (g *GoAuth) GetTokenStore() oauth2.TokenStore {
+func (g *GoAuth) GetPushedRequestStore() *statestore.PushedRequestStore {
+	return g.pushedRequests
+}
+
+func (g *GoAuth) GetTokenStore() *JWTTokenStore {
 	return g.tokenStore
 }
 
-func InitializeGoAuth(dbConn *gorm.DB, isLocalDev bool) (*GoAuth, error) {
+func (g *GoAuth) GetScopeRegistry() *bizscope.StaticScopeRegistry {
+	return g.scopeRegistry
+}
+
+func (g *GoAuth) GetScopeCache() *bizscope.ScopeCache {
+	return g.scopeCache
+}
+
+func (g *GoAuth) GetAPIClientStore() *bizapiclient.APIClientStore {
+	return g.apiClientStore
+}
+
+func (g *GoAuth) GetDeviceStore() devicestore.DeviceStore {
+	return g.deviceStore
+}
+
+func (g *GoAuth) GetTokenExchanger() *token.TokenExchanger {
+	return g.tokenExchanger
+}
+
+func (g *GoAuth) GetClientAuthenticator() *bizclientauth.ClientAuthenticator {
+	return g.clientAuth
+}
+
+func (g *GoAuth) GetProofVerifier() *dpop.ProofVerifier {
+	return g.proofVerifier
+}
+
+// GetIssuer returns the URL identifying this server, which JWTs signed by clients name as their audience.
+func (g *GoAuth) GetIssuer() string {
+	return g.issuer
+}
+
+// AuthenticateUser checks the email and password the same way the login page does, and returns the user's ID. The
+// attempt is audited as a login to the client.
+func (g *GoAuth) AuthenticateUser(ctx context.Context, clientID string, email string, password string) (string, error) {
+	return g.goAuthHandler.authenticateUser(ctx, clientID, email, password)
+}
+
+// ReloadAPIClients reloads the API clients from the database and drops the cached scopes of every changed client.
+func (g *GoAuth) ReloadAPIClients(ctx context.Context) (*bizapiclient.ReloadResult, error) {
+	result, err := g.apiClientStore.Reload(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, clientID := range result.Changed() {
+		g.scopeCache.InvalidateClient(clientID)
+	}
+	logger.Infof("Reloaded API clients. added: %v, updated: %v, removed: %v", result.Added, result.Updated, result.Removed)
+
+	return result, nil
+}
+
+// StartAPIClientReloader reloads the API clients every interval until ctx is done.
+func (g *GoAuth) StartAPIClientReloader(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := g.ReloadAPIClients(ctx); err != nil {
+					logger.Errorf("Failed to reload API clients: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func InitializeGoAuth(dbConn *gorm.DB, isLocalDev bool, passwordHasher *bizpassword.PasswordHasher, auditor *bizaudit.Auditor) (*GoAuth, error) {
 	goAuth := &GoAuth{}
 
 	// Initialize state store
 	goAuth.statestore = statestore.NewStateStore()
-	goAuth.manager = manage.NewDefaultManager()
+	goAuth.pushedRequests = statestore.NewPushedRequestStore()
+	goAuth.manager = NewManager()
 
 	codeTTL := osutil.GetEnvInt("CODE_TTL", 300)
 	accessTTL := osutil.GetEnvInt("ACCESS_TTL", 3600)
 	refreshTTL := osutil.GetEnvInt("REFRESH_TTL", 86400)
 
 	// Initialize API client store
-	goAuthClientStore, apiClientStore, err := initializeAPIClientStore(dbConn, isLocalDev)
-	if err != nil {
+	goAuth.apiClientStore = bizapiclient.NewAPIClientStore(dbConn, isLocalDev)
+	goAuth.manager.MapClientStorage(NewAPIClientInfoStore(goAuth.apiClientStore))
+	goAuth.manager.SetValidateURIHandler(validateRedirectURI)
+
+	// Initialize scope registry. The default scopes are created in every environment since the scopes table did not
+	// exist before, and existing roles and API clients refer to them.
+	logger.Info("Creating default scopes...")
+	if err := createDefaultScopeRecords(dbConn); err != nil {
 		return nil, err
 	}
-	goAuth.manager.MapClientStorage(goAuthClientStore)
+	var err error
+	goAuth.scopeRegistry, err = bizscope.LoadScopeRegistry(context.Background(), dbConn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scope registry: %v", err)
+	}
 
 	//token memory store
 
+	var tokenStore oauth2.TokenStore
 	hasKeyLimit := osutil.GetEnvBool("RESTRICT_NUM_KEYS", false)
 	if hasKeyLimit {
-		redisHost := osutil.GetEnvString("REDIS_HOST", "localhost")
-		redisPort := osutil.GetEnvString("REDIS_PORT", "6379")
-		redisUser := osutil.GetEnvString("REDIS_USER", "default")
-		redisPassword := osutil.GetEnvString("REDIS_PASSWORD", "password")
-
-		redisClient := redis.NewClient(&redis.Options{
-			Addr:     fmt.Sprintf("%s:%s", redisHost, redisPort),
-			Password: redisPassword,
-			Username: redisUser,
-		})
-		goAuth.tokenStore, err = InitializeJWTTokenStoreWithKeyLimit(redisClient, "./lua/create.lua", osutil.GetEnvInt("MAX_NUM_KEYS", 5))
+		tokenStore, err = InitializeJWTTokenStoreWithKeyLimit(newRedisClient(), "./lua/create.lua", osutil.GetEnvInt("MAX_NUM_KEYS", 5))
 	} else {
-		goAuth.tokenStore, err = InitializeJWTTokenStore()
+		tokenStore, err = InitializeJWTTokenStore()
+	}
+	goAuth.manager.MustTokenStorage(tokenStore, err)
+	goAuth.tokenStore = tokenStore.(*JWTTokenStore)
+
+	// Device authorizations are polled by the device on whichever instance the load balancer picks, so deployments
+	// running more than one instance need them in Redis.
+	switch deviceStore := osutil.GetEnvString("DEVICE_CODE_STORE", "memory"); deviceStore {
+	case "redis":
+		logger.Info("Initializing device store in Redis.")
+		goAuth.deviceStore = devicestore.NewRedisDeviceStore(newRedisClient())
+	case "memory":
+		logger.Info("Initializing device store in memory.")
+		goAuth.deviceStore = devicestore.NewMemoryDeviceStore()
+	default:
+		return nil, fmt.Errorf("unknown device code store: %s", deviceStore)
 	}
-	goAuth.manager.MustTokenStorage(goAuth.tokenStore, err)
 
 	// Configure JWT token generation with custom claims
 	jwtSecret := osutil.GetEnvString("JWT_SECRET", "your-secret-key")
-	accessGen := token.NewJWTTokenGenerator("jwt-key", []byte(jwtSecret), apiClientStore, bizscope.NewScopeAuthority(dbConn))
+	goAuth.scopeCache = bizscope.NewScopeCache(time.Duration(osutil.GetEnvInt("SCOPE_CACHE_TTL", 60)) * time.Second)
+	scopeAuthority := bizscope.NewScopeAuthority(dbConn, goAuth.scopeRegistry, goAuth.scopeCache, osutil.GetEnvBool("ALLOW_SCOPE_DOWNSCOPING", false))
+	accessGen := token.NewJWTTokenGenerator("jwt-key", []byte(jwtSecret), goAuth.apiClientStore, scopeAuthority)
 	goAuth.manager.MapAccessGenerate(accessGen)
+	goAuth.tokenExchanger = token.NewTokenExchanger([]byte(jwtSecret), goAuth.tokenStore, goAuth.apiClientStore, goAuth.scopeRegistry, time.Duration(accessTTL)*time.Second)
 	goAuth.manager.SetAuthorizeCodeExp(time.Duration(codeTTL) * time.Second)
+	// Only the device authorization grant issues refresh tokens, since a device without a browser cannot send the user
+	// through the login again when its access token expires.
 	goAuth.manager.SetAuthorizeCodeTokenCfg(&manage.Config{
+		AccessTokenExp:    time.Duration(accessTTL) * time.Second,
+		RefreshTokenExp:   time.Duration(refreshTTL) * time.Second,
+		IsGenerateRefresh: false,
+	})
+	goAuth.manager.SetGrantTypeConfig(oauth2.GrantType(bizapiclient.GrantTypeDeviceCode), &manage.Config{
 		AccessTokenExp:    time.Duration(accessTTL) * time.Second,
 		RefreshTokenExp:   time.Duration(refreshTTL) * time.Second,
 		IsGenerateRefresh: true,
@@ -91,7 +214,37 @@ func InitializeGoAuth(dbConn *gorm.DB, isLocalDev bool) (*GoAuth, error) {
 
 	goAuth.srv = server.NewDefaultServer(goAuth.manager)
 	goAuth.srv.SetAllowGetAccessRequest(true)
-	goAuth.srv.SetClientInfoHandler(server.ClientFormHandler)
+
+	// Client assertions are single use. Like device codes, their IDs have to be in Redis once there is more than one
+	// instance, or an assertion could be replayed against another instance.
+	var jtiStore jtistore.JTIStore
+	switch store := osutil.GetEnvString("JTI_STORE", "memory"); store {
+	case "redis":
+		logger.Info("Initializing JTI store in Redis.")
+		jtiStore = jtistore.NewRedisJTIStore(newRedisClient())
+	case "memory":
+		logger.Info("Initializing JTI store in memory.")
+		jtiStore = jtistore.NewMemoryJTIStore()
+	default:
+		return nil, fmt.Errorf("unknown JTI store: %s", store)
+	}
+	goAuth.issuer = osutil.GetEnvString("ISSUER", "http://localhost:9096/"+osutil.GetEnvString("AUTH_ROUTE_NAME", "auth"))
+	clientCAs, err := loadClientCAs(osutil.GetEnvString("TLS_CLIENT_CA_FILE", ""))
+	if err != nil {
+		return nil, err
+	}
+	goAuth.clientAuth = bizclientauth.NewClientAuthenticator(goAuth.apiClientStore, jtiStore,
+		[]string{goAuth.issuer, goAuth.issuer + "/token", goAuth.issuer + "/par",
+			goAuth.issuer + "/revoke", goAuth.issuer + "/introspect"}, clientCAs)
+	goAuth.srv.SetClientInfoHandler(goAuth.clientAuth.ClientInfoHandler)
+
+	// DPoP proofs name the URL they were made for, which clients know by the issuer's origin.
+	issuerURL, err := url.Parse(goAuth.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid issuer %s: %v", goAuth.issuer, err)
+	}
+	goAuth.proofVerifier = dpop.NewProofVerifier(issuerURL.Scheme+"://"+issuerURL.Host, jtiStore,
+		time.Duration(osutil.GetEnvInt("DPOP_PROOF_MAX_AGE", 60))*time.Second)
 
 	//create default local dev user
 	if isLocalDev {
@@ -106,17 +259,89 @@ func InitializeGoAuth(dbConn *gorm.DB, isLocalDev bool) (*GoAuth, error) {
 		}
 	}
 
-	goAuthHandler := &GoAuthHandler{
-		dbConn: dbConn,
+	goAuth.goAuthHandler = &GoAuthHandler{
+		dbConn:         dbConn,
+		passwordHasher: passwordHasher,
+		apiClientStore: goAuth.apiClientStore,
+		auditor:        auditor,
 	}
 
-	goAuth.srv.SetUserAuthorizationHandler(goAuthHandler.userAuthorizationHandler)
-	goAuth.srv.SetInternalErrorHandler(goAuthHandler.setInternalErrorHandler)
-	goAuth.srv.SetResponseErrorHandler(goAuthHandler.setResponseErrorHandler)
+	goAuth.srv.SetUserAuthorizationHandler(goAuth.goAuthHandler.userAuthorizationHandler)
+	goAuth.srv.SetRefreshingValidationHandler(goAuth.goAuthHandler.refreshingValidationHandler)
+	goAuth.srv.SetClientAuthorizedHandler(goAuth.goAuthHandler.clientAuthorizedHandler)
+	goAuth.srv.SetInternalErrorHandler(goAuth.goAuthHandler.setInternalErrorHandler)
+	goAuth.srv.SetResponseErrorHandler(goAuth.goAuthHandler.setResponseErrorHandler)
 
 	return goAuth, nil
 }
 
+func newRedisClient() *redis.Client {
+	redisHost := osutil.GetEnvString("REDIS_HOST", "localhost")
+	redisPort := osutil.GetEnvString("REDIS_PORT", "6379")
+	redisUser := osutil.GetEnvString("REDIS_USER", "default")
+	redisPassword := osutil.GetEnvString("REDIS_PASSWORD", "password")
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%s", redisHost, redisPort),
+		Password: redisPassword,
+		Username: redisUser,
+	})
+	client.AddHook(metrics.NewRedisHook())
+	if err := redisotel.InstrumentTracing(client); err != nil {
+		logger.Errorf("Failed to instrument Redis client for tracing: %v", err)
+	}
+	return client
+}
+
+func createDBScopeRecords(dbConn *gorm.DB, name string, description string, consentText string, parents []string) error {
+	var scope dbmodel.Scope
+	result := dbConn.Where("name = ?", name).First(&scope)
+	if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
+		return fmt.Errorf("error checking scope: %v", result.Error)
+	}
+
+	if result.RowsAffected == 0 {
+		scope = dbmodel.Scope{
+			Name:        name,
+			Description: description,
+			ConsentText: consentText,
+		}
+		if err := dbConn.Create(&scope).Error; err != nil {
+			return fmt.Errorf("failed to create scope: %v", err)
+		}
+	}
+
+	for _, parent := range parents {
+		var scopeParent dbmodel.ScopeParent
+		result = dbConn.Where("scope = ? AND parent = ?", name, parent).First(&scopeParent)
+		if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
+			return fmt.Errorf("error checking scope parent: %v", result.Error)
+		}
+
+		if result.RowsAffected == 0 {
+			scopeParent = dbmodel.ScopeParent{
+				Scope:  name,
+				Parent: parent,
+			}
+			if err := dbConn.Create(&scopeParent).Error; err != nil {
+				return fmt.Errorf("failed to create scope parent: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func createDefaultScopeRecords(dbConn *gorm.DB) error {
+	for _, scope := range defaults.DEFAULT_SCOPES {
+		err := createDBScopeRecords(dbConn, scope["name"].(string), scope["description"].(string), scope["consent_text"].(string), scope["parents"].([]string))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func createDBRoleRecords(dbConn *gorm.DB, roleId int, roleDescription string, roleScopes []string) error {
 	var role dbmodel.Role
 	result := dbConn.Where("description = ?", roleDescription).First(&role)
@@ -219,18 +444,18 @@ func createLocalDevUser(dbConn *gorm.DB) error {
 	return nil
 }
 
-func initializeAPIClientStore(dbConn *gorm.DB, isLocalDev bool) (*store.ClientStore, *bizapiclient.APIClientStore, error) {
-	apiClientStore := bizapiclient.NewAPIClientStore(dbConn, isLocalDev)
-
-	goauthClientStore := store.NewClientStore()
-	goauthClients := apiClientStore.GetAPIClients()
-	for _, client := range goauthClients {
-		goauthClientStore.Set(client.ID, &oauthmodels.Client{
-			ID:     client.ID,
-			Secret: client.Secret,
-			Domain: client.Domain,
-		})
+// loadClientCAs loads the CAs issuing the certificates of tls_client_auth clients. Without a file, no CA is trusted.
+func loadClientCAs(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
 	}
-
-	return goauthClientStore, apiClientStore, nil
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", caFile)
+	}
+	return pool, nil
 }
@@ -6,20 +6,30 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 
 	"github.com/go-oauth2/oauth2/v4"
 	"github.com/go-oauth2/oauth2/v4/errors"
 	"github.com/go-oauth2/oauth2/v4/models"
 	"github.com/kdjuwidja/aishoppercommon/logger"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"netherealmstudio.com/m/v2/metrics"
+	"netherealmstudio.com/m/v2/tracing"
 )
 
 const (
 	scriptSHAKey = "SHA:createScript"
+	// tooManyTokensReply is returned by lua/create.lua when the user already holds the maximum number of access tokens.
+	tooManyTokensReply = "ERROR: too many access tokens"
+	// exchangePrefix is the key prefix of access tokens issued by the token exchange.
+	exchangePrefix = "exchange"
 )
 
 type JWTTokenStore struct {
 	redisClient *redis.Client
+	// keyCacheMu guards keyCache, which the token endpoint writes while the token verifier reads it.
+	keyCacheMu  sync.RWMutex
 	keyCache    map[string]string
 	script      string
 	hasKeyLimit bool
@@ -98,7 +108,10 @@ func (jwtts *JWTTokenStore) executiveScript(ctx context.Context, script string,
 	}
 }
 
-func (jwtts *JWTTokenStore) Create(ctx context.Context, info oauth2.TokenInfo) error {
+func (jwtts *JWTTokenStore) Create(ctx context.Context, info oauth2.TokenInfo) (err error) {
+	ctx, span := tracing.Start(ctx, "JWTTokenStore.Create", attribute.String("client_id", info.GetClientID()))
+	defer func() { tracing.End(span, err) }()
+
 	jv, err := json.Marshal(info)
 	if err != nil {
 		return err
@@ -116,25 +129,63 @@ func (jwtts *JWTTokenStore) Create(ctx context.Context, info oauth2.TokenInfo) e
 			fmt.Sprintf("%.0f", info.GetRefreshExpiresIn().Seconds()),
 			string(jv))
 		if err != nil {
+			metrics.TokenStoreError("create", metrics.TokenStoreRedisError)
 			return err
 		}
 
 		if reply != "SUCCESS" {
+			if reply == tooManyTokensReply {
+				metrics.TokenStoreError("create", metrics.TokenStoreTooManyTokens)
+			} else {
+				metrics.TokenStoreError("create", metrics.TokenStoreScriptError)
+			}
 			return errors.New(reply)
 		}
 	} else {
+		jwtts.keyCacheMu.Lock()
 		jwtts.keyCache["code:"+info.GetCode()] = string(jv)
 		jwtts.keyCache["access:"+info.GetAccess()] = string(jv)
 		jwtts.keyCache["refresh:"+info.GetRefresh()] = string(jv)
+		jwtts.keyCacheMu.Unlock()
 	}
 
 	return nil
 }
 
-func (jwtts *JWTTokenStore) getBySearchKeyMatching(ctx context.Context, prefix string, searchKey string) (oauth2.TokenInfo, error) {
+// CreateExchanged stores an access token issued by the token exchange. Exchanged tokens are kept under their own prefix,
+// which the create script does not count, so that services exchanging a user's token do not use up the user's limit.
+func (jwtts *JWTTokenStore) CreateExchanged(ctx context.Context, info oauth2.TokenInfo) (err error) {
+	ctx, span := tracing.Start(ctx, "JWTTokenStore.CreateExchanged", attribute.String("client_id", info.GetClientID()))
+	defer func() { tracing.End(span, err) }()
+
+	jv, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	if jwtts.hasKeyLimit {
+		key := exchangePrefix + ":" + info.GetUserID() + ":" + info.GetAccess()
+		if err := jwtts.redisClient.Set(ctx, key, string(jv), info.GetAccessExpiresIn()).Err(); err != nil {
+			metrics.TokenStoreError("create", metrics.TokenStoreRedisError)
+			return err
+		}
+	} else {
+		jwtts.keyCacheMu.Lock()
+		jwtts.keyCache[exchangePrefix+":"+info.GetAccess()] = string(jv)
+		jwtts.keyCacheMu.Unlock()
+	}
+
+	return nil
+}
+
+func (jwtts *JWTTokenStore) getBySearchKeyMatching(ctx context.Context, prefix string, searchKey string) (_ oauth2.TokenInfo, err error) {
+	ctx, span := tracing.Start(ctx, "JWTTokenStore.Get", attribute.String("token.kind", prefix))
+	defer func() { tracing.End(span, err) }()
+
 	if jwtts.hasKeyLimit {
 		keys, err := jwtts.redisClient.Keys(ctx, prefix+":*:"+searchKey).Result()
 		if err != nil {
+			metrics.TokenStoreError("get", metrics.TokenStoreRedisError)
 			return nil, err
 		}
 
@@ -146,6 +197,7 @@ func (jwtts *JWTTokenStore) getBySearchKeyMatching(ctx context.Context, prefix s
 		key := keys[0]
 		data, err := jwtts.redisClient.Get(ctx, key).Result()
 		if err != nil {
+			metrics.TokenStoreError("get", metrics.TokenStoreRedisError)
 			return nil, err
 		}
 
@@ -156,7 +208,9 @@ func (jwtts *JWTTokenStore) getBySearchKeyMatching(ctx context.Context, prefix s
 
 		return &tokenInfo, nil
 	} else {
+		jwtts.keyCacheMu.RLock()
 		key, ok := jwtts.keyCache[prefix+":"+searchKey]
+		jwtts.keyCacheMu.RUnlock()
 		if !ok {
 			return nil, errors.ErrInvalidAccessToken
 		}
@@ -174,8 +228,46 @@ func (jwtts *JWTTokenStore) GetByCode(ctx context.Context, code string) (oauth2.
 	return jwtts.getBySearchKeyMatching(ctx, "code", code)
 }
 
+// GetByAccess looks up access tokens issued by the token endpoint and by the token exchange.
 func (jwtts *JWTTokenStore) GetByAccess(ctx context.Context, access string) (oauth2.TokenInfo, error) {
-	return jwtts.getBySearchKeyMatching(ctx, "access", access)
+	ti, err := jwtts.getBySearchKeyMatching(ctx, "access", access)
+	if err == errors.ErrInvalidAccessToken {
+		return jwtts.getBySearchKeyMatching(ctx, exchangePrefix, access)
+	}
+	return ti, err
+}
+
+// IsAccessIssued reports whether the access token was issued to the user, by the token endpoint or the token exchange,
+// and has not been removed since. Unlike GetByAccess, it looks up the user's keys for the token directly rather than
+// scanning the keyspace for it, so that it can run on every authenticated request.
+func (jwtts *JWTTokenStore) IsAccessIssued(ctx context.Context, userID string, access string) (_ bool, err error) {
+	ctx, span := tracing.Start(ctx, "JWTTokenStore.IsAccessIssued")
+	defer func() { tracing.End(span, err) }()
+
+	if jwtts.hasKeyLimit {
+		count, err := jwtts.redisClient.Exists(ctx, "access:"+userID+":"+access, exchangePrefix+":"+userID+":"+access).Result()
+		if err != nil {
+			metrics.TokenStoreError("get", metrics.TokenStoreRedisError)
+			return false, err
+		}
+		return count > 0, nil
+	} else {
+		jwtts.keyCacheMu.RLock()
+		defer jwtts.keyCacheMu.RUnlock()
+		for _, prefix := range []string{"access", exchangePrefix} {
+			data, ok := jwtts.keyCache[prefix+":"+access]
+			if !ok {
+				continue
+			}
+
+			var tokenInfo models.Token
+			if err := json.Unmarshal([]byte(data), &tokenInfo); err != nil {
+				return false, err
+			}
+			return tokenInfo.UserID == userID, nil
+		}
+		return false, nil
+	}
 }
 
 func (jwtts *JWTTokenStore) GetByRefresh(ctx context.Context, refresh string) (oauth2.TokenInfo, error) {
@@ -183,10 +275,14 @@ func (jwtts *JWTTokenStore) GetByRefresh(ctx context.Context, refresh string) (o
 
 }
 
-func (jwtts *JWTTokenStore) removeBySearchKeyMatching(ctx context.Context, prefix string, searchKey string) error {
+func (jwtts *JWTTokenStore) removeBySearchKeyMatching(ctx context.Context, prefix string, searchKey string) (err error) {
+	ctx, span := tracing.Start(ctx, "JWTTokenStore.Remove", attribute.String("token.kind", prefix))
+	defer func() { tracing.End(span, err) }()
+
 	if jwtts.hasKeyLimit {
 		keys, err := jwtts.redisClient.Keys(ctx, prefix+":*:"+searchKey).Result()
 		if err != nil {
+			metrics.TokenStoreError("remove", metrics.TokenStoreRedisError)
 			return err
 		}
 
@@ -196,8 +292,14 @@ func (jwtts *JWTTokenStore) removeBySearchKeyMatching(ctx context.Context, prefi
 
 		//should only have exactly one key
 		key := keys[0]
-		return jwtts.redisClient.Del(ctx, key).Err()
+		if err := jwtts.redisClient.Del(ctx, key).Err(); err != nil {
+			metrics.TokenStoreError("remove", metrics.TokenStoreRedisError)
+			return err
+		}
+		return nil
 	} else {
+		jwtts.keyCacheMu.Lock()
+		defer jwtts.keyCacheMu.Unlock()
 		_, ok := jwtts.keyCache[prefix+":"+searchKey]
 		if !ok {
 			return errors.ErrInvalidAccessToken
@@ -213,9 +315,76 @@ func (jwtts *JWTTokenStore) RemoveByCode(ctx context.Context, code string) error
 }
 
 func (jwtts *JWTTokenStore) RemoveByAccess(ctx context.Context, access string) error {
-	return jwtts.removeBySearchKeyMatching(ctx, "access", access)
+	err := jwtts.removeBySearchKeyMatching(ctx, "access", access)
+	if err == errors.ErrInvalidAccessToken {
+		return jwtts.removeBySearchKeyMatching(ctx, exchangePrefix, access)
+	}
+	return err
 }
 
 func (jwtts *JWTTokenStore) RemoveByRefresh(ctx context.Context, refresh string) error {
 	return jwtts.removeBySearchKeyMatching(ctx, "refresh", refresh)
 }
+
+// RemoveByUserID removes every code, access, exchanged and refresh token issued to the given user.
+func (jwtts *JWTTokenStore) RemoveByUserID(ctx context.Context, userID string) (err error) {
+	ctx, span := tracing.Start(ctx, "JWTTokenStore.RemoveByUserID")
+	defer func() { tracing.End(span, err) }()
+
+	if jwtts.hasKeyLimit {
+		for _, prefix := range []string{"code", "access", exchangePrefix, "refresh"} {
+			keys, err := jwtts.redisClient.Keys(ctx, prefix+":"+userID+":*").Result()
+			if err != nil {
+				return err
+			}
+
+			if len(keys) == 0 {
+				continue
+			}
+
+			if err := jwtts.redisClient.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else {
+		jwtts.keyCacheMu.Lock()
+		defer jwtts.keyCacheMu.Unlock()
+		for key, data := range jwtts.keyCache {
+			var tokenInfo models.Token
+			if err := json.Unmarshal([]byte(data), &tokenInfo); err != nil {
+				return err
+			}
+
+			if tokenInfo.UserID == userID {
+				delete(jwtts.keyCache, key)
+			}
+		}
+		return nil
+	}
+}
+
+// HasKeyLimit reports whether tokens are kept in Redis with a limit on the number of keys per user.
+func (jwtts *JWTTokenStore) HasKeyLimit() bool {
+	return jwtts.hasKeyLimit
+}
+
+// CheckReady pings Redis and makes sure the create script is loaded into it. Loading the script is idempotent, so that
+// after a Redis restart or SCRIPT FLUSH the instance becomes ready again without waiting for a token to be created.
+func (jwtts *JWTTokenStore) CheckReady(ctx context.Context) error {
+	if !jwtts.hasKeyLimit {
+		return nil
+	}
+	if err := jwtts.redisClient.Ping(ctx).Err(); err != nil {
+		return err
+	}
+	if jwtts.script == "" {
+		return fmt.Errorf("create script is empty")
+	}
+
+	sha, err := jwtts.redisClient.ScriptLoad(ctx, jwtts.script).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load create script: %v", err)
+	}
+	return jwtts.redisClient.Set(ctx, scriptSHAKey, sha, 0).Err()
+}
@@ -2,13 +2,21 @@ package goauth
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/kdjuwidja/aishoppercommon/logger"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	"netherealmstudio.com/m/v2/token"
 )
 
 // lua script is created after the first running of the test. In order to test the create and reuse of the script, we may need to directly shell into redis and flush the script.
@@ -69,6 +77,14 @@ func TestJWTTokenStoreWithKeyLimit(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, token.UserID, foundToken.GetUserID())
 
+		// Test IsAccessIssued
+		issued, err := store.(*JWTTokenStore).IsAccessIssued(ctx, token.UserID, token.Access)
+		assert.NoError(t, err)
+		assert.True(t, issued)
+		issued, err = store.(*JWTTokenStore).IsAccessIssued(ctx, "other_user", token.Access)
+		assert.NoError(t, err)
+		assert.False(t, issued)
+
 		// Test GetByRefresh
 		foundToken, err = store.GetByRefresh(ctx, token.Refresh)
 		assert.NoError(t, err)
@@ -85,6 +101,9 @@ func TestJWTTokenStoreWithKeyLimit(t *testing.T) {
 		assert.NoError(t, err)
 		_, err = store.GetByAccess(ctx, token.Access)
 		assert.Error(t, err)
+		issued, err = store.(*JWTTokenStore).IsAccessIssued(ctx, token.UserID, token.Access)
+		assert.NoError(t, err)
+		assert.False(t, issued)
 
 		// Test RemoveByRefresh
 		err = store.RemoveByRefresh(ctx, token.Refresh)
@@ -158,6 +177,14 @@ func TestJWTTokenStore(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, token.UserID, foundToken.GetUserID())
 
+		// Test IsAccessIssued
+		issued, err := store.(*JWTTokenStore).IsAccessIssued(ctx, token.UserID, token.Access)
+		assert.NoError(t, err)
+		assert.True(t, issued)
+		issued, err = store.(*JWTTokenStore).IsAccessIssued(ctx, "other_user", token.Access)
+		assert.NoError(t, err)
+		assert.False(t, issued)
+
 		// Test GetByRefresh
 		foundToken, err = store.GetByRefresh(ctx, token.Refresh)
 		assert.NoError(t, err)
@@ -174,6 +201,9 @@ func TestJWTTokenStore(t *testing.T) {
 		assert.NoError(t, err)
 		_, err = store.GetByAccess(ctx, token.Access)
 		assert.Error(t, err)
+		issued, err = store.(*JWTTokenStore).IsAccessIssued(ctx, token.UserID, token.Access)
+		assert.NoError(t, err)
+		assert.False(t, issued)
 
 		// Test RemoveByRefresh
 		err = store.RemoveByRefresh(ctx, token.Refresh)
@@ -203,4 +233,184 @@ func TestJWTTokenStore(t *testing.T) {
 		err = store.RemoveByRefresh(ctx, "non_existent_refresh")
 		assert.Error(t, err)
 	})
+
+	t.Run("Remove By User ID", func(t *testing.T) {
+		tokens := []*models.Token{
+			{ClientID: "test_client", UserID: "user_a", Access: "access_a1", Code: "code_a1", AccessExpiresIn: time.Duration(accessTTL) * time.Second},
+			{ClientID: "test_client", UserID: "user_a", Access: "access_a2", AccessExpiresIn: time.Duration(accessTTL) * time.Second},
+			{ClientID: "test_client", UserID: "user_b", Access: "access_b1", AccessExpiresIn: time.Duration(accessTTL) * time.Second},
+		}
+		for _, token := range tokens {
+			assert.NoError(t, store.Create(ctx, token))
+		}
+
+		err := store.(*JWTTokenStore).RemoveByUserID(ctx, "user_a")
+		assert.NoError(t, err)
+
+		_, err = store.GetByAccess(ctx, "access_a1")
+		assert.Error(t, err)
+		_, err = store.GetByAccess(ctx, "access_a2")
+		assert.Error(t, err)
+		_, err = store.GetByCode(ctx, "code_a1")
+		assert.Error(t, err)
+
+		foundToken, err := store.GetByAccess(ctx, "access_b1")
+		assert.NoError(t, err)
+		assert.Equal(t, "user_b", foundToken.GetUserID())
+	})
+}
+
+type testExchangeClientStore map[string]*bizapiclient.APIClient
+
+func (s testExchangeClientStore) GetClient(clientID string) (*bizapiclient.APIClient, error) {
+	client, ok := s[clientID]
+	if !ok {
+		return nil, fmt.Errorf("client not found")
+	}
+	return client, nil
+}
+
+// Exchanged tokens do not count towards the user's limit, so a service calling others on behalf of the user cannot lock
+// the user out.
+func TestJWTTokenStoreExchangedTokensWithKeyLimit(t *testing.T) {
+	redisClient := redis.NewClient(&redis.Options{
+		Addr:     "localhost:7379",
+		Password: "testpassword",
+		Username: "default",
+	})
+
+	const maxNumKeys = 2
+	secret := []byte("test-secret")
+	ctx := context.Background()
+	store, err := InitializeJWTTokenStoreWithKeyLimit(redisClient, "../lua/create.lua", maxNumKeys)
+	require.NoError(t, err)
+	jwtStore := store.(*JWTTokenStore)
+	require.NoError(t, jwtStore.RemoveByUserID(ctx, "exchange_user"))
+
+	login := func() (string, error) {
+		access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"sub":   "exchange_user",
+			"scope": "shoplist",
+			"jti":   uuid.New().String(),
+		}).SignedString(secret)
+		require.NoError(t, err)
+		return access, store.Create(ctx, &models.Token{
+			ClientID:        "test_client",
+			UserID:          "exchange_user",
+			Scope:           "shoplist",
+			Access:          access,
+			AccessCreateAt:  time.Now(),
+			AccessExpiresIn: time.Hour,
+		})
+	}
+
+	subjectToken, err := login()
+	require.NoError(t, err)
+
+	registry := bizscope.NewStaticScopeRegistry([]*bizscope.ScopeDefinition{{Name: "shoplist"}})
+	clients := testExchangeClientStore{
+		"search": {ID: "search", Secret: "search-secret", ExchangeAudiences: "shoplist=shoplist"},
+	}
+	exchanger := token.NewTokenExchanger(secret, jwtStore, clients, registry, time.Hour)
+
+	var exchanged []string
+	for i := 0; i < maxNumKeys+1; i++ {
+		resp, err := exchanger.Exchange(ctx, &token.TokenExchangeRequest{
+			ClientID:         "search",
+			ClientSecret:     "search-secret",
+			SubjectToken:     subjectToken,
+			SubjectTokenType: token.TokenTypeAccessToken,
+			Audience:         "shoplist",
+		})
+		require.NoError(t, err)
+		exchanged = append(exchanged, resp.AccessToken)
+	}
+
+	// The user can still log in.
+	_, err = login()
+	require.NoError(t, err)
+	_, err = login()
+	assert.EqualError(t, err, tooManyTokensReply)
+
+	// Exchanged tokens are found and revoked like any other access token.
+	foundToken, err := store.GetByAccess(ctx, exchanged[0])
+	require.NoError(t, err)
+	assert.Equal(t, "exchange_user", foundToken.GetUserID())
+	issued, err := jwtStore.IsAccessIssued(ctx, "exchange_user", exchanged[0])
+	require.NoError(t, err)
+	assert.True(t, issued)
+
+	require.NoError(t, store.RemoveByAccess(ctx, exchanged[0]))
+	_, err = store.GetByAccess(ctx, exchanged[0])
+	assert.Error(t, err)
+	issued, err = jwtStore.IsAccessIssued(ctx, "exchange_user", exchanged[0])
+	require.NoError(t, err)
+	assert.False(t, issued)
+
+	require.NoError(t, jwtStore.RemoveByUserID(ctx, "exchange_user"))
+	_, err = store.GetByAccess(ctx, exchanged[1])
+	assert.Error(t, err)
+}
+
+// TestJWTTokenStoreConcurrentAccess issues, verifies and revokes tokens in parallel, as the token endpoint and the token
+// verifier do. Run with -race to check the key cache.
+func TestJWTTokenStoreConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	store, err := InitializeJWTTokenStore()
+	require.NoError(t, err)
+	jwtStore := store.(*JWTTokenStore)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userID := fmt.Sprintf("user_%d", i%2)
+			for j := 0; j < 50; j++ {
+				access := fmt.Sprintf("access_%d_%d", i, j)
+				assert.NoError(t, store.Create(ctx, &models.Token{UserID: userID, Access: access, AccessExpiresIn: time.Hour}))
+				_, err := jwtStore.IsAccessIssued(ctx, userID, access)
+				assert.NoError(t, err)
+				if j%10 == 0 {
+					assert.NoError(t, jwtStore.RemoveByUserID(ctx, userID))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestJWTTokenStoreCheckReady(t *testing.T) {
+	redisClient := redis.NewClient(&redis.Options{
+		Addr:     "localhost:7379",
+		Password: "testpassword",
+		Username: "default",
+	})
+
+	ctx := context.Background()
+	store, err := InitializeJWTTokenStoreWithKeyLimit(redisClient, "../lua/create.lua", 5)
+	require.NoError(t, err)
+	jwtStore := store.(*JWTTokenStore)
+	defer jwtStore.RemoveByUserID(ctx, "ready_user")
+
+	require.NoError(t, jwtStore.CheckReady(ctx))
+	sha, err := redisClient.Get(ctx, scriptSHAKey).Result()
+	require.NoError(t, err)
+
+	// A Redis restart drops the script. The check loads it again, since an instance that is not ready gets no token
+	// requests that would load it.
+	require.NoError(t, redisClient.ScriptFlush(ctx).Err())
+	require.NoError(t, jwtStore.CheckReady(ctx))
+	exists, err := redisClient.ScriptExists(ctx, sha).Result()
+	require.NoError(t, err)
+	assert.True(t, exists[0])
+
+	require.NoError(t, store.Create(ctx, &models.Token{
+		ClientID:        "test_client",
+		UserID:          "ready_user",
+		Access:          "ready_access_token",
+		AccessCreateAt:  time.Now(),
+		AccessExpiresIn: time.Hour,
+	}))
 }
@@ -0,0 +1,103 @@
+package goauth
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/errors"
+	"github.com/go-oauth2/oauth2/v4/manage"
+	"github.com/go-oauth2/oauth2/v4/models"
+)
+
+// Manager is the go-oauth2 manager with token configs for the grant types that are handled outside go-oauth2, such as
+// the device authorization grant. go-oauth2 only keeps configs for its own grant types, and issues tokens of any other
+// grant type without a refresh token.
+type Manager struct {
+	*manage.Manager
+	accessGenerate oauth2.AccessGenerate
+	tokenStore     oauth2.TokenStore
+	gtcfg          map[oauth2.GrantType]*manage.Config
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		Manager: manage.NewDefaultManager(),
+		gtcfg:   map[oauth2.GrantType]*manage.Config{},
+	}
+}
+
+// SetGrantTypeConfig sets the token config of a grant type that go-oauth2 does not know.
+func (m *Manager) SetGrantTypeConfig(gt oauth2.GrantType, cfg *manage.Config) {
+	m.gtcfg[gt] = cfg
+}
+
+func (m *Manager) MapAccessGenerate(gen oauth2.AccessGenerate) {
+	m.Manager.MapAccessGenerate(gen)
+	m.accessGenerate = gen
+}
+
+func (m *Manager) MustTokenStorage(stor oauth2.TokenStore, err error) {
+	m.Manager.MustTokenStorage(stor, err)
+	m.tokenStore = stor
+}
+
+// GenerateAccessToken issues the tokens of grant types with a config from SetGrantTypeConfig the same way go-oauth2
+// issues the tokens of its own grant types, and leaves every other grant type to go-oauth2.
+func (m *Manager) GenerateAccessToken(ctx context.Context, gt oauth2.GrantType, tgr *oauth2.TokenGenerateRequest) (oauth2.TokenInfo, error) {
+	gcfg, ok := m.gtcfg[gt]
+	if !ok {
+		return m.Manager.GenerateAccessToken(ctx, gt, tgr)
+	}
+
+	cli, err := m.GetClient(ctx, tgr.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if cliPass, ok := cli.(oauth2.ClientPasswordVerifier); ok {
+		if !cliPass.VerifyPassword(tgr.ClientSecret) {
+			return nil, errors.ErrInvalidClient
+		}
+	} else if len(cli.GetSecret()) > 0 && tgr.ClientSecret != cli.GetSecret() {
+		return nil, errors.ErrInvalidClient
+	}
+
+	ti := models.NewToken()
+	ti.SetClientID(tgr.ClientID)
+	ti.SetUserID(tgr.UserID)
+	ti.SetRedirectURI(tgr.RedirectURI)
+	ti.SetScope(tgr.Scope)
+
+	createAt := time.Now()
+	ti.SetAccessCreateAt(createAt)
+	aexp := gcfg.AccessTokenExp
+	if exp := tgr.AccessTokenExp; exp > 0 {
+		aexp = exp
+	}
+	ti.SetAccessExpiresIn(aexp)
+	if gcfg.IsGenerateRefresh {
+		ti.SetRefreshCreateAt(createAt)
+		ti.SetRefreshExpiresIn(gcfg.RefreshTokenExp)
+	}
+
+	av, rv, err := m.accessGenerate.Token(ctx, &oauth2.GenerateBasic{
+		Client:    cli,
+		UserID:    tgr.UserID,
+		CreateAt:  createAt,
+		TokenInfo: ti,
+		Request:   tgr.Request,
+	}, gcfg.IsGenerateRefresh)
+	if err != nil {
+		return nil, err
+	}
+	ti.SetAccess(av)
+	if rv != "" {
+		ti.SetRefresh(rv)
+	}
+
+	if err := m.tokenStore.Create(ctx, ti); err != nil {
+		return nil, err
+	}
+
+	return ti, nil
+}
@@ -0,0 +1,43 @@
+package jtistore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// JTIStore remembers the IDs of JWTs that were already presented, so that a captured JWT cannot be replayed.
+type JTIStore interface {
+	// Use records the JWT ID until expiresAt. It returns false if the ID is already recorded and has not expired.
+	Use(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
+}
+
+// MemoryJTIStore keeps JWT IDs in memory, which only protects against replays on the same instance.
+type MemoryJTIStore struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func NewMemoryJTIStore() *MemoryJTIStore {
+	return &MemoryJTIStore{
+		used: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryJTIStore) Use(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, removeAt := range s.used {
+		if !now.Before(removeAt) {
+			delete(s.used, id)
+		}
+	}
+
+	if _, ok := s.used[jti]; ok {
+		return false, nil
+	}
+	s.used[jti] = expiresAt
+	return true, nil
+}
@@ -0,0 +1,40 @@
+package jtistore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryJTIStore_Use(t *testing.T) {
+	store := NewMemoryJTIStore()
+	ctx := context.Background()
+
+	ok, err := store.Use(ctx, "client:1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = store.Use(ctx, "client:1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, ok, "a JWT ID can only be used once")
+
+	ok, err = store.Use(ctx, "client:2", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestMemoryJTIStore_ForgetsExpired(t *testing.T) {
+	store := NewMemoryJTIStore()
+	ctx := context.Background()
+
+	ok, err := store.Use(ctx, "client:1", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = store.Use(ctx, "client:1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
@@ -0,0 +1,30 @@
+package jtistore
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const jtiKeyPrefix = "jti:"
+
+// RedisJTIStore keeps JWT IDs in Redis so that a JWT used on one instance is rejected by every other instance.
+type RedisJTIStore struct {
+	redisClient *redis.Client
+}
+
+func NewRedisJTIStore(redisClient *redis.Client) *RedisJTIStore {
+	return &RedisJTIStore{
+		redisClient: redisClient,
+	}
+}
+
+func (s *RedisJTIStore) Use(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		// Expired JWTs are rejected before their ID is checked, so there is nothing to remember.
+		return true, nil
+	}
+	return s.redisClient.SetNX(ctx, jtiKeyPrefix+jti, 1, ttl).Result()
+}
@@ -0,0 +1,237 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningMethods are the asymmetric JWS algorithms accepted for JWTs verified against a client's key set.
+var SigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+var ErrNoMatchingKey = errors.New("no key in the key set matches the token")
+
+// KeySet is a parsed JSON Web Key Set (RFC 7517) holding the public keys a client signs its JWTs with.
+type KeySet struct {
+	keys []key
+}
+
+type key struct {
+	kid       string
+	alg       string
+	publicKey crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d"`
+}
+
+// Parse parses a JWKS document. Keys meant for encryption are skipped, and a set without a usable signing key is an
+// error.
+func Parse(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	set := &KeySet{}
+	for i, jwk := range doc.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		publicKey, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %d in JWKS: %v", i, err)
+		}
+		set.keys = append(set.keys, key{kid: jwk.Kid, alg: jwk.Alg, publicKey: publicKey})
+	}
+	if len(set.keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no signing keys")
+	}
+	return set, nil
+}
+
+// PublicKeys returns the signing keys of the set.
+func (s *KeySet) PublicKeys() []crypto.PublicKey {
+	publicKeys := make([]crypto.PublicKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		publicKeys = append(publicKeys, k.publicKey)
+	}
+	return publicKeys
+}
+
+// ParseKey parses a single public JWK, such as the one in the header of a DPoP proof. Private keys are rejected.
+func ParseKey(data []byte) (crypto.PublicKey, error) {
+	var jwk jsonWebKey
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, fmt.Errorf("invalid JWK: %v", err)
+	}
+	return jwk.publicKey()
+}
+
+// Thumbprint returns the base64url encoded JWK SHA-256 thumbprint of RFC 7638 of a public JWK.
+func Thumbprint(data []byte) (string, error) {
+	var jwk jsonWebKey
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return "", fmt.Errorf("invalid JWK: %v", err)
+	}
+
+	// The thumbprint covers only the required members of the key type, in lexicographic order.
+	var members []byte
+	var err error
+	switch jwk.Kty {
+	case "RSA":
+		members, err = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N})
+	case "EC":
+		members, err = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y})
+	case "OKP":
+		members, err = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X})
+	default:
+		return "", fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(members)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.D != "" {
+		return nil, fmt.Errorf("private keys are not accepted")
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Keyfunc returns the key a token was signed with, picked by the kid header if the token has one and by the key
+// type its algorithm needs. Use it together with jwt.WithValidMethods(SigningMethods).
+func (s *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	kid, _ := token.Header["kid"].(string)
+
+	for _, k := range s.keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		if FitsAlgorithm(k.publicKey, alg) {
+			return k.publicKey, nil
+		}
+	}
+	return nil, ErrNoMatchingKey
+}
+
+var ecdsaAlgorithms = map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}
+
+// FitsAlgorithm reports whether the public key can verify signatures of the JWS algorithm.
+func FitsAlgorithm(publicKey crypto.PublicKey, alg string) bool {
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return ecdsaAlgorithms[publicKey.Curve.Params().Name] == alg
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	default:
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) string {
+	return fmt.Sprintf(`{"kty":"RSA","kid":%q,"n":%q,"e":%q}`, kid, encode(key.N.Bytes()), encode(big.NewInt(int64(key.E)).Bytes()))
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) string {
+	return fmt.Sprintf(`{"kty":"EC","kid":%q,"crv":"P-256","x":%q,"y":%q}`, kid, encode(key.X.Bytes()), encode(key.Y.Bytes()))
+}
+
+func TestKeySet_Keyfunc(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	set, err := Parse([]byte(`{"keys":[` + rsaJWK("rsa-1", &rsaKey.PublicKey) + `,` + ecJWK("ec-1", &ecKey.PublicKey) + `]}`))
+	require.NoError(t, err)
+
+	parse := func(signed string) error {
+		_, err := jwt.Parse(signed, set.Keyfunc, jwt.WithValidMethods(SigningMethods))
+		return err
+	}
+
+	// Keys are picked by kid, and by key type without one.
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "client"}).SignedString(rsaKey)
+	require.NoError(t, err)
+	assert.NoError(t, parse(signed))
+
+	withKid := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "client"})
+	withKid.Header["kid"] = "ec-1"
+	signed, err = withKid.SignedString(ecKey)
+	require.NoError(t, err)
+	assert.NoError(t, parse(signed))
+
+	withKid.Header["kid"] = "rsa-1"
+	signed, err = withKid.SignedString(ecKey)
+	require.NoError(t, err)
+	assert.Error(t, parse(signed))
+
+	// Symmetric algorithms are never accepted, even with a key derived from the key set.
+	signed, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "client"}).SignedString(rsaKey.PublicKey.N.Bytes())
+	require.NoError(t, err)
+	assert.Error(t, parse(signed))
+}
+
+func TestParse_Invalid(t *testing.T) {
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	for name, doc := range map[string]string{
+		"NotJSON":       `keys`,
+		"Empty":         `{"keys":[]}`,
+		"OnlyEncKeys":   `{"keys":[{"kty":"RSA","use":"enc","n":"AQAB","e":"AQAB"}]}`,
+		"UnknownType":   `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`,
+		"SmallRSAKey":   `{"keys":[` + rsaJWK("small", &smallKey.PublicKey) + `]}`,
+		"PointOffCurve": `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(doc))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// The example key of RFC 7638 section 3.1.
+	jwk := `{"kty":"RSA","e":"AQAB","alg":"RS256","kid":"2011-04-29","n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw"}`
+	thumbprint, err := Thumbprint([]byte(jwk))
+	require.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+
+	_, err = ParseKey([]byte(`{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ","d":"AQ"}`))
+	assert.Error(t, err, "private keys are rejected")
+}
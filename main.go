@@ -1,35 +1,71 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"html/template"
-	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/kdjuwidja/aishoppercommon/db"
 	"github.com/kdjuwidja/aishoppercommon/logger"
 	"github.com/kdjuwidja/aishoppercommon/osutil"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"netherealmstudio.com/m/v2/apiHandlers"
 	apiHandlersaccount "netherealmstudio.com/m/v2/apiHandlers/account"
+	apiHandlersaudit "netherealmstudio.com/m/v2/apiHandlers/audit"
 	apiHandlersauth "netherealmstudio.com/m/v2/apiHandlers/auth"
+	apiHandlersclient "netherealmstudio.com/m/v2/apiHandlers/client"
 	apiHandlersdev "netherealmstudio.com/m/v2/apiHandlers/dev"
 	apiHandlershealth "netherealmstudio.com/m/v2/apiHandlers/health"
+	apiHandlersrole "netherealmstudio.com/m/v2/apiHandlers/role"
+	apiHandlersuser "netherealmstudio.com/m/v2/apiHandlers/user"
+	bizaccount "netherealmstudio.com/m/v2/biz/account"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizaudit "netherealmstudio.com/m/v2/biz/audit"
+	bizdevice "netherealmstudio.com/m/v2/biz/device"
+	bizpassword "netherealmstudio.com/m/v2/biz/password"
 	bizregister "netherealmstudio.com/m/v2/biz/register"
+	bizrole "netherealmstudio.com/m/v2/biz/role"
+	bizuser "netherealmstudio.com/m/v2/biz/user"
 	dbmodel "netherealmstudio.com/m/v2/db"
 	"netherealmstudio.com/m/v2/goauth"
+	"netherealmstudio.com/m/v2/mailer"
+	"netherealmstudio.com/m/v2/metrics"
+	"netherealmstudio.com/m/v2/tlsconfig"
+	"netherealmstudio.com/m/v2/token"
+	"netherealmstudio.com/m/v2/tracing"
 )
 
 func main() {
 	isLocalDev := osutil.GetEnvString("IS_LOCAL_DEV", "true") == "true"
+	serviceName := osutil.GetEnvString("SERVICE_NAME", "auth")
+
+	shutdownTracing, err := tracing.Init(context.Background(), osutil.GetEnvString("TRACING_EXPORTER", tracing.ExporterNone), serviceName)
+	if err != nil {
+		logger.Fatalf("Failed to initialize tracing: %v", err)
+	}
 
 	models := []interface{}{
 		&dbmodel.APIClient{},
 		&dbmodel.User{},
 		&dbmodel.APIClientScope{},
+		&dbmodel.APIClientExchangeAudience{},
+		&dbmodel.Scope{},
+		&dbmodel.ScopeParent{},
 		&dbmodel.Role{},
 		&dbmodel.RoleScope{},
 		&dbmodel.UserRole{},
 		&dbmodel.RegistrationCode{},
+		&dbmodel.UserStatusChange{},
+		&dbmodel.EmailVerification{},
+		&dbmodel.AuditEvent{},
 	}
 
 	mysqlConn, err := db.InitializeMySQLConnectionPool(osutil.GetEnvString("USER_DB_USER", "ai_shopper_dev"),
@@ -46,6 +82,13 @@ func main() {
 	}
 	defer mysqlConn.Close()
 
+	if err := mysqlConn.GetDB().Use(metrics.NewGormPlugin()); err != nil {
+		logger.Fatalf("Failed to instrument database: %v", err)
+	}
+	if err := mysqlConn.GetDB().Use(tracing.NewGormPlugin()); err != nil {
+		logger.Fatalf("Failed to instrument database: %v", err)
+	}
+
 	// Migrate database
 	logger.Info("Migrating database...")
 	mysqlConn.AutoMigrate()
@@ -53,17 +96,69 @@ func main() {
 
 	// Load templates
 	tmpl := template.Must(template.ParseFiles("web/templates/login.html"))
+	registerTmpl := template.Must(template.ParseFiles("web/templates/register.html"))
+	deviceTmpl := template.Must(template.ParseFiles("web/templates/device.html"))
+
+	passwordHasher, err := bizpassword.NewPasswordHasher(osutil.GetEnvString("PASSWORD_HASH_ALGORITHM", bizpassword.AlgorithmArgon2id),
+		bizpassword.NewArgon2idAlgorithm(uint32(osutil.GetEnvInt("ARGON2_MEMORY_KIB", 64*1024)),
+			uint32(osutil.GetEnvInt("ARGON2_ITERATIONS", 3)),
+			uint8(osutil.GetEnvInt("ARGON2_PARALLELISM", 2))),
+		bizpassword.NewBcryptAlgorithm(osutil.GetEnvInt("BCRYPT_COST", 10)),
+	)
+	if err != nil {
+		logger.Fatalf("Failed to initialize password hasher: %v", err)
+	}
+
+	// Audit events are kept in the database for the admin query endpoint, and optionally written as JSON lines for log
+	// shippers.
+	auditStore := bizaudit.NewDBStore(mysqlConn.GetDB())
+	auditSinks := []bizaudit.Sink{auditStore}
+	if auditLogFile := osutil.GetEnvString("AUDIT_LOG_FILE", ""); auditLogFile != "" {
+		file, err := os.OpenFile(auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			logger.Fatalf("Failed to open audit log file: %v", err)
+		}
+		defer file.Close()
+		auditSinks = append(auditSinks, bizaudit.NewJSONLinesSink(file))
+	}
+	auditor := bizaudit.NewAuditor(auditSinks...)
 
-	goAuth, err := goauth.InitializeGoAuth(mysqlConn.GetDB(), isLocalDev)
+	goAuth, err := goauth.InitializeGoAuth(mysqlConn.GetDB(), isLocalDev, passwordHasher, auditor)
 	if err != nil {
 		logger.Fatalf("Failed to initialize GoAuth: %v", err)
 	}
 
+	// ctx is done on SIGTERM or SIGINT, which stops the background reloaders and starts the graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Reload API clients periodically and on SIGHUP
+	if reloadInterval := osutil.GetEnvInt("API_CLIENT_RELOAD_INTERVAL", 300); reloadInterval > 0 {
+		goAuth.StartAPIClientReloader(ctx, time.Duration(reloadInterval)*time.Second)
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			logger.Info("Received SIGHUP, reloading API clients...")
+			if _, err := goAuth.ReloadAPIClients(context.Background()); err != nil {
+				logger.Errorf("Failed to reload API clients: %v", err)
+			}
+		}
+	}()
+
 	// Initialize Gin router
 	router := gin.Default()
 	trustProxiesConf := osutil.GetEnvString("TRUST_PROXIES", "127.0.0.1")
 	trustProxies := strings.Split(trustProxiesConf, ",")
 	router.SetTrustedProxies(trustProxies)
+	router.Use(otelgin.Middleware(serviceName))
+	router.Use(metrics.Middleware())
+	requestInfo, err := apiHandlersaudit.RequestInfo(trustProxies)
+	if err != nil {
+		logger.Fatalf("Invalid TRUST_PROXIES: %v", err)
+	}
+	router.Use(requestInfo)
 
 	// CORS middleware
 	router.Use(func(c *gin.Context) {
@@ -91,30 +186,222 @@ func main() {
 	router.Static("/"+authRouteName+"/static", "./web/static")
 
 	// Initialize handlers
-	healthHandler := apiHandlershealth.InitializeHealthHandler()
-	authorizeHandler := apiHandlersauth.InitializeAuthorizeHandler(goAuth.GetSrv(), tmpl, goAuth.GetStateStore())
-	tokenHandler := apiHandlersauth.InitializeTokenHandler(goAuth.GetSrv(), goAuth.GetTokenStore())
+	readinessChecks := map[string]apiHandlershealth.Check{
+		"mysql": func(ctx context.Context) error {
+			sqlDB, err := mysqlConn.GetDB().DB()
+			if err != nil {
+				return err
+			}
+			return sqlDB.PingContext(ctx)
+		},
+	}
+	if goAuth.GetTokenStore().HasKeyLimit() {
+		readinessChecks["redis"] = goAuth.GetTokenStore().CheckReady
+	}
+	healthHandler := apiHandlershealth.InitializeHealthHandler(readinessChecks,
+		time.Duration(osutil.GetEnvInt("READINESS_TIMEOUT", 2))*time.Second)
+	requestObjectVerifier := token.NewRequestObjectVerifier(goAuth.GetIssuer())
+	authorizeHandler := apiHandlersauth.InitializeAuthorizeHandler(goAuth.GetSrv(), tmpl, goAuth.GetStateStore(), goAuth.GetPushedRequestStore(), requestObjectVerifier, goAuth.GetAPIClientStore())
+	parHandler := apiHandlersauth.InitializePARHandler(goAuth.GetPushedRequestStore(), requestObjectVerifier, goAuth.GetClientAuthenticator(),
+		time.Duration(osutil.GetEnvInt("PAR_REQUEST_TTL", 60))*time.Second)
+	deviceAuthorizer := bizdevice.NewDeviceAuthorizer(goAuth.GetDeviceStore(), goAuth.GetAPIClientStore(), bizdevice.DeviceAuthorizerConfig{
+		ExpiresIn:       time.Duration(osutil.GetEnvInt("DEVICE_CODE_TTL", 600)) * time.Second,
+		Interval:        osutil.GetEnvInt("DEVICE_POLL_INTERVAL", 5),
+		VerificationURI: osutil.GetEnvString("DEVICE_VERIFICATION_URI", "http://localhost:9096/"+authRouteName+"/device"),
+	})
+	tokenHandler := apiHandlersauth.InitializeTokenHandler(goAuth.GetSrv(), goAuth.GetTokenStore(), goAuth.GetAPIClientStore(), deviceAuthorizer, goAuth.GetTokenExchanger(), goAuth.GetProofVerifier(),
+		auditor, time.Duration(osutil.GetEnvInt("ACCESS_TTL", 3600))*time.Second)
+	revocationHandler := apiHandlersauth.InitializeRevocationHandler(goAuth.GetTokenStore(), goAuth.GetClientAuthenticator(), auditor)
 	responseFactory := apiHandlers.Initialize()
-	accountHandler := apiHandlersaccount.InitializeAccountHandler(bizregister.NewRegistrationManager(mysqlConn.GetDB(), 10, osutil.GetEnvInt("USER_ROLE_ID", 2)), responseFactory)
+	deviceHandler := apiHandlersauth.InitializeDeviceHandler(deviceTmpl, deviceAuthorizer, goAuth.GetAPIClientStore(), goAuth.GetClientAuthenticator(), goAuth, responseFactory)
+	var accountMailer mailer.Mailer
+	if smtpHost := osutil.GetEnvString("SMTP_HOST", ""); smtpHost != "" {
+		accountMailer = mailer.NewSMTPMailer(smtpHost,
+			osutil.GetEnvString("SMTP_PORT", "587"),
+			osutil.GetEnvString("SMTP_USER", ""),
+			osutil.GetEnvString("SMTP_PASSWORD", ""),
+			osutil.GetEnvString("SMTP_FROM", "no-reply@localhost"))
+	} else {
+		logger.Warn("SMTP not configured. Emails will be written to the log.")
+		accountMailer = mailer.NewLogMailer()
+	}
 
-	tokenVerifier := apiHandlers.InitializeTokenVerifier(*responseFactory)
+	var breachedPasswordList bizpassword.BreachedPasswordList
+	if breachedListPath := osutil.GetEnvString("BREACHED_PASSWORD_LIST", ""); breachedListPath != "" {
+		fileList, err := bizpassword.NewFileBreachedPasswordList(breachedListPath)
+		if err != nil {
+			logger.Fatalf("Failed to load breached password list: %v", err)
+		}
+		defer fileList.Close()
+		breachedPasswordList = fileList
+	}
+
+	passwordPolicy := bizpassword.NewPolicy(bizpassword.PolicyConfig{
+		MinLength:     osutil.GetEnvInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:     osutil.GetEnvInt("PASSWORD_MAX_LENGTH", bizpassword.BcryptMaxLength),
+		RequireUpper:  osutil.GetEnvBool("PASSWORD_REQUIRE_UPPER", false),
+		RequireLower:  osutil.GetEnvBool("PASSWORD_REQUIRE_LOWER", false),
+		RequireDigit:  osutil.GetEnvBool("PASSWORD_REQUIRE_DIGIT", false),
+		RequireSymbol: osutil.GetEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+		DisallowEmail: osutil.GetEnvBool("PASSWORD_DISALLOW_EMAIL", true),
+	}, breachedPasswordList)
+
+	accountManager := bizaccount.NewAccountManager(mysqlConn.GetDB(), passwordPolicy, passwordHasher, goAuth.GetTokenStore(), goAuth.GetScopeCache(), accountMailer,
+		osutil.GetEnvString("EMAIL_VERIFY_URL", "http://localhost:3000/verify-email"),
+		time.Duration(osutil.GetEnvInt("EMAIL_VERIFY_TTL", 86400))*time.Second)
+	registrationManager := bizregister.NewRegistrationManager(mysqlConn.GetDB(), 10, osutil.GetEnvInt("USER_ROLE_ID", 2),
+		time.Duration(osutil.GetEnvInt("REGISTRATION_CODE_TTL", 7*86400))*time.Second, passwordPolicy, passwordHasher,
+		bizregister.NewInviter(accountMailer, osutil.GetEnvString("INVITE_URL", "http://localhost:9096/"+authRouteName+"/register")),
+		osutil.GetEnvInt("REGISTRATION_CODE_MAX_BATCH", 500))
+	accountHandler := apiHandlersaccount.InitializeAccountHandler(registrationManager, accountManager, auditor, responseFactory)
+	registerHandler := apiHandlersauth.InitializeRegisterHandler(goAuth.GetSrv(), registerTmpl, goAuth.GetStateStore(), registrationManager, auditor, responseFactory)
+	userManager := bizuser.NewUserManager(mysqlConn.GetDB(), goAuth.GetTokenStore())
+	userHandler := apiHandlersuser.InitializeUserHandler(userManager, auditor, responseFactory)
+	roleHandler := apiHandlersrole.InitializeRoleHandler(bizrole.NewRoleManager(mysqlConn.GetDB(), goAuth.GetScopeRegistry(), goAuth.GetScopeCache()), goAuth.GetScopeRegistry(), goAuth.GetScopeCache(), responseFactory)
+
+	auditHandler := apiHandlersaudit.InitializeAuditHandler(auditor, auditStore, responseFactory)
+
+	clientHandler := apiHandlersclient.InitializeClientHandler(goAuth, responseFactory)
+	clientRegistrar := bizapiclient.NewClientRegistrar(mysqlConn.GetDB(), goAuth.GetScopeRegistry(), bizapiclient.ClientRegistrationPolicy{
+		AllowedScopes:     strings.Fields(osutil.GetEnvString("DCR_ALLOWED_SCOPES", "profile")),
+		AllowedGrantTypes: strings.Fields(osutil.GetEnvString("DCR_ALLOWED_GRANT_TYPES", bizapiclient.GrantTypeAuthorizationCode+" "+bizapiclient.GrantTypeRefreshToken)),
+	})
+	clientRegistrationHandler := apiHandlersclient.InitializeClientRegistrationHandler(clientRegistrar, goAuth,
+		strings.FieldsFunc(osutil.GetEnvString("DCR_INITIAL_ACCESS_TOKENS", ""), func(r rune) bool { return r == ',' }),
+		osutil.GetEnvString("CLIENT_REGISTRATION_URI", "http://localhost:9096/"+authRouteName+"/register-client"))
+
+	tokenVerifier := apiHandlers.InitializeTokenVerifier(*responseFactory, goAuth.GetScopeRegistry(), goAuth.GetProofVerifier(), goAuth.GetTokenStore(), userManager)
 
 	// Register routes for auth
 	router.GET(getRoute(authRouteName, "/health"), healthHandler.HealthCheck)
+	router.GET(getRoute(authRouteName, "/health/live"), healthHandler.HealthCheck)
+	router.GET(getRoute(authRouteName, "/health/ready"), healthHandler.ReadinessCheck)
 	router.GET(getRoute(authRouteName, "/authorize"), authorizeHandler.Handle)
 	router.POST(getRoute(authRouteName, "/authorize"), authorizeHandler.Handle)
+	router.POST(getRoute(authRouteName, "/par"), parHandler.Handle)
 	router.POST(getRoute(authRouteName, "/token"), tokenHandler.Handle)
+	router.POST(getRoute(authRouteName, "/revoke"), revocationHandler.Revoke)
+	router.POST(getRoute(authRouteName, "/introspect"), revocationHandler.Introspect)
+	router.POST(getRoute(authRouteName, "/device_authorization"), deviceHandler.DeviceAuthorization)
+	router.GET(getRoute(authRouteName, "/device"), deviceHandler.Verify)
+	router.POST(getRoute(authRouteName, "/device"), deviceHandler.Verify)
+	router.GET(getRoute(authRouteName, "/register"), registerHandler.Handle)
+	router.POST(getRoute(authRouteName, "/register"), registerHandler.Handle)
+	router.POST(getRoute(authRouteName, "/register-client"), clientRegistrationHandler.RegisterClient)
+	router.GET(getRoute(authRouteName, "/register-client/:client_id"), clientRegistrationHandler.GetClient)
+	router.PUT(getRoute(authRouteName, "/register-client/:client_id"), clientRegistrationHandler.UpdateClient)
+	router.DELETE(getRoute(authRouteName, "/register-client/:client_id"), clientRegistrationHandler.DeleteClient)
 	if osutil.GetEnvString("IS_LOCAL_DEV", "false") == "true" {
-		tempHandler := apiHandlersdev.InitializeDevHandler()
+		tempHandler := apiHandlersdev.InitializeDevHandler(passwordHasher)
 		router.GET(getRoute(authRouteName, "/bcrypt"), tempHandler.GetBCryptHash)
+		router.GET(getRoute(authRouteName, "/hash"), tempHandler.GetPasswordHash)
 	}
 
 	// Register routes for account
 	router.GET(getRoute(accoutRouteName, "/code"), tokenVerifier.VerifyToken([]string{"admin"}, accountHandler.GetRegistrationCode))
+	router.POST(getRoute(accoutRouteName, "/codes"), tokenVerifier.VerifyToken([]string{"admin"}, accountHandler.CreateRegistrationCode))
+	router.POST(getRoute(accoutRouteName, "/codes/batch"), tokenVerifier.VerifyToken([]string{"admin"}, accountHandler.CreateRegistrationCodeBatch))
+	router.GET(getRoute(accoutRouteName, "/codes"), tokenVerifier.VerifyToken([]string{"admin"}, accountHandler.ListRegistrationCodes))
+	router.GET(getRoute(accoutRouteName, "/codes/:code"), tokenVerifier.VerifyToken([]string{"admin"}, accountHandler.GetRegistrationCodeInfo))
+	router.DELETE(getRoute(accoutRouteName, "/codes/:code"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("revoke_registration_code", accountHandler.RevokeRegistrationCode)))
 	router.POST(getRoute(accoutRouteName, "/register"), accountHandler.RegisterAccount)
+	router.PUT(getRoute(accoutRouteName, "/password"), tokenVerifier.VerifyToken([]string{"profile"}, accountHandler.ChangePassword))
+	router.PUT(getRoute(accoutRouteName, "/email"), tokenVerifier.VerifyToken([]string{"profile"}, accountHandler.ChangeEmail))
+	router.POST(getRoute(accoutRouteName, "/email/verify"), accountHandler.VerifyEmail)
+	router.DELETE(getRoute(accoutRouteName, ""), tokenVerifier.VerifyToken([]string{"profile"}, accountHandler.DeleteAccount))
+	router.POST(getRoute(accoutRouteName, "/users/:user_id/deactivate"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("deactivate_user", userHandler.DeactivateUser)))
+	router.POST(getRoute(accoutRouteName, "/users/:user_id/reactivate"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("reactivate_user", userHandler.ReactivateUser)))
+	router.GET(getRoute(accoutRouteName, "/users/:user_id/status"), tokenVerifier.VerifyToken([]string{"admin"}, userHandler.GetStatusHistory))
+	router.GET(getRoute(accoutRouteName, "/users/:user_id/roles"), tokenVerifier.VerifyToken([]string{"admin"}, roleHandler.GetUserRoles))
+	router.PUT(getRoute(accoutRouteName, "/users/:user_id/roles/:role_id"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("assign_role", roleHandler.AssignRole)))
+	router.DELETE(getRoute(accoutRouteName, "/users/:user_id/roles/:role_id"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("unassign_role", roleHandler.UnassignRole)))
+	router.GET(getRoute(accoutRouteName, "/scopes"), tokenVerifier.VerifyToken([]string{"admin"}, roleHandler.ListScopes))
+	router.GET(getRoute(accoutRouteName, "/scopes/cache"), tokenVerifier.VerifyToken([]string{"admin"}, roleHandler.GetScopeCacheStats))
+	router.POST(getRoute(accoutRouteName, "/clients/reload"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("reload_clients", clientHandler.ReloadClients)))
+	router.GET(getRoute(accoutRouteName, "/roles"), tokenVerifier.VerifyToken([]string{"admin"}, roleHandler.ListRoles))
+	router.POST(getRoute(accoutRouteName, "/roles"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("create_role", roleHandler.CreateRole)))
+	router.GET(getRoute(accoutRouteName, "/roles/:role_id"), tokenVerifier.VerifyToken([]string{"admin"}, roleHandler.GetRole))
+	router.PUT(getRoute(accoutRouteName, "/roles/:role_id"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("update_role", roleHandler.UpdateRole)))
+	router.DELETE(getRoute(accoutRouteName, "/roles/:role_id"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("delete_role", roleHandler.DeleteRole)))
+	router.POST(getRoute(accoutRouteName, "/roles/:role_id/scopes"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("add_role_scopes", roleHandler.AddRoleScopes)))
+	router.DELETE(getRoute(accoutRouteName, "/roles/:role_id/scopes/:scope"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.AdminChange("remove_role_scope", roleHandler.RemoveRoleScope)))
+	router.GET(getRoute(accoutRouteName, "/audit/events"), tokenVerifier.VerifyToken([]string{"admin"}, auditHandler.ListEvents))
+
+	// Start server. With a certificate configured, TLS is terminated here, so that client certificates reach the
+	// mutual TLS client authentication.
+	srv := &http.Server{
+		Addr:    osutil.GetEnvString("LISTEN_ADDR", ":9096"),
+		Handler: router,
+	}
+	if certFile := osutil.GetEnvString("TLS_CERT_FILE", ""); certFile != "" {
+		certReloader, err := tlsconfig.NewCertReloader(certFile, osutil.GetEnvString("TLS_KEY_FILE", ""))
+		if err != nil {
+			logger.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		certReloader.Start(ctx, time.Duration(osutil.GetEnvInt("TLS_RELOAD_INTERVAL", 60))*time.Second)
+		minVersion, err := tlsconfig.ParseMinVersion(osutil.GetEnvString("TLS_MIN_VERSION", "1.2"))
+		if err != nil {
+			logger.Fatalf("Invalid TLS configuration: %v", err)
+		}
+		cipherSuites, err := tlsconfig.ParseCipherSuites(osutil.GetEnvString("TLS_CIPHER_SUITES", ""))
+		if err != nil {
+			logger.Fatalf("Invalid TLS configuration: %v", err)
+		}
+
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certReloader.GetCertificate,
+			MinVersion:     minVersion,
+			CipherSuites:   cipherSuites,
+			// Certificates are verified by the client authentication, since self-signed ones are pinned per client.
+			ClientAuth: tls.RequestClientCert,
+		}
+	}
+
+	// Metrics are not authenticated, so they are served on their own port, which is kept off the public network.
+	metricsRouter := gin.New()
+	metricsRouter.GET("/metrics", metrics.Handler())
+	metricsSrv := &http.Server{
+		Addr:    osutil.GetEnvString("METRICS_ADDR", ":9097"),
+		Handler: metricsRouter,
+	}
+	go func() {
+		if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("Metrics server failed: %v", err)
+		}
+	}()
+
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
 
-	// Start server
-	log.Fatal(router.Run(":9096"))
+	// Fail readiness first and give the load balancer SHUTDOWN_DELAY to stop routing here, then let the in-flight
+	// requests finish within SHUTDOWN_TIMEOUT.
+	logger.Info("Shutting down...")
+	healthHandler.SetDraining()
+	time.Sleep(time.Duration(osutil.GetEnvInt("SHUTDOWN_DELAY", 0)) * time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(osutil.GetEnvInt("SHUTDOWN_TIMEOUT", 30))*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Failed to drain in-flight requests: %v", err)
+	}
+	if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Failed to stop metrics server: %v", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Errorf("Failed to flush traces: %v", err)
+	}
+	logger.Info("Server stopped")
 }
 
 func getRoute(servinceName string, route string) string {
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const gormStartKey = "metrics:start"
+
+// GormPlugin measures the duration of every statement run through gorm.
+type GormPlugin struct{}
+
+func NewGormPlugin() *GormPlugin {
+	return &GormPlugin{}
+}
+
+func (p *GormPlugin) Name() string {
+	return "metrics"
+}
+
+func (p *GormPlugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	for _, err := range []error{
+		callback.Create().Before("gorm:create").Register("metrics:before_create", startStatement),
+		callback.Create().After("gorm:create").Register("metrics:after_create", finishStatement("create")),
+		callback.Query().Before("gorm:query").Register("metrics:before_query", startStatement),
+		callback.Query().After("gorm:query").Register("metrics:after_query", finishStatement("query")),
+		callback.Update().Before("gorm:update").Register("metrics:before_update", startStatement),
+		callback.Update().After("gorm:update").Register("metrics:after_update", finishStatement("update")),
+		callback.Delete().Before("gorm:delete").Register("metrics:before_delete", startStatement),
+		callback.Delete().After("gorm:delete").Register("metrics:after_delete", finishStatement("delete")),
+		callback.Row().Before("gorm:row").Register("metrics:before_row", startStatement),
+		callback.Row().After("gorm:row").Register("metrics:after_row", finishStatement("row")),
+		callback.Raw().Before("gorm:raw").Register("metrics:before_raw", startStatement),
+		callback.Raw().After("gorm:raw").Register("metrics:after_raw", finishStatement("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startStatement(db *gorm.DB) {
+	db.InstanceSet(gormStartKey, time.Now())
+}
+
+func finishStatement(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(gormStartKey)
+		if !ok {
+			return
+		}
+		start, ok := value.(time.Time)
+		if !ok {
+			return
+		}
+		// Not finding a record is an answer, not a failing database.
+		err := db.Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = nil
+		}
+		dbQueryDuration.WithLabelValues(operation, status(err)).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,142 @@
+// Package metrics holds the Prometheus metrics of the auth flows, and the instrumentation of the HTTP handlers, the
+// database and Redis. The collectors are registered with the default registry, which /metrics serves on METRICS_ADDR.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "auth"
+
+// Outcomes of an authorization request. Failures are counted with the reason they were rejected for.
+const (
+	AuthorizeSuccess            = "success"
+	AuthorizeUnknownClient      = "unknown_client"
+	AuthorizeInvalidRequest     = "invalid_request"
+	AuthorizeInvalidRequestURI  = "invalid_request_uri"
+	AuthorizePARRequired        = "par_required"
+	AuthorizeInvalidRequestObj  = "invalid_request_object"
+	AuthorizeUnregisteredURI    = "unregistered_redirect_uri"
+	AuthorizeInvalidState       = "invalid_state"
+	AuthorizeInvalidCredentials = "invalid_credentials"
+	AuthorizeInactiveUser       = "inactive_user"
+	AuthorizeError              = "error"
+)
+
+// DynamicClient is the client label of dynamically registered clients, so that registrations do not create a series
+// each.
+const DynamicClient = "dynamic"
+
+// Reasons the token store fails an operation.
+const (
+	TokenStoreTooManyTokens = "too_many_tokens"
+	TokenStoreScriptError   = "script_error"
+	TokenStoreRedisError    = "redis_error"
+)
+
+// Reasons the scope authority denies a request.
+const (
+	ScopeDeniedClientHasNoScopes = "client_has_no_scopes"
+	ScopeDeniedUserHasNoScopes   = "user_has_no_scopes"
+	ScopeDeniedNoDefaultScope    = "no_default_scope"
+	ScopeDeniedUserLacksScope    = "user_lacks_scope"
+	ScopeDeniedClientLacksScope  = "client_lacks_scope"
+	ScopeDeniedNothingGranted    = "nothing_granted"
+)
+
+var (
+	authorizeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authorize_requests_total",
+		Help:      "Authorization requests by outcome, which is success or the reason the request failed.",
+	}, []string{"outcome"})
+
+	tokensIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "Access tokens issued by grant type and client, with dynamically registered clients counted together.",
+	}, []string{"grant_type", "client_id"})
+
+	tokenStoreErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_store_errors_total",
+		Help:      "Failed token store operations by operation and reason.",
+	}, []string{"operation", "reason"})
+
+	scopeDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scope_denials_total",
+		Help:      "Scope requests denied by the scope authority by reason.",
+	}, []string{"reason"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of database statements by operation and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "status"})
+
+	redisCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Duration of Redis commands by command and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command", "status"})
+)
+
+// AuthorizeOutcome counts an authorization request with its outcome.
+func AuthorizeOutcome(outcome string) {
+	authorizeRequests.WithLabelValues(outcome).Inc()
+}
+
+// TokenIssued counts an access token issued to the client. clientID is the ID of a client configured by an admin, or
+// DynamicClient.
+func TokenIssued(grantType string, clientID string) {
+	tokensIssued.WithLabelValues(grantType, clientID).Inc()
+}
+
+// TokenStoreError counts a failed token store operation.
+func TokenStoreError(operation string, reason string) {
+	tokenStoreErrors.WithLabelValues(operation, reason).Inc()
+}
+
+// ScopeDenied counts a scope request denied by the scope authority.
+func ScopeDenied(reason string) {
+	scopeDenials.WithLabelValues(reason).Inc()
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// Middleware measures the duration of every request by its route pattern, so that path parameters do not create a
+// series per value. Requests matching no route are counted under an empty route.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		httpRequestDuration.WithLabelValues(c.Request.Method, c.FullPath(), strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+func status(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/auth/users/:user_id", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	router.GET("/metrics", Handler())
+
+	for _, path := range []string{"/auth/users/1", "/auth/users/2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	// Requests are counted by their route, not by the path parameters.
+	assert.Equal(t, 1, testutil.CollectAndCount(httpRequestDuration, "auth_http_request_duration_seconds"))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `auth_http_request_duration_seconds_count{method="GET",route="/auth/users/:user_id",status="204"} 2`)
+}
+
+func TestCounters(t *testing.T) {
+	AuthorizeOutcome(AuthorizeInvalidCredentials)
+	AuthorizeOutcome(AuthorizeInvalidCredentials)
+	TokenIssued("authorization_code", "shopper")
+	TokenIssued("authorization_code", DynamicClient)
+	TokenStoreError("create", TokenStoreTooManyTokens)
+	ScopeDenied(ScopeDeniedUserLacksScope)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(authorizeRequests.WithLabelValues(AuthorizeInvalidCredentials)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(tokensIssued.WithLabelValues("authorization_code", "shopper")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(tokenStoreErrors.WithLabelValues("create", TokenStoreTooManyTokens)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(scopeDenials.WithLabelValues(ScopeDeniedUserLacksScope)))
+}
+
+func TestRedisHook(t *testing.T) {
+	// Nothing listens on the port, so the command fails and is counted as an error.
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond, MaxRetries: -1})
+	client.AddHook(NewRedisHook())
+	defer client.Close()
+
+	assert.Error(t, client.Ping(context.Background()).Err())
+	count, err := testutil.GatherAndCount(prometheus.DefaultGatherer, "auth_redis_command_duration_seconds")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `auth_redis_command_duration_seconds_count{command="ping",status="error"} 1`)
+}
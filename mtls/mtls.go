@@ -0,0 +1,67 @@
+package mtls
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ConfirmationClaim is the cnf member of RFC 8705 section 3.1 binding a token to a client certificate.
+const ConfirmationClaim = "x5t#S256"
+
+type thumbprintContextKey struct{}
+
+// PeerCertificate returns the certificate the client presented in the TLS handshake, or nil if it presented none.
+func PeerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// Thumbprint returns the base64url encoded SHA-256 hash of the DER encoded certificate.
+func Thumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// SPKIPin returns the base64 encoded SHA-256 hash of the certificate's public key, which stays the same when a
+// self-signed certificate is reissued for the same key.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// PublicKeyPin returns the SPKIPin of the certificates issued for a public key.
+func PublicKeyPin(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// WithThumbprint returns a context carrying the certificate thumbprint the tokens issued for the request are bound to.
+func WithThumbprint(ctx context.Context, thumbprint string) context.Context {
+	return context.WithValue(ctx, thumbprintContextKey{}, thumbprint)
+}
+
+// ThumbprintFromContext returns the thumbprint set by WithThumbprint, or "" for requests without a client certificate.
+func ThumbprintFromContext(ctx context.Context) string {
+	thumbprint, _ := ctx.Value(thumbprintContextKey{}).(string)
+	return thumbprint
+}
+
+// BoundThumbprint returns the certificate thumbprint of an access token's claims, or "" if the token is not bound to
+// a certificate.
+func BoundThumbprint(claims jwt.MapClaims) string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	thumbprint, _ := cnf[ConfirmationClaim].(string)
+	return thumbprint
+}
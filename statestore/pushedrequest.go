@@ -0,0 +1,75 @@
+package statestore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// RequestURIPrefix is the URN prefix of RFC 9126 section 2.2 for request URIs issued by the PAR endpoint.
+const RequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+// PushedRequest holds the authorization parameters a client pushed ahead of redirecting the user to /authorize.
+type PushedRequest struct {
+	ClientID     string
+	RedirectURI  string
+	ResponseType string
+	Scope        string
+	State        string
+	expiresAt    time.Time
+}
+
+// PushedRequestStore keeps pushed authorization requests until they are used or expire
+type PushedRequestStore struct {
+	requests map[string]PushedRequest
+	mu       sync.Mutex
+}
+
+// NewPushedRequestStore creates a new PushedRequestStore instance
+func NewPushedRequestStore() *PushedRequestStore {
+	return &PushedRequestStore{
+		requests: make(map[string]PushedRequest),
+	}
+}
+
+// Push stores the request and returns the request URI referring to it
+func (s *PushedRequestStore) Push(request PushedRequest, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	requestURI := RequestURIPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for uri, pushed := range s.requests {
+		if !now.Before(pushed.expiresAt) {
+			delete(s.requests, uri)
+		}
+	}
+
+	request.expiresAt = now.Add(ttl)
+	s.requests[requestURI] = request
+	return requestURI, nil
+}
+
+// Take returns the request of the request URI and removes it, so that every request URI is used once. The request
+// is only returned to the client that pushed it.
+func (s *PushedRequestStore) Take(requestURI, clientID string) (PushedRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, exists := s.requests[requestURI]
+	if !exists || request.ClientID != clientID {
+		return PushedRequest{}, false
+	}
+	delete(s.requests, requestURI)
+
+	if !time.Now().Before(request.expiresAt) {
+		return PushedRequest{}, false
+	}
+	return request, true
+}
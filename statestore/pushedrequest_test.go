@@ -0,0 +1,42 @@
+package statestore
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushedRequestStore_Take(t *testing.T) {
+	store := NewPushedRequestStore()
+	request := PushedRequest{ClientID: "client", RedirectURI: "https://example.com/cb", ResponseType: "code", State: "state"}
+
+	requestURI, err := store.Push(request, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(requestURI, RequestURIPrefix))
+
+	// Another client cannot use the request URI, and does not use it up either.
+	_, ok := store.Take(requestURI, "other")
+	assert.False(t, ok)
+
+	taken, ok := store.Take(requestURI, "client")
+	require.True(t, ok)
+	assert.Equal(t, "https://example.com/cb", taken.RedirectURI)
+	assert.Equal(t, "state", taken.State)
+
+	// Request URIs are single use.
+	_, ok = store.Take(requestURI, "client")
+	assert.False(t, ok)
+}
+
+func TestPushedRequestStore_Expired(t *testing.T) {
+	store := NewPushedRequestStore()
+
+	requestURI, err := store.Push(PushedRequest{ClientID: "client"}, -time.Second)
+	require.NoError(t, err)
+
+	_, ok := store.Take(requestURI, "client")
+	assert.False(t, ok)
+}
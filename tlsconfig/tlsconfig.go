@@ -0,0 +1,144 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdjuwidja/aishoppercommon/logger"
+)
+
+// CertReloader serves the certificate of a certificate and key file pair, and picks up new files written over them,
+// such as renewed certificates, without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+// NewCertReloader loads the certificate. Failing to load it is an error here, while later failures keep the
+// previous certificate.
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.certificate, nil
+}
+
+// Start checks the files for changes at every interval until the context is done.
+func (r *CertReloader) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reloaded, err := r.reloadIfChanged()
+				if err != nil {
+					logger.Errorf("Failed to reload TLS certificate: %v", err)
+				} else if reloaded {
+					logger.Infof("Reloaded TLS certificate from %s", r.certFile)
+				}
+			}
+		}
+	}()
+}
+
+// reloadIfChanged loads the files if either was modified since the last load. Both files are written separately on
+// renewal, so a pair that does not match yet is reported and retried on the next check.
+func (r *CertReloader) reloadIfChanged() (bool, error) {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.certificate != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.certificate = &certificate
+	r.modTime = modTime
+	return true, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ParseMinVersion parses a minimum TLS version given as 1.2 or 1.3. Older versions are not supported.
+func ParseMinVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported minimum TLS version: %s", version)
+	}
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names, as named by crypto/tls. Suites Go considers
+// insecure are rejected. An empty list returns nil, which leaves the choice to Go. The list only applies to TLS 1.2,
+// since TLS 1.3 suites are not configurable.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+
+	supported := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		supported[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := supported[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
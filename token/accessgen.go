@@ -2,13 +2,18 @@ package token
 
 import (
 	"context"
+	"encoding/base64"
+	"strings"
 	"time"
 
 	"github.com/go-oauth2/oauth2/v4"
 	"github.com/go-oauth2/oauth2/v4/generates"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
 	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	"netherealmstudio.com/m/v2/dpop"
+	"netherealmstudio.com/m/v2/mtls"
 )
 
 // TokenGenerator handles JWT token generation
@@ -30,17 +35,32 @@ func NewJWTTokenGenerator(key string, secret []byte, apiClientStore *bizapiclien
 // Token generates a new JWT token
 func (g *AccessTokenGenerator) Token(ctx context.Context, data *oauth2.GenerateBasic, isGenRefresh bool) (string, string, error) {
 	requestedScope := data.Request.Form.Get("requestedScope")
-	err := g.scopeAuthority.AuthorizeScope(ctx, data.Client.GetID(), data.UserID, requestedScope)
+	grantedScope, err := g.scopeAuthority.AuthorizeScope(ctx, data.Client.GetID(), data.UserID, requestedScope)
 	if err != nil {
 		return "", "", err
 	}
 
+	// The granted scope may differ from the requested one, and is returned in the token response from the token info.
+	data.TokenInfo.SetScope(grantedScope)
+
 	// Create claims
 	claims := jwt.MapClaims{
 		"exp":   time.Now().Add(24 * time.Hour).Unix(),
 		"iat":   time.Now().Unix(),
 		"sub":   data.UserID,
-		"scope": requestedScope,
+		"scope": grantedScope,
+	}
+	// Tokens requested with a DPoP proof are bound to the proof's key (RFC 9449 section 6), and tokens requested over
+	// mutual TLS to the client certificate (RFC 8705 section 3).
+	cnf := map[string]interface{}{}
+	if jkt := dpop.ThumbprintFromContext(data.Request.Context()); jkt != "" {
+		cnf["jkt"] = jkt
+	}
+	if thumbprint := mtls.ThumbprintFromContext(data.Request.Context()); thumbprint != "" {
+		cnf[mtls.ConfirmationClaim] = thumbprint
+	}
+	if len(cnf) > 0 {
+		claims["cnf"] = cnf
 	}
 
 	// Create token
@@ -52,6 +72,13 @@ func (g *AccessTokenGenerator) Token(ctx context.Context, data *oauth2.GenerateB
 		return "", "", err
 	}
 
-	// Return empty refresh token since we're not implementing refresh token functionality
-	return accessToken, "", nil
+	// Refresh tokens are opaque, and generated the same way go-oauth2 generates them for its own JWT access tokens.
+	refreshToken := ""
+	if isGenRefresh {
+		t := uuid.NewSHA1(uuid.Must(uuid.NewRandom()), []byte(accessToken)).String()
+		refreshToken = base64.URLEncoding.EncodeToString([]byte(t))
+		refreshToken = strings.ToUpper(strings.TrimRight(refreshToken, "="))
+	}
+
+	return accessToken, refreshToken, nil
 }
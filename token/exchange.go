@@ -0,0 +1,262 @@
+package token
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/golang-jwt/jwt/v5"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	"netherealmstudio.com/m/v2/dpop"
+	"netherealmstudio.com/m/v2/mtls"
+)
+
+const (
+	// GrantTypeTokenExchange is the grant type of RFC 8693 section 2.1.
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// TokenTypeAccessToken is the only token type accepted as subject token and issued by the exchange.
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+	// Error codes of RFC 6749 section 5.2 and RFC 8693 section 2.2.2.
+	ErrCodeInvalidRequest     = "invalid_request"
+	ErrCodeInvalidClient      = "invalid_client"
+	ErrCodeUnauthorizedClient = "unauthorized_client"
+	ErrCodeInvalidGrant       = "invalid_grant"
+	ErrCodeInvalidScope       = "invalid_scope"
+	ErrCodeInvalidTarget      = "invalid_target"
+)
+
+// ExchangeError is returned when a token exchange request is rejected. Code is the OAuth error code to respond with.
+type ExchangeError struct {
+	Code        string
+	Description string
+}
+
+func (e *ExchangeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// ClientStore looks up the API clients exchanging tokens.
+type ClientStore interface {
+	GetClient(clientID string) (*bizapiclient.APIClient, error)
+}
+
+// TokenStore keeps the tokens issued by the exchange along with the subject tokens they are exchanged for.
+type TokenStore interface {
+	oauth2.TokenStore
+	// CreateExchanged stores an exchanged token apart from the tokens issued by the token endpoint, so that it does not
+	// count towards the user's token limit.
+	CreateExchanged(ctx context.Context, info oauth2.TokenInfo) error
+	// IsAccessIssued reports whether the access token was issued to the user and has not been revoked since.
+	IsAccessIssued(ctx context.Context, userID string, access string) (bool, error)
+}
+
+// TokenExchangeRequest holds the parameters of RFC 8693 section 2.1 supported by this service.
+type TokenExchangeRequest struct {
+	ClientID           string
+	ClientSecret       string
+	SubjectToken       string
+	SubjectTokenType   string
+	RequestedTokenType string
+	Audience           string
+	Scope              string
+}
+
+// TokenExchangeResponse is the token exchange response of RFC 8693 section 2.2.1.
+type TokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Scope           string `json:"scope"`
+}
+
+// TokenExchanger lets a service calling another service on behalf of a user exchange the user's access token for one
+// restricted to the other service and to fewer scopes. The issued token names the calling client in its act claim.
+type TokenExchanger struct {
+	secret        []byte
+	tokenStore    TokenStore
+	clientStore   ClientStore
+	scopeRegistry bizscope.ScopeRegistry
+	accessTTL     time.Duration
+}
+
+func NewTokenExchanger(secret []byte, tokenStore TokenStore, clientStore ClientStore, scopeRegistry bizscope.ScopeRegistry, accessTTL time.Duration) *TokenExchanger {
+	return &TokenExchanger{
+		secret:        secret,
+		tokenStore:    tokenStore,
+		clientStore:   clientStore,
+		scopeRegistry: scopeRegistry,
+		accessTTL:     accessTTL,
+	}
+}
+
+func (e *TokenExchanger) Exchange(ctx context.Context, req *TokenExchangeRequest) (*TokenExchangeResponse, error) {
+	client, err := e.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.SubjectToken == "" || req.SubjectTokenType != TokenTypeAccessToken {
+		return nil, &ExchangeError{ErrCodeInvalidRequest, "an access token is required as subject_token"}
+	}
+	if req.RequestedTokenType != "" && req.RequestedTokenType != TokenTypeAccessToken {
+		return nil, &ExchangeError{ErrCodeInvalidRequest, "only access tokens can be issued"}
+	}
+	if req.Audience == "" {
+		return nil, &ExchangeError{ErrCodeInvalidRequest, "audience is required"}
+	}
+
+	allowedScopes, ok := client.ExchangeScopes(req.Audience)
+	if !ok {
+		return nil, &ExchangeError{ErrCodeInvalidTarget, "the client may not exchange tokens for this audience"}
+	}
+
+	subject, err := e.parseSubjectToken(ctx, req.SubjectToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// A sender-constrained subject token is only exchanged with a proof of its key or over a connection with its
+	// certificate, or a stolen token could be exchanged for a bearer token.
+	if jkt := dpop.BoundThumbprint(subject); jkt != "" && jkt != dpop.ThumbprintFromContext(ctx) {
+		return nil, &ExchangeError{ErrCodeInvalidGrant, "subject_token is bound to a DPoP key the request has no proof of"}
+	}
+	if thumbprint := mtls.BoundThumbprint(subject); thumbprint != "" && thumbprint != mtls.ThumbprintFromContext(ctx) {
+		return nil, &ExchangeError{ErrCodeInvalidGrant, "subject_token is bound to a client certificate the request was not made with"}
+	}
+
+	grantedScope, err := e.narrowScope(subject, allowedScopes, req.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	// The exchanged token never outlives the token it was exchanged for.
+	now := time.Now()
+	expiresAt := now.Add(e.accessTTL)
+	if subjectExp, err := subject.GetExpirationTime(); err == nil && subjectExp != nil && subjectExp.Before(expiresAt) {
+		expiresAt = subjectExp.Time
+	}
+
+	// RFC 8693 section 4.1 nests the act claim of the subject token, so the whole delegation chain stays visible.
+	act := jwt.MapClaims{"sub": req.ClientID}
+	if prior, ok := subject["act"]; ok {
+		act["act"] = prior
+	}
+	userID, _ := subject.GetSubject()
+	claims := jwt.MapClaims{
+		"exp":       expiresAt.Unix(),
+		"iat":       now.Unix(),
+		"sub":       userID,
+		"scope":     grantedScope,
+		"aud":       req.Audience,
+		"client_id": req.ClientID,
+		"act":       act,
+	}
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(e.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stored with the user's other tokens, so that logging the user out or deactivating them revokes it as well. A
+	// service exchanges tokens on every call it makes for the user, so they do not count towards the user's limit.
+	ti := models.NewToken()
+	ti.SetClientID(req.ClientID)
+	ti.SetUserID(userID)
+	ti.SetScope(grantedScope)
+	ti.SetAccess(accessToken)
+	ti.SetAccessCreateAt(now)
+	ti.SetAccessExpiresIn(expiresAt.Sub(now))
+	if err := e.tokenStore.CreateExchanged(ctx, ti); err != nil {
+		return nil, err
+	}
+
+	return &TokenExchangeResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: TokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(expiresAt.Sub(now).Seconds()),
+		Scope:           grantedScope,
+	}, nil
+}
+
+// authenticateClient only lets confidential clients registered for the grant exchange tokens, since the exchanged
+// token acts on behalf of the user.
+func (e *TokenExchanger) authenticateClient(clientID string, clientSecret string) (*bizapiclient.APIClient, error) {
+	client, err := e.clientStore.GetClient(clientID)
+	if err != nil {
+		return nil, &ExchangeError{ErrCodeInvalidClient, "unknown client"}
+	}
+	if client.Secret == "" {
+		return nil, &ExchangeError{ErrCodeUnauthorizedClient, "public clients may not exchange tokens"}
+	}
+	if subtle.ConstantTimeCompare([]byte(client.Secret), []byte(clientSecret)) != 1 {
+		return nil, &ExchangeError{ErrCodeInvalidClient, "invalid client secret"}
+	}
+	if !client.IsGrantTypeAllowed(GrantTypeTokenExchange) {
+		return nil, &ExchangeError{ErrCodeUnauthorizedClient, "the client may not use the token exchange grant"}
+	}
+	return client, nil
+}
+
+// parseSubjectToken verifies the subject token's signature and expiry, and that it has not been revoked.
+func (e *TokenExchanger) parseSubjectToken(ctx context.Context, subjectToken string) (jwt.MapClaims, error) {
+	parsed, err := jwt.Parse(subjectToken, func(token *jwt.Token) (interface{}, error) {
+		return e.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || !parsed.Valid {
+		return nil, &ExchangeError{ErrCodeInvalidGrant, "invalid subject_token"}
+	}
+
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, &ExchangeError{ErrCodeInvalidGrant, "invalid subject_token"}
+	}
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return nil, &ExchangeError{ErrCodeInvalidGrant, "subject_token has no subject"}
+	}
+
+	if issued, err := e.tokenStore.IsAccessIssued(ctx, sub, subjectToken); err != nil || !issued {
+		return nil, &ExchangeError{ErrCodeInvalidGrant, "subject_token has been revoked"}
+	}
+
+	return claims, nil
+}
+
+// narrowScope grants the requested scopes if both the subject token and the exchange policy of the audience cover
+// them, implied scopes included. Without a requested scope, everything the two have in common is granted.
+func (e *TokenExchanger) narrowScope(subject jwt.MapClaims, allowedScopes []string, requestedScope string) (string, error) {
+	subjectScope, _ := subject["scope"].(string)
+	subjectScopes := e.scopeRegistry.Expand(strings.Fields(subjectScope))
+	allowed := e.scopeRegistry.Expand(allowedScopes)
+
+	requested := strings.Fields(requestedScope)
+	if len(requested) == 0 {
+		requested = allowedScopes
+	} else {
+		for _, scope := range requested {
+			if !slices.Contains(subjectScopes, scope) || !slices.Contains(allowed, scope) {
+				return "", &ExchangeError{ErrCodeInvalidScope, fmt.Sprintf("scope cannot be granted: %s", scope)}
+			}
+		}
+	}
+
+	granted := make([]string, 0, len(requested))
+	for _, scope := range requested {
+		if slices.Contains(subjectScopes, scope) && !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	if len(granted) == 0 {
+		return "", &ExchangeError{ErrCodeInvalidScope, "none of the allowed scopes are held by the subject_token"}
+	}
+
+	return strings.Join(granted, " "), nil
+}
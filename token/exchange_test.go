@@ -0,0 +1,257 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-oauth2/oauth2/v4"
+	"github.com/go-oauth2/oauth2/v4/models"
+	"github.com/go-oauth2/oauth2/v4/store"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	bizscope "netherealmstudio.com/m/v2/biz/scope"
+	"netherealmstudio.com/m/v2/dpop"
+	"netherealmstudio.com/m/v2/mtls"
+)
+
+var testSecret = []byte("test-secret")
+
+type testClientStore map[string]*bizapiclient.APIClient
+
+func (s testClientStore) GetClient(clientID string) (*bizapiclient.APIClient, error) {
+	client, ok := s[clientID]
+	if !ok {
+		return nil, fmt.Errorf("client not found")
+	}
+	return client, nil
+}
+
+// testTokenStore keeps exchanged tokens like any other token.
+type testTokenStore struct {
+	oauth2.TokenStore
+}
+
+func (s *testTokenStore) CreateExchanged(ctx context.Context, info oauth2.TokenInfo) error {
+	return s.Create(ctx, info)
+}
+
+func (s *testTokenStore) IsAccessIssued(ctx context.Context, userID string, access string) (bool, error) {
+	ti, err := s.GetByAccess(ctx, access)
+	if err != nil || ti == nil {
+		return false, err
+	}
+	return ti.GetUserID() == userID, nil
+}
+
+func newTestExchanger(t *testing.T) *TokenExchanger {
+	memoryStore, err := store.NewMemoryTokenStore()
+	require.NoError(t, err)
+	tokenStore := &testTokenStore{memoryStore}
+
+	registry := bizscope.NewStaticScopeRegistry([]*bizscope.ScopeDefinition{
+		{Name: "profile"},
+		{Name: "search"},
+		{Name: "shoplist"},
+		{Name: "shoplist:read", Parents: []string{"shoplist"}},
+	})
+	clients := testClientStore{
+		"search":   {ID: "search", Secret: "search-secret", ExchangeAudiences: "shoplist=shoplist:read"},
+		"public":   {ID: "public", ExchangeAudiences: "shoplist=shoplist:read"},
+		"implicit": {ID: "implicit", Secret: "secret", GrantTypes: "authorization_code", ExchangeAudiences: "shoplist=shoplist:read"},
+	}
+	return NewTokenExchanger(testSecret, tokenStore, clients, registry, time.Hour)
+}
+
+// issueSubjectToken signs and stores a user access token the way the access token generator does.
+func issueSubjectToken(t *testing.T, exchanger *TokenExchanger, claims jwt.MapClaims) string {
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+	require.NoError(t, err)
+
+	ti := models.NewToken()
+	ti.SetUserID(claims["sub"].(string))
+	ti.SetAccess(accessToken)
+	ti.SetAccessCreateAt(time.Now())
+	ti.SetAccessExpiresIn(time.Hour)
+	require.NoError(t, exchanger.tokenStore.Create(context.Background(), ti))
+	return accessToken
+}
+
+func parseIssuedToken(t *testing.T, accessToken string) jwt.MapClaims {
+	parsed, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) { return testSecret, nil })
+	require.NoError(t, err)
+	return parsed.Claims.(jwt.MapClaims)
+}
+
+func exchangeRequest(clientID string, clientSecret string, subjectToken string, scope string) *TokenExchangeRequest {
+	return &TokenExchangeRequest{
+		ClientID:         clientID,
+		ClientSecret:     clientSecret,
+		SubjectToken:     subjectToken,
+		SubjectTokenType: TokenTypeAccessToken,
+		Audience:         "shoplist",
+		Scope:            scope,
+	}
+}
+
+func assertExchangeError(t *testing.T, err error, code string) {
+	var exchangeErr *ExchangeError
+	require.ErrorAs(t, err, &exchangeErr)
+	assert.Equal(t, code, exchangeErr.Code)
+}
+
+func TestTokenExchanger_Exchange(t *testing.T) {
+	exchanger := newTestExchanger(t)
+	ctx := context.Background()
+	subjectExp := time.Now().Add(30 * time.Minute).Unix()
+	subjectToken := issueSubjectToken(t, exchanger, jwt.MapClaims{"sub": "user-1", "scope": "profile shoplist search", "exp": subjectExp})
+
+	// Without a requested scope the policy's scopes held by the subject are granted, implied scopes included.
+	resp, err := exchanger.Exchange(ctx, exchangeRequest("search", "search-secret", subjectToken, ""))
+	require.NoError(t, err)
+	assert.Equal(t, "shoplist:read", resp.Scope)
+	assert.Equal(t, TokenTypeAccessToken, resp.IssuedTokenType)
+	assert.Equal(t, "Bearer", resp.TokenType)
+
+	claims := parseIssuedToken(t, resp.AccessToken)
+	assert.Equal(t, "user-1", claims["sub"])
+	assert.Equal(t, "shoplist:read", claims["scope"])
+	assert.Equal(t, "shoplist", claims["aud"])
+	assert.Equal(t, map[string]interface{}{"sub": "search"}, claims["act"])
+	// The exchanged token does not outlive the subject token.
+	assert.Equal(t, float64(subjectExp), claims["exp"])
+
+	// The exchanged token is stored, so that revoking the user's tokens revokes it as well.
+	stored, err := exchanger.tokenStore.GetByAccess(ctx, resp.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "search", stored.GetClientID())
+	assert.Equal(t, "user-1", stored.GetUserID())
+}
+
+func TestTokenExchanger_NestsActClaim(t *testing.T) {
+	exchanger := newTestExchanger(t)
+	subjectToken := issueSubjectToken(t, exchanger, jwt.MapClaims{
+		"sub":   "user-1",
+		"scope": "shoplist",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"act":   map[string]interface{}{"sub": "gateway"},
+	})
+
+	resp, err := exchanger.Exchange(context.Background(), exchangeRequest("search", "search-secret", subjectToken, "shoplist:read"))
+	require.NoError(t, err)
+
+	claims := parseIssuedToken(t, resp.AccessToken)
+	assert.Equal(t, map[string]interface{}{"sub": "search", "act": map[string]interface{}{"sub": "gateway"}}, claims["act"])
+}
+
+func TestTokenExchanger_SenderConstrainedSubjectToken(t *testing.T) {
+	exchanger := newTestExchanger(t)
+	ctx := context.Background()
+
+	t.Run("DPoP", func(t *testing.T) {
+		subjectToken := issueSubjectToken(t, exchanger, jwt.MapClaims{
+			"sub":   "user-1",
+			"scope": "shoplist",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"cnf":   map[string]interface{}{"jkt": "key-thumbprint"},
+		})
+
+		_, err := exchanger.Exchange(ctx, exchangeRequest("search", "search-secret", subjectToken, ""))
+		assertExchangeError(t, err, ErrCodeInvalidGrant)
+
+		_, err = exchanger.Exchange(dpop.WithThumbprint(ctx, "other-thumbprint"), exchangeRequest("search", "search-secret", subjectToken, ""))
+		assertExchangeError(t, err, ErrCodeInvalidGrant)
+
+		_, err = exchanger.Exchange(dpop.WithThumbprint(ctx, "key-thumbprint"), exchangeRequest("search", "search-secret", subjectToken, ""))
+		assert.NoError(t, err)
+	})
+
+	t.Run("ClientCertificate", func(t *testing.T) {
+		subjectToken := issueSubjectToken(t, exchanger, jwt.MapClaims{
+			"sub":   "user-1",
+			"scope": "shoplist",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"cnf":   map[string]interface{}{mtls.ConfirmationClaim: "cert-thumbprint"},
+		})
+
+		_, err := exchanger.Exchange(ctx, exchangeRequest("search", "search-secret", subjectToken, ""))
+		assertExchangeError(t, err, ErrCodeInvalidGrant)
+
+		_, err = exchanger.Exchange(mtls.WithThumbprint(ctx, "cert-thumbprint"), exchangeRequest("search", "search-secret", subjectToken, ""))
+		assert.NoError(t, err)
+	})
+}
+
+func TestTokenExchanger_Rejections(t *testing.T) {
+	exchanger := newTestExchanger(t)
+	ctx := context.Background()
+	subjectToken := issueSubjectToken(t, exchanger, jwt.MapClaims{"sub": "user-1", "scope": "shoplist", "exp": time.Now().Add(time.Hour).Unix()})
+
+	t.Run("UnknownClient", func(t *testing.T) {
+		_, err := exchanger.Exchange(ctx, exchangeRequest("unknown", "", subjectToken, ""))
+		assertExchangeError(t, err, ErrCodeInvalidClient)
+	})
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		_, err := exchanger.Exchange(ctx, exchangeRequest("search", "wrong", subjectToken, ""))
+		assertExchangeError(t, err, ErrCodeInvalidClient)
+	})
+
+	t.Run("PublicClient", func(t *testing.T) {
+		_, err := exchanger.Exchange(ctx, exchangeRequest("public", "", subjectToken, ""))
+		assertExchangeError(t, err, ErrCodeUnauthorizedClient)
+	})
+
+	t.Run("GrantTypeNotRegistered", func(t *testing.T) {
+		_, err := exchanger.Exchange(ctx, exchangeRequest("implicit", "secret", subjectToken, ""))
+		assertExchangeError(t, err, ErrCodeUnauthorizedClient)
+	})
+
+	t.Run("AudienceNotAllowed", func(t *testing.T) {
+		req := exchangeRequest("search", "search-secret", subjectToken, "")
+		req.Audience = "billing"
+		_, err := exchanger.Exchange(ctx, req)
+		assertExchangeError(t, err, ErrCodeInvalidTarget)
+	})
+
+	t.Run("UnsupportedTokenType", func(t *testing.T) {
+		req := exchangeRequest("search", "search-secret", subjectToken, "")
+		req.SubjectTokenType = "urn:ietf:params:oauth:token-type:id_token"
+		_, err := exchanger.Exchange(ctx, req)
+		assertExchangeError(t, err, ErrCodeInvalidRequest)
+	})
+
+	t.Run("ScopeBeyondPolicy", func(t *testing.T) {
+		_, err := exchanger.Exchange(ctx, exchangeRequest("search", "search-secret", subjectToken, "shoplist"))
+		assertExchangeError(t, err, ErrCodeInvalidScope)
+	})
+
+	t.Run("ScopeNotHeldBySubject", func(t *testing.T) {
+		token := issueSubjectToken(t, exchanger, jwt.MapClaims{"sub": "user-2", "scope": "profile", "exp": time.Now().Add(time.Hour).Unix()})
+		_, err := exchanger.Exchange(ctx, exchangeRequest("search", "search-secret", token, ""))
+		assertExchangeError(t, err, ErrCodeInvalidScope)
+	})
+
+	t.Run("ForgedSubjectToken", func(t *testing.T) {
+		forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user-1", "scope": "shoplist", "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("other-secret"))
+		require.NoError(t, err)
+		_, err = exchanger.Exchange(ctx, exchangeRequest("search", "search-secret", forged, ""))
+		assertExchangeError(t, err, ErrCodeInvalidGrant)
+	})
+
+	t.Run("ExpiredSubjectToken", func(t *testing.T) {
+		token := issueSubjectToken(t, exchanger, jwt.MapClaims{"sub": "user-1", "scope": "shoplist", "exp": time.Now().Add(-time.Minute).Unix()})
+		_, err := exchanger.Exchange(ctx, exchangeRequest("search", "search-secret", token, ""))
+		assertExchangeError(t, err, ErrCodeInvalidGrant)
+	})
+
+	t.Run("RevokedSubjectToken", func(t *testing.T) {
+		token := issueSubjectToken(t, exchanger, jwt.MapClaims{"sub": "user-1", "scope": "shoplist", "exp": time.Now().Add(time.Hour).Unix()})
+		require.NoError(t, exchanger.tokenStore.RemoveByAccess(ctx, token))
+		_, err := exchanger.Exchange(ctx, exchangeRequest("search", "search-secret", token, ""))
+		assertExchangeError(t, err, ErrCodeInvalidGrant)
+	})
+}
@@ -0,0 +1,82 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+	"netherealmstudio.com/m/v2/jwks"
+)
+
+// ErrCodeInvalidRequestObject is the error code of RFC 9101 section 6.3 for request objects failing verification.
+const ErrCodeInvalidRequestObject = "invalid_request_object"
+
+// ErrInvalidRequestObject is wrapped by every error returned for a request object that cannot be trusted.
+var ErrInvalidRequestObject = errors.New(ErrCodeInvalidRequestObject)
+
+// RequestObject holds the authorization parameters of a verified request object.
+type RequestObject struct {
+	ClientID     string
+	RedirectURI  string
+	ResponseType string
+	Scope        string
+	State        string
+}
+
+// RequestObjectVerifier verifies signed request objects (RFC 9101) against the key set the client registered.
+type RequestObjectVerifier struct {
+	issuer string
+}
+
+// NewRequestObjectVerifier creates a verifier that requires request objects to name issuer as their audience.
+func NewRequestObjectVerifier(issuer string) *RequestObjectVerifier {
+	return &RequestObjectVerifier{issuer: issuer}
+}
+
+// Verify checks the signature, issuer, audience and expiry of the request object, and that it was made for the
+// client of the authorization request. Per RFC 9101 section 6.3 only the parameters inside the request object are
+// used, the query parameters next to it are ignored.
+func (v *RequestObjectVerifier) Verify(client *bizapiclient.APIClient, requestObject string) (*RequestObject, error) {
+	if client.JWKS == "" {
+		return nil, fmt.Errorf("%w: the client has no registered keys", ErrInvalidRequestObject)
+	}
+	keySet, err := jwks.Parse([]byte(client.JWKS))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequestObject, err)
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(requestObject, claims, keySet.Keyfunc,
+		jwt.WithValidMethods(jwks.SigningMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(client.ID),
+		jwt.WithAudience(v.issuer))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequestObject, err)
+	}
+
+	obj := &RequestObject{
+		ClientID:     stringClaim(claims, "client_id"),
+		RedirectURI:  stringClaim(claims, "redirect_uri"),
+		ResponseType: stringClaim(claims, "response_type"),
+		Scope:        stringClaim(claims, "scope"),
+		State:        stringClaim(claims, "state"),
+	}
+	if obj.ClientID != client.ID {
+		return nil, fmt.Errorf("%w: client_id does not match the request", ErrInvalidRequestObject)
+	}
+	// Request objects must not nest further request objects.
+	if _, ok := claims["request"]; ok {
+		return nil, fmt.Errorf("%w: request objects must not contain request", ErrInvalidRequestObject)
+	}
+	if _, ok := claims["request_uri"]; ok {
+		return nil, fmt.Errorf("%w: request objects must not contain request_uri", ErrInvalidRequestObject)
+	}
+	return obj, nil
+}
+
+func stringClaim(claims jwt.MapClaims, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
@@ -0,0 +1,102 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bizapiclient "netherealmstudio.com/m/v2/biz/apiclient"
+)
+
+const testIssuer = "https://auth.example.com/auth"
+
+func newSigningClient(t *testing.T) (*bizapiclient.APIClient, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	keySet := fmt.Sprintf(`{"keys":[{"kty":"EC","crv":"P-256","x":%q,"y":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.Bytes()), base64.RawURLEncoding.EncodeToString(key.Y.Bytes()))
+	return &bizapiclient.APIClient{ID: "partner", JWKS: keySet}, key
+}
+
+func signRequestObject(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func requestObjectClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":           "partner",
+		"aud":           testIssuer,
+		"exp":           time.Now().Add(time.Minute).Unix(),
+		"client_id":     "partner",
+		"redirect_uri":  "https://partner.example.com/callback",
+		"response_type": "code",
+		"scope":         "profile",
+		"state":         "xyz",
+	}
+}
+
+func TestRequestObjectVerifier_Verify(t *testing.T) {
+	verifier := NewRequestObjectVerifier(testIssuer)
+	client, key := newSigningClient(t)
+
+	obj, err := verifier.Verify(client, signRequestObject(t, key, requestObjectClaims()))
+	require.NoError(t, err)
+	assert.Equal(t, &RequestObject{
+		ClientID:     "partner",
+		RedirectURI:  "https://partner.example.com/callback",
+		ResponseType: "code",
+		Scope:        "profile",
+		State:        "xyz",
+	}, obj)
+}
+
+func TestRequestObjectVerifier_Rejections(t *testing.T) {
+	verifier := NewRequestObjectVerifier(testIssuer)
+	client, key := newSigningClient(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		key    *ecdsa.PrivateKey
+		modify func(jwt.MapClaims)
+	}{
+		"WrongKey":       {key: otherKey},
+		"WrongAudience":  {key: key, modify: func(c jwt.MapClaims) { c["aud"] = "https://other.example.com" }},
+		"WrongIssuer":    {key: key, modify: func(c jwt.MapClaims) { c["iss"] = "other" }},
+		"ClientMismatch": {key: key, modify: func(c jwt.MapClaims) { c["client_id"] = "other" }},
+		"Expired":        {key: key, modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		"NoExpiry":       {key: key, modify: func(c jwt.MapClaims) { delete(c, "exp") }},
+		"NestedRequest":  {key: key, modify: func(c jwt.MapClaims) { c["request_uri"] = "urn:example" }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			claims := requestObjectClaims()
+			if tc.modify != nil {
+				tc.modify(claims)
+			}
+			_, err := verifier.Verify(client, signRequestObject(t, tc.key, claims))
+			assert.ErrorIs(t, err, ErrInvalidRequestObject)
+		})
+	}
+
+	t.Run("ClientWithoutKeys", func(t *testing.T) {
+		_, err := verifier.Verify(&bizapiclient.APIClient{ID: "partner"}, signRequestObject(t, key, requestObjectClaims()))
+		assert.ErrorIs(t, err, ErrInvalidRequestObject)
+	})
+
+	t.Run("Unsigned", func(t *testing.T) {
+		unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, requestObjectClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		require.NoError(t, err)
+		_, err = verifier.Verify(client, unsigned)
+		assert.ErrorIs(t, err, ErrInvalidRequestObject)
+	})
+}
@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const gormSpanKey = "tracing:span"
+
+// GormPlugin runs every statement in a span, as a child of the span in the statement's context. Statements only join
+// the trace of a request when they are run with WithContext.
+type GormPlugin struct{}
+
+func NewGormPlugin() *GormPlugin {
+	return &GormPlugin{}
+}
+
+func (p *GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (p *GormPlugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	for _, err := range []error{
+		callback.Create().Before("gorm:create").Register("tracing:before_create", startStatement("create")),
+		callback.Create().After("gorm:create").Register("tracing:after_create", finishStatement),
+		callback.Query().Before("gorm:query").Register("tracing:before_query", startStatement("query")),
+		callback.Query().After("gorm:query").Register("tracing:after_query", finishStatement),
+		callback.Update().Before("gorm:update").Register("tracing:before_update", startStatement("update")),
+		callback.Update().After("gorm:update").Register("tracing:after_update", finishStatement),
+		callback.Delete().Before("gorm:delete").Register("tracing:before_delete", startStatement("delete")),
+		callback.Delete().After("gorm:delete").Register("tracing:after_delete", finishStatement),
+		callback.Row().Before("gorm:row").Register("tracing:before_row", startStatement("row")),
+		callback.Row().After("gorm:row").Register("tracing:after_row", finishStatement),
+		callback.Raw().Before("gorm:raw").Register("tracing:before_raw", startStatement("raw")),
+		callback.Raw().After("gorm:raw").Register("tracing:after_raw", finishStatement),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startStatement(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		_, span := Start(db.Statement.Context, "gorm."+operation,
+			semconv.DBSystemMySQL,
+			semconv.DBOperationName(operation))
+		db.InstanceSet(gormSpanKey, span)
+	}
+}
+
+func finishStatement(db *gorm.DB) {
+	value, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+
+	// The statement is recorded with its placeholders, so that no values end up in the trace.
+	span.SetAttributes(semconv.DBQueryText(db.Statement.SQL.String()), semconv.DBCollectionName(db.Statement.Table),
+		attribute.Int64("db.rows_affected", db.RowsAffected))
+	// Not finding a record is an answer, not a failing database.
+	err := db.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	End(span, err)
+}